@@ -0,0 +1,220 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/pause"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+var log = logrus.WithField("package", "pkg/admin")
+
+type Config struct {
+	DB    *pg.DB
+	Queue *queue.Queue
+	// Token is required, every request must contain the header "Authorization: Bearer <token>".
+	Token string
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg == nil || cfg.DB == nil {
+		return errors.New("cfg.DB is required")
+	}
+	if cfg.Queue == nil {
+		return errors.New("cfg.Queue is required")
+	}
+	if cfg.Token == "" {
+		return errors.New("cfg.Token is required")
+	}
+	return nil
+}
+
+// Handler serves the admin HTTP API:
+// POST /api/tasks - adds a task to the queue,
+// GET /api/queues - returns the stats of the queues,
+// GET /api/servers - returns the servers with the dates of their last updates,
+// GET/POST/DELETE /api/pauses - returns/pauses/resumes the paused servers and versions,
+// GET/PUT /api/versions - returns/saves the versions,
+// POST/DELETE /api/special-servers - adds/removes the special servers.
+type Handler struct {
+	db    *pg.DB
+	queue *queue.Queue
+	token string
+	mux   *http.ServeMux
+}
+
+func New(cfg *Config) (*Handler, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		db:    cfg.DB,
+		queue: cfg.Queue,
+		token: cfg.Token,
+		mux:   http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/api/tasks", h.allowMethods(h.enqueueTask, http.MethodPost))
+	h.mux.HandleFunc("/api/queues", h.allowMethods(h.getQueueStats, http.MethodGet))
+	h.mux.HandleFunc("/api/servers", h.allowMethods(h.getServers, http.MethodGet))
+	h.mux.HandleFunc("/api/pauses", h.allowMethods(h.handlePauses, http.MethodGet, http.MethodPost, http.MethodDelete))
+	h.mux.HandleFunc("/api/versions", h.allowMethods(h.handleVersions, http.MethodGet, http.MethodPut))
+	h.mux.HandleFunc("/api/special-servers", h.allowMethods(h.handleSpecialServers, http.MethodPost, http.MethodDelete))
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) allowMethods(fn http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				fn(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s isn't allowed", r.Method))
+	}
+}
+
+type enqueueTaskRequest struct {
+	Task     string `json:"task"`
+	Server   string `json:"server"`
+	Version  string `json:"version"`
+	Timezone string `json:"timezone"`
+}
+
+func (req enqueueTaskRequest) arg(kind string) (string, error) {
+	args := map[string]string{
+		"server":   req.Server,
+		"version":  req.Version,
+		"timezone": req.Timezone,
+	}
+	for k, v := range args {
+		if k != kind && v != "" {
+			return "", errors.Errorf("the task '%s' doesn't accept the field '%s'", req.Task, k)
+		}
+	}
+	return args[kind], nil
+}
+
+type enqueueTaskResponse struct {
+	Task string `json:"task"`
+	ID   string `json:"id"`
+}
+
+func (h *Handler) enqueueTask(w http.ResponseWriter, r *http.Request) {
+	var req enqueueTaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+		return
+	}
+	kind, err := queue.TaskArgKind(req.Task)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	arg, err := req.arg(kind)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	msg, err := h.queue.Enqueue(r.Context(), req.Task, arg)
+	if err != nil {
+		writeError(w, statusCodeFromError(err), err)
+		return
+	}
+	log.
+		WithFields(map[string]interface{}{
+			"task": req.Task,
+			"arg":  arg,
+		}).
+		Infof("admin: the task '%s' has been added to the queue", req.Task)
+	writeJSON(w, http.StatusAccepted, enqueueTaskResponse{
+		Task: req.Task,
+		ID:   msg.ID,
+	})
+}
+
+func (h *Handler) getQueueStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.queue.Stats(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+type server struct {
+	Key              string               `json:"key"`
+	Status           twmodel.ServerStatus `json:"status"`
+	VersionCode      twmodel.VersionCode  `json:"versionCode"`
+	DataUpdatedAt    string               `json:"dataUpdatedAt"`
+	HistoryUpdatedAt string               `json:"historyUpdatedAt"`
+	StatsUpdatedAt   string               `json:"statsUpdatedAt"`
+	Paused           bool                 `json:"paused"`
+	PauseReason      string               `json:"pauseReason,omitempty"`
+}
+
+func (h *Handler) getServers(w http.ResponseWriter, r *http.Request) {
+	var servers []*twmodel.Server
+	q := h.db.
+		ModelContext(r.Context(), &servers).
+		Column("key", "status", "version_code", "data_updated_at", "history_updated_at", "stats_updated_at").
+		Order("key ASC")
+	if status := r.URL.Query().Get("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if version := r.URL.Query().Get("version"); version != "" {
+		q = q.Where("version_code = ?", version)
+	}
+	if err := q.Select(); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "couldn't load the servers"))
+		return
+	}
+	p, err := pause.Load(r.Context(), h.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	onlyPaused := r.URL.Query().Get("paused") == "true"
+
+	resp := make([]server, 0, len(servers))
+	for _, s := range servers {
+		paused, reason := p.ServerPause(s)
+		if onlyPaused && !paused {
+			continue
+		}
+		resp = append(resp, server{
+			Key:              s.Key,
+			Status:           s.Status,
+			VersionCode:      s.VersionCode,
+			DataUpdatedAt:    formatTime(s.DataUpdatedAt),
+			HistoryUpdatedAt: formatTime(s.HistoryUpdatedAt),
+			StatsUpdatedAt:   formatTime(s.StatsUpdatedAt),
+			Paused:           paused,
+			PauseReason:      reason,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
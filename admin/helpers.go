@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/catalog"
+	"github.com/tribalwarshelp/dataupdater/pause"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn(errors.Wrap(err, "couldn't write the response"))
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode >= http.StatusInternalServerError {
+		log.Error(err)
+	}
+	writeJSON(w, statusCode, errorResponse{
+		Error: err.Error(),
+	})
+}
+
+func statusCodeFromError(err error) int {
+	switch {
+	case errors.Is(err, queue.ErrUnknownTask),
+		errors.Is(err, queue.ErrInvalidArg),
+		errors.Is(err, catalog.ErrInvalidVersion),
+		errors.Is(err, catalog.ErrInvalidSpecialServer):
+		return http.StatusBadRequest
+	case errors.Is(err, queue.ErrServerNotFound),
+		errors.Is(err, queue.ErrVersionNotFound),
+		errors.Is(err, pause.ErrServerNotFound),
+		errors.Is(err, pause.ErrVersionNotFound),
+		errors.Is(err, catalog.ErrVersionNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
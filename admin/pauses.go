@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/pause"
+)
+
+type pauseRequest struct {
+	Server  string `json:"server"`
+	Version string `json:"version"`
+	Reason  string `json:"reason"`
+}
+
+func (req pauseRequest) validate() error {
+	if (req.Server == "") == (req.Version == "") {
+		return errors.New("expected either 'server' or 'version'")
+	}
+	return nil
+}
+
+func (h *Handler) handlePauses(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getPauses(w, r)
+	case http.MethodPost:
+		h.pause(w, r)
+	case http.MethodDelete:
+		h.resume(w, r)
+	}
+}
+
+func (h *Handler) getPauses(w http.ResponseWriter, r *http.Request) {
+	p, err := pause.Load(r.Context(), h.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (h *Handler) pause(w http.ResponseWriter, r *http.Request) {
+	var req pauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var p interface{}
+	var err error
+	if req.Server != "" {
+		p, err = pause.PauseServer(r.Context(), h.db, req.Server, req.Reason)
+	} else {
+		p, err = pause.PauseVersion(r.Context(), h.db, req.Version, req.Reason)
+	}
+	if err != nil {
+		writeError(w, statusCodeFromError(err), err)
+		return
+	}
+	log.
+		WithFields(map[string]interface{}{
+			"server":  req.Server,
+			"version": req.Version,
+			"reason":  req.Reason,
+		}).
+		Info("admin: the updates have been paused")
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (h *Handler) resume(w http.ResponseWriter, r *http.Request) {
+	req := pauseRequest{
+		Server:  r.URL.Query().Get("server"),
+		Version: r.URL.Query().Get("version"),
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var err error
+	if req.Server != "" {
+		_, err = pause.ResumeServer(r.Context(), h.db, req.Server)
+	} else {
+		_, err = pause.ResumeVersion(r.Context(), h.db, req.Version)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.
+		WithFields(map[string]interface{}{
+			"server":  req.Server,
+			"version": req.Version,
+		}).
+		Info("admin: the updates have been resumed")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/catalog"
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+type version struct {
+	Code           twmodel.VersionCode `json:"code"`
+	Name           string              `json:"name"`
+	Host           string              `json:"host"`
+	Timezone       string              `json:"timezone"`
+	SpecialServers []string            `json:"specialServers"`
+	Disabled       bool                `json:"disabled"`
+	DisableReason  string              `json:"disableReason,omitempty"`
+}
+
+func (h *Handler) handleVersions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getVersions(w, r)
+	case http.MethodPut:
+		h.saveVersion(w, r)
+	}
+}
+
+func (h *Handler) getVersions(w http.ResponseWriter, r *http.Request) {
+	var versions []*twmodel.Version
+	if err := h.db.ModelContext(r.Context(), &versions).Relation("SpecialServers").Order("code ASC").Select(); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "couldn't load the versions"))
+		return
+	}
+	var pauses []*model.VersionPause
+	if err := h.db.ModelContext(r.Context(), &pauses).Select(); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "couldn't load the paused versions"))
+		return
+	}
+	pausesByCode := make(map[twmodel.VersionCode]*model.VersionPause, len(pauses))
+	for _, p := range pauses {
+		pausesByCode[p.VersionCode] = p
+	}
+
+	resp := make([]version, len(versions))
+	for i, v := range versions {
+		resp[i] = version{
+			Code:           v.Code,
+			Name:           v.Name,
+			Host:           v.Host,
+			Timezone:       v.Timezone,
+			SpecialServers: []string{},
+		}
+		for _, s := range v.SpecialServers {
+			resp[i].SpecialServers = append(resp[i].SpecialServers, s.Key)
+		}
+		if p, ok := pausesByCode[v.Code]; ok {
+			resp[i].Disabled = true
+			resp[i].DisableReason = p.Reason
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type saveVersionRequest struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Timezone string `json:"timezone"`
+	// Disabled is optional, the disabled state isn't changed if it's omitted.
+	Disabled      *bool  `json:"disabled"`
+	DisableReason string `json:"disableReason"`
+}
+
+func (h *Handler) saveVersion(w http.ResponseWriter, r *http.Request) {
+	var req saveVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+		return
+	}
+	v := &twmodel.Version{
+		Code:     twmodel.VersionCode(req.Code),
+		Name:     req.Name,
+		Host:     req.Host,
+		Timezone: req.Timezone,
+	}
+	if err := catalog.SaveVersion(r.Context(), h.db, v); err != nil {
+		writeError(w, statusCodeFromError(err), err)
+		return
+	}
+	if req.Disabled != nil {
+		if err := catalog.SetVersionDisabled(r.Context(), h.db, req.Code, *req.Disabled, req.DisableReason); err != nil {
+			writeError(w, statusCodeFromError(err), err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+type specialServerRequest struct {
+	Version string `json:"version"`
+	Key     string `json:"key"`
+}
+
+func (h *Handler) handleSpecialServers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req specialServerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+			return
+		}
+		if err := catalog.AddSpecialServer(r.Context(), h.db, req.Version, req.Key); err != nil {
+			writeError(w, statusCodeFromError(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, req)
+	case http.MethodDelete:
+		req := specialServerRequest{
+			Version: r.URL.Query().Get("version"),
+			Key:     r.URL.Query().Get("key"),
+		}
+		if err := catalog.RemoveSpecialServer(r.Context(), h.db, req.Version, req.Key); err != nil {
+			writeError(w, statusCodeFromError(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
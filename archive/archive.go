@@ -0,0 +1,174 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+)
+
+const (
+	SnapshotIDLayout = "20060102T150405Z"
+	gzipExt          = ".gz"
+)
+
+var log = logrus.WithField("package", "pkg/archive")
+
+type Config struct {
+	Storage Storage
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg == nil || cfg.Storage == nil {
+		return errors.New("cfg.Storage is required")
+	}
+	return nil
+}
+
+// Archiver saves the raw payloads fetched from TW servers. Payloads are grouped into snapshots
+// (one per server data update) and stored gzipped as <server key>/<snapshot id>/<file name>.gz.
+// A snapshot can be read back with dataloader.NewFSServerDataLoader.
+type Archiver struct {
+	storage Storage
+}
+
+func New(cfg *Config) (*Archiver, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return &Archiver{
+		storage: cfg.Storage,
+	}, nil
+}
+
+func NewSnapshotID(fetchedAt time.Time) string {
+	return fetchedAt.UTC().Format(SnapshotIDLayout)
+}
+
+// Transport returns a http.RoundTripper that saves every successfully fetched payload into the given snapshot.
+func (a *Archiver) Transport(rt http.RoundTripper, serverKey, snapshotID string) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{
+		rt:         rt,
+		archiver:   a,
+		serverKey:  serverKey,
+		snapshotID: snapshotID,
+	}
+}
+
+// Snapshots returns the IDs of all snapshots of the given server, from the oldest to the newest.
+func (a *Archiver) Snapshots(serverKey string) ([]string, error) {
+	ids, err := a.storage.List(serverKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list the snapshots of the server '%s'", serverKey)
+	}
+	return ids, nil
+}
+
+func (a *Archiver) LatestSnapshot(serverKey string) (string, error) {
+	ids, err := a.Snapshots(serverKey)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", errors.Errorf("there are no snapshots of the server '%s'", serverKey)
+	}
+	return ids[len(ids)-1], nil
+}
+
+// Prune deletes the snapshots of the given server created before the given time and returns their number.
+// The entries whose names aren't snapshot IDs are left untouched.
+func (a *Archiver) Prune(serverKey string, before time.Time) (int, error) {
+	ids, err := a.Snapshots(serverKey)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, id := range ids {
+		createdAt, err := time.Parse(SnapshotIDLayout, id)
+		if err != nil || !createdAt.Before(before) {
+			continue
+		}
+		if err := a.storage.Delete(path.Join(serverKey, id)); err != nil {
+			return deleted, errors.Wrapf(err, "couldn't delete the snapshot '%s' of the server '%s'", id, serverKey)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (a *Archiver) OpenSnapshot(serverKey, snapshotID string) (fs.FS, error) {
+	fsys, err := a.storage.FS(path.Join(serverKey, snapshotID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open the snapshot '%s' of the server '%s'", snapshotID, serverKey)
+	}
+	return fsys, nil
+}
+
+func (a *Archiver) NewServerDataLoader(serverKey, snapshotID string) (dataloader.ServerDataLoader, error) {
+	fsys, err := a.OpenSnapshot(serverKey, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	return dataloader.NewFSServerDataLoader(fsys), nil
+}
+
+func (a *Archiver) save(serverKey, snapshotID, fileName string, payload []byte) error {
+	name := path.Join(serverKey, snapshotID, fileName)
+	if strings.HasSuffix(fileName, gzipExt) {
+		return a.storage.Save(name, bytes.NewReader(payload))
+	}
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(payload); err != nil {
+		return errors.Wrapf(err, "couldn't compress '%s'", name)
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "couldn't compress '%s'", name)
+	}
+	return a.storage.Save(name+gzipExt, buf)
+}
+
+type transport struct {
+	rt         http.RoundTripper
+	archiver   *Archiver
+	serverKey  string
+	snapshotID string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	payload, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(payload))
+
+	entry := log.WithField("key", t.serverKey)
+	fileName, err := dataloader.FileNameFromURL(req.URL)
+	if err != nil {
+		entry.Warn(errors.Wrap(err, "archive: couldn't determine the file name"))
+		return resp, nil
+	}
+	if err := t.archiver.save(t.serverKey, t.snapshotID, fileName, payload); err != nil {
+		entry.Warn(errors.Wrapf(err, "archive: %s: couldn't save the payload", t.serverKey))
+	}
+	return resp, nil
+}
@@ -0,0 +1,62 @@
+package archive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiverPrune(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiver, err := New(&Config{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{
+		"pl1/" + NewSnapshotID(now.Add(-40*24*time.Hour)) + "/village.txt.gz",
+		"pl1/" + NewSnapshotID(now.Add(-31*24*time.Hour)) + "/village.txt.gz",
+		"pl1/" + NewSnapshotID(now.Add(-time.Hour)) + "/village.txt.gz",
+		"pl1/notes/readme.txt",
+		"pl2/" + NewSnapshotID(now.Add(-40*24*time.Hour)) + "/village.txt.gz",
+	} {
+		if err := storage.Save(name, strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := archiver.Prune("pl1", now.Add(-30*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("Prune() = %d, want 2", deleted)
+	}
+	ids, err := archiver.Snapshots("pl1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{NewSnapshotID(now.Add(-time.Hour)), "notes"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("Snapshots(pl1) = %v, want %v", ids, want)
+	}
+	if ids, _ := archiver.Snapshots("pl2"); len(ids) != 1 {
+		t.Errorf("the snapshots of another server have been deleted, left: %v", ids)
+	}
+}
+
+func TestLocalStorageDeleteRoot(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"", "/", "..", "pl1/../.."} {
+		if err := storage.Delete(dir); err == nil {
+			t.Errorf("Delete(%q) hasn't returned an error", dir)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+type Storage interface {
+	// Save stores the content of r under the given slash-separated name.
+	Save(name string, r io.Reader) error
+	// List returns the sorted names of the entries stored directly under the given directory.
+	List(dir string) ([]string, error)
+	// FS returns a file system rooted at the given directory.
+	FS(dir string) (fs.FS, error)
+	// Delete removes the given directory with its content.
+	Delete(dir string) error
+}
+
+type LocalStorage struct {
+	root string
+}
+
+var _ Storage = (*LocalStorage)(nil)
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, errors.New("root is required")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrapf(err, "couldn't create the directory '%s'", root)
+	}
+	return &LocalStorage{
+		root: root,
+	}, nil
+}
+
+func (s *LocalStorage) Save(name string, r io.Reader) error {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create the directory for '%s'", name)
+	}
+
+	// the content is written to a temporary file first, so an interrupted write never leaves a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create a temporary file for '%s'", name)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "couldn't write '%s'", name)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "couldn't write '%s'", name)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return errors.Wrapf(err, "couldn't write '%s'", name)
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(s.path(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read the directory '%s'", dir)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *LocalStorage) FS(dir string) (fs.FS, error) {
+	p := s.path(dir)
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open the directory '%s'", dir)
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("'%s' isn't a directory", dir)
+	}
+	return os.DirFS(p), nil
+}
+
+func (s *LocalStorage) Delete(dir string) error {
+	p := s.path(dir)
+	if p == filepath.Clean(s.root) {
+		return errors.New("the root directory can't be deleted")
+	}
+	if err := os.RemoveAll(p); err != nil {
+		return errors.Wrapf(err, "couldn't delete the directory '%s'", dir)
+	}
+	return nil
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
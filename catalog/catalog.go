@@ -0,0 +1,198 @@
+// Package catalog manages the versions (markets) and their special servers.
+package catalog
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/pause"
+)
+
+var log = logrus.WithField("package", "pkg/catalog")
+
+var (
+	ErrInvalidVersion       = errors.New("invalid version")
+	ErrVersionNotFound      = errors.New("version not found")
+	ErrInvalidSpecialServer = errors.New("invalid special server")
+)
+
+// ValidateVersion checks whether all fields are set and the timezone is valid.
+func ValidateVersion(v *twmodel.Version) error {
+	switch {
+	case v.Code == "":
+		return errors.Wrap(ErrInvalidVersion, "the code is required")
+	case v.Name == "":
+		return errors.Wrapf(ErrInvalidVersion, "%s: the name is required", v.Code)
+	case v.Host == "" || strings.Contains(v.Host, "/"):
+		return errors.Wrapf(ErrInvalidVersion, "%s: the host is required and mustn't contain the scheme nor the path", v.Code)
+	case v.Timezone == "":
+		return errors.Wrapf(ErrInvalidVersion, "%s: the timezone is required", v.Code)
+	}
+	if _, err := time.LoadLocation(v.Timezone); err != nil {
+		return errors.Wrapf(ErrInvalidVersion, "%s: invalid timezone '%s'", v.Code, v.Timezone)
+	}
+	return nil
+}
+
+// SaveVersion inserts the version or updates its name, host and timezone.
+func SaveVersion(ctx context.Context, db orm.DB, v *twmodel.Version) error {
+	if err := ValidateVersion(v); err != nil {
+		return err
+	}
+	_, err := db.ModelContext(ctx, v).
+		OnConflict("(code) DO UPDATE").
+		Set("name = EXCLUDED.name").
+		Set("host = EXCLUDED.host").
+		Set("timezone = EXCLUDED.timezone").
+		Insert()
+	if err != nil {
+		return errors.Wrapf(err, "%s: couldn't save the version", v.Code)
+	}
+	log.WithField("code", v.Code).Infof("%s: The version has been saved (host: %s, timezone: %s)", v.Code, v.Host, v.Timezone)
+	return nil
+}
+
+// AddSpecialServer marks the server of the version as special, so it's skipped by the data updates.
+func AddSpecialServer(ctx context.Context, db orm.DB, code, key string) error {
+	if key == "" {
+		return errors.Wrap(ErrInvalidSpecialServer, "the key is required")
+	}
+	if err := versionExists(ctx, db, code); err != nil {
+		return err
+	}
+	_, err := db.ModelContext(ctx, &twmodel.SpecialServer{
+		VersionCode: twmodel.VersionCode(code),
+		Key:         key,
+	}).
+		OnConflict("DO NOTHING").
+		Insert()
+	if err != nil {
+		return errors.Wrapf(err, "%s: couldn't add the special server '%s'", code, key)
+	}
+	log.WithField("code", code).Infof("%s: The special server '%s' has been added", code, key)
+	return nil
+}
+
+// RemoveSpecialServer unmarks the server, so it's updated like any other server.
+func RemoveSpecialServer(ctx context.Context, db orm.DB, code, key string) error {
+	_, err := db.ModelContext(ctx, &twmodel.SpecialServer{}).
+		Where("version_code = ? AND key = ?", code, key).
+		Delete()
+	if err != nil {
+		return errors.Wrapf(err, "%s: couldn't remove the special server '%s'", code, key)
+	}
+	log.WithField("code", code).Infof("%s: The special server '%s' has been removed", code, key)
+	return nil
+}
+
+// SetVersionDisabled pauses (or resumes) the updates of all servers of the version (see pause.PauseVersion).
+func SetVersionDisabled(ctx context.Context, db orm.DB, code string, disabled bool, reason string) error {
+	if !disabled {
+		_, err := pause.ResumeVersion(ctx, db, code)
+		return err
+	}
+	_, err := pause.PauseVersion(ctx, db, code, reason)
+	return err
+}
+
+func versionExists(ctx context.Context, db orm.DB, code string) error {
+	exists, err := db.ModelContext(ctx, &twmodel.Version{}).Where("code = ?", code).Exists()
+	if err != nil {
+		return errors.Wrapf(err, "%s: couldn't load the version", code)
+	}
+	if !exists {
+		return errors.Wrapf(ErrVersionNotFound, "'%s'", code)
+	}
+	return nil
+}
+
+type ImportOptions struct {
+	// Overwrite updates the name, host, timezone and the disabled state of the existing versions.
+	// Otherwise, only the missing versions and special servers are inserted.
+	Overwrite bool
+	// Prune removes the special servers that aren't in the seed (only of the versions in the seed).
+	Prune bool
+}
+
+type ImportResult struct {
+	VersionsInserted       int `json:"versionsInserted"`
+	VersionsUpdated        int `json:"versionsUpdated"`
+	SpecialServersInserted int `json:"specialServersInserted"`
+	SpecialServersRemoved  int `json:"specialServersRemoved"`
+}
+
+// Import saves the versions and the special servers declared in the seed.
+// The versions that aren't in the seed are left untouched.
+func Import(ctx context.Context, db orm.DB, seed *Seed, opts ImportOptions) (*ImportResult, error) {
+	if err := seed.Validate(); err != nil {
+		return nil, err
+	}
+	result := &ImportResult{}
+	for _, sv := range seed.Versions {
+		v := sv.version()
+		exists, err := db.ModelContext(ctx, &twmodel.Version{}).Where("code = ?", v.Code).Exists()
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: couldn't load the version", sv.Code)
+		}
+		switch {
+		case !exists:
+			if _, err := db.ModelContext(ctx, v).Insert(); err != nil {
+				return nil, errors.Wrapf(err, "%s: couldn't insert the version", sv.Code)
+			}
+			result.VersionsInserted++
+		case opts.Overwrite:
+			if _, err := db.ModelContext(ctx, v).Column("name", "host", "timezone").WherePK().Update(); err != nil {
+				return nil, errors.Wrapf(err, "%s: couldn't update the version", sv.Code)
+			}
+			result.VersionsUpdated++
+		}
+
+		for _, key := range sv.SpecialServers {
+			res, err := db.ModelContext(ctx, &twmodel.SpecialServer{
+				VersionCode: v.Code,
+				Key:         key,
+			}).
+				OnConflict("DO NOTHING").
+				Insert()
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: couldn't add the special server '%s'", sv.Code, key)
+			}
+			result.SpecialServersInserted += res.RowsAffected()
+		}
+		if opts.Prune {
+			q := db.ModelContext(ctx, &twmodel.SpecialServer{}).Where("version_code = ?", v.Code)
+			if len(sv.SpecialServers) > 0 {
+				q = q.Where("key NOT IN (?)", pg.In(sv.SpecialServers))
+			}
+			res, err := q.Delete()
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: couldn't remove the special servers", sv.Code)
+			}
+			result.SpecialServersRemoved += res.RowsAffected()
+		}
+
+		// the disabled state of the existing versions is managed by the API/CLI unless the seed overwrites it
+		if !exists || opts.Overwrite {
+			if err := SetVersionDisabled(ctx, db, sv.Code, sv.Disabled, "disabled by the seed"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (sv *SeedVersion) version() *twmodel.Version {
+	return &twmodel.Version{
+		Code:     twmodel.VersionCode(sv.Code),
+		Name:     sv.Name,
+		Host:     sv.Host,
+		Timezone: sv.Timezone,
+	}
+}
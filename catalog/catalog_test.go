@@ -0,0 +1,118 @@
+// The test is in the external package, because postgrestest imports catalog (through postgres).
+package catalog_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/catalog"
+	"github.com/tribalwarshelp/dataupdater/pause"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+)
+
+func TestImport(t *testing.T) {
+	db := postgrestest.Connect(t)
+	ctx := context.Background()
+	existing := postgrestest.Version(t, db)
+	newCode := string(existing.Code) + "n"
+	postgrestest.DeleteVersionOnCleanup(t, db, twmodel.VersionCode(newCode))
+	seed := &catalog.Seed{
+		Versions: []*catalog.SeedVersion{
+			{
+				Code:           string(existing.Code),
+				Name:           existing.Name,
+				Host:           "new." + existing.Host,
+				Timezone:       existing.Timezone,
+				SpecialServers: []string{string(existing.Code) + "1"},
+			},
+			{
+				Code:           newCode,
+				Name:           "Test " + newCode,
+				Host:           newCode + ".example.com",
+				Timezone:       "Europe/Berlin",
+				SpecialServers: []string{newCode + "1", newCode + "2"},
+				Disabled:       true,
+			},
+		},
+	}
+	loadVersion := func(code string) *twmodel.Version {
+		t.Helper()
+		v := &twmodel.Version{}
+		if err := db.Model(v).Where("code = ?", code).Relation("SpecialServers").Select(); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	specialServers := func(v *twmodel.Version) []string {
+		keys := make([]string, 0, len(v.SpecialServers))
+		for _, s := range v.SpecialServers {
+			keys = append(keys, s.Key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	isPaused := func(code string) bool {
+		t.Helper()
+		paused, err := pause.IsVersionPaused(ctx, db, twmodel.VersionCode(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paused
+	}
+
+	result, err := catalog.Import(ctx, db, seed, catalog.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (catalog.ImportResult{VersionsInserted: 1, SpecialServersInserted: 3}) {
+		t.Errorf("Import() = %+v, want 1 inserted version and 3 inserted special servers", *result)
+	}
+	if v := loadVersion(string(existing.Code)); v.Host != existing.Host {
+		t.Errorf("the host of the existing version has been overwritten (%s)", v.Host)
+	}
+	if v := loadVersion(newCode); v.Timezone != "Europe/Berlin" || len(v.SpecialServers) != 2 {
+		t.Errorf("the new version: timezone = %s, special servers = %v", v.Timezone, specialServers(v))
+	}
+	if !isPaused(newCode) {
+		t.Error("the disabled version hasn't been paused")
+	}
+
+	result, err = catalog.Import(ctx, db, seed, catalog.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (catalog.ImportResult{}) {
+		t.Errorf("the second Import() = %+v, want no changes", *result)
+	}
+
+	seed.Versions[1].SpecialServers = []string{newCode + "2"}
+	seed.Versions[1].Disabled = false
+	result, err = catalog.Import(ctx, db, seed, catalog.ImportOptions{Overwrite: true, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (catalog.ImportResult{VersionsUpdated: 2, SpecialServersRemoved: 1}) {
+		t.Errorf("Import() with Overwrite and Prune = %+v, want 2 updated versions and 1 removed special server", *result)
+	}
+	if v := loadVersion(string(existing.Code)); v.Host != "new."+existing.Host {
+		t.Errorf("the host of the existing version = %s, want new.%s", v.Host, existing.Host)
+	}
+	if keys := specialServers(loadVersion(newCode)); len(keys) != 1 || keys[0] != newCode+"2" {
+		t.Errorf("the special servers of the new version = %v, want [%s2]", keys, newCode)
+	}
+	if isPaused(newCode) {
+		t.Error("the version enabled by the seed is still paused")
+	}
+
+	var count int
+	if _, err := db.QueryOne(pg.Scan(&count), "SELECT count(*) FROM versions WHERE code IN (?)", pg.In([]string{string(existing.Code), newCode})); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("versions = %d, want 2", count)
+	}
+}
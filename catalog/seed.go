@@ -0,0 +1,101 @@
+package catalog
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed default_seed.yml
+var defaultSeed []byte
+
+// Seed declares the versions and their special servers.
+type Seed struct {
+	Versions []*SeedVersion `json:"versions" yaml:"versions"`
+}
+
+type SeedVersion struct {
+	Code     string `json:"code" yaml:"code"`
+	Name     string `json:"name" yaml:"name"`
+	Host     string `json:"host" yaml:"host"`
+	Timezone string `json:"timezone" yaml:"timezone"`
+	// SpecialServers are the keys of the servers that are skipped by the data updates.
+	SpecialServers []string `json:"specialServers" yaml:"specialServers"`
+	// Disabled pauses the updates of all servers of the version (see model.VersionPause).
+	Disabled bool `json:"disabled" yaml:"disabled"`
+}
+
+// DefaultSeed returns the built-in versions.
+func DefaultSeed() (*Seed, error) {
+	seed, err := decodeSeed(defaultSeed, ".yml")
+	if err != nil {
+		return nil, errors.Wrap(err, "the default seed is invalid")
+	}
+	return seed, nil
+}
+
+// LoadSeedFile reads the seed from the given JSON or YAML (.yml/.yaml) file.
+func LoadSeedFile(path string) (*Seed, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read the seed file")
+	}
+	seed, err := decodeSeed(b, filepath.Ext(path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	return seed, nil
+}
+
+func decodeSeed(b []byte, ext string) (*Seed, error) {
+	seed := &Seed{}
+	switch strings.ToLower(ext) {
+	case ".yml", ".yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(seed); err != nil {
+			return nil, errors.Wrap(err, "couldn't decode the seed")
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(seed); err != nil {
+			return nil, errors.Wrap(err, "couldn't decode the seed")
+		}
+	default:
+		return nil, errors.Errorf("unsupported seed file extension '%s' (expected .json, .yml or .yaml)", ext)
+	}
+	if err := seed.Validate(); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// Validate checks the versions and whether the codes are unique.
+func (s *Seed) Validate() error {
+	codes := make(map[string]bool, len(s.Versions))
+	for i, v := range s.Versions {
+		if v == nil {
+			return errors.Errorf("versions[%d] is empty", i)
+		}
+		if err := ValidateVersion(v.version()); err != nil {
+			return errors.Wrapf(err, "versions[%d]", i)
+		}
+		if codes[v.Code] {
+			return errors.Errorf("versions[%d]: duplicate code '%s'", i, v.Code)
+		}
+		codes[v.Code] = true
+		for _, key := range v.SpecialServers {
+			if key == "" {
+				return errors.Errorf("versions[%d]: the special server key is empty", i)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package catalog
+
+import (
+	"testing"
+)
+
+func TestDecodeSeed(t *testing.T) {
+	tests := []struct {
+		name         string
+		b            string
+		ext          string
+		wantVersions int
+		wantErr      bool
+	}{
+		{
+			name: "yaml",
+			b: `versions:
+  - code: pl
+    name: Polska
+    host: plemiona.pl
+    timezone: Europe/Warsaw
+    specialServers: [pls1]
+  - code: en
+    name: International
+    host: tribalwars.net
+    timezone: Europe/London
+    disabled: true
+`,
+			ext:          ".yml",
+			wantVersions: 2,
+		},
+		{
+			name:         "json",
+			b:            `{"versions":[{"code":"pl","name":"Polska","host":"plemiona.pl","timezone":"Europe/Warsaw"}]}`,
+			ext:          ".JSON",
+			wantVersions: 1,
+		},
+		{
+			name:    "unknown field",
+			b:       `{"versions":[{"code":"pl","name":"Polska","host":"plemiona.pl","timezone":"Europe/Warsaw","tz":"UTC"}]}`,
+			ext:     ".json",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported extension",
+			b:       `versions: []`,
+			ext:     ".toml",
+			wantErr: true,
+		},
+		{
+			name: "duplicate code",
+			b: `versions:
+  - {code: pl, name: Polska, host: plemiona.pl, timezone: Europe/Warsaw}
+  - {code: pl, name: Polska, host: plemiona.pl, timezone: Europe/Warsaw}
+`,
+			ext:     ".yaml",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timezone",
+			b:       `versions: [{code: pl, name: Polska, host: plemiona.pl, timezone: Europe/Nowhere}]`,
+			ext:     ".yml",
+			wantErr: true,
+		},
+		{
+			name:    "host with a scheme",
+			b:       `versions: [{code: pl, name: Polska, host: "https://plemiona.pl", timezone: Europe/Warsaw}]`,
+			ext:     ".yml",
+			wantErr: true,
+		},
+		{
+			name:    "empty special server",
+			b:       `versions: [{code: pl, name: Polska, host: plemiona.pl, timezone: Europe/Warsaw, specialServers: [""]}]`,
+			ext:     ".yml",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seed, err := decodeSeed([]byte(tt.b), tt.ext)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSeed() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && len(seed.Versions) != tt.wantVersions {
+				t.Errorf("len(Versions) = %d, want %d", len(seed.Versions), tt.wantVersions)
+			}
+		})
+	}
+}
+
+func TestDefaultSeed(t *testing.T) {
+	seed, err := DefaultSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seed.Versions) == 0 {
+		t.Error("the default seed has no versions")
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"github.com/Kichiyaki/goutil/envutil"
+	"context"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/tribalwarshelp/dataupdater/cmd/internal"
@@ -15,7 +16,18 @@ import (
 )
 
 func main() {
-	redisClient, err := internal.NewRedisClient()
+	cfg, err := internal.LoadConfig()
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't load the config"))
+	}
+
+	stopTracing, err := internal.InitTracing(&cfg.Tracing, "cron")
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't initialize the tracing"))
+	}
+	defer stopTracing()
+
+	redisClient, err := internal.NewRedisClient(&cfg.Redis)
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "couldn't connect to Redis"))
 	}
@@ -25,7 +37,7 @@ func main() {
 		}
 	}()
 
-	dbConn, err := postgres.Connect(nil)
+	dbConn, err := postgres.Connect(cfg.DB.PostgresConfig(false))
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "couldn't connect to the db"))
 	}
@@ -35,19 +47,28 @@ func main() {
 		}
 	}()
 
-	q, err := queue.New(&queue.Config{
-		DB:          dbConn,
-		Redis:       redisClient,
-		WorkerLimit: envutil.GetenvInt("WORKER_LIMIT"),
-	})
+	queueCfg := internal.NewQueueConfig(cfg)
+	queueCfg.DB = dbConn
+	queueCfg.Redis = redisClient
+	q, err := queue.New(queueCfg)
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "couldn't initialize a queue"))
 	}
 
+	instanceID, err := newInstanceID(cfg.Cron.InstanceID)
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't determine the instance ID"))
+	}
 	c, err := twhelpcron.New(&twhelpcron.Config{
-		DB:        dbConn,
-		RunOnInit: envutil.GetenvBool("RUN_ON_INIT"),
-		Queue:     q,
+		DB:             dbConn,
+		RunOnInit:      cfg.Cron.RunOnInit,
+		CatchUp:        cfg.Cron.CatchUp,
+		Schedules:      internal.NewCronSchedules(cfg),
+		Queue:          q,
+		Redis:          redisClient,
+		InstanceID:     instanceID,
+		LeaderLeaseTTL: cfg.Cron.LeaderLeaseTTL,
+		ReloadInterval: cfg.Cron.ReloadInterval,
 	})
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "couldn't initialize a cron instance"))
@@ -57,11 +78,42 @@ func main() {
 	}
 	defer c.Stop()
 
-	logrus.Info("Cron is up and running!")
+	stopMetricsServer := internal.StartMetricsServer(cfg.MetricsAddr)
+	defer stopMetricsServer()
+
+	healthHandler := internal.NewHealthHandler(dbConn, redisClient)
+	healthHandler.AddLivenessCheck("cron", c.CheckTicks)
+	healthHandler.AddInfo("leader", func(_ context.Context) interface{} {
+		return c.Leader()
+	})
+	stopHealthServer := internal.StartHealthServer(cfg.HealthAddr, healthHandler)
+	defer stopHealthServer()
+
+	logrus.WithField("instanceID", instanceID).Info("Cron is up and running!")
 
 	channel := make(chan os.Signal, 1)
-	signal.Notify(channel, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGINT)
-	<-channel
+	signal.Notify(channel, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range channel {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		logrus.Info("SIGHUP received, reloading the jobs")
+		if err := c.Reload(); err != nil {
+			logrus.Error(err)
+		}
+	}
 
 	logrus.Info("shutting down")
 }
+
+// newInstanceID returns the given ID or, if it's empty, the hostname with the process ID.
+func newInstanceID(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid()), nil
+}
@@ -2,20 +2,33 @@ package main
 
 import (
 	"context"
-	"github.com/Kichiyaki/goutil/envutil"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/tribalwarshelp/dataupdater/admin"
 	"github.com/tribalwarshelp/dataupdater/cmd/internal"
 	"github.com/tribalwarshelp/dataupdater/postgres"
 	"github.com/tribalwarshelp/dataupdater/queue"
 )
 
 func main() {
-	redisClient, err := internal.NewRedisClient()
+	cfg, err := internal.LoadConfig()
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "Couldn't load the config"))
+	}
+
+	stopTracing, err := internal.InitTracing(&cfg.Tracing, "dataupdater")
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "Couldn't initialize the tracing"))
+	}
+	defer stopTracing()
+
+	redisClient, err := internal.NewRedisClient(&cfg.Redis)
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "Couldn't connect to Redis"))
 	}
@@ -25,7 +38,7 @@ func main() {
 		}
 	}()
 
-	dbConn, err := postgres.Connect(&postgres.Config{SkipDBInitialization: true})
+	dbConn, err := postgres.Connect(cfg.DB.PostgresConfig(true))
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "Couldn't connect to the db"))
 	}
@@ -35,11 +48,22 @@ func main() {
 		}
 	}()
 
-	q, err := queue.New(&queue.Config{
-		DB:          dbConn,
-		Redis:       redisClient,
-		WorkerLimit: envutil.GetenvInt("WORKER_LIMIT"),
-	})
+	archiver, err := internal.NewArchiver(&cfg.Archive)
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "Couldn't initialize the archiver"))
+	}
+
+	rateLimiter, err := internal.NewRateLimiter(&cfg.RateLimit, redisClient)
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "Couldn't initialize the rate limiter"))
+	}
+
+	queueCfg := internal.NewQueueConfig(cfg)
+	queueCfg.DB = dbConn
+	queueCfg.Redis = redisClient
+	queueCfg.Archiver = archiver
+	queueCfg.RateLimiter = rateLimiter
+	q, err := queue.New(queueCfg)
 	if err != nil {
 		logrus.Fatal(errors.Wrap(err, "Couldn't initialize a queue"))
 	}
@@ -47,6 +71,38 @@ func main() {
 		logrus.Fatal(errors.Wrap(err, "Couldn't start the queue"))
 	}
 
+	stopMetricsServer := internal.StartMetricsServer(cfg.MetricsAddr)
+	defer stopMetricsServer()
+
+	healthHandler := internal.NewHealthHandler(dbConn, redisClient)
+	healthHandler.AddLivenessCheck("consumers", q.CheckConsumers)
+	stopHealthServer := internal.StartHealthServer(cfg.HealthAddr, healthHandler)
+	defer stopHealthServer()
+
+	var adminServer *http.Server
+	if addr := cfg.Admin.Addr; addr != "" {
+		adminHandler, err := admin.New(&admin.Config{
+			DB:    dbConn,
+			Queue: q,
+			Token: cfg.Admin.Token,
+		})
+		if err != nil {
+			logrus.Fatal(errors.Wrap(err, "Couldn't initialize the admin API"))
+		}
+		adminServer = &http.Server{
+			Addr:         addr,
+			Handler:      adminHandler,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Fatal(errors.Wrap(err, "Couldn't start the admin API"))
+			}
+		}()
+		logrus.WithField("addr", addr).Info("Admin API is up and running!")
+	}
+
 	logrus.Info("Data updater is up and running!")
 
 	channel := make(chan os.Signal, 1)
@@ -54,6 +110,13 @@ func main() {
 	<-channel
 
 	logrus.Info("shutting down")
+	if adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logrus.Warn(errors.Wrap(err, "Couldn't shut down the admin API"))
+		}
+		cancel()
+	}
 	if err := q.Close(); err != nil {
 		logrus.Fatal(err)
 	}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+)
+
+const (
+	archiveStorageLocal = "local"
+)
+
+// NewArchiver returns nil if the archive isn't configured (the dir is empty).
+func NewArchiver(cfg *ArchiveConfig) (*archive.Archiver, error) {
+	storage, err := newArchiveStorage(cfg)
+	if err != nil || storage == nil {
+		return nil, err
+	}
+	archiver, err := archive.New(&archive.Config{
+		Storage: storage,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "NewArchiver")
+	}
+	return archiver, nil
+}
+
+func newArchiveStorage(cfg *ArchiveConfig) (archive.Storage, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	switch storageType := cfg.Storage; storageType {
+	case "", archiveStorageLocal:
+		storage, err := archive.NewLocalStorage(cfg.Dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "newArchiveStorage")
+		}
+		return storage, nil
+	default:
+		return nil, errors.Errorf("newArchiveStorage: unsupported storage type '%s'", storageType)
+	}
+}
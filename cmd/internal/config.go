@@ -0,0 +1,438 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	twhelpcron "github.com/tribalwarshelp/dataupdater/cron"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/queue"
+	"github.com/tribalwarshelp/dataupdater/ratelimit"
+	"github.com/tribalwarshelp/dataupdater/tracing"
+)
+
+const day = 24 * time.Hour
+
+// Config is the configuration shared by all commands.
+// It's loaded from the YAML file set in CONFIG_FILE (optional),
+// then the ENV variables listed in the env tags override the values from the file.
+type Config struct {
+	DB            DBConfig        `yaml:"db"`
+	Redis         RedisConfig     `yaml:"redis"`
+	Queue         QueueConfig     `yaml:"queue"`
+	Cron          CronConfig      `yaml:"cron"`
+	Archive       ArchiveConfig   `yaml:"archive"`
+	RateLimit     RateLimitConfig `yaml:"rateLimit"`
+	Tracing       TracingConfig   `yaml:"tracing"`
+	Admin         AdminConfig     `yaml:"admin"`
+	ServerDataDir string          `yaml:"serverDataDir" env:"SERVER_DATA_DIR"`
+	MetricsAddr   string          `yaml:"metricsAddr" env:"METRICS_ADDR"`
+	HealthAddr    string          `yaml:"healthAddr" env:"HEALTH_ADDR"`
+}
+
+type DBConfig struct {
+	User       string `yaml:"user" env:"DB_USER"`
+	Password   string `yaml:"password" env:"DB_PASSWORD"`
+	Name       string `yaml:"name" env:"DB_NAME"`
+	Host       string `yaml:"host" env:"DB_HOST"`
+	Port       int    `yaml:"port" env:"DB_PORT"`
+	PoolSize   int    `yaml:"poolSize" env:"DB_POOL_SIZE"`
+	LogQueries bool   `yaml:"logQueries" env:"LOG_DB_QUERIES"`
+	// SeedFile is the JSON/YAML file with the versions (the built-in ones are used by default).
+	SeedFile string `yaml:"seedFile" env:"DB_SEED_FILE"`
+}
+
+// PostgresConfig returns the config used to connect to the db.
+func (cfg *DBConfig) PostgresConfig(skipDBInitialization bool) *postgres.Config {
+	return &postgres.Config{
+		User:                 cfg.User,
+		Password:             cfg.Password,
+		Database:             cfg.Name,
+		Addr:                 cfg.Host + ":" + strconv.Itoa(cfg.Port),
+		PoolSize:             cfg.PoolSize,
+		LogQueries:           cfg.LogQueries,
+		SkipDBInitialization: skipDBInitialization,
+		SeedFile:             cfg.SeedFile,
+	}
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr" env:"REDIS_ADDR"`
+	Username string `yaml:"username" env:"REDIS_USERNAME"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD"`
+	DB       int    `yaml:"db" env:"REDIS_DB"`
+}
+
+type QueueConfig struct {
+	// WorkerLimit is the default number of workers per queue.
+	WorkerLimit int `yaml:"workerLimit" env:"WORKER_LIMIT"`
+	// Queues contains the queue-specific settings,
+	// overridden by <QUEUE>_QUEUE_WORKER_LIMIT and <QUEUE>_QUEUE_RESERVATION_TIMEOUT (e.g. HISTORY_QUEUE_WORKER_LIMIT).
+	Queues map[string]*QueueSettings `yaml:"queues"`
+	// Routes moves the tasks to other queues (task name => queue name),
+	// extended by QUEUE_ROUTES (e.g. "updateServerStats=maintenance,vacuum=data").
+	Routes             map[string]string `yaml:"routes"`
+	HTTPTimeout        time.Duration     `yaml:"httpTimeout" env:"HTTP_TIMEOUT"`
+	TransactionTimeout time.Duration     `yaml:"transactionTimeout" env:"TRANSACTION_TIMEOUT"`
+	// BulkLoadThreshold - see queue.Config.BulkLoadThreshold.
+	BulkLoadThreshold int             `yaml:"bulkLoadThreshold" env:"BULK_LOAD_THRESHOLD"`
+	Retention         RetentionConfig `yaml:"retention"`
+}
+
+type QueueSettings struct {
+	WorkerLimit        int           `yaml:"workerLimit"`
+	ReservationTimeout time.Duration `yaml:"reservationTimeout"`
+}
+
+type RetentionConfig struct {
+	HistoryDays        int `yaml:"historyDays" env:"HISTORY_RETENTION_DAYS"`
+	DeletedPlayersDays int `yaml:"deletedPlayersDays" env:"DELETED_PLAYERS_RETENTION_DAYS"`
+	DeletedTribesDays  int `yaml:"deletedTribesDays" env:"DELETED_TRIBES_RETENTION_DAYS"`
+	TaskRunsDays       int `yaml:"taskRunsDays" env:"TASK_RUNS_RETENTION_DAYS"`
+	// SnapshotsDays - how long the archived snapshots are kept (used only if the archive is enabled).
+	SnapshotsDays int `yaml:"snapshotsDays" env:"SNAPSHOTS_RETENTION_DAYS"`
+}
+
+type CronConfig struct {
+	RunOnInit bool `yaml:"runOnInit" env:"RUN_ON_INIT"`
+	// CatchUp enables enqueuing the overdue tasks on startup (false by default).
+	CatchUp bool `yaml:"catchUp" env:"CRON_CATCH_UP"`
+	// InstanceID identifies the instance in the leader election (hostname-pid by default).
+	InstanceID     string        `yaml:"instanceID" env:"INSTANCE_ID"`
+	LeaderLeaseTTL time.Duration `yaml:"leaderLeaseTTL" env:"LEADER_LEASE_TTL"`
+	// ReloadInterval is how often the jobs are reconciled with the versions (1 minute by default).
+	ReloadInterval time.Duration   `yaml:"reloadInterval" env:"CRON_RELOAD_INTERVAL"`
+	Schedules      SchedulesConfig `yaml:"schedules"`
+}
+
+type SchedulesConfig struct {
+	UpdateServerData          string `yaml:"updateServerData" env:"CRON_UPDATE_SERVER_DATA"`
+	UpdateEnnoblements        string `yaml:"updateEnnoblements" env:"CRON_UPDATE_ENNOBLEMENTS"`
+	Vacuum                    string `yaml:"vacuum" env:"CRON_VACUUM"`
+	DeleteNonExistentVillages string `yaml:"deleteNonExistentVillages" env:"CRON_DELETE_NON_EXISTENT_VILLAGES"`
+	UpdateHistory             string `yaml:"updateHistory" env:"CRON_UPDATE_HISTORY"`
+	UpdateStats               string `yaml:"updateStats" env:"CRON_UPDATE_STATS"`
+}
+
+type ArchiveConfig struct {
+	// Dir - the archive is disabled if it's empty.
+	Dir     string `yaml:"dir" env:"ARCHIVE_DIR"`
+	Storage string `yaml:"storage" env:"ARCHIVE_STORAGE"`
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond     int `yaml:"requestsPerSecond" env:"RATE_LIMIT_REQUESTS_PER_SECOND"`
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests" env:"RATE_LIMIT_MAX_CONCURRENT_REQUESTS"`
+	// LeaseTimeout - a download slot is released after this time even if its holder hasn't released it.
+	// It must be at least queue.httpTimeout, so the slot isn't released while the request is still in progress.
+	LeaseTimeout time.Duration `yaml:"leaseTimeout" env:"RATE_LIMIT_LEASE_TIMEOUT"`
+}
+
+type TracingConfig struct {
+	// Exporter - the tracing is disabled if it's empty.
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER"`
+	SampleRatio float64 `yaml:"sampleRatio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+type AdminConfig struct {
+	// Addr - the admin API is disabled if it's empty. Token is required if it's set.
+	Addr  string `yaml:"addr" env:"ADMIN_API_ADDR"`
+	Token string `yaml:"token" env:"ADMIN_API_TOKEN"`
+}
+
+func defaultConfig() *Config {
+	schedules := twhelpcron.DefaultSchedules()
+	retention := queue.DefaultRetention()
+	return &Config{
+		DB: DBConfig{
+			Port: 5432,
+		},
+		Queue: QueueConfig{
+			WorkerLimit:        1,
+			Queues:             make(map[string]*QueueSettings),
+			Routes:             make(map[string]string),
+			HTTPTimeout:        queue.DefaultHTTPTimeout,
+			TransactionTimeout: queue.DefaultTransactionTimeout,
+			BulkLoadThreshold:  queue.DefaultBulkLoadThreshold,
+			Retention: RetentionConfig{
+				HistoryDays:        int(retention.History / day),
+				DeletedPlayersDays: int(retention.DeletedPlayers / day),
+				DeletedTribesDays:  int(retention.DeletedTribes / day),
+				TaskRunsDays:       int(retention.TaskRuns / day),
+				SnapshotsDays:      int(retention.Snapshots / day),
+			},
+		},
+		RateLimit: RateLimitConfig{
+			LeaseTimeout: ratelimit.DefaultLeaseTimeout,
+		},
+		Cron: CronConfig{
+			Schedules: SchedulesConfig{
+				UpdateServerData:          schedules.UpdateServerData,
+				UpdateEnnoblements:        schedules.UpdateEnnoblements,
+				Vacuum:                    schedules.Vacuum,
+				DeleteNonExistentVillages: schedules.DeleteNonExistentVillages,
+				UpdateHistory:             schedules.UpdateHistory,
+				UpdateStats:               schedules.UpdateStats,
+			},
+		},
+	}
+}
+
+// LoadConfig loads and validates the config.
+func LoadConfig() (*Config, error) {
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path, cfg); err != nil {
+			return nil, errors.Wrap(err, "LoadConfig")
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, errors.Wrap(err, "LoadConfig")
+	}
+	if err := applyQueueEnv(&cfg.Queue); err != nil {
+		return nil, errors.Wrap(err, "LoadConfig")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Wrap(err, "LoadConfig: the config is invalid")
+	}
+	return cfg, nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yml", ".yaml":
+	default:
+		return errors.Errorf("unsupported config file format '%s', expected .yml or .yaml", ext)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open the config file")
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return errors.Wrapf(err, "couldn't decode the config file '%s'", path)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides the fields with the env tag with the values of the set ENV variables.
+// A variable set to an empty string resets the field to its zero value.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if value == "" {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+		if err := setFieldValue(field, value); err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+	return nil
+}
+
+func setFieldValue(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return errors.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+func applyQueueEnv(cfg *QueueConfig) error {
+	if cfg.Queues == nil {
+		cfg.Queues = make(map[string]*QueueSettings)
+	}
+	if cfg.Routes == nil {
+		cfg.Routes = make(map[string]string)
+	}
+	for _, name := range queue.QueueNames() {
+		prefix := strings.ToUpper(name) + "_QUEUE_"
+		settings := cfg.Queues[name]
+		if settings == nil {
+			settings = &QueueSettings{}
+		}
+		if limit := os.Getenv(prefix + "WORKER_LIMIT"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %sWORKER_LIMIT", prefix)
+			}
+			settings.WorkerLimit = n
+		}
+		if timeout := os.Getenv(prefix + "RESERVATION_TIMEOUT"); timeout != "" {
+			d, err := time.ParseDuration(timeout)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %sRESERVATION_TIMEOUT", prefix)
+			}
+			settings.ReservationTimeout = d
+		}
+		if *settings != (QueueSettings{}) {
+			cfg.Queues[name] = settings
+		}
+	}
+
+	routes, err := parseQueueRoutes(os.Getenv("QUEUE_ROUTES"))
+	if err != nil {
+		return errors.Wrap(err, "invalid QUEUE_ROUTES")
+	}
+	for taskName, queueName := range routes {
+		cfg.Routes[taskName] = queueName
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.DB.Host == "" || cfg.DB.Name == "" || cfg.DB.User == "" {
+		return errors.New("db.host, db.name and db.user are required")
+	}
+	if cfg.DB.Port <= 0 || cfg.DB.PoolSize < 0 {
+		return errors.New("db.port must be greater than 0 and db.poolSize greater than or equal to 0")
+	}
+	if cfg.Redis.Addr == "" {
+		return errors.New("redis.addr is required")
+	}
+	if err := cfg.Queue.validate(); err != nil {
+		return errors.Wrap(err, "queue")
+	}
+	if err := cfg.Cron.schedules().Validate(); err != nil {
+		return errors.Wrap(err, "cron.schedules")
+	}
+	if cfg.Cron.LeaderLeaseTTL != 0 && cfg.Cron.LeaderLeaseTTL < 3*time.Second {
+		return errors.New("cron.leaderLeaseTTL must be at least 3 seconds")
+	}
+	if cfg.Cron.ReloadInterval < 0 {
+		return errors.New("cron.reloadInterval must be greater than or equal to 0")
+	}
+	if cfg.Archive.Storage != "" && cfg.Archive.Storage != archiveStorageLocal {
+		return errors.Errorf("archive.storage: unsupported storage type '%s'", cfg.Archive.Storage)
+	}
+	if cfg.RateLimit.RequestsPerSecond < 0 || cfg.RateLimit.MaxConcurrentRequests < 0 {
+		return errors.New("rateLimit: the limits must be greater than or equal to 0")
+	}
+	if cfg.RateLimit.LeaseTimeout < cfg.Queue.HTTPTimeout {
+		return errors.New("rateLimit.leaseTimeout must be at least queue.httpTimeout")
+	}
+	switch cfg.Tracing.Exporter {
+	case "", tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		return errors.Errorf("tracing.exporter: unsupported exporter '%s'", cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		return errors.New("tracing.sampleRatio must be between 0 and 1")
+	}
+	if cfg.Admin.Addr != "" && cfg.Admin.Token == "" {
+		return errors.New("admin.token is required if admin.addr is set")
+	}
+	return nil
+}
+
+func (cfg *QueueConfig) validate() error {
+	if cfg.WorkerLimit < 1 {
+		return errors.New("workerLimit must be greater than 0")
+	}
+	for name, settings := range cfg.Queues {
+		if !isQueueName(name) {
+			return errors.Errorf("queues: unknown queue '%s'", name)
+		}
+		if settings != nil && (settings.WorkerLimit < 0 || settings.ReservationTimeout < 0) {
+			return errors.Errorf("queues.%s: the settings must be greater than or equal to 0", name)
+		}
+	}
+	for taskName, queueName := range cfg.Routes {
+		if _, err := queue.TaskArgKind(taskName); err != nil {
+			return errors.Errorf("routes: unknown task '%s'", taskName)
+		}
+		if !isQueueName(queueName) {
+			return errors.Errorf("routes.%s: unknown queue '%s'", taskName, queueName)
+		}
+	}
+	if cfg.HTTPTimeout <= 0 || cfg.TransactionTimeout <= 0 {
+		return errors.New("httpTimeout and transactionTimeout must be greater than 0")
+	}
+	if cfg.Retention.HistoryDays <= 0 ||
+		cfg.Retention.DeletedPlayersDays <= 0 ||
+		cfg.Retention.DeletedTribesDays <= 0 ||
+		cfg.Retention.TaskRunsDays <= 0 ||
+		cfg.Retention.SnapshotsDays <= 0 {
+		return errors.New("retention: the number of days must be greater than 0")
+	}
+	return nil
+}
+
+// NewCronSchedules returns the schedules of the cron jobs based on the loaded config.
+func NewCronSchedules(cfg *Config) twhelpcron.Schedules {
+	return cfg.Cron.schedules()
+}
+
+func (cfg *CronConfig) schedules() twhelpcron.Schedules {
+	return twhelpcron.Schedules{
+		UpdateServerData:          cfg.Schedules.UpdateServerData,
+		UpdateEnnoblements:        cfg.Schedules.UpdateEnnoblements,
+		Vacuum:                    cfg.Schedules.Vacuum,
+		DeleteNonExistentVillages: cfg.Schedules.DeleteNonExistentVillages,
+		UpdateHistory:             cfg.Schedules.UpdateHistory,
+		UpdateStats:               cfg.Schedules.UpdateStats,
+	}
+}
+
+func isQueueName(name string) bool {
+	for _, queueName := range queue.QueueNames() {
+		if queueName == name {
+			return true
+		}
+	}
+	return false
+}
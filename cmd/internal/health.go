@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"context"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/health"
+)
+
+// NewHealthHandler returns the health handler with the readiness checks of the db and Redis.
+func NewHealthHandler(db *pg.DB, redisClient redis.UniversalClient) *health.Handler {
+	h := health.NewHandler()
+	h.AddReadinessCheck("postgres", func(ctx context.Context) error {
+		return errors.Wrap(db.Ping(ctx), "couldn't ping the db")
+	})
+	h.AddReadinessCheck("redis", func(ctx context.Context) error {
+		return errors.Wrap(redisClient.Ping(ctx).Err(), "couldn't ping Redis")
+	})
+	return h
+}
+
+// StartHealthServer serves /healthz and /readyz on the given address (e.g. :8082).
+// It does nothing if the address is empty. The returned function shuts the server down.
+func StartHealthServer(addr string, h *health.Handler) func() {
+	return startHTTPServer("health", addr, h)
+}
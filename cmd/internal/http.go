@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// startHTTPServer serves the handler on the given address in the background.
+// It does nothing if the address is empty. The returned function shuts the server down.
+func startHTTPServer(name, addr string, handler http.Handler) func() {
+	if addr == "" {
+		return func() {}
+	}
+
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Fatal(errors.Wrapf(err, "couldn't start the %s server", name))
+		}
+	}()
+	logrus.WithField("addr", addr).Infof("The %s server is up and running", name)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Warn(errors.Wrapf(err, "couldn't shut down the %s server", name))
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// StartMetricsServer serves the Prometheus metrics on the given address (e.g. :9100/metrics).
+// It does nothing if the address is empty. The returned function shuts the server down.
+func StartMetricsServer(addr string) func() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return startHTTPServer("metrics", addr, mux)
+}
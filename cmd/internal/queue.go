@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+// NewQueueConfig returns the queue config based on the loaded config.
+// The dependencies (Redis, DB etc.) have to be set by the caller.
+func NewQueueConfig(cfg *Config) *queue.Config {
+	queueCfg := &queue.Config{
+		WorkerLimit:        cfg.Queue.WorkerLimit,
+		Queues:             make(map[string]*queue.QueueConfig, len(cfg.Queue.Queues)),
+		Routes:             make(map[string]string, len(cfg.Queue.Routes)),
+		ServerDataDir:      cfg.ServerDataDir,
+		HTTPTimeout:        cfg.Queue.HTTPTimeout,
+		TransactionTimeout: cfg.Queue.TransactionTimeout,
+		BulkLoadThreshold:  cfg.Queue.BulkLoadThreshold,
+		UpdateHistorySpec:  cfg.Cron.Schedules.UpdateHistory,
+		UpdateStatsSpec:    cfg.Cron.Schedules.UpdateStats,
+		Retention: queue.Retention{
+			History:        time.Duration(cfg.Queue.Retention.HistoryDays) * day,
+			DeletedPlayers: time.Duration(cfg.Queue.Retention.DeletedPlayersDays) * day,
+			DeletedTribes:  time.Duration(cfg.Queue.Retention.DeletedTribesDays) * day,
+			TaskRuns:       time.Duration(cfg.Queue.Retention.TaskRunsDays) * day,
+			Snapshots:      time.Duration(cfg.Queue.Retention.SnapshotsDays) * day,
+		},
+	}
+	for name, settings := range cfg.Queue.Queues {
+		if settings == nil {
+			continue
+		}
+		queueCfg.Queues[name] = &queue.QueueConfig{
+			WorkerLimit:        settings.WorkerLimit,
+			ReservationTimeout: settings.ReservationTimeout,
+		}
+	}
+	for taskName, queueName := range cfg.Queue.Routes {
+		queueCfg.Routes[taskName] = queueName
+	}
+	return queueCfg
+}
+
+func parseQueueRoutes(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range strings.Split(s, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid route '%s', expected <task name>=<queue name>", route)
+		}
+		routes[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return routes, nil
+}
@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/ratelimit"
+)
+
+// NewRateLimiter returns nil if none of the limits is set.
+func NewRateLimiter(cfg *RateLimitConfig, client redis.UniversalClient) (*ratelimit.Limiter, error) {
+	if cfg.RequestsPerSecond <= 0 && cfg.MaxConcurrentRequests <= 0 {
+		return nil, nil
+	}
+	limiter, err := ratelimit.New(&ratelimit.Config{
+		Redis:                 client,
+		RequestsPerSecond:     cfg.RequestsPerSecond,
+		MaxConcurrentRequests: cfg.MaxConcurrentRequests,
+		LeaseTimeout:          cfg.LeaseTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "NewRateLimiter")
+	}
+	return limiter, nil
+}
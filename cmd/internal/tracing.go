@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/tracing"
+)
+
+// InitTracing sets up the tracing. It does nothing if the exporter isn't set.
+// The OTLP exporter is configured with the standard OpenTelemetry ENV variables (e.g. OTEL_EXPORTER_OTLP_ENDPOINT).
+// The returned function flushes the remaining spans.
+func InitTracing(cfg *TracingConfig, serviceName string) (func(), error) {
+	exporter := cfg.Exporter
+	if exporter == "" {
+		return func() {}, nil
+	}
+
+	shutdown, err := tracing.Init(&tracing.Config{
+		Exporter:    exporter,
+		ServiceName: serviceName,
+		SampleRatio: cfg.SampleRatio,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "InitTracing")
+	}
+	logrus.WithField("exporter", exporter).Info("Tracing is enabled")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't shut down the tracer provider"))
+		}
+	}, nil
+}
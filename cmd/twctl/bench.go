@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+type benchResult struct {
+	Method     string        `json:"method"`
+	Run        int           `json:"run"`
+	Rows       int           `json:"rows"`
+	Duration   time.Duration `json:"duration"`
+	RowsPerSec int           `json:"rowsPerSec"`
+}
+
+// benchUpsert compares the multi-row INSERT with COPY on synthetic data saved to a scratch schema.
+// The first run inserts the rows, the next ones update them.
+func benchUpsert(a *app, args []string) error {
+	fs := flag.NewFlagSet("bench-upsert", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	numberOfTribes := fs.Int("tribes", 2000, "number of tribes")
+	numberOfPlayers := fs.Int("players", 20000, "number of players")
+	numberOfVillages := fs.Int("villages", 100000, "number of villages")
+	runs := fs.Int("runs", 3, "number of runs per method")
+	schema := fs.String("schema", "bench_upsert", "the scratch schema (it's dropped before and after the benchmark)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *numberOfTribes < 0 || *numberOfPlayers < 0 || *numberOfVillages < 0 || *runs < 1 {
+		return errors.New("the number of rows must be greater than or equal to 0 and -runs greater than 0")
+	}
+	exists, err := a.db.Model(&twmodel.Server{}).Where("key = ?", *schema).Exists()
+	if err != nil {
+		return errors.Wrap(err, "couldn't check the servers")
+	}
+	if exists {
+		return errors.Errorf("'%s' is the schema of a server, choose another one", *schema)
+	}
+
+	server := &twmodel.Server{Key: *schema, VersionCode: "bench"}
+	defer func() {
+		if err := dropBenchSchema(a.db, *schema); err != nil {
+			logrus.Warnf("couldn't drop the bench schema %s: %v", *schema, err)
+		}
+	}()
+	methods := []struct {
+		name      string
+		threshold int
+	}{
+		{"insert", -1},
+		{"copy", 1},
+	}
+	var results []benchResult
+	for _, method := range methods {
+		if err := dropBenchSchema(a.db, *schema); err != nil {
+			return errors.Wrapf(err, "couldn't drop the bench schema %s", *schema)
+		}
+		if _, err := postgres.MigrateServer(a.db, server, postgres.LatestMigration); err != nil {
+			return err
+		}
+		for run := 1; run <= *runs; run++ {
+			// the same data for every method
+			rnd := rand.New(rand.NewSource(int64(run)))
+			tribes := syntheticTribes(rnd, *numberOfTribes)
+			players := syntheticPlayers(rnd, *numberOfPlayers, *numberOfTribes)
+			villages := syntheticVillages(rnd, *numberOfVillages, *numberOfPlayers)
+			rows := len(tribes) + len(players) + len(villages)
+
+			start := time.Now()
+			err := queue.SaveServerData(context.Background(), a.db, server, tribes, players, villages, method.threshold)
+			if err != nil {
+				return errors.Wrapf(err, "%s, run %d", method.name, run)
+			}
+			duration := time.Since(start)
+			results = append(results, benchResult{
+				Method:     method.name,
+				Run:        run,
+				Rows:       rows,
+				Duration:   duration,
+				RowsPerSec: int(float64(rows) / duration.Seconds()),
+			})
+		}
+	}
+
+	return a.print(results, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "METHOD\tRUN\tROWS\tDURATION\tROWS/S")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\n", r.Method, r.Run, r.Rows, r.Duration.Round(time.Millisecond), r.RowsPerSec)
+		}
+	})
+}
+
+func dropBenchSchema(db *pg.DB, schema string) error {
+	_, err := db.Exec("DROP SCHEMA IF EXISTS ? CASCADE", pg.Ident(schema))
+	return err
+}
+
+func syntheticTribes(rnd *rand.Rand, n int) []*twmodel.Tribe {
+	exists := true
+	tribes := make([]*twmodel.Tribe, n)
+	for i := range tribes {
+		tribes[i] = &twmodel.Tribe{
+			ID:            i + 1,
+			Name:          "Tribe " + strconv.Itoa(i+1),
+			Tag:           "T" + strconv.Itoa(i+1),
+			Exists:        &exists,
+			TotalMembers:  rnd.Intn(100),
+			TotalVillages: rnd.Intn(5000),
+			Points:        rnd.Intn(10000000),
+			AllPoints:     rnd.Intn(10000000),
+			Rank:          i + 1,
+			Dominance:     rnd.Float64() * 10,
+			OpponentsDefeated: twmodel.OpponentsDefeated{
+				RankAtt:  i + 1,
+				ScoreAtt: rnd.Intn(10000000),
+			},
+		}
+	}
+	return tribes
+}
+
+func syntheticPlayers(rnd *rand.Rand, n, numberOfTribes int) []*twmodel.Player {
+	exists := true
+	players := make([]*twmodel.Player, n)
+	for i := range players {
+		tribeID := 0
+		if numberOfTribes > 0 {
+			tribeID = rnd.Intn(numberOfTribes + 1)
+		}
+		players[i] = &twmodel.Player{
+			ID:            i + 1,
+			Name:          "Player " + strconv.Itoa(i+1),
+			Exists:        &exists,
+			TotalVillages: rnd.Intn(500),
+			Points:        rnd.Intn(5000000),
+			Rank:          i + 1,
+			TribeID:       tribeID,
+			DailyGrowth:   rnd.Intn(10000),
+			OpponentsDefeated: twmodel.OpponentsDefeated{
+				RankAtt:  i + 1,
+				ScoreAtt: rnd.Intn(1000000),
+				RankDef:  i + 1,
+				ScoreDef: rnd.Intn(1000000),
+			},
+		}
+	}
+	return players
+}
+
+func syntheticVillages(rnd *rand.Rand, n, numberOfPlayers int) []*twmodel.Village {
+	villages := make([]*twmodel.Village, n)
+	for i := range villages {
+		playerID := 0
+		if numberOfPlayers > 0 {
+			playerID = rnd.Intn(numberOfPlayers + 1)
+		}
+		villages[i] = &twmodel.Village{
+			ID:       i + 1,
+			Name:     "Village " + strconv.Itoa(i+1),
+			Points:   rnd.Intn(13000),
+			X:        rnd.Intn(1000),
+			Y:        rnd.Intn(1000),
+			Bonus:    rnd.Intn(10),
+			PlayerID: playerID,
+		}
+	}
+	return villages
+}
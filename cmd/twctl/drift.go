@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+)
+
+func drift(a *app, args []string) error {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	serverKey := fs.String("server", "", "check only the schema of the given server")
+	fix := fs.Bool("fix", false, "fix the drifts that can be fixed automatically")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var servers []*twmodel.Server
+	q := a.db.Model(&servers).Order("key ASC")
+	if *serverKey != "" {
+		q = q.Where("key = ?", *serverKey)
+	}
+	if err := q.Select(); err != nil {
+		return errors.Wrap(err, "couldn't load the servers")
+	}
+	if *serverKey != "" && len(servers) == 0 {
+		return errors.Errorf("server '%s' not found", *serverKey)
+	}
+
+	ctx := context.Background()
+	reports := make([]*postgres.DriftReport, 0, len(servers))
+	drifted := 0
+	for _, server := range servers {
+		report, err := postgres.DetectServerDrift(ctx, a.db, server)
+		if err == nil && *fix {
+			report, err = postgres.FixServerDrift(ctx, a.db, server, report)
+		}
+		if err != nil {
+			report = &postgres.DriftReport{
+				Server: server.Key,
+				Drifts: []postgres.Drift{},
+				Error:  err.Error(),
+			}
+		}
+		if report.HasDrift() || report.Error != "" {
+			drifted++
+		}
+		reports = append(reports, report)
+	}
+
+	err := a.print(reports, func(w *tabwriter.Writer) {
+		for _, r := range reports {
+			status := "ok"
+			switch {
+			case r.Error != "":
+				status = "error: " + r.Error
+			case r.HasDrift():
+				status = fmt.Sprintf("%d drifts", len(r.Drifts))
+			}
+			if r.Fixed > 0 {
+				status += fmt.Sprintf(" (%d fixed)", r.Fixed)
+			}
+			fmt.Fprintf(w, "%s: %s\n", r.Server, status)
+			for _, d := range r.Drifts {
+				fmt.Fprintf(w, "  %s\n", d)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if drifted > 0 {
+		return errors.Errorf("%d of %d server schemas have drifted", drifted, len(servers))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+const maxErrorLength = 80
+
+type failedTaskFilter struct {
+	ids       []int
+	taskName  string
+	serverKey string
+	all       bool
+}
+
+func (f *failedTaskFilter) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.taskName, "task", "", "filter by the task name")
+	fs.StringVar(&f.serverKey, "server", "", "filter by the server key")
+}
+
+func (f *failedTaskFilter) parseIDs(fs *flag.FlagSet) error {
+	for _, arg := range fs.Args() {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return errors.Errorf("invalid ID '%s'", arg)
+		}
+		f.ids = append(f.ids, id)
+	}
+	if len(f.ids) == 0 && !f.all && f.taskName == "" && f.serverKey == "" {
+		return errors.New("specify the IDs, -task, -server or -all")
+	}
+	return nil
+}
+
+func (f *failedTaskFilter) load(db *pg.DB, limit int) ([]*model.FailedTask, error) {
+	var tasks []*model.FailedTask
+	q := db.Model(&tasks).Order("id ASC")
+	if len(f.ids) > 0 {
+		q = q.Where("id = ANY(?)", pg.Array(f.ids))
+	}
+	if f.taskName != "" {
+		q = q.Where("task_name = ?", f.taskName)
+	}
+	if f.serverKey != "" {
+		q = q.Where("server_key = ?", f.serverKey)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load the failed tasks")
+	}
+	return tasks, nil
+}
+
+func failedTasks(a *app, args []string) error {
+	fs := flag.NewFlagSet("failed-tasks", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	f := &failedTaskFilter{}
+	f.register(fs)
+	limit := fs.Int("limit", 100, "maximum number of failed tasks to show (0 = no limit)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tasks, err := f.load(a.db, *limit)
+	if err != nil {
+		return err
+	}
+	return a.print(tasks, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tTASK\tSERVER\tATTEMPTS\tFAILED AT\tLAST ERROR")
+		for _, ft := range tasks {
+			lastErr := ft.LastError()
+			if len(lastErr) > maxErrorLength {
+				lastErr = lastErr[:maxErrorLength] + "..."
+			}
+			fmt.Fprintf(
+				w,
+				"%d\t%s\t%s\t%d\t%s\t%s\n",
+				ft.ID,
+				ft.TaskName,
+				ft.ServerKey,
+				len(ft.Attempts),
+				ft.CreatedAt.Format(time.RFC3339),
+				lastErr,
+			)
+		}
+	})
+}
+
+func failedTask(a *app, args []string) error {
+	fs := flag.NewFlagSet("failed-task", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one ID")
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return errors.Errorf("invalid ID '%s'", fs.Arg(0))
+	}
+
+	ft := &model.FailedTask{}
+	if err := a.db.Model(ft).Where("id = ?", id).Select(); err != nil {
+		return errors.Wrapf(err, "couldn't load the failed task %d", id)
+	}
+	// the attempts don't fit in a table
+	return printJSON(ft)
+}
+
+func requeueFailedTasks(a *app, args []string) error {
+	fs := flag.NewFlagSet("requeue-failed-tasks", flag.ExitOnError)
+	f := &failedTaskFilter{}
+	f.register(fs)
+	fs.BoolVar(&f.all, "all", false, "requeue all failed tasks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := f.parseIDs(fs); err != nil {
+		return err
+	}
+
+	tasks, err := f.load(a.db, 0)
+	if err != nil {
+		return err
+	}
+	q, err := a.newQueue()
+	if err != nil {
+		return err
+	}
+	for _, ft := range tasks {
+		if err := q.Requeue(ft); err != nil {
+			return errors.Wrapf(err, "couldn't requeue the failed task %d", ft.ID)
+		}
+		if _, err := a.db.Model(ft).WherePK().Delete(); err != nil {
+			return errors.Wrapf(err, "the failed task %d has been requeued, but couldn't be deleted", ft.ID)
+		}
+		fmt.Printf("%d: %s %s has been requeued\n", ft.ID, ft.TaskName, ft.ServerKey)
+	}
+	return nil
+}
+
+func discardFailedTasks(a *app, args []string) error {
+	fs := flag.NewFlagSet("discard-failed-tasks", flag.ExitOnError)
+	f := &failedTaskFilter{}
+	f.register(fs)
+	fs.BoolVar(&f.all, "all", false, "discard all failed tasks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := f.parseIDs(fs); err != nil {
+		return err
+	}
+
+	tasks, err := f.load(a.db, 0)
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+	ids := make([]int, len(tasks))
+	for i, ft := range tasks {
+		ids[i] = ft.ID
+	}
+	res, err := a.db.Model(&model.FailedTask{}).Where("id = ANY(?)", pg.Array(ids)).Delete()
+	if err != nil {
+		return errors.Wrap(err, "couldn't delete the failed tasks")
+	}
+	fmt.Printf("%d failed task(s) have been discarded\n", res.RowsAffected())
+	return nil
+}
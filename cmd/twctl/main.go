@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/cmd/internal"
+	twhelpcron "github.com/tribalwarshelp/dataupdater/cron"
+	"github.com/tribalwarshelp/dataupdater/model"
+	twhelppause "github.com/tribalwarshelp/dataupdater/pause"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+const usage = `Usage: twctl <command> [flags] [args]
+
+Commands:
+  enqueue <task> [server key|version code|timezone]   add the task to the queue
+  tasks                                               list the tasks and their args
+  servers [-status open|closed] [-version code] [-paused]
+                                                      list the servers
+  versions                                            list the versions
+  set-version <code> [-name n] [-host h] [-timezone tz] [-disable [-reason text] | -enable]
+                                                      add or update the version
+  add-special-server <version code> <key>             skip the server in the data updates
+  remove-special-server <version code> <key>          update the server like any other server
+  import-seed [-overwrite] [-prune] <file>            import the versions from the JSON/YAML seed file
+  migrate [-status] [-public | -servers | -server key] [-target version]
+                                                      migrate the public and server schemas
+  drift [-server key] [-fix]                          compare the server schemas with the structure expected by the code
+  bench-upsert [-tribes n] [-players n] [-villages n] [-runs n]
+                                                      compare INSERT and COPY on synthetic data
+  queues                                              show the number of messages in the queues
+  schedules                                           list the schedules of the versions
+  set-schedule <version code> [-data spec] [-history spec] [-stats spec]
+                                                      override the schedules of the version ("" restores the global one)
+  reset-schedule <version code>                       restore the global schedules of the version
+  pause (-server key | -version code) [-reason text]  exclude the server/version from the scheduled updates
+  resume (-server key | -version code)                include the server/version in the scheduled updates again
+  pauses                                              list the paused servers and versions
+  snapshots <server key>                              list the archived snapshots of the server
+  replay <server key> [-snapshot id] [-ignore-hashes=false]
+                                                      update the server data from the archived snapshot (the latest one by default)
+  failed-tasks [-task name] [-server key] [-limit n]  list the tasks that have exhausted their retries
+  failed-task <id>                                    show the details of the failed task
+  requeue-failed-tasks [-task name] [-server key] [-all] [id...]
+                                                      add the failed tasks back to the queue
+  discard-failed-tasks [-task name] [-server key] [-all] [id...]
+                                                      delete the failed tasks
+`
+
+type app struct {
+	cfg   *internal.Config
+	db    *pg.DB
+	redis redis.UniversalClient
+	json  bool
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+	var fn func(a *app, args []string) error
+	switch cmd {
+	case "enqueue":
+		fn = enqueue
+	case "tasks":
+		// doesn't need the db nor Redis
+		if err := tasks(&app{}, args); err != nil {
+			logrus.Fatal(errors.Wrap(err, cmd))
+		}
+		return
+	case "servers":
+		fn = servers
+	case "versions":
+		fn = versions
+	case "set-version":
+		fn = setVersion
+	case "add-special-server":
+		fn = addSpecialServer
+	case "remove-special-server":
+		fn = removeSpecialServer
+	case "import-seed":
+		fn = importSeed
+	case "migrate":
+		fn = migrate
+	case "drift":
+		fn = drift
+	case "bench-upsert":
+		fn = benchUpsert
+	case "queues":
+		fn = queues
+	case "schedules":
+		fn = schedules
+	case "set-schedule":
+		fn = setSchedule
+	case "reset-schedule":
+		fn = resetSchedule
+	case "pause":
+		fn = pause
+	case "resume":
+		fn = resume
+	case "pauses":
+		fn = pauses
+	case "snapshots":
+		fn = snapshots
+	case "replay":
+		fn = replay
+	case "failed-tasks":
+		fn = failedTasks
+	case "failed-task":
+		fn = failedTask
+	case "requeue-failed-tasks":
+		fn = requeueFailedTasks
+	case "discard-failed-tasks":
+		fn = discardFailedTasks
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cfg, err := internal.LoadConfig()
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't load the config"))
+	}
+
+	redisClient, err := internal.NewRedisClient(&cfg.Redis)
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't connect to Redis"))
+	}
+	defer func() {
+		if err := redisClient.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the Redis connection"))
+		}
+	}()
+
+	dbConn, err := postgres.Connect(cfg.DB.PostgresConfig(true))
+	if err != nil {
+		logrus.Fatal(errors.Wrap(err, "couldn't connect to the db"))
+	}
+	defer func() {
+		if err := dbConn.Close(); err != nil {
+			logrus.Warn(errors.Wrap(err, "couldn't close the db connection"))
+		}
+	}()
+
+	if err := fn(&app{cfg: cfg, db: dbConn, redis: redisClient}, args); err != nil {
+		logrus.Fatal(errors.Wrap(err, cmd))
+	}
+}
+
+func (a *app) newQueue() (*queue.Queue, error) {
+	cfg := internal.NewQueueConfig(a.cfg)
+	cfg.DB = a.db
+	cfg.Redis = a.redis
+	q, err := queue.New(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't initialize a queue")
+	}
+	return q, nil
+}
+
+func (a *app) registerJSONFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&a.json, "json", false, "print the output as JSON")
+}
+
+func (a *app) print(v interface{}, printTable func(w *tabwriter.Writer)) error {
+	if a.json {
+		return printJSON(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printTable(w)
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func enqueue(a *app, args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("expected a task name and an optional arg")
+	}
+	taskName, arg := fs.Arg(0), fs.Arg(1)
+
+	q, err := a.newQueue()
+	if err != nil {
+		return err
+	}
+	msg, err := q.Enqueue(context.Background(), taskName, arg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("the task '%s' has been added to the queue (id: %s)\n", taskName, msg.ID)
+	return nil
+}
+
+func tasks(a *app, args []string) error {
+	fs := flag.NewFlagSet("tasks", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	type task struct {
+		Name string `json:"name"`
+		Arg  string `json:"arg,omitempty"`
+	}
+	var result []task
+	for _, name := range queue.TaskNames() {
+		kind, err := queue.TaskArgKind(name)
+		if err != nil {
+			return err
+		}
+		result = append(result, task{Name: name, Arg: kind})
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "TASK\tARG")
+		for _, t := range result {
+			fmt.Fprintf(w, "%s\t%s\n", t.Name, t.Arg)
+		}
+	})
+}
+
+func servers(a *app, args []string) error {
+	fs := flag.NewFlagSet("servers", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	status := fs.String("status", "", "filter by the status (open, closed)")
+	version := fs.String("version", "", "filter by the version code")
+	onlyPaused := fs.Bool("paused", false, "show only the paused servers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var servers []*twmodel.Server
+	q := a.db.
+		Model(&servers).
+		Column("key", "status", "version_code", "data_updated_at", "history_updated_at", "stats_updated_at").
+		Order("key ASC")
+	if *status != "" {
+		q = q.Where("status = ?", *status)
+	}
+	if *version != "" {
+		q = q.Where("version_code = ?", *version)
+	}
+	if err := q.Select(); err != nil {
+		return errors.Wrap(err, "couldn't load the servers")
+	}
+	p, err := twhelppause.Load(context.Background(), a.db)
+	if err != nil {
+		return err
+	}
+
+	type server struct {
+		*twmodel.Server
+		Paused      bool   `json:"paused"`
+		PauseReason string `json:"pauseReason,omitempty"`
+	}
+	result := make([]server, 0, len(servers))
+	for _, s := range servers {
+		paused, reason := p.ServerPause(s)
+		if *onlyPaused && !paused {
+			continue
+		}
+		result = append(result, server{
+			Server:      s,
+			Paused:      paused,
+			PauseReason: reason,
+		})
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "KEY\tSTATUS\tVERSION\tDATA UPDATED AT\tHISTORY UPDATED AT\tSTATS UPDATED AT\tPAUSED")
+		for _, s := range result {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.Key,
+				s.Status,
+				s.VersionCode,
+				formatTime(s.DataUpdatedAt),
+				formatTime(s.HistoryUpdatedAt),
+				formatTime(s.StatsUpdatedAt),
+				formatPause(s.Paused, s.PauseReason),
+			)
+		}
+	})
+}
+
+func queues(a *app, args []string) error {
+	fs := flag.NewFlagSet("queues", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	q, err := a.newQueue()
+	if err != nil {
+		return err
+	}
+	result, err := q.Stats(context.Background())
+	if err != nil {
+		return err
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "QUEUE\tPENDING\tIN FLIGHT\tDELAYED")
+		for _, s := range result {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", s.Name, s.Pending, s.InFlight, s.Delayed)
+		}
+	})
+}
+
+func schedules(a *app, args []string) error {
+	fs := flag.NewFlagSet("schedules", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var versions []*twmodel.Version
+	if err := a.db.Model(&versions).Order("code ASC").Select(); err != nil {
+		return errors.Wrap(err, "couldn't load the versions")
+	}
+	var overrides []*model.VersionSchedule
+	if err := a.db.Model(&overrides).Select(); err != nil {
+		return errors.Wrap(err, "couldn't load the version schedules")
+	}
+	overridesByCode := make(map[twmodel.VersionCode]*model.VersionSchedule, len(overrides))
+	for _, override := range overrides {
+		overridesByCode[override.VersionCode] = override
+	}
+
+	type schedule struct {
+		VersionCode      twmodel.VersionCode `json:"versionCode"`
+		Timezone         string              `json:"timezone"`
+		UpdateServerData string              `json:"updateServerData"`
+		UpdateHistory    string              `json:"updateHistory"`
+		UpdateStats      string              `json:"updateStats"`
+	}
+	defaults := internal.NewCronSchedules(a.cfg)
+	result := make([]schedule, 0, len(versions))
+	for _, v := range versions {
+		s := schedule{
+			VersionCode:      v.Code,
+			Timezone:         v.Timezone,
+			UpdateServerData: defaults.UpdateServerData + " (global)",
+			UpdateHistory:    defaults.UpdateHistory + " (global)",
+			UpdateStats:      defaults.UpdateStats + " (global)",
+		}
+		if override, ok := overridesByCode[v.Code]; ok {
+			if override.UpdateServerData != "" {
+				s.UpdateServerData = override.UpdateServerData
+			}
+			if override.UpdateHistory != "" {
+				s.UpdateHistory = override.UpdateHistory
+			}
+			if override.UpdateStats != "" {
+				s.UpdateStats = override.UpdateStats
+			}
+		}
+		result = append(result, s)
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "VERSION\tTIMEZONE\tDATA\tHISTORY\tSTATS")
+		for _, s := range result {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.VersionCode, s.Timezone, s.UpdateServerData, s.UpdateHistory, s.UpdateStats)
+		}
+	})
+}
+
+func setSchedule(a *app, args []string) error {
+	fs := flag.NewFlagSet("set-schedule", flag.ExitOnError)
+	data := fs.String("data", "", "the schedule of the data update")
+	history := fs.String("history", "", "the schedule of the history update")
+	stats := fs.String("stats", "", "the schedule of the stats update")
+	if len(args) < 1 {
+		return errors.New("expected a version code")
+	}
+	code := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || fs.NFlag() == 0 {
+		return errors.New("expected a version code and at least one of the flags: -data, -history, -stats")
+	}
+
+	if err := a.db.Model(&twmodel.Version{}).Where("code = ?", code).Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return errors.Errorf("version '%s' not found", code)
+		}
+		return errors.Wrap(err, "couldn't load the version")
+	}
+	schedule := &model.VersionSchedule{
+		VersionCode: twmodel.VersionCode(code),
+	}
+	if err := a.db.Model(schedule).WherePK().Select(); err != nil && err != pg.ErrNoRows {
+		return errors.Wrap(err, "couldn't load the version schedule")
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data":
+			schedule.UpdateServerData = *data
+		case "history":
+			schedule.UpdateHistory = *history
+		case "stats":
+			schedule.UpdateStats = *stats
+		}
+	})
+	if err := twhelpcron.ValidateVersionSchedule(schedule); err != nil {
+		return err
+	}
+	if schedule.IsEmpty() {
+		return deleteSchedule(a, code)
+	}
+
+	schedule.UpdatedAt = time.Now()
+	if _, err := a.db.Model(schedule).
+		OnConflict("(version_code) DO UPDATE").
+		Set("update_server_data = EXCLUDED.update_server_data").
+		Set("update_history = EXCLUDED.update_history").
+		Set("update_stats = EXCLUDED.update_stats").
+		Set("updated_at = EXCLUDED.updated_at").
+		Insert(); err != nil {
+		return errors.Wrap(err, "couldn't save the version schedule")
+	}
+	fmt.Printf("the schedule of the version '%s' has been saved\n", code)
+	return nil
+}
+
+func resetSchedule(a *app, args []string) error {
+	fs := flag.NewFlagSet("reset-schedule", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected a version code")
+	}
+	return deleteSchedule(a, fs.Arg(0))
+}
+
+func deleteSchedule(a *app, code string) error {
+	if _, err := a.db.Model(&model.VersionSchedule{}).Where("version_code = ?", code).Delete(); err != nil {
+		return errors.Wrap(err, "couldn't delete the version schedule")
+	}
+	fmt.Printf("the version '%s' uses the global schedules\n", code)
+	return nil
+}
+
+func registerPauseTargetFlags(fs *flag.FlagSet) (server *string, version *string) {
+	server = fs.String("server", "", "the server key")
+	version = fs.String("version", "", "the version code")
+	return server, version
+}
+
+func pause(a *app, args []string) error {
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	server, version := registerPauseTargetFlags(fs)
+	reason := fs.String("reason", "", "why the updates have been paused")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*server == "") == (*version == "") {
+		return errors.New("expected either -server or -version")
+	}
+
+	if *server != "" {
+		if _, err := twhelppause.PauseServer(context.Background(), a.db, *server, *reason); err != nil {
+			return err
+		}
+		fmt.Printf("the server '%s' has been paused\n", *server)
+		return nil
+	}
+	if _, err := twhelppause.PauseVersion(context.Background(), a.db, *version, *reason); err != nil {
+		return err
+	}
+	fmt.Printf("the version '%s' has been paused\n", *version)
+	return nil
+}
+
+func resume(a *app, args []string) error {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	server, version := registerPauseTargetFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*server == "") == (*version == "") {
+		return errors.New("expected either -server or -version")
+	}
+
+	var resumed bool
+	var err error
+	target := "server '" + *server + "'"
+	if *server != "" {
+		resumed, err = twhelppause.ResumeServer(context.Background(), a.db, *server)
+	} else {
+		resumed, err = twhelppause.ResumeVersion(context.Background(), a.db, *version)
+		target = "version '" + *version + "'"
+	}
+	if err != nil {
+		return err
+	}
+	if !resumed {
+		fmt.Printf("the %s hasn't been paused\n", target)
+		return nil
+	}
+	fmt.Printf("the %s has been resumed\n", target)
+	return nil
+}
+
+func pauses(a *app, args []string) error {
+	fs := flag.NewFlagSet("pauses", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	p, err := twhelppause.Load(context.Background(), a.db)
+	if err != nil {
+		return err
+	}
+	return a.print(p, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "SERVER\tVERSION\tPAUSED AT\tREASON")
+		for _, v := range p.Versions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", "*", v.VersionCode, formatTime(v.PausedAt), v.Reason)
+		}
+		for _, s := range p.Servers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ServerKey, "-", formatTime(s.PausedAt), s.Reason)
+		}
+	})
+}
+
+func formatPause(paused bool, reason string) string {
+	if !paused {
+		return "-"
+	}
+	if reason == "" {
+		return "yes"
+	}
+	return "yes (" + reason + ")"
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+)
+
+func migrate(a *app, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	status := fs.Bool("status", false, "show the versions of the schemas instead of migrating them")
+	onlyPublic := fs.Bool("public", false, "migrate only the public schema")
+	onlyServers := fs.Bool("servers", false, "migrate only the server schemas")
+	serverKey := fs.String("server", "", "migrate only the schema of the given server")
+	target := fs.Int("target", postgres.LatestMigration, "the target version (the latest one by default), requires -public, -servers or -server")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	scopes := 0
+	for _, set := range []bool{*onlyPublic, *onlyServers, *serverKey != ""} {
+		if set {
+			scopes++
+		}
+	}
+	if scopes > 1 {
+		return errors.New("-public, -servers and -server are mutually exclusive")
+	}
+	if *target != postgres.LatestMigration && scopes == 0 {
+		return errors.New("the public and server schemas have different versions, use -target with -public, -servers or -server")
+	}
+	migratePublic := !*onlyServers && *serverKey == ""
+	migrateServers := !*onlyPublic
+
+	var servers []*twmodel.Server
+	if migrateServers {
+		q := a.db.Model(&servers).Order("key ASC")
+		if *serverKey != "" {
+			q = q.Where("key = ?", *serverKey)
+		}
+		if err := q.Select(); err != nil {
+			return errors.Wrap(err, "couldn't load the servers")
+		}
+		if *serverKey != "" && len(servers) == 0 {
+			return errors.Errorf("server '%s' not found", *serverKey)
+		}
+	}
+
+	if *status {
+		return a.printMigrationStatus(migratePublic, servers)
+	}
+
+	if migratePublic {
+		result, err := postgres.MigratePublic(a.db, *target)
+		if err != nil {
+			return err
+		}
+		a.printMigrationResult(postgres.ServerMigrationProgress{Result: result})
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	return postgres.MigrateServers(context.Background(), a.db, servers, *target, a.printMigrationResult)
+}
+
+// printMigrationResult prints the result of the migration as soon as the schema has been migrated,
+// one line (or one JSON object) per schema.
+func (a *app) printMigrationResult(p postgres.ServerMigrationProgress) {
+	if a.json {
+		if err := json.NewEncoder(os.Stdout).Encode(p); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+	prefix := ""
+	if p.Total > 0 {
+		prefix = fmt.Sprintf("[%d/%d] ", p.Done, p.Total)
+	}
+	schema := p.Server
+	if p.Result != nil {
+		schema = p.Result.Schema
+	}
+	switch {
+	case p.Error != "":
+		fmt.Printf("%s%s: error: %s\n", prefix, schema, p.Error)
+	case !p.Result.Changed():
+		fmt.Printf("%s%s: up to date (version %d)\n", prefix, schema, p.Result.ToVersion)
+	default:
+		fmt.Printf(
+			"%s%s: %d -> %d (applied: %v, reverted: %v, %s)\n",
+			prefix,
+			schema,
+			p.Result.FromVersion,
+			p.Result.ToVersion,
+			p.Result.Applied,
+			p.Result.Reverted,
+			p.Result.Duration,
+		)
+	}
+}
+
+func (a *app) printMigrationStatus(public bool, servers []*twmodel.Server) error {
+	var result []*postgres.MigrationStatus
+	if public {
+		status, err := postgres.PublicMigrationStatus(a.db)
+		if err != nil {
+			return err
+		}
+		result = append(result, status)
+	}
+	for _, server := range servers {
+		status, err := postgres.ServerMigrationStatus(a.db, server)
+		if err != nil {
+			return err
+		}
+		result = append(result, status)
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "SCHEMA\tVERSION\tLATEST\tPENDING")
+		for _, s := range result {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%v\n", s.Schema, s.Version, s.Latest, s.Pending)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+	"github.com/tribalwarshelp/dataupdater/cmd/internal"
+)
+
+func (a *app) newArchiver() (*archive.Archiver, error) {
+	archiver, err := internal.NewArchiver(&a.cfg.Archive)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't initialize the archiver")
+	}
+	if archiver == nil {
+		return nil, errors.New("the archive isn't configured (archive.dir/ARCHIVE_DIR is empty)")
+	}
+	return archiver, nil
+}
+
+func snapshots(a *app, args []string) error {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected a server key")
+	}
+
+	archiver, err := a.newArchiver()
+	if err != nil {
+		return err
+	}
+	ids, err := archiver.Snapshots(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
+
+func replay(a *app, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	snapshotID := fs.String("snapshot", "", "ID of the snapshot to replay (defaults to the latest one)")
+	ignoreHashes := fs.Bool("ignore-hashes", true, "save all rows from the snapshot and rewrite their hashes (false saves only the changed rows)")
+	if len(args) < 1 {
+		return errors.New("expected a server key")
+	}
+	serverKey := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("expected a server key and optional flags")
+	}
+
+	archiver, err := a.newArchiver()
+	if err != nil {
+		return err
+	}
+	if *snapshotID == "" {
+		*snapshotID, err = archiver.LatestSnapshot(serverKey)
+		if err != nil {
+			return err
+		}
+	}
+	dl, err := archiver.NewServerDataLoader(serverKey, *snapshotID)
+	if err != nil {
+		return err
+	}
+
+	server := &twmodel.Server{}
+	if err := a.db.Model(server).Where("key = ?", serverKey).Relation("Version").Select(); err != nil {
+		return errors.Wrapf(err, "couldn't load the server '%s'", serverKey)
+	}
+
+	q, err := a.newQueue()
+	if err != nil {
+		return err
+	}
+
+	entry := logrus.WithField("key", server.Key).WithField("snapshot", *snapshotID)
+	entry.Infof("%s: Replaying the snapshot %s...", server.Key, *snapshotID)
+	if err := q.ReplayServerData(context.Background(), dl, server, *ignoreHashes); err != nil {
+		return errors.Wrap(err, "couldn't replay the snapshot")
+	}
+	entry.Infof("%s: The snapshot %s has been replayed", server.Key, *snapshotID)
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/catalog"
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+func versions(a *app, args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var versions []*twmodel.Version
+	if err := a.db.Model(&versions).Relation("SpecialServers").Order("code ASC").Select(); err != nil {
+		return errors.Wrap(err, "couldn't load the versions")
+	}
+	var pauses []*model.VersionPause
+	if err := a.db.Model(&pauses).Select(); err != nil {
+		return errors.Wrap(err, "couldn't load the paused versions")
+	}
+	pausesByCode := make(map[twmodel.VersionCode]*model.VersionPause, len(pauses))
+	for _, p := range pauses {
+		pausesByCode[p.VersionCode] = p
+	}
+
+	type version struct {
+		*twmodel.Version
+		Disabled      bool   `json:"disabled"`
+		DisableReason string `json:"disableReason,omitempty"`
+	}
+	result := make([]version, len(versions))
+	for i, v := range versions {
+		result[i] = version{Version: v}
+		if p, ok := pausesByCode[v.Code]; ok {
+			result[i].Disabled = true
+			result[i].DisableReason = p.Reason
+		}
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "CODE\tNAME\tHOST\tTIMEZONE\tSPECIAL SERVERS\tDISABLED")
+		for _, v := range result {
+			keys := make([]string, len(v.SpecialServers))
+			for i, s := range v.SpecialServers {
+				keys[i] = s.Key
+			}
+			specialServers := strings.Join(keys, ",")
+			if specialServers == "" {
+				specialServers = "-"
+			}
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%s\t%s\t%s\n",
+				v.Code,
+				v.Name,
+				v.Host,
+				v.Timezone,
+				specialServers,
+				formatPause(v.Disabled, v.DisableReason),
+			)
+		}
+	})
+}
+
+func setVersion(a *app, args []string) error {
+	fs := flag.NewFlagSet("set-version", flag.ExitOnError)
+	name := fs.String("name", "", "the name of the version")
+	host := fs.String("host", "", "the host of the version (e.g. plemiona.pl)")
+	timezone := fs.String("timezone", "", "the timezone of the version (e.g. Europe/Warsaw)")
+	disable := fs.Bool("disable", false, "pause the updates of all servers of the version")
+	enable := fs.Bool("enable", false, "resume the updates of all servers of the version")
+	reason := fs.String("reason", "", "why the version has been disabled")
+	if len(args) < 1 {
+		return errors.New("expected a version code")
+	}
+	code := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("expected a version code and flags")
+	}
+	if *disable && *enable {
+		return errors.New("-disable and -enable are mutually exclusive")
+	}
+
+	ctx := context.Background()
+	v := &twmodel.Version{
+		Code: twmodel.VersionCode(code),
+	}
+	if err := a.db.ModelContext(ctx, v).WherePK().Select(); err != nil && err != pg.ErrNoRows {
+		return errors.Wrap(err, "couldn't load the version")
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			v.Name = *name
+		case "host":
+			v.Host = *host
+		case "timezone":
+			v.Timezone = *timezone
+		}
+	})
+	if err := catalog.SaveVersion(ctx, a.db, v); err != nil {
+		return err
+	}
+	if *disable || *enable {
+		if err := catalog.SetVersionDisabled(ctx, a.db, code, *disable, *reason); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("the version '%s' has been saved\n", code)
+	return nil
+}
+
+func addSpecialServer(a *app, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected a version code and a server key")
+	}
+	if err := catalog.AddSpecialServer(context.Background(), a.db, args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("the server '%s' is skipped by the data updates\n", args[1])
+	return nil
+}
+
+func removeSpecialServer(a *app, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected a version code and a server key")
+	}
+	if err := catalog.RemoveSpecialServer(context.Background(), a.db, args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("the server '%s' is no longer a special server\n", args[1])
+	return nil
+}
+
+func importSeed(a *app, args []string) error {
+	fs := flag.NewFlagSet("import-seed", flag.ExitOnError)
+	a.registerJSONFlag(fs)
+	overwrite := fs.Bool("overwrite", false, "update the existing versions")
+	prune := fs.Bool("prune", false, "remove the special servers that aren't in the file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected a seed file")
+	}
+
+	seed, err := catalog.LoadSeedFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var result *catalog.ImportResult
+	err = a.db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		var err error
+		result, err = catalog.Import(context.Background(), tx, seed, catalog.ImportOptions{
+			Overwrite: *overwrite,
+			Prune:     *prune,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return a.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "VERSIONS INSERTED\tVERSIONS UPDATED\tSPECIAL SERVERS INSERTED\tSPECIAL SERVERS REMOVED")
+		fmt.Fprintf(
+			w,
+			"%d\t%d\t%d\t%d\n",
+			result.VersionsInserted,
+			result.VersionsUpdated,
+			result.SpecialServersInserted,
+			result.SpecialServersRemoved,
+		)
+	})
+}
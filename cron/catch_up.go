@@ -0,0 +1,223 @@
+package cron
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/pause"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+const (
+	// catchUpLookback limits how far back the missed runs are looked for.
+	catchUpLookback = 31 * 24 * time.Hour
+	// maxMissedRuns limits the number of the missed runs checked per server and task (e.g. "@every 1m" and a long downtime).
+	maxMissedRuns = 1000
+)
+
+// versionSpecs returns the effective data, history and stats specs of the version.
+func (c *Cron) versionSpecs(version *twmodel.Version, override *model.VersionSchedule) (data, history, stats string) {
+	data = c.schedules.UpdateServerData
+	history = withTimezone(version.Timezone, c.schedules.UpdateHistory)
+	stats = withTimezone(version.Timezone, c.schedules.UpdateStats)
+	if override == nil {
+		return data, history, stats
+	}
+	if override.UpdateServerData != "" {
+		data = withTimezone(version.Timezone, override.UpdateServerData)
+	}
+	if override.UpdateHistory != "" {
+		history = withTimezone(version.Timezone, override.UpdateHistory)
+	}
+	if override.UpdateStats != "" {
+		stats = withTimezone(version.Timezone, override.UpdateStats)
+	}
+	return data, history, stats
+}
+
+// catchUp compares the update dates of every open server with the expected schedule
+// and adds the overdue tasks to the queue:
+// - the data of the version is updated if any of its servers has missed a scheduled data update,
+// - the history/stats of the version are updated if any of its servers has missed today's run
+// (the history/stats can't be created for a past date, so the runs missed on the previous days are only recorded as gaps).
+// The dates of the missed data/history/stats runs are saved in the missed_runs table
+// (the data updates missed on the previous days are gaps as well, the update catches up only the current data).
+// The paused servers and the servers of the paused versions are ignored.
+func (c *Cron) catchUp() error {
+	var servers []*twmodel.Server
+	err := c.db.Model(&servers).
+		Where("status = ?", twmodel.ServerStatusOpen).
+		Apply(pause.NotPaused).
+		Relation("Version").
+		Select()
+	if err != nil {
+		return errors.Wrap(err, "Cron.catchUp: couldn't load the servers")
+	}
+	schedulesByCode, err := c.loadVersionSchedules()
+	if err != nil {
+		return errors.Wrap(err, "Cron.catchUp")
+	}
+
+	now := time.Now()
+	locations := make(map[string]*time.Location)
+	versions := make(map[twmodel.VersionCode]*twmodel.Version)
+	dataOverdue := make(map[twmodel.VersionCode]bool)
+	historyOverdue := make(map[twmodel.VersionCode]bool)
+	statsOverdue := make(map[twmodel.VersionCode]bool)
+	var missedRuns []*model.MissedRun
+	for _, server := range servers {
+		if server.Version == nil {
+			continue
+		}
+		entry := c.log.WithField("key", server.Key)
+		location, ok := locations[server.Version.Timezone]
+		if !ok {
+			location, err = time.LoadLocation(server.Version.Timezone)
+			if err != nil {
+				entry.Warn(errors.Wrapf(err, "Cron.catchUp: %s: couldn't load the location", server.Key))
+				continue
+			}
+			locations[server.Version.Timezone] = location
+		}
+		versions[server.VersionCode] = server.Version
+		dataSpec, historySpec, statsSpec := c.versionSpecs(server.Version, schedulesByCode[server.VersionCode])
+
+		missed, err := missedScheduledRuns(dataSpec, server.DataUpdatedAt, now)
+		if err != nil {
+			entry.Warn(errors.Wrapf(err, "Cron.catchUp: %s", server.Key))
+		} else {
+			if len(missed) > 0 || server.DataUpdatedAt.IsZero() {
+				dataOverdue[server.VersionCode] = true
+			}
+			missedRuns = append(missedRuns, newMissedRuns(server.Key, queue.UpdateServerData, missed, now, location)...)
+		}
+
+		for _, daily := range []struct {
+			taskName  string
+			spec      string
+			updatedAt time.Time
+			overdue   map[twmodel.VersionCode]bool
+		}{
+			{queue.UpdateServerHistory, historySpec, server.HistoryUpdatedAt, historyOverdue},
+			{queue.UpdateServerStats, statsSpec, server.StatsUpdatedAt, statsOverdue},
+		} {
+			// the history/stats of a new server haven't been updated yet,
+			// so the runs are looked for since its data update instead of catchUpLookback back
+			since := daily.updatedAt
+			if since.IsZero() {
+				since = server.DataUpdatedAt
+			}
+			missed, err := missedScheduledRuns(daily.spec, since, now)
+			if err != nil {
+				entry.Warn(errors.Wrapf(err, "Cron.catchUp: %s", server.Key))
+				continue
+			}
+			runs := newMissedRuns(server.Key, daily.taskName, missed, now, location)
+			for _, run := range runs {
+				if run.CaughtUp {
+					daily.overdue[server.VersionCode] = true
+				}
+			}
+			missedRuns = append(missedRuns, runs...)
+		}
+	}
+
+	if len(missedRuns) > 0 {
+		_, err := c.db.Model(&missedRuns).
+			OnConflict("DO NOTHING").
+			Insert()
+		if err != nil {
+			c.log.Warn(errors.Wrap(err, "Cron.catchUp: couldn't save the missed runs"))
+		}
+		for _, run := range missedRuns {
+			missedRunsCounter.WithLabelValues(run.TaskName).Inc()
+		}
+	}
+
+	for code := range versions {
+		if dataOverdue[code] {
+			_ = c.updateVersionServerData(string(code))
+		}
+		if historyOverdue[code] {
+			_ = c.updateVersionHistory(string(code))
+		}
+		if statsOverdue[code] {
+			_ = c.updateVersionStats(string(code))
+		}
+	}
+	c.log.
+		WithField("numberOfServers", len(servers)).
+		WithField("numberOfMissedRuns", len(missedRuns)).
+		Infof(
+			"Cron.catchUp: The overdue tasks have been added to the queue (data: %d, history: %d, stats: %d versions)",
+			len(dataOverdue),
+			len(historyOverdue),
+			len(statsOverdue),
+		)
+	return nil
+}
+
+// missedScheduledRuns returns the times the job should have been run at since the last run (at most catchUpLookback back).
+// Nothing is returned if the job has never been run.
+func missedScheduledRuns(spec string, lastRun, now time.Time) ([]time.Time, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid spec '%s'", spec)
+	}
+	if lastRun.IsZero() {
+		return nil, nil
+	}
+	since := lastRun
+	if lookback := now.Add(-catchUpLookback); since.Before(lookback) {
+		since = lookback
+	}
+	var missed []time.Time
+	for t := schedule.Next(since); !t.IsZero() && !t.After(now) && len(missed) < maxMissedRuns; t = schedule.Next(t) {
+		missed = append(missed, t)
+	}
+	return missed, nil
+}
+
+// newMissedRuns returns one missed run per date in the given location.
+// The run missed today is caught up, the others are gaps.
+func newMissedRuns(
+	serverKey, taskName string,
+	missed []time.Time,
+	now time.Time,
+	location *time.Location,
+) []*model.MissedRun {
+	var runs []*model.MissedRun
+	today := localDate(now.In(location))
+	seen := make(map[time.Time]bool)
+	for _, scheduledAt := range missed {
+		date := localDate(scheduledAt.In(location))
+		if seen[date] {
+			continue
+		}
+		seen[date] = true
+		runs = append(runs, &model.MissedRun{
+			ServerKey:   serverKey,
+			TaskName:    taskName,
+			Date:        date,
+			ScheduledAt: scheduledAt,
+			CaughtUp:    date.Equal(today),
+			DetectedAt:  now,
+		})
+	}
+	return runs
+}
+
+// localDate returns the date of t in its location, in the same form as the create_date of the history/stats.
+func localDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (c *Cron) runCatchUp() {
+	if err := c.catchUp(); err != nil {
+		c.log.Error(err)
+	}
+}
@@ -0,0 +1,208 @@
+package cron
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+func TestMissedScheduledRuns(t *testing.T) {
+	now := time.Date(2021, 5, 10, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		spec    string
+		lastRun time.Time
+		want    []time.Time
+		wantLen int
+		wantErr bool
+	}{
+		{
+			name:    "up to date",
+			spec:    "0 * * * *",
+			lastRun: time.Date(2021, 5, 10, 12, 0, 5, 0, time.UTC),
+		},
+		{
+			name:    "missed runs",
+			spec:    "0 * * * *",
+			lastRun: time.Date(2021, 5, 10, 9, 0, 5, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2021, 5, 10, 10, 0, 0, 0, time.UTC),
+				time.Date(2021, 5, 10, 11, 0, 0, 0, time.UTC),
+				time.Date(2021, 5, 10, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:    "the run scheduled at now is missed",
+			spec:    "30 12 * * *",
+			lastRun: time.Date(2021, 5, 9, 12, 30, 5, 0, time.UTC),
+			want:    []time.Time{now},
+		},
+		{
+			name:    "CRON_TZ",
+			spec:    "CRON_TZ=Europe/Warsaw 30 1 * * *",
+			lastRun: time.Date(2021, 5, 8, 12, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2021, 5, 8, 23, 30, 0, 0, time.UTC),
+				time.Date(2021, 5, 9, 23, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:    "never run",
+			spec:    "0 * * * *",
+			lastRun: time.Time{},
+		},
+		{
+			name:    "limited by the lookback",
+			spec:    "0 0 * * *",
+			lastRun: now.AddDate(-1, 0, 0),
+			wantLen: 31,
+		},
+		{
+			name:    "limited by maxMissedRuns",
+			spec:    "@every 1m",
+			lastRun: now.AddDate(0, 0, -7),
+			wantLen: maxMissedRuns,
+		},
+		{
+			name:    "invalid spec",
+			spec:    "0 * * *",
+			lastRun: now.Add(-time.Hour),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := missedScheduledRuns(tt.spec, tt.lastRun, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("missedScheduledRuns() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantLen > 0 {
+				if len(got) != tt.wantLen {
+					t.Errorf("len(missedScheduledRuns()) = %d, want %d", len(got), tt.wantLen)
+				}
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("missedScheduledRuns() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("missedScheduledRuns()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewMissedRuns(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2021, 5, 10, 12, 0, 0, 0, time.UTC)
+	missed := []time.Time{
+		// 2021-05-09 01:30 in Warsaw
+		time.Date(2021, 5, 8, 23, 30, 0, 0, time.UTC),
+		time.Date(2021, 5, 9, 10, 0, 0, 0, time.UTC),
+		// 2021-05-10 01:30 in Warsaw
+		time.Date(2021, 5, 9, 23, 30, 0, 0, time.UTC),
+	}
+
+	runs := newMissedRuns("pl170", "updateServerHistory", missed, now, warsaw)
+
+	var dates []time.Time
+	var caughtUp []bool
+	for _, run := range runs {
+		dates = append(dates, run.Date)
+		caughtUp = append(caughtUp, run.CaughtUp)
+	}
+	wantDates := []time.Time{
+		time.Date(2021, 5, 9, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 5, 10, 0, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(dates, wantDates) {
+		t.Errorf("dates = %v, want %v", dates, wantDates)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(caughtUp, want) {
+		t.Errorf("caughtUp = %v, want %v", caughtUp, want)
+	}
+}
+
+func TestCronCatchUp(t *testing.T) {
+	c, db, q := newTestCron(t)
+	server := postgrestest.Server(t, db)
+	now := time.Now()
+	server.DataUpdatedAt = now.Add(-3 * time.Hour)
+	server.HistoryUpdatedAt = now.Add(-3 * 24 * time.Hour)
+	server.StatsUpdatedAt = now.Add(-3 * 24 * time.Hour)
+	if _, err := db.Model(server).Column("data_updated_at", "history_updated_at", "stats_updated_at").WherePK().Update(); err != nil {
+		t.Fatal(err)
+	}
+	queuedMessages := func() map[string]int64 {
+		t.Helper()
+		stats, err := q.Stats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := make(map[string]int64, len(stats))
+		for _, s := range stats {
+			messages[s.Name] = s.Pending + s.Delayed
+		}
+		return messages
+	}
+	missedRuns := func() map[string][]*model.MissedRun {
+		t.Helper()
+		var runs []*model.MissedRun
+		if err := db.Model(&runs).Where("server_key = ?", server.Key).Order("date ASC").Select(); err != nil {
+			t.Fatal(err)
+		}
+		byTask := make(map[string][]*model.MissedRun)
+		for _, run := range runs {
+			byTask[run.TaskName] = append(byTask[run.TaskName], run)
+		}
+		return byTask
+	}
+
+	before := queuedMessages()
+	if err := c.catchUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := queuedMessages(); after[queue.DataQueue] <= before[queue.DataQueue] {
+		t.Errorf("the data update of the version hasn't been added to the queue (%d messages before, %d after)", before[queue.DataQueue], after[queue.DataQueue])
+	}
+	runs := missedRuns()
+	if len(runs[queue.UpdateServerData]) == 0 {
+		t.Errorf("the missed data updates haven't been recorded")
+	}
+	for _, taskName := range []string{queue.UpdateServerHistory, queue.UpdateServerStats} {
+		gaps := 0
+		for _, run := range runs[taskName] {
+			if !run.CaughtUp {
+				gaps++
+			}
+		}
+		// the runs of the last 2 days have been missed, the one of today only if it's already after its schedule
+		if gaps < 2 {
+			t.Errorf("%s: %d gaps have been recorded, want at least 2", taskName, gaps)
+		}
+	}
+
+	// the missed runs are recorded once
+	if err := c.catchUp(); err != nil {
+		t.Fatal(err)
+	}
+	again := missedRuns()
+	for _, taskName := range []string{queue.UpdateServerData, queue.UpdateServerHistory, queue.UpdateServerStats} {
+		if len(again[taskName]) != len(runs[taskName]) {
+			t.Errorf("%s: %d missed runs after the second catch-up, want %d", taskName, len(again[taskName]), len(runs[taskName]))
+		}
+	}
+}
@@ -2,7 +2,9 @@ package cron
 
 import (
 	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"time"
 
 	"github.com/tribalwarshelp/dataupdater/queue"
 )
@@ -11,6 +13,20 @@ type Config struct {
 	DB        *pg.DB
 	Queue     *queue.Queue
 	RunOnInit bool
+	// CatchUp enables adding the overdue data/history/stats tasks to the queue
+	// whenever the instance starts running the schedules (e.g. after a downtime).
+	CatchUp bool
+	// Schedules - the empty specs are replaced with the defaults.
+	Schedules Schedules
+	// Redis is optional. If set, the cron instances sharing the same Redis elect a leader and only the leader runs the schedules.
+	Redis redis.UniversalClient
+	// InstanceID identifies the instance in the leader election (e.g. the hostname). Required if Redis is set.
+	InstanceID string
+	// LeaderLeaseTTL is how long the leader holds the lease without renewing it,
+	// i.e. how long it takes to fail over if the leader crashes. Default is 15 seconds.
+	LeaderLeaseTTL time.Duration
+	// ReloadInterval is how often the jobs are reconciled with the versions and their schedules. Default is 1 minute.
+	ReloadInterval time.Duration
 }
 
 func validateConfig(cfg *Config) error {
@@ -20,5 +36,17 @@ func validateConfig(cfg *Config) error {
 	if cfg.Queue == nil {
 		return errors.New("cfg.Queue is required")
 	}
+	if err := cfg.Schedules.Validate(); err != nil {
+		return errors.Wrap(err, "cfg.Schedules")
+	}
+	if cfg.Redis != nil && cfg.InstanceID == "" {
+		return errors.New("cfg.InstanceID is required if cfg.Redis is set")
+	}
+	if cfg.LeaderLeaseTTL < 0 || (cfg.LeaderLeaseTTL > 0 && cfg.LeaderLeaseTTL < 3*time.Second) {
+		return errors.New("cfg.LeaderLeaseTTL must be at least 3 seconds")
+	}
+	if cfg.ReloadInterval < 0 {
+		return errors.New("cfg.ReloadInterval must be greater than or equal to 0")
+	}
 	return nil
 }
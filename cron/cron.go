@@ -3,22 +3,49 @@ package cron
 import (
 	"context"
 	"fmt"
+	"github.com/bsm/redislock"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 
+	"github.com/tribalwarshelp/dataupdater/model"
 	"github.com/tribalwarshelp/dataupdater/queue"
 )
 
+var tracer = otel.Tracer("github.com/tribalwarshelp/dataupdater/cron")
+
 type Cron struct {
 	*cron.Cron
 	queue     *queue.Queue
 	db        *pg.DB
 	runOnInit bool
-	log       logrus.FieldLogger
+	// catchUpOnStart - see catchUp
+	catchUpOnStart bool
+	schedules      Schedules
+	initJobs       []func()
+	initOnce       sync.Once
+	elector        *leaderElector
+	log            logrus.FieldLogger
+
+	reloadInterval time.Duration
+	reloadMu       sync.Mutex
+	stopReload     chan struct{}
+	reloadDone     chan struct{}
+
+	mu             sync.Mutex
+	ticks          map[cron.EntryID]*tick
+	entryIDs       map[string]cron.EntryID
+	startedAt      time.Time
+	scheduledSince time.Time
 }
 
 func New(cfg *Config) (*Cron, error) {
@@ -32,10 +59,32 @@ func New(cfg *Config) (*Cron, error) {
 				cron.PrintfLogger(log),
 			),
 		)),
-		queue:     cfg.Queue,
-		db:        cfg.DB,
-		runOnInit: cfg.RunOnInit,
-		log:       log,
+		queue:          cfg.Queue,
+		db:             cfg.DB,
+		runOnInit:      cfg.RunOnInit,
+		catchUpOnStart: cfg.CatchUp,
+		schedules:      cfg.Schedules.withDefaults(),
+		log:            log,
+		reloadInterval: cfg.ReloadInterval,
+		ticks:          make(map[cron.EntryID]*tick),
+		entryIDs:       make(map[string]cron.EntryID),
+	}
+	if c.reloadInterval == 0 {
+		c.reloadInterval = defaultReloadInterval
+	}
+	if cfg.Redis != nil {
+		c.elector = &leaderElector{
+			redis:      cfg.Redis,
+			locker:     redislock.New(cfg.Redis),
+			instanceID: cfg.InstanceID,
+			ttl:        cfg.LeaderLeaseTTL,
+			onElected:  c.startSchedules,
+			onDemoted:  c.stopSchedules,
+			log:        log,
+		}
+		if c.elector.ttl == 0 {
+			c.elector.ttl = defaultLeaderLeaseTTL
+		}
 	}
 	if err := c.init(); err != nil {
 		return nil, err
@@ -44,107 +93,315 @@ func New(cfg *Config) (*Cron, error) {
 }
 
 func (c *Cron) init() error {
+	jobs, err := c.loadJobs()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		fn, err := c.addJob(j.spec, j.name, j.fn)
+		if err != nil {
+			return err
+		}
+		if c.runOnInit && j.runOnInit {
+			c.initJobs = append(c.initJobs, fn)
+		}
+	}
+	return nil
+}
+
+// job is a cron entry.
+type job struct {
+	name      string
+	spec      string
+	fn        func() error
+	runOnInit bool
+}
+
+// loadJobs returns the jobs built from the global schedules and the versions with their own schedules (see model.VersionSchedule).
+func (c *Cron) loadJobs() ([]job, error) {
 	var versions []*twmodel.Version
-	if err := c.db.Model(&versions).DistinctOn("timezone").Select(); err != nil {
-		return errors.Wrap(err, "couldn't load versions")
+	if err := c.db.Model(&versions).Order("code ASC").Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load versions")
+	}
+	schedulesByCode, err := c.loadVersionSchedules()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []job{
+		{
+			name:      "Cron.updateServerData",
+			spec:      c.schedules.UpdateServerData,
+			fn:        c.updateServerData,
+			runOnInit: true,
+		},
+		{
+			name:      "Cron.vacuumDatabase",
+			spec:      c.schedules.Vacuum,
+			fn:        c.vacuumDatabase,
+			runOnInit: true,
+		},
+		{
+			name: "Cron.deleteNonExistentVillages",
+			spec: c.schedules.DeleteNonExistentVillages,
+			fn:   c.deleteNonExistentVillages,
+		},
+		{
+			name: "Cron.updateEnnoblements",
+			spec: c.schedules.UpdateEnnoblements,
+			fn:   c.updateEnnoblements,
+		},
 	}
 
-	var updateHistoryFuncs []func()
-	var updateStatsFuncs []func()
+	var historyJobs, statsJobs []job
+	historyTimezones := make(map[string]bool)
+	statsTimezones := make(map[string]bool)
 	for _, version := range versions {
-		updateHistory := createFnWithTimezone(version.Timezone, c.updateHistory)
-		updateHistoryFuncs = append(updateHistoryFuncs, updateHistory)
+		schedule, ok := schedulesByCode[version.Code]
+		if !ok {
+			schedule = &model.VersionSchedule{}
+		}
 
-		updateStats := createFnWithTimezone(version.Timezone, c.updateStats)
-		updateStatsFuncs = append(updateStatsFuncs, updateStats)
+		if schedule.UpdateServerData != "" {
+			jobs = append(jobs, job{
+				name:      "Cron.updateVersionServerData:" + string(version.Code),
+				spec:      withTimezone(version.Timezone, schedule.UpdateServerData),
+				fn:        createFnWithArg(string(version.Code), c.updateVersionServerData),
+				runOnInit: true,
+			})
+		}
 
-		if _, err := c.AddFunc(fmt.Sprintf("CRON_TZ=%s 30 1 * * *", version.Timezone), updateHistory); err != nil {
-			return err
+		if schedule.UpdateHistory != "" {
+			historyJobs = append(historyJobs, job{
+				name:      "Cron.updateVersionHistory:" + string(version.Code),
+				spec:      withTimezone(version.Timezone, schedule.UpdateHistory),
+				fn:        createFnWithArg(string(version.Code), c.updateVersionHistory),
+				runOnInit: true,
+			})
+		} else if !historyTimezones[version.Timezone] {
+			historyTimezones[version.Timezone] = true
+			historyJobs = append(historyJobs, job{
+				name:      "Cron.updateHistory:" + version.Timezone,
+				spec:      withTimezone(version.Timezone, c.schedules.UpdateHistory),
+				fn:        createFnWithArg(version.Timezone, c.updateHistory),
+				runOnInit: true,
+			})
 		}
-		if _, err := c.AddFunc(fmt.Sprintf("CRON_TZ=%s 45 1 * * *", version.Timezone), updateStats); err != nil {
-			return err
+
+		if schedule.UpdateStats != "" {
+			statsJobs = append(statsJobs, job{
+				name:      "Cron.updateVersionStats:" + string(version.Code),
+				spec:      withTimezone(version.Timezone, schedule.UpdateStats),
+				fn:        createFnWithArg(string(version.Code), c.updateVersionStats),
+				runOnInit: true,
+			})
+		} else if !statsTimezones[version.Timezone] {
+			statsTimezones[version.Timezone] = true
+			statsJobs = append(statsJobs, job{
+				name:      "Cron.updateStats:" + version.Timezone,
+				spec:      withTimezone(version.Timezone, c.schedules.UpdateStats),
+				fn:        createFnWithArg(version.Timezone, c.updateStats),
+				runOnInit: true,
+			})
 		}
 	}
-	if _, err := c.AddFunc("0 * * * *", c.updateServerData); err != nil {
-		return err
+	jobs = append(jobs, historyJobs...)
+	jobs = append(jobs, statsJobs...)
+	return jobs, nil
+}
+
+// loadVersionSchedules returns the valid version schedules by version code.
+func (c *Cron) loadVersionSchedules() (map[twmodel.VersionCode]*model.VersionSchedule, error) {
+	var versionSchedules []*model.VersionSchedule
+	if err := c.db.Model(&versionSchedules).Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load the version schedules")
 	}
-	if _, err := c.AddFunc("20 1 * * *", c.vacuumDatabase); err != nil {
-		return err
+	schedulesByCode := make(map[twmodel.VersionCode]*model.VersionSchedule, len(versionSchedules))
+	for _, schedule := range versionSchedules {
+		if err := ValidateVersionSchedule(schedule); err != nil {
+			c.log.Warn(errors.Wrapf(err, "%s: the version schedule is invalid, the global schedules are used", schedule.VersionCode))
+			continue
+		}
+		schedulesByCode[schedule.VersionCode] = schedule
 	}
-	if _, err := c.AddFunc("10 1 * * *", c.deleteNonExistentVillages); err != nil {
-		return err
+	return schedulesByCode, nil
+}
+
+// addJob adds the job to the cron and returns the job wrapped so that its successful runs are recorded.
+func (c *Cron) addJob(spec, name string, fn func() error) (func(), error) {
+	t := &tick{
+		name:    name,
+		spec:    spec,
+		addedAt: time.Now(),
 	}
-	if _, err := c.AddFunc("@every 1m", c.updateEnnoblements); err != nil {
-		return err
+	job := func() {
+		t.record(fn())
+	}
+	id, err := c.AddFunc(spec, job)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't add the job '%s'", name)
 	}
-	if c.runOnInit {
-		go func() {
-			c.updateServerData()
-			c.vacuumDatabase()
-			for _, fn := range updateHistoryFuncs {
-				fn()
-			}
-			for _, fn := range updateStatsFuncs {
-				fn()
-			}
-		}()
+	c.mu.Lock()
+	c.ticks[id] = t
+	c.entryIDs[name] = id
+	c.mu.Unlock()
+	return job, nil
+}
+
+// removeJob removes the job with the given name from the cron.
+func (c *Cron) removeJob(name string) {
+	c.mu.Lock()
+	id, ok := c.entryIDs[name]
+	delete(c.entryIDs, name)
+	delete(c.ticks, id)
+	c.mu.Unlock()
+	if ok {
+		c.Remove(id)
 	}
-	return nil
 }
 
+// Start runs the schedules right away or, if the leader election is enabled, once this instance has been elected as the leader.
+// The jobs are periodically reconciled with the versions (see Reload).
 func (c *Cron) Start() error {
-	c.Cron.Start()
+	c.mu.Lock()
+	c.startedAt = time.Now()
+	c.mu.Unlock()
+	c.startReloading()
+	if c.elector == nil {
+		c.startSchedules()
+		return nil
+	}
+	c.elector.start()
 	return nil
 }
 
 func (c *Cron) Stop() error {
-	c.Cron.Stop()
+	c.stopReloading()
+	if c.elector == nil {
+		c.stopSchedules()
+		return nil
+	}
+	c.elector.close()
 	return nil
 }
 
-func (c *Cron) updateServerData() {
-	err := c.queue.Add(queue.GetTask(queue.LoadVersionsAndUpdateServerData).WithArgs(context.Background()))
-	if err != nil {
-		c.logError("Cron.updateServerData", queue.LoadVersionsAndUpdateServerData, err)
+// Leader returns the state of the leader election.
+// Without the leader election, the instance is always the leader.
+func (c *Cron) Leader() LeaderInfo {
+	if c.elector == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		info := LeaderInfo{
+			IsLeader: !c.scheduledSince.IsZero(),
+		}
+		if info.IsLeader {
+			since := c.scheduledSince
+			info.Since = &since
+		}
+		return info
 	}
+	return c.elector.info()
 }
 
-func (c *Cron) updateEnnoblements() {
-	err := c.queue.Add(queue.GetTask(queue.UpdateEnnoblements).WithArgs(context.Background()))
-	if err != nil {
-		c.logError("Cron.updateEnnoblements", queue.UpdateEnnoblements, err)
-	}
+func (c *Cron) startSchedules() {
+	c.mu.Lock()
+	c.scheduledSince = time.Now()
+	c.mu.Unlock()
+	c.Cron.Start()
+	// the init jobs and the catch-up run once per process, not after every election
+	c.initOnce.Do(func() {
+		if len(c.initJobs) > 0 {
+			go func() {
+				for _, job := range c.initJobs {
+					job()
+				}
+			}()
+			return
+		}
+		// RunOnInit runs everything anyway
+		if c.catchUpOnStart {
+			go c.runCatchUp()
+		}
+	})
 }
 
-func (c *Cron) updateHistory(timezone string) {
-	err := c.queue.Add(queue.GetTask(queue.UpdateHistory).WithArgs(context.Background(), timezone))
-	if err != nil {
-		c.logError("Cron.updateHistory", queue.UpdateHistory, err)
-	}
+func (c *Cron) stopSchedules() {
+	c.Cron.Stop()
+	c.mu.Lock()
+	c.scheduledSince = time.Time{}
+	c.mu.Unlock()
 }
 
-func (c *Cron) updateStats(timezone string) {
-	err := c.queue.Add(queue.GetTask(queue.UpdateStats).WithArgs(context.Background(), timezone))
-	if err != nil {
-		c.logError("Cron.updateStats", queue.UpdateStats, err)
-	}
+func (c *Cron) updateServerData() error {
+	return c.enqueue("Cron.updateServerData", queue.LoadVersionsAndUpdateServerData)
+}
+
+func (c *Cron) updateEnnoblements() error {
+	return c.enqueue("Cron.updateEnnoblements", queue.UpdateEnnoblements)
+}
+
+func (c *Cron) updateHistory(timezone string) error {
+	return c.enqueue("Cron.updateHistory", queue.UpdateHistory, timezone)
+}
+
+func (c *Cron) updateStats(timezone string) error {
+	return c.enqueue("Cron.updateStats", queue.UpdateStats, timezone)
+}
+
+func (c *Cron) updateVersionServerData(code string) error {
+	return c.enqueueWithArg("Cron.updateVersionServerData", queue.LoadServersAndUpdateData, code)
+}
+
+func (c *Cron) updateVersionHistory(code string) error {
+	return c.enqueueWithArg("Cron.updateVersionHistory", queue.UpdateVersionHistory, code)
+}
+
+func (c *Cron) updateVersionStats(code string) error {
+	return c.enqueueWithArg("Cron.updateVersionStats", queue.UpdateVersionStats, code)
+}
+
+func (c *Cron) vacuumDatabase() error {
+	return c.enqueue("Cron.vacuumDatabase", queue.Vacuum)
 }
 
-func (c *Cron) vacuumDatabase() {
-	err := c.queue.Add(queue.GetTask(queue.Vacuum).WithArgs(context.Background()))
+func (c *Cron) deleteNonExistentVillages() error {
+	return c.enqueue("Cron.deleteNonExistentVillages", queue.DeleteNonExistentVillages)
+}
+
+// enqueue adds the task to the queue within a new trace,
+// so the task and the tasks it enqueues are reported as a part of this trace.
+func (c *Cron) enqueue(prefix string, taskName string, args ...interface{}) error {
+	ctx, span := tracer.Start(context.Background(), prefix, trace.WithAttributes(attribute.String("task", taskName)))
+	defer span.End()
+	err := c.queue.Add(queue.GetTask(taskName).WithArgs(ctx, args...))
 	if err != nil {
-		c.logError("Cron.vacuumDatabase", queue.Vacuum, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		c.logError(prefix, taskName, err)
 	}
+	return err
 }
 
-func (c *Cron) deleteNonExistentVillages() {
-	err := c.queue.Add(queue.GetTask(queue.DeleteNonExistentVillages).WithArgs(context.Background()))
+// enqueueWithArg works like enqueue, but the arg (e.g. a version code) is resolved by queue.Queue.Enqueue,
+// so the task gets the current data from the db.
+func (c *Cron) enqueueWithArg(prefix string, taskName string, arg string) error {
+	ctx, span := tracer.Start(
+		context.Background(),
+		prefix,
+		trace.WithAttributes(attribute.String("task", taskName), attribute.String("arg", arg)),
+	)
+	defer span.End()
+	_, err := c.queue.Enqueue(ctx, taskName, arg)
 	if err != nil {
-		c.logError("Cron.deleteNonExistentVillages", queue.DeleteNonExistentVillages, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		c.logError(prefix, taskName, err)
 	}
+	return err
 }
 
 func (c *Cron) logError(prefix string, taskName string, err error) {
+	enqueueFailures.WithLabelValues(taskName).Inc()
 	c.log.Error(
 		errors.Wrapf(
 			err,
@@ -155,8 +412,12 @@ func (c *Cron) logError(prefix string, taskName string, err error) {
 	)
 }
 
-func createFnWithTimezone(timezone string, fn func(timezone string)) func() {
-	return func() {
-		fn(timezone)
+func createFnWithArg(arg string, fn func(arg string) error) func() error {
+	return func() error {
+		return fn(arg)
 	}
 }
+
+func withTimezone(timezone, spec string) string {
+	return fmt.Sprintf("CRON_TZ=%s %s", timezone, spec)
+}
@@ -0,0 +1,65 @@
+package cron
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+var (
+	testQueueOnce sync.Once
+	testDB        *pg.DB
+	testQueue     *queue.Queue
+	testQueueErr  error
+)
+
+// newTestCron returns a cron using the database set in postgrestest.EnvDBURL and a queue backed by miniredis.
+// The queue is shared by all tests (with its db connection), because the tasks can be registered only once per process.
+func newTestCron(t *testing.T) (*Cron, *pg.DB, *queue.Queue) {
+	t.Helper()
+	cfg := postgrestest.Config(t)
+	testQueueOnce.Do(func() {
+		testDB, testQueueErr = postgres.Connect(cfg)
+		if testQueueErr != nil {
+			return
+		}
+		var mr *miniredis.Miniredis
+		mr, testQueueErr = miniredis.Run()
+		if testQueueErr != nil {
+			return
+		}
+		testQueue, testQueueErr = queue.New(&queue.Config{
+			Redis: redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+			DB:    testDB,
+		})
+	})
+	if testQueueErr != nil {
+		t.Fatal(testQueueErr)
+	}
+	c, err := New(&Config{
+		DB:    testDB,
+		Queue: testQueue,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, testDB, testQueue
+}
+
+// jobSpec returns the spec of the job with the given name.
+func (c *Cron) jobSpec(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.entryIDs[name]
+	if !ok {
+		return "", false
+	}
+	return c.ticks[id].spec, true
+}
@@ -0,0 +1,107 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+)
+
+// tickGracePeriod is how long a job may be overdue before the cron is considered unhealthy.
+const tickGracePeriod = 2 * time.Minute
+
+// tick records the last successful run of a cron job.
+type tick struct {
+	name    string
+	spec    string
+	addedAt time.Time
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   error
+}
+
+func (t *tick) record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.lastError = err
+		return
+	}
+	t.lastSuccess = time.Now()
+	t.lastError = nil
+}
+
+func (t *tick) state() (time.Time, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastSuccess, t.lastError
+}
+
+// CheckTicks returns an error if any job has missed its schedule,
+// i.e. the next scheduled run after the last successful one is overdue by more than tickGracePeriod.
+// The jobs that haven't succeeded since this instance has started running the schedules
+// (or since they were added, see Reload) are checked against that time.
+// If the leader election is enabled, it also checks that the instance still takes part in it.
+func (c *Cron) CheckTicks(_ context.Context) error {
+	c.mu.Lock()
+	startedAt := c.startedAt
+	scheduledSince := c.scheduledSince
+	ticks := make(map[cron.EntryID]*tick, len(c.ticks))
+	for id, t := range c.ticks {
+		ticks[id] = t
+	}
+	c.mu.Unlock()
+	if startedAt.IsZero() {
+		return errors.New("the cron hasn't been started")
+	}
+	if c.elector != nil {
+		if err := c.elector.check(startedAt); err != nil {
+			return err
+		}
+	}
+	// the followers don't run the schedules
+	if scheduledSince.IsZero() {
+		return nil
+	}
+
+	now := time.Now()
+	var overdue []string
+	for _, entry := range c.Entries() {
+		t, ok := ticks[entry.ID]
+		if !ok {
+			continue
+		}
+		lastSuccess, lastErr := t.state()
+		since := lastSuccess
+		if since.Before(scheduledSince) {
+			since = scheduledSince
+		}
+		if since.Before(t.addedAt) {
+			since = t.addedAt
+		}
+		if deadline := entry.Schedule.Next(since).Add(tickGracePeriod); !now.After(deadline) {
+			continue
+		}
+		msg := fmt.Sprintf("%s (%s): ", t.name, t.spec)
+		if lastSuccess.IsZero() {
+			msg += "no successful run"
+		} else {
+			msg += "the last successful run at " + lastSuccess.Format(time.RFC3339)
+		}
+		if lastErr != nil {
+			msg += ", the last error: " + lastErr.Error()
+		}
+		overdue = append(overdue, msg)
+	}
+	if len(overdue) > 0 {
+		sort.Strings(overdue)
+		return errors.Errorf("the jobs are overdue: %s", strings.Join(overdue, "; "))
+	}
+	return nil
+}
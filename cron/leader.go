@@ -0,0 +1,236 @@
+package cron
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	leaderKey = "dataupdater:cron:leader"
+	// redislock prepends a random token of this length to the lock value
+	leaderTokenLength      = 22
+	defaultLeaderLeaseTTL  = 15 * time.Second
+	leaderCampaignInterval = time.Second
+)
+
+// LeaderInfo describes the state of the leader election from the point of view of this instance.
+type LeaderInfo struct {
+	InstanceID string     `json:"instanceID"`
+	Leader     string     `json:"leader"`
+	IsLeader   bool       `json:"isLeader"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+// leaderElector elects one of the cron instances, which share the same Redis, as the leader.
+// The leader holds a lease (a Redis lock) and renews it every third of its TTL.
+// The other instances try to obtain the lease every second,
+// so they take over right after the leader has released the lease on shutdown or within the TTL if the leader has crashed.
+// The leader which can't renew the lease steps down after two thirds of the TTL, i.e. before the lease can expire
+// and be obtained by another instance.
+type leaderElector struct {
+	redis      redis.UniversalClient
+	locker     *redislock.Client
+	instanceID string
+	ttl        time.Duration
+	onElected  func()
+	onDemoted  func()
+	log        logrus.FieldLogger
+
+	mu          sync.Mutex
+	lock        *redislock.Lock
+	leader      string
+	since       time.Time
+	lastRenewal time.Time
+	lastContact time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (e *leaderElector) start() {
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.run()
+}
+
+func (e *leaderElector) run() {
+	defer close(e.done)
+	e.campaign()
+	for {
+		interval := leaderCampaignInterval
+		if e.isLeader() {
+			interval = e.ttl / 3
+		}
+		select {
+		case <-e.stop:
+			e.resign()
+			return
+		case <-time.After(interval):
+			e.campaign()
+		}
+	}
+}
+
+func (e *leaderElector) close() {
+	if e.stop == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+}
+
+// campaign renews the lease if this instance is the leader or tries to obtain it otherwise.
+func (e *leaderElector) campaign() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaderCampaignInterval)
+	defer cancel()
+
+	e.mu.Lock()
+	lock := e.lock
+	e.mu.Unlock()
+
+	if lock != nil {
+		err := lock.Refresh(ctx, e.ttl, nil)
+		e.mu.Lock()
+		if err == nil || errors.Is(err, redislock.ErrNotObtained) {
+			e.lastContact = time.Now()
+		}
+		switch {
+		case err == nil:
+			e.lastRenewal = e.lastContact
+			e.mu.Unlock()
+		case errors.Is(err, redislock.ErrNotObtained) || time.Since(e.lastRenewal) >= e.ttl*2/3:
+			e.mu.Unlock()
+			e.demote(errors.Wrap(err, "couldn't renew the lease"))
+		default:
+			e.mu.Unlock()
+			e.log.Warn(errors.Wrap(err, "leaderElector: couldn't renew the lease, retrying"))
+		}
+		return
+	}
+
+	lock, err := e.locker.Obtain(ctx, leaderKey, e.ttl, &redislock.Options{Metadata: e.instanceID})
+	if err == nil {
+		e.elect(lock)
+		return
+	}
+
+	if !errors.Is(err, redislock.ErrNotObtained) {
+		e.log.Warn(errors.Wrap(err, "leaderElector: couldn't obtain the lease"))
+		return
+	}
+	leader, err := e.currentLeader(ctx)
+	if err != nil {
+		e.log.Warn(errors.Wrap(err, "leaderElector: couldn't load the current leader"))
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastContact = time.Now()
+	if leader != e.leader {
+		e.log.WithField("leader", leader).Infof("leaderElector: %s is the leader now", leader)
+		e.leader = leader
+	}
+}
+
+func (e *leaderElector) elect(lock *redislock.Lock) {
+	now := time.Now()
+	e.mu.Lock()
+	e.lock = lock
+	e.leader = e.instanceID
+	e.since = now
+	e.lastRenewal = now
+	e.lastContact = now
+	e.mu.Unlock()
+
+	e.log.WithField("leader", e.instanceID).Infof("leaderElector: %s has been elected as the leader", e.instanceID)
+	e.onElected()
+}
+
+func (e *leaderElector) demote(reason error) {
+	e.mu.Lock()
+	e.lock = nil
+	e.leader = ""
+	e.since = time.Time{}
+	e.mu.Unlock()
+
+	e.log.WithField("instanceID", e.instanceID).Warn(errors.Wrapf(reason, "leaderElector: %s is no longer the leader", e.instanceID))
+	e.onDemoted()
+}
+
+// resign releases the lease, so another instance can take over immediately.
+func (e *leaderElector) resign() {
+	e.mu.Lock()
+	lock := e.lock
+	e.lock = nil
+	e.leader = ""
+	e.since = time.Time{}
+	e.mu.Unlock()
+	if lock == nil {
+		return
+	}
+
+	e.onDemoted()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := lock.Release(ctx); err != nil && !errors.Is(err, redislock.ErrLockNotHeld) {
+		e.log.Warn(errors.Wrap(err, "leaderElector: couldn't release the lease"))
+		return
+	}
+	e.log.WithField("instanceID", e.instanceID).Infof("leaderElector: %s has released the lease", e.instanceID)
+}
+
+func (e *leaderElector) currentLeader(ctx context.Context) (string, error) {
+	value, err := e.redis.Get(ctx, leaderKey).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(value) < leaderTokenLength {
+		return "", nil
+	}
+	return value[leaderTokenLength:], nil
+}
+
+func (e *leaderElector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lock != nil
+}
+
+func (e *leaderElector) info() LeaderInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info := LeaderInfo{
+		InstanceID: e.instanceID,
+		Leader:     e.leader,
+		IsLeader:   e.lock != nil,
+	}
+	if !e.since.IsZero() {
+		since := e.since
+		info.Since = &since
+	}
+	return info
+}
+
+// check returns an error if the instance hasn't been able to take part in the election for longer than the TTL,
+// e.g. because the connection to Redis has been lost.
+func (e *leaderElector) check(startedAt time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last := e.lastContact
+	if last.IsZero() {
+		last = startedAt
+	}
+	if since := time.Since(last); since > e.ttl {
+		return errors.Errorf("the instance hasn't taken part in the leader election for %s", since.Round(time.Second))
+	}
+	return nil
+}
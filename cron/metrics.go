@@ -0,0 +1,26 @@
+package cron
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var enqueueFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dataupdater_cron_enqueue_failures_total",
+	Help: "Number of tasks that the cron couldn't add to the queue, by task name.",
+}, []string{"task"})
+
+var reloads = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dataupdater_cron_reloads_total",
+	Help: "Number of times the cron jobs have been reconciled with the versions.",
+})
+
+var jobChanges = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dataupdater_cron_job_changes_total",
+	Help: "Number of cron jobs added, removed or rescheduled by the reloads.",
+})
+
+var missedRunsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dataupdater_cron_missed_runs_total",
+	Help: "Number of the dates with a data, history or stats run the servers have missed (detected on startup), by task name.",
+}, []string{"task"})
@@ -0,0 +1,103 @@
+package cron
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultReloadInterval = time.Minute
+
+// Reload reconciles the jobs with the versions and their schedules (see model.VersionSchedule),
+// i.e. it adds the jobs of the new versions/timezones, removes the jobs that are no longer needed
+// and re-adds the jobs whose spec has changed. Every change is logged.
+func (c *Cron) Reload() error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	jobs, err := c.loadJobs()
+	if err != nil {
+		return errors.Wrap(err, "Cron.Reload")
+	}
+
+	c.mu.Lock()
+	current := make(map[string]string, len(c.entryIDs))
+	for name, id := range c.entryIDs {
+		current[name] = c.ticks[id].spec
+	}
+	c.mu.Unlock()
+
+	desired := make(map[string]bool, len(jobs))
+	changes := 0
+	for _, j := range jobs {
+		desired[j.name] = true
+		spec, ok := current[j.name]
+		if ok && spec == j.spec {
+			continue
+		}
+		if ok {
+			c.removeJob(j.name)
+		}
+		if _, err := c.addJob(j.spec, j.name, j.fn); err != nil {
+			return errors.Wrap(err, "Cron.Reload")
+		}
+		changes++
+		entry := c.log.WithField("job", j.name)
+		if ok {
+			entry.Infof("Cron.Reload: The job '%s' has been rescheduled from '%s' to '%s'", j.name, spec, j.spec)
+		} else {
+			entry.Infof("Cron.Reload: The job '%s' has been added (%s)", j.name, j.spec)
+		}
+	}
+	for name, spec := range current {
+		if desired[name] {
+			continue
+		}
+		c.removeJob(name)
+		changes++
+		c.log.WithField("job", name).Infof("Cron.Reload: The job '%s' has been removed (%s)", name, spec)
+	}
+	reloads.Inc()
+	if changes > 0 {
+		jobChanges.Add(float64(changes))
+	}
+	c.log.Debugf("Cron.Reload: The jobs have been reloaded (%d changes)", changes)
+	return nil
+}
+
+func (c *Cron) startReloading() {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	if c.stopReload != nil {
+		return
+	}
+	c.stopReload = make(chan struct{})
+	c.reloadDone = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(c.reloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := c.Reload(); err != nil {
+					c.log.Error(err)
+				}
+			}
+		}
+	}(c.stopReload, c.reloadDone)
+}
+
+func (c *Cron) stopReloading() {
+	c.reloadMu.Lock()
+	stop, done := c.stopReload, c.reloadDone
+	c.stopReload, c.reloadDone = nil, nil
+	c.reloadMu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
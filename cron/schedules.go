@@ -0,0 +1,110 @@
+package cron
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/queue"
+)
+
+// Schedules contains the cron specs of the jobs (e.g. "0 * * * *" or "@every 1m").
+type Schedules struct {
+	UpdateServerData          string
+	UpdateEnnoblements        string
+	Vacuum                    string
+	DeleteNonExistentVillages string
+	// UpdateHistory and UpdateStats are run in the timezone of every version,
+	// so they mustn't contain CRON_TZ.
+	UpdateHistory string
+	UpdateStats   string
+}
+
+func DefaultSchedules() Schedules {
+	return Schedules{
+		UpdateServerData:          "0 * * * *",
+		UpdateEnnoblements:        "@every 1m",
+		Vacuum:                    "20 1 * * *",
+		DeleteNonExistentVillages: "10 1 * * *",
+		UpdateHistory:             queue.DefaultUpdateHistorySpec,
+		UpdateStats:               queue.DefaultUpdateStatsSpec,
+	}
+}
+
+// withDefaults returns the schedules with the empty specs replaced with the defaults.
+func (s Schedules) withDefaults() Schedules {
+	defaults := DefaultSchedules()
+	for _, spec := range []struct {
+		value        *string
+		defaultValue string
+	}{
+		{&s.UpdateServerData, defaults.UpdateServerData},
+		{&s.UpdateEnnoblements, defaults.UpdateEnnoblements},
+		{&s.Vacuum, defaults.Vacuum},
+		{&s.DeleteNonExistentVillages, defaults.DeleteNonExistentVillages},
+		{&s.UpdateHistory, defaults.UpdateHistory},
+		{&s.UpdateStats, defaults.UpdateStats},
+	} {
+		if *spec.value == "" {
+			*spec.value = spec.defaultValue
+		}
+	}
+	return s
+}
+
+// Validate checks whether the specs can be parsed. The empty specs are valid (the defaults are used).
+func (s Schedules) Validate() error {
+	for _, spec := range []struct {
+		name  string
+		value string
+		noTZ  bool
+	}{
+		{"UpdateServerData", s.UpdateServerData, false},
+		{"UpdateEnnoblements", s.UpdateEnnoblements, false},
+		{"Vacuum", s.Vacuum, false},
+		{"DeleteNonExistentVillages", s.DeleteNonExistentVillages, false},
+		{"UpdateHistory", s.UpdateHistory, true},
+		{"UpdateStats", s.UpdateStats, true},
+	} {
+		if spec.value == "" {
+			continue
+		}
+		if err := validateSpec(spec.name, spec.value, spec.noTZ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateVersionSchedule checks whether the specs can be parsed. The empty specs are valid (the global schedules are used).
+// The specs are run in the timezone of the version, so they mustn't contain CRON_TZ.
+func ValidateVersionSchedule(s *model.VersionSchedule) error {
+	for _, spec := range []struct {
+		name  string
+		value string
+	}{
+		{"UpdateServerData", s.UpdateServerData},
+		{"UpdateHistory", s.UpdateHistory},
+		{"UpdateStats", s.UpdateStats},
+	} {
+		if spec.value == "" {
+			continue
+		}
+		if err := validateSpec(spec.name, spec.value, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateSpec(name, spec string, noTZ bool) error {
+	if noTZ && (strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=")) {
+		return errors.Errorf("%s: the timezone is set automatically, remove CRON_TZ from '%s'", name, spec)
+	}
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return errors.Wrapf(err, "%s: invalid spec '%s'", name, spec)
+	}
+	return nil
+}
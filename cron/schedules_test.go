@@ -0,0 +1,157 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+)
+
+func TestSchedulesValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		schedules Schedules
+		wantErr   bool
+	}{
+		{
+			name:      "empty",
+			schedules: Schedules{},
+		},
+		{
+			name:      "defaults",
+			schedules: DefaultSchedules(),
+		},
+		{
+			name: "descriptors and CRON_TZ",
+			schedules: Schedules{
+				UpdateServerData:   "CRON_TZ=Europe/Warsaw 0 * * * *",
+				UpdateEnnoblements: "@every 30s",
+				Vacuum:             "@daily",
+			},
+		},
+		{
+			name:      "invalid spec",
+			schedules: Schedules{Vacuum: "0 * * *"},
+			wantErr:   true,
+		},
+		{
+			name:      "CRON_TZ in the history spec",
+			schedules: Schedules{UpdateHistory: "CRON_TZ=Europe/Warsaw 30 1 * * *"},
+			wantErr:   true,
+		},
+		{
+			name:      "TZ in the stats spec",
+			schedules: Schedules{UpdateStats: "TZ=Europe/Warsaw 45 1 * * *"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedules.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateVersionSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule *model.VersionSchedule
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			schedule: &model.VersionSchedule{VersionCode: "pl"},
+		},
+		{
+			name: "valid",
+			schedule: &model.VersionSchedule{
+				VersionCode:      "pl",
+				UpdateServerData: "30 * * * *",
+				UpdateHistory:    "0 2 * * *",
+				UpdateStats:      "@daily",
+			},
+		},
+		{
+			name:     "invalid spec",
+			schedule: &model.VersionSchedule{VersionCode: "pl", UpdateStats: "every day"},
+			wantErr:  true,
+		},
+		{
+			name:     "CRON_TZ in the data spec",
+			schedule: &model.VersionSchedule{VersionCode: "pl", UpdateServerData: "CRON_TZ=UTC 0 * * * *"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateVersionSchedule(tt.schedule); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateVersionSchedule() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronReloadVersionSchedule(t *testing.T) {
+	c, db, _ := newTestCron(t)
+	version := postgrestest.Version(t, db)
+	dataJob := "Cron.updateVersionServerData:" + string(version.Code)
+	historyJob := "Cron.updateVersionHistory:" + string(version.Code)
+	statsJob := "Cron.updateVersionStats:" + string(version.Code)
+	saveSchedule := func(schedule *model.VersionSchedule) {
+		t.Helper()
+		schedule.VersionCode = version.Code
+		schedule.UpdatedAt = time.Now()
+		if _, err := db.Model(schedule).
+			OnConflict("(version_code) DO UPDATE").
+			Set("update_server_data = EXCLUDED.update_server_data").
+			Set("update_history = EXCLUDED.update_history").
+			Set("update_stats = EXCLUDED.update_stats").
+			Set("updated_at = EXCLUDED.updated_at").
+			Insert(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func() {
+		t.Helper()
+		if err := c.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertJob := func(name, want string) {
+		t.Helper()
+		got, ok := c.jobSpec(name)
+		switch {
+		case want == "" && ok:
+			t.Errorf("the job %s has been scheduled (%s)", name, got)
+		case want != "" && got != want:
+			t.Errorf("the spec of the job %s = %q, want %q", name, got, want)
+		}
+	}
+
+	reload()
+	assertJob(dataJob, "")
+	assertJob(historyJob, "")
+	assertJob("Cron.updateHistory:"+version.Timezone, withTimezone(version.Timezone, c.schedules.UpdateHistory))
+
+	saveSchedule(&model.VersionSchedule{UpdateServerData: "*/10 * * * *", UpdateHistory: "0 3 * * *"})
+	reload()
+	assertJob(dataJob, withTimezone(version.Timezone, "*/10 * * * *"))
+	assertJob(historyJob, withTimezone(version.Timezone, "0 3 * * *"))
+	assertJob(statsJob, "")
+
+	saveSchedule(&model.VersionSchedule{UpdateServerData: "*/5 * * * *"})
+	reload()
+	assertJob(dataJob, withTimezone(version.Timezone, "*/5 * * * *"))
+	assertJob(historyJob, "")
+
+	if _, err := db.Model(&model.VersionSchedule{}).Where("version_code = ?", version.Code).Delete(); err != nil {
+		t.Fatal(err)
+	}
+	reload()
+	assertJob(dataJob, "")
+}
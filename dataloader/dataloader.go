@@ -0,0 +1,19 @@
+package dataloader
+
+import (
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+type ServerDataLoader interface {
+	LoadOD(tribe bool) (map[int]*twmodel.OpponentsDefeated, error)
+	LoadVillages() ([]*twmodel.Village, error)
+	LoadTribes() ([]*twmodel.Tribe, error)
+	LoadPlayers() ([]*twmodel.Player, error)
+	LoadEnnoblements(cfg *twdataloader.LoadEnnoblementsConfig) ([]*twmodel.Ennoblement, error)
+	GetConfig() (*twmodel.ServerConfig, error)
+	GetBuildingConfig() (*twmodel.BuildingConfig, error)
+	GetUnitConfig() (*twmodel.UnitConfig, error)
+}
+
+var _ ServerDataLoader = (*twdataloader.ServerDataLoader)(nil)
@@ -0,0 +1,120 @@
+package dataloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+)
+
+const (
+	fsBaseURL         = "http://fs"
+	endpointInterface = "/interface.php"
+	gzipExt           = ".gz"
+)
+
+// NewFSServerDataLoader returns a ServerDataLoader that reads the map files (village.txt, player.txt, ally.txt,
+// kill_*.txt, conquer.txt) and the configs (get_config.xml, get_building_info.xml, get_unit_info.xml)
+// from the given file system. Every file may be stored as it is or gzipped (with the .gz extension).
+func NewFSServerDataLoader(fsys fs.FS) ServerDataLoader {
+	return NewValidatingServerDataLoader(twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+		BaseURL: fsBaseURL,
+		Client: &http.Client{
+			Transport: &fsTransport{
+				fsys: fsys,
+			},
+		},
+	}))
+}
+
+// NewDirServerDataLoader is a shortcut for NewFSServerDataLoader(os.DirFS(dir)).
+func NewDirServerDataLoader(dir string) ServerDataLoader {
+	return NewFSServerDataLoader(os.DirFS(dir))
+}
+
+type fsTransport struct {
+	fsys fs.FS
+}
+
+func (t *fsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	name, err := FileNameFromURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	b, err := t.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
+
+func (t *fsTransport) readFile(name string) ([]byte, error) {
+	b, err := fs.ReadFile(t.fsys, name)
+	if err == nil {
+		return b, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) || strings.HasSuffix(name, gzipExt) {
+		return nil, errors.Wrapf(err, "couldn't read the file '%s'", name)
+	}
+
+	// the requested file doesn't exist, but there may be a gzipped version of it
+	f, gzErr := t.fsys.Open(name + gzipExt)
+	if gzErr != nil {
+		if errors.Is(gzErr, fs.ErrNotExist) {
+			return nil, errors.Wrapf(err, "couldn't read the file '%s'", name)
+		}
+		return nil, errors.Wrapf(gzErr, "couldn't read the file '%s'", name+gzipExt)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decompress the file '%s'", name+gzipExt)
+	}
+	defer r.Close()
+	b, err = io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decompress the file '%s'", name+gzipExt)
+	}
+	return b, nil
+}
+
+// FileNameFromURL maps the URL of the given TW endpoint to the name of the file it is stored in.
+// For example, /map/village.txt.gz => village.txt.gz, /interface.php?func=get_config => get_config.xml.
+func FileNameFromURL(u *url.URL) (string, error) {
+	if u.Path == endpointInterface {
+		switch fn := u.Query().Get("func"); fn {
+		case "":
+			return "", errors.Errorf("unsupported endpoint '%s'", u.String())
+		case "get_conquer":
+			return "conquer.txt", nil
+		default:
+			return path.Base(fn) + ".xml", nil
+		}
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", errors.Errorf("unsupported endpoint '%s'", u.String())
+	}
+	return name, nil
+}
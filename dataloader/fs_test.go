@@ -0,0 +1,40 @@
+package dataloader
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestFileNameFromURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{url: "https://pl170.plemiona.pl/map/village.txt.gz", want: "village.txt.gz"},
+		{url: "https://pl170.plemiona.pl/map/kill_att_tribe.txt.gz", want: "kill_att_tribe.txt.gz"},
+		{url: "https://pl170.plemiona.pl/interface.php?func=get_config", want: "get_config.xml"},
+		{url: "https://pl170.plemiona.pl/interface.php?func=get_unit_info", want: "get_unit_info.xml"},
+		{url: "https://pl170.plemiona.pl/interface.php?func=get_conquer&since=1620000000", want: "conquer.txt"},
+		{url: "https://pl170.plemiona.pl/interface.php?func=../../etc/passwd", want: "passwd.xml"},
+		{url: "https://pl170.plemiona.pl/interface.php", wantErr: true},
+		{url: "https://pl170.plemiona.pl/", wantErr: true},
+		{url: "https://pl170.plemiona.pl", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := FileNameFromURL(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FileNameFromURL() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FileNameFromURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
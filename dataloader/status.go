@@ -0,0 +1,54 @@
+package dataloader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// StatusError is returned when a TW server responds with a status code other than 2xx.
+type StatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d (%s)", e.StatusCode, e.URL)
+}
+
+// Temporary reports whether the request may succeed if it is retried later.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError ||
+		e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusRequestTimeout
+}
+
+// NewStatusCheckingTransport returns a http.RoundTripper that turns non-2xx responses into a *StatusError.
+func NewStatusCheckingTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &statusCheckingTransport{
+		rt: rt,
+	}
+}
+
+type statusCheckingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *statusCheckingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			URL:        req.URL.String(),
+		}
+	}
+	return resp, nil
+}
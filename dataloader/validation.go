@@ -0,0 +1,91 @@
+package dataloader
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+// ErrInvalidData is matched (errors.Is) by the errors returned by the ServerDataLoader for the malformed data,
+// e.g. a line with an invalid number of fields.
+var ErrInvalidData = errors.New("invalid data")
+
+// invalidLineFormat is the message of the errors returned by twdataloader for the lines with an invalid number of fields.
+// twdataloader doesn't return typed errors for them, TestInvalidLineFormat pins the message of every parser.
+const invalidLineFormat = "invalid line format"
+
+type invalidDataError struct {
+	err error
+}
+
+func (e *invalidDataError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidDataError) Unwrap() error {
+	return e.err
+}
+
+func (e *invalidDataError) Is(target error) bool {
+	return target == ErrInvalidData
+}
+
+func wrapInvalidData(err error) error {
+	if err == nil || !strings.HasPrefix(errors.Cause(err).Error(), invalidLineFormat) {
+		return err
+	}
+	return &invalidDataError{err: err}
+}
+
+// NewValidatingServerDataLoader returns a ServerDataLoader whose errors caused by the malformed data match ErrInvalidData.
+func NewValidatingServerDataLoader(dl ServerDataLoader) ServerDataLoader {
+	return &validatingServerDataLoader{
+		dl: dl,
+	}
+}
+
+type validatingServerDataLoader struct {
+	dl ServerDataLoader
+}
+
+func (v *validatingServerDataLoader) LoadOD(tribe bool) (map[int]*twmodel.OpponentsDefeated, error) {
+	od, err := v.dl.LoadOD(tribe)
+	return od, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) LoadVillages() ([]*twmodel.Village, error) {
+	villages, err := v.dl.LoadVillages()
+	return villages, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) LoadTribes() ([]*twmodel.Tribe, error) {
+	tribes, err := v.dl.LoadTribes()
+	return tribes, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) LoadPlayers() ([]*twmodel.Player, error) {
+	players, err := v.dl.LoadPlayers()
+	return players, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) LoadEnnoblements(cfg *twdataloader.LoadEnnoblementsConfig) ([]*twmodel.Ennoblement, error) {
+	ennoblements, err := v.dl.LoadEnnoblements(cfg)
+	return ennoblements, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) GetConfig() (*twmodel.ServerConfig, error) {
+	cfg, err := v.dl.GetConfig()
+	return cfg, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) GetBuildingConfig() (*twmodel.BuildingConfig, error) {
+	cfg, err := v.dl.GetBuildingConfig()
+	return cfg, wrapInvalidData(err)
+}
+
+func (v *validatingServerDataLoader) GetUnitConfig() (*twmodel.UnitConfig, error) {
+	cfg, err := v.dl.GetUnitConfig()
+	return cfg, wrapInvalidData(err)
+}
@@ -0,0 +1,169 @@
+package dataloader
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidatingServerDataLoader(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		load    func(dl ServerDataLoader) error
+		invalid bool
+	}{
+		{
+			name:    "village with a missing field",
+			file:    "village.txt",
+			content: "1,Village,500,500,0,26\n",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadVillages()
+				return err
+			},
+			invalid: true,
+		},
+		{
+			name:    "player with a missing field",
+			file:    "player.txt",
+			content: "1,Player,0,1,26\n",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadPlayers()
+				return err
+			},
+			invalid: true,
+		},
+		{
+			name:    "tribe with a missing field",
+			file:    "ally.txt",
+			content: "1,Tribe,TAG,1,1,26,26\n",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadTribes()
+				return err
+			},
+			invalid: true,
+		},
+		{
+			name:    "od with a missing field",
+			file:    "kill_all.txt",
+			content: "1,1\n",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadOD(false)
+				return err
+			},
+			invalid: true,
+		},
+		{
+			name:    "valid village",
+			file:    "village.txt",
+			content: "1,Village,500,500,0,26,0\n",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadVillages()
+				return err
+			},
+		},
+		{
+			name: "missing file",
+			file: "player.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadVillages()
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := NewFSServerDataLoader(fstest.MapFS{
+				tt.file: &fstest.MapFile{Data: []byte(tt.content)},
+			})
+			err := tt.load(dl)
+			if got := errors.Is(err, ErrInvalidData); got != tt.invalid {
+				t.Errorf("errors.Is(%v, ErrInvalidData) = %t, want %t", err, got, tt.invalid)
+			}
+		})
+	}
+}
+
+// TestInvalidLineFormat pins the messages of the errors returned by the twdataloader parsers,
+// wrapInvalidData recognizes them only by the invalidLineFormat prefix.
+func TestInvalidLineFormat(t *testing.T) {
+	tests := []struct {
+		file string
+		load func(dl ServerDataLoader) error
+		want string
+	}{
+		{
+			file: "village.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadVillages()
+				return err
+			},
+			want: "invalid line format (should be id,name,x,y,playerID,points,bonus)",
+		},
+		{
+			file: "player.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadPlayers()
+				return err
+			},
+			want: "invalid line format (should be id,name,tribeid,villages,points,rank)",
+		},
+		{
+			file: "ally.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadTribes()
+				return err
+			},
+			want: "invalid line format (should be id,name,tag,members,villages,points,allpoints,rank)",
+		},
+		{
+			file: "kill_all.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadOD(false)
+				return err
+			},
+			want: "invalid line format (should be rank,id,score)",
+		},
+		{
+			file: "kill_all_tribe.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadOD(true)
+				return err
+			},
+			want: "invalid line format (should be rank,id,score)",
+		},
+		{
+			file: "conquer.txt",
+			load: func(dl ServerDataLoader) error {
+				_, err := dl.LoadEnnoblements(nil)
+				return err
+			},
+			want: "invalid line format (should be village_id,timestamp,new_owner_id,old_owner_id)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			dl := NewFSServerDataLoader(fstest.MapFS{
+				tt.file: &fstest.MapFile{Data: []byte("1\n")},
+			})
+			err := tt.load(dl)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := errors.Cause(errors.Unwrap(err)).Error(); got != tt.want {
+				t.Errorf("got message %q, want %q", got, tt.want)
+			}
+			if !strings.HasPrefix(tt.want, invalidLineFormat) {
+				t.Errorf("%q doesn't start with %q", tt.want, invalidLineFormat)
+			}
+			if !errors.Is(err, ErrInvalidData) {
+				t.Errorf("errors.Is(%v, ErrInvalidData) = false, want true", err)
+			}
+		})
+	}
+}
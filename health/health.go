@@ -0,0 +1,175 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+
+	checkTimeout = 5 * time.Second
+)
+
+var log = logrus.WithField("package", "pkg/health")
+
+// Check returns an error if the checked component isn't healthy.
+type Check func(ctx context.Context) error
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Info returns additional information included in the reports (e.g. the current leader).
+type Info func(ctx context.Context) interface{}
+
+type Report struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks"`
+	Info   map[string]interface{}  `json:"info,omitempty"`
+}
+
+// Handler serves the liveness (/healthz) and readiness (/readyz) probes.
+// Both respond with 200 if all checks have passed and with 503 otherwise.
+type Handler struct {
+	mu        sync.RWMutex
+	liveness  map[string]Check
+	readiness map[string]Check
+	info      map[string]Info
+	mux       *http.ServeMux
+}
+
+func NewHandler() *Handler {
+	h := &Handler{
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+		info:      make(map[string]Info),
+		mux:       http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/healthz", h.serveChecks(h.Liveness))
+	h.mux.HandleFunc("/readyz", h.serveChecks(h.Readiness))
+	return h
+}
+
+// AddLivenessCheck adds a check that fails if the process should be restarted.
+func (h *Handler) AddLivenessCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness[name] = check
+}
+
+// AddReadinessCheck adds a check that fails if the process can't do its work at the moment (e.g. the db is down).
+func (h *Handler) AddReadinessCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness[name] = check
+}
+
+// AddInfo adds the information included in both reports.
+func (h *Handler) AddInfo(name string, info Info) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.info[name] = info
+}
+
+func (h *Handler) Liveness(ctx context.Context) *Report {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.report(ctx, h.liveness)
+}
+
+func (h *Handler) Readiness(ctx context.Context) *Report {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.report(ctx, h.readiness)
+}
+
+func (h *Handler) report(ctx context.Context, checks map[string]Check) *Report {
+	report := runChecks(ctx, checks)
+	if len(h.info) > 0 {
+		report.Info = make(map[string]interface{}, len(h.info))
+		for name, info := range h.info {
+			report.Info[name] = info(ctx)
+		}
+	}
+	return report
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serveChecks(fn func(ctx context.Context) *Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		report := fn(r.Context())
+		statusCode := http.StatusOK
+		if report.Status != StatusOK {
+			statusCode = http.StatusServiceUnavailable
+			for _, name := range report.failed() {
+				log.
+					WithField("check", name).
+					Warnf("%s %s: %s", r.URL.Path, name, report.Checks[name].Error)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Warn(errors.Wrap(err, "couldn't write the response"))
+		}
+	}
+}
+
+func (r *Report) failed() []string {
+	var names []string
+	for name, result := range r.Checks {
+		if result.Status != StatusOK {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runChecks(ctx context.Context, checks map[string]Check) *Report {
+	report := &Report{
+		Status: StatusOK,
+		Checks: make(map[string]*CheckResult, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			result := &CheckResult{Status: StatusOK}
+			if err := check(ctx); err != nil {
+				result.Status = StatusFail
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
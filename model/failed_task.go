@@ -0,0 +1,35 @@
+package model
+
+import (
+	"time"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+type FailedTaskAttempt struct {
+	Number   int       `json:"number"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// FailedTask is a task that has exhausted its retries (or has failed permanently).
+type FailedTask struct {
+	tableName struct{} `pg:"failed_tasks,alias:failed_task"`
+
+	ID          int                  `json:"id"`
+	TaskName    string               `pg:",notnull" json:"taskName"`
+	ServerKey   string               `json:"serverKey,omitempty"`
+	VersionCode twmodel.VersionCode  `json:"versionCode,omitempty"`
+	URL         string               `json:"url,omitempty"`
+	Timezone    string               `json:"timezone,omitempty"`
+	ArgsBin     []byte               `json:"-"`
+	Attempts    []*FailedTaskAttempt `pg:"type:jsonb" json:"attempts"`
+	CreatedAt   time.Time            `pg:"default:now(),use_zero" json:"createdAt"`
+}
+
+func (ft *FailedTask) LastError() string {
+	if len(ft.Attempts) == 0 {
+		return ""
+	}
+	return ft.Attempts[len(ft.Attempts)-1].Error
+}
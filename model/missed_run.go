@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+)
+
+// MissedRun is a date with a scheduled run (data/history/stats update) that didn't happen for the server,
+// e.g. because the cron was down. The runs missed on the current day are caught up, the older ones are gaps in the data.
+type MissedRun struct {
+	tableName struct{} `pg:"missed_runs,alias:missed_run"`
+
+	ID        int64  `json:"id"`
+	ServerKey string `pg:",notnull,unique:missed_run" json:"serverKey"`
+	TaskName  string `pg:",notnull,unique:missed_run" json:"taskName"`
+	// Date is the date of the missing records (the create_date of the history/stats, the local date of the data updates).
+	Date        time.Time `pg:"type:date,notnull,unique:missed_run" json:"date"`
+	ScheduledAt time.Time `pg:",notnull" json:"scheduledAt"`
+	CaughtUp    bool      `pg:",use_zero,notnull" json:"caughtUp"`
+	DetectedAt  time.Time `pg:"default:now(),notnull" json:"detectedAt"`
+}
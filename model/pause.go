@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+// ServerPause excludes the server from the scheduled updates (e.g. while its schema is being repaired).
+type ServerPause struct {
+	tableName struct{} `pg:"server_pauses,alias:server_pause"`
+
+	ServerKey string    `pg:",pk" json:"serverKey"`
+	Reason    string    `json:"reason"`
+	PausedAt  time.Time `pg:"default:now(),notnull" json:"pausedAt"`
+}
+
+// VersionPause excludes all servers of the version from the scheduled updates.
+type VersionPause struct {
+	tableName struct{} `pg:"version_pauses,alias:version_pause"`
+
+	VersionCode twmodel.VersionCode `pg:",pk" json:"versionCode"`
+	Reason      string              `json:"reason"`
+	PausedAt    time.Time           `pg:"default:now(),notnull" json:"pausedAt"`
+}
@@ -0,0 +1,12 @@
+package model
+
+// RowHash is the hash of the columns of a tribe, player or village saved during the last server data update.
+// The rows whose hash hasn't changed aren't updated.
+type RowHash struct {
+	tableName struct{} `pg:"?SERVER.row_hashes,alias:row_hash"`
+
+	// Entity is the name of the table (tribes, players, villages).
+	Entity string `pg:",pk"`
+	ID     int    `pg:"type:bigint,pk"`
+	Hash   int64  `pg:",use_zero,notnull"`
+}
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	TaskRunOutcomeSucceeded = "succeeded"
+	TaskRunOutcomeUnchanged = "unchanged"
+	TaskRunOutcomeFailed    = "failed"
+	// TaskRunOutcomeSkipped - the task hasn't been run, e.g. because another task was being processed for the server.
+	TaskRunOutcomeSkipped = "skipped"
+)
+
+// TaskRun is a single execution of a server-scoped task (every retry is recorded separately).
+type TaskRun struct {
+	tableName struct{} `pg:"task_runs,alias:task_run"`
+
+	ID         int64     `json:"id"`
+	TaskName   string    `pg:",notnull" json:"taskName"`
+	ServerKey  string    `json:"serverKey,omitempty"`
+	StartedAt  time.Time `pg:",notnull" json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Outcome    string    `pg:",notnull" json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+
+	// PlayersUpserted, TribesUpserted and VillagesUpserted are the new and changed rows (see RowHash),
+	// the unchanged rows aren't updated.
+	PlayersUpserted          int `pg:",use_zero" json:"playersUpserted"`
+	TribesUpserted           int `pg:",use_zero" json:"tribesUpserted"`
+	VillagesUpserted         int `pg:",use_zero" json:"villagesUpserted"`
+	PlayersInserted          int `pg:",use_zero" json:"playersInserted"`
+	PlayersChanged           int `pg:",use_zero" json:"playersChanged"`
+	PlayersUnchanged         int `pg:",use_zero" json:"playersUnchanged"`
+	TribesInserted           int `pg:",use_zero" json:"tribesInserted"`
+	TribesChanged            int `pg:",use_zero" json:"tribesChanged"`
+	TribesUnchanged          int `pg:",use_zero" json:"tribesUnchanged"`
+	VillagesInserted         int `pg:",use_zero" json:"villagesInserted"`
+	VillagesChanged          int `pg:",use_zero" json:"villagesChanged"`
+	VillagesUnchanged        int `pg:",use_zero" json:"villagesUnchanged"`
+	PlayersMarkedDeleted     int `pg:",use_zero" json:"playersMarkedDeleted"`
+	TribesMarkedDeleted      int `pg:",use_zero" json:"tribesMarkedDeleted"`
+	DailyPlayerStatsUpserted int `pg:",use_zero" json:"dailyPlayerStatsUpserted"`
+	DailyTribeStatsUpserted  int `pg:",use_zero" json:"dailyTribeStatsUpserted"`
+	HistoryRecordsInserted   int `pg:",use_zero" json:"historyRecordsInserted"`
+	EnnoblementsInserted     int `pg:",use_zero" json:"ennoblementsInserted"`
+	VillagesDeleted          int `pg:",use_zero" json:"villagesDeleted"`
+	// HistoryRecordsDeleted and DailyStatsDeleted are the player and tribe rows deleted by the vacuum,
+	// ServerStatsInserted is the row inserted by the stats update (the daily stats are upserted by the data update).
+	HistoryRecordsDeleted int `pg:",use_zero" json:"historyRecordsDeleted"`
+	DailyStatsDeleted     int `pg:",use_zero" json:"dailyStatsDeleted"`
+	ServerStatsInserted   int `pg:",use_zero" json:"serverStatsInserted"`
+}
+
+func (r *TaskRun) Duration() time.Duration {
+	if r.FinishedAt.IsZero() {
+		return 0
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
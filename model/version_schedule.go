@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+// VersionSchedule overrides the global cron schedules for the servers of the given version.
+// An empty spec means that the global schedule is used.
+type VersionSchedule struct {
+	tableName struct{} `pg:"version_schedules,alias:version_schedule"`
+
+	VersionCode      twmodel.VersionCode `pg:",pk" json:"versionCode"`
+	UpdateServerData string              `pg:",use_zero" json:"updateServerData"`
+	UpdateHistory    string              `pg:",use_zero" json:"updateHistory"`
+	UpdateStats      string              `pg:",use_zero" json:"updateStats"`
+	UpdatedAt        time.Time           `pg:"default:now(),notnull" json:"updatedAt"`
+}
+
+// IsEmpty reports whether none of the schedules is overridden.
+func (s *VersionSchedule) IsEmpty() bool {
+	return s.UpdateServerData == "" && s.UpdateHistory == "" && s.UpdateStats == ""
+}
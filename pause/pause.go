@@ -0,0 +1,157 @@
+// Package pause manages the servers and versions excluded from the updates (see model.ServerPause and model.VersionPause).
+package pause
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+var log = logrus.WithField("package", "pkg/pause")
+
+var (
+	ErrServerNotFound  = errors.New("server not found")
+	ErrVersionNotFound = errors.New("version not found")
+)
+
+// List lists the paused servers and versions.
+type List struct {
+	Servers  []*model.ServerPause  `json:"servers"`
+	Versions []*model.VersionPause `json:"versions"`
+}
+
+// Load returns all paused servers and versions.
+func Load(ctx context.Context, db orm.DB) (*List, error) {
+	p := &List{
+		Servers:  []*model.ServerPause{},
+		Versions: []*model.VersionPause{},
+	}
+	if err := db.ModelContext(ctx, &p.Servers).Order("server_key ASC").Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load the paused servers")
+	}
+	if err := db.ModelContext(ctx, &p.Versions).Order("version_code ASC").Select(); err != nil {
+		return nil, errors.Wrap(err, "couldn't load the paused versions")
+	}
+	return p, nil
+}
+
+// ServerPause reports whether the server or its version has been paused.
+func (p *List) ServerPause(server *twmodel.Server) (paused bool, reason string) {
+	for _, v := range p.Versions {
+		if v.VersionCode == server.VersionCode {
+			return true, "version: " + v.Reason
+		}
+	}
+	for _, s := range p.Servers {
+		if s.ServerKey == server.Key {
+			return true, s.Reason
+		}
+	}
+	return false, ""
+}
+
+// NotPaused excludes the paused servers and the servers of the paused versions from the query of twmodel.Server.
+func NotPaused(q *orm.Query) (*orm.Query, error) {
+	return q.
+		Where("server.key NOT IN (SELECT server_key FROM server_pauses)").
+		Where("server.version_code NOT IN (SELECT version_code FROM version_pauses)"), nil
+}
+
+// IsServerPaused reports whether the server or its version has been paused.
+func IsServerPaused(ctx context.Context, db orm.DB, server *twmodel.Server) (bool, error) {
+	paused, err := db.ModelContext(ctx, &model.ServerPause{}).
+		Where("server_key = ?", server.Key).
+		Exists()
+	if err != nil {
+		return false, errors.Wrapf(err, "%s: couldn't check whether the server has been paused", server.Key)
+	}
+	if paused {
+		return true, nil
+	}
+	return IsVersionPaused(ctx, db, server.VersionCode)
+}
+
+// IsVersionPaused reports whether the version has been paused.
+func IsVersionPaused(ctx context.Context, db orm.DB, code twmodel.VersionCode) (bool, error) {
+	paused, err := db.ModelContext(ctx, &model.VersionPause{}).
+		Where("version_code = ?", code).
+		Exists()
+	if err != nil {
+		return false, errors.Wrapf(err, "%s: couldn't check whether the version has been paused", code)
+	}
+	return paused, nil
+}
+
+// PauseServer excludes the server from the updates, the reason of an existing pause is updated.
+func PauseServer(ctx context.Context, db orm.DB, key, reason string) (*model.ServerPause, error) {
+	exists, err := db.ModelContext(ctx, &twmodel.Server{}).Where("key = ?", key).Exists()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the server", key)
+	}
+	if !exists {
+		return nil, errors.Wrapf(ErrServerNotFound, "'%s'", key)
+	}
+	p := &model.ServerPause{
+		ServerKey: key,
+		Reason:    reason,
+		PausedAt:  time.Now(),
+	}
+	_, err = db.ModelContext(ctx, p).
+		OnConflict("(server_key) DO UPDATE").
+		Set("reason = EXCLUDED.reason").
+		Insert()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't pause the server", key)
+	}
+	log.WithField("key", key).Infof("%s: The server has been paused", key)
+	return p, nil
+}
+
+// PauseVersion excludes all servers of the version from the updates, the reason of an existing pause is updated.
+func PauseVersion(ctx context.Context, db orm.DB, code, reason string) (*model.VersionPause, error) {
+	exists, err := db.ModelContext(ctx, &twmodel.Version{}).Where("code = ?", code).Exists()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the version", code)
+	}
+	if !exists {
+		return nil, errors.Wrapf(ErrVersionNotFound, "'%s'", code)
+	}
+	p := &model.VersionPause{
+		VersionCode: twmodel.VersionCode(code),
+		Reason:      reason,
+		PausedAt:    time.Now(),
+	}
+	_, err = db.ModelContext(ctx, p).
+		OnConflict("(version_code) DO UPDATE").
+		Set("reason = EXCLUDED.reason").
+		Insert()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't pause the version", code)
+	}
+	log.WithField("code", code).Infof("%s: The version has been paused", code)
+	return p, nil
+}
+
+// ResumeServer includes the server in the updates again. It reports false if the server hasn't been paused.
+func ResumeServer(ctx context.Context, db orm.DB, key string) (bool, error) {
+	res, err := db.ModelContext(ctx, &model.ServerPause{}).Where("server_key = ?", key).Delete()
+	if err != nil {
+		return false, errors.Wrapf(err, "%s: couldn't resume the server", key)
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// ResumeVersion includes the servers of the version in the updates again. It reports false if the version hasn't been paused.
+func ResumeVersion(ctx context.Context, db orm.DB, code string) (bool, error) {
+	res, err := db.ModelContext(ctx, &model.VersionPause{}).Where("version_code = ?", code).Delete()
+	if err != nil {
+		return false, errors.Wrapf(err, "%s: couldn't resume the version", code)
+	}
+	return res.RowsAffected() > 0, nil
+}
@@ -0,0 +1,689 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+type DriftKind string
+
+const (
+	DriftMissingSchema      DriftKind = "missing_schema"
+	DriftMissingTable       DriftKind = "missing_table"
+	DriftMissingColumn      DriftKind = "missing_column"
+	DriftColumnType         DriftKind = "column_type"
+	DriftColumnDefault      DriftKind = "column_default"
+	DriftMissingIndex       DriftKind = "missing_index"
+	DriftIndexNotConstraint DriftKind = "index_not_constraint"
+	DriftMissingFunction    DriftKind = "missing_function"
+	DriftOutdatedFunction   DriftKind = "outdated_function"
+	DriftMissingTrigger     DriftKind = "missing_trigger"
+)
+
+// maxIdentifierLength is the length the PostgreSQL identifiers are truncated to.
+const maxIdentifierLength = 63
+
+// Drift is a difference between the server schema and the structure expected by the current code.
+type Drift struct {
+	Kind DriftKind `json:"kind"`
+	// Object is the name of the table, column (table.column), index, function or trigger.
+	Object   string `json:"object"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// Fixable is false if the drift can't be fixed automatically (e.g. a column type that requires converting the data).
+	Fixable bool `json:"fixable"`
+}
+
+func (d Drift) String() string {
+	s := string(d.Kind) + " " + d.Object
+	if d.Expected != "" {
+		s += ", expected: " + d.Expected
+	}
+	if d.Actual != "" {
+		s += ", actual: " + d.Actual
+	}
+	if !d.Fixable {
+		s += " (manual fix required)"
+	}
+	return s
+}
+
+// DriftReport lists the drifts of the server schema.
+type DriftReport struct {
+	Server string  `json:"server"`
+	Drifts []Drift `json:"drifts"`
+	// Fixed is the number of the drifts fixed by FixServerDrift.
+	Fixed int    `json:"fixed,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (r *DriftReport) HasDrift() bool {
+	return len(r.Drifts) > 0
+}
+
+func (r *DriftReport) add(d Drift) {
+	r.Drifts = append(r.Drifts, d)
+}
+
+type expectedColumn struct {
+	name    string
+	sqlType string
+	// dflt is empty if the default value isn't checked
+	dflt string
+}
+
+type expectedTable struct {
+	name    string
+	columns []expectedColumn
+	pk      []string
+	// uniques are the column sets of the unique constraints
+	uniques [][]string
+}
+
+type expectedFunction struct {
+	name   string
+	source string
+}
+
+type expectedTrigger struct {
+	name  string
+	table string
+}
+
+var (
+	functionRegexp = regexp.MustCompile(`(?s)CREATE OR REPLACE FUNCTION \S+?\.(\w+)\(\).*?\$BODY\$(.*?)\$BODY\$`)
+	triggerRegexp  = regexp.MustCompile(`(?s)CREATE TRIGGER (\S+)\s.*?\sON \S+?\.(\w+)`)
+	defaultRegexp  = regexp.MustCompile(`(?i)ALTER TABLE \S+?\.(\w+) ALTER COLUMN (\w+) set default (.+?);`)
+)
+
+var sqlTypeAliases = map[string]string{
+	"timestamptz": "timestamp with time zone",
+	"timestamp":   "timestamp without time zone",
+	"int":         "integer",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"int2":        "smallint",
+	"serial":      "integer",
+	"bigserial":   "bigint",
+	"smallserial": "smallint",
+	"float8":      "double precision",
+	"float4":      "real",
+	"bool":        "boolean",
+	"varchar":     "character varying",
+}
+
+func normalizeSQLType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	suffix := ""
+	if strings.HasSuffix(t, "[]") {
+		t, suffix = strings.TrimSuffix(t, "[]"), "[]"
+	}
+	if alias, ok := sqlTypeAliases[t]; ok {
+		t = alias
+	}
+	return t + suffix
+}
+
+func isSerial(t string) bool {
+	switch strings.ToLower(t) {
+	case "serial", "bigserial", "smallserial":
+		return true
+	}
+	return false
+}
+
+// normalizeSQL makes the comparison of the SQL fragments insensitive to whitespace and case.
+func normalizeSQL(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+func truncateIdentifier(name string) string {
+	if len(name) > maxIdentifierLength {
+		return name[:maxIdentifierLength]
+	}
+	return name
+}
+
+func formatServerSQL(query string, server *twmodel.Server) string {
+	return string(orm.NewFormatter().FormatQuery(nil, query, pg.Safe(server.Key), server.VersionCode))
+}
+
+// serverModels are the tables of the server schema expected by the current code.
+func serverModels() []interface{} {
+	return []interface{}{
+		(*twmodel.Tribe)(nil),
+		(*twmodel.Player)(nil),
+		(*twmodel.Village)(nil),
+		(*twmodel.Ennoblement)(nil),
+		(*twmodel.ServerStats)(nil),
+		(*twmodel.TribeHistory)(nil),
+		(*twmodel.PlayerHistory)(nil),
+		(*twmodel.TribeChange)(nil),
+		(*twmodel.DailyPlayerStats)(nil),
+		(*twmodel.DailyTribeStats)(nil),
+		(*model.RowHash)(nil),
+	}
+}
+
+// expectedServerTables returns the tables of the server schema, as created by the twmodel types and initServerDefaultValues.
+func expectedServerTables(server *twmodel.Server) []expectedTable {
+	defaults := make(map[string]string)
+	for _, m := range defaultRegexp.FindAllStringSubmatch(formatServerSQL(initServerDefaultValues, server), -1) {
+		defaults[m[1]+"."+m[2]] = m[3]
+	}
+
+	var tables []expectedTable
+	for _, model := range serverModels() {
+		table := orm.GetTable(reflect.TypeOf(model).Elem())
+		name := string(table.SQLName)
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		name = strings.Trim(name, `"`)
+		t := expectedTable{name: name}
+		pks := make(map[*orm.Field]bool)
+		for _, f := range table.PKs {
+			pks[f] = true
+			t.pk = append(t.pk, f.SQLName)
+		}
+		for _, f := range table.Fields {
+			c := expectedColumn{
+				name:    f.SQLName,
+				sqlType: f.UserSQLType,
+				dflt:    string(f.Default),
+			}
+			if c.sqlType == "" {
+				c.sqlType = f.SQLType
+				if pks[f] {
+					c.sqlType = pkSQLType(f.SQLType)
+				}
+			}
+			if isSerial(c.sqlType) {
+				// the default value is the next value of the sequence
+				c.dflt = ""
+			}
+			if dflt, ok := defaults[name+"."+f.SQLName]; ok {
+				c.dflt = dflt
+			}
+			c.sqlType = normalizeSQLType(c.sqlType)
+			t.columns = append(t.columns, c)
+		}
+		groups := make([]string, 0, len(table.Unique))
+		for group := range table.Unique {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			var columns []string
+			for _, f := range table.Unique[group] {
+				columns = append(columns, f.SQLName)
+			}
+			t.uniques = append(t.uniques, columns)
+		}
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+// pkSQLType mirrors go-pg, which creates the integer primary keys without an explicit type as serial.
+func pkSQLType(t string) string {
+	switch t {
+	case "smallint":
+		return "smallserial"
+	case "integer":
+		return "serial"
+	case "bigint":
+		return "bigserial"
+	}
+	return t
+}
+
+func expectedServerFunctions(server *twmodel.Server) []expectedFunction {
+	var functions []expectedFunction
+	for _, query := range []string{initServerFunctions, rowHashFunctions} {
+		for _, m := range functionRegexp.FindAllStringSubmatch(formatServerSQL(query, server), -1) {
+			functions = append(functions, expectedFunction{name: m[1], source: m[2]})
+		}
+	}
+	return functions
+}
+
+func expectedServerTriggers(server *twmodel.Server) []expectedTrigger {
+	var triggers []expectedTrigger
+	for _, query := range []string{initServerTriggers, rowHashTriggers} {
+		for _, m := range triggerRegexp.FindAllStringSubmatch(formatServerSQL(query, server), -1) {
+			triggers = append(triggers, expectedTrigger{name: truncateIdentifier(m[1]), table: m[2]})
+		}
+	}
+	return triggers
+}
+
+type actualColumn struct {
+	TableName     string
+	ColumnName    string
+	ColumnType    string
+	ColumnDefault string
+}
+
+type actualIndex struct {
+	IndexName    string
+	TableName    string
+	IsPrimary    bool
+	IsConstraint bool
+	Columns      []string `pg:",array"`
+}
+
+type actualFunction struct {
+	FunctionName string
+	Source       string
+}
+
+type actualTrigger struct {
+	TriggerName string
+	TableName   string
+}
+
+// DetectServerDrift compares the server schema with the tables defined by the twmodel types
+// and with the functions and triggers created by initServerFunctions/initServerTriggers and rowHashFunctions/rowHashTriggers.
+func DetectServerDrift(ctx context.Context, db pg.DBI, server *twmodel.Server) (*DriftReport, error) {
+	report := &DriftReport{
+		Server: server.Key,
+		Drifts: []Drift{},
+	}
+	if !SchemaExists(db, server.Key) {
+		report.add(Drift{Kind: DriftMissingSchema, Object: server.Key, Fixable: true})
+		return report, nil
+	}
+
+	var columns []actualColumn
+	_, err := db.QueryContext(ctx, &columns, `
+		SELECT c.relname AS table_name, a.attname AS column_name, format_type(a.atttypid, a.atttypmod) AS column_type,
+			coalesce(pg_get_expr(d.adbin, d.adrelid), '') AS column_default
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE n.nspname = ? AND c.relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped
+	`, server.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the columns", server.Key)
+	}
+	var indexes []actualIndex
+	_, err = db.QueryContext(ctx, &indexes, `
+		SELECT ci.relname AS index_name, c.relname AS table_name, i.indisprimary AS is_primary,
+			EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u')) AS is_constraint,
+			array(
+				SELECT a.attname::text
+				FROM unnest(i.indkey::int2[]) AS k(attnum)
+				JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+			) AS columns
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_class ci ON ci.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ? AND i.indisunique AND i.indisvalid
+	`, server.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the indexes", server.Key)
+	}
+	var functions []actualFunction
+	_, err = db.QueryContext(ctx, &functions, `
+		SELECT p.proname AS function_name, p.prosrc AS source
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname = ?
+	`, server.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the functions", server.Key)
+	}
+	var triggers []actualTrigger
+	_, err = db.QueryContext(ctx, &triggers, `
+		SELECT t.tgname AS trigger_name, c.relname AS table_name
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = ? AND NOT t.tgisinternal
+	`, server.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the triggers", server.Key)
+	}
+
+	columnsByTable := make(map[string]map[string]actualColumn)
+	for _, c := range columns {
+		if columnsByTable[c.TableName] == nil {
+			columnsByTable[c.TableName] = make(map[string]actualColumn)
+		}
+		columnsByTable[c.TableName][c.ColumnName] = c
+	}
+	for _, t := range expectedServerTables(server) {
+		actual, ok := columnsByTable[t.name]
+		if !ok {
+			report.add(Drift{Kind: DriftMissingTable, Object: t.name, Fixable: true})
+			continue
+		}
+		for _, c := range t.columns {
+			object := t.name + "." + c.name
+			a, ok := actual[c.name]
+			if !ok {
+				report.add(Drift{Kind: DriftMissingColumn, Object: object, Expected: c.sqlType, Fixable: true})
+				continue
+			}
+			if normalizeSQLType(a.ColumnType) != c.sqlType {
+				report.add(Drift{Kind: DriftColumnType, Object: object, Expected: c.sqlType, Actual: a.ColumnType})
+			}
+			if c.dflt != "" && normalizeSQL(a.ColumnDefault) != normalizeSQL(c.dflt) {
+				report.add(Drift{Kind: DriftColumnDefault, Object: object, Expected: c.dflt, Actual: a.ColumnDefault, Fixable: true})
+			}
+		}
+		if len(t.pk) > 0 && !hasPrimaryKey(indexes, t.name, t.pk) {
+			report.add(Drift{
+				Kind:     DriftMissingIndex,
+				Object:   t.name,
+				Expected: "PRIMARY KEY (" + strings.Join(t.pk, ", ") + ")",
+				Fixable:  true,
+			})
+		}
+		for _, u := range t.uniques {
+			if d, ok := uniqueConstraintDrift(indexes, t.name, u); ok {
+				report.add(d)
+			}
+		}
+	}
+
+	sources := make(map[string]string)
+	for _, f := range functions {
+		sources[f.FunctionName] = f.Source
+	}
+	for _, f := range expectedServerFunctions(server) {
+		source, ok := sources[f.name]
+		if !ok {
+			report.add(Drift{Kind: DriftMissingFunction, Object: f.name, Fixable: true})
+			continue
+		}
+		if normalizeSQL(source) != normalizeSQL(f.source) {
+			report.add(Drift{Kind: DriftOutdatedFunction, Object: f.name, Fixable: true})
+		}
+	}
+
+	existingTriggers := make(map[string]bool)
+	for _, t := range triggers {
+		existingTriggers[t.TableName+"."+t.TriggerName] = true
+	}
+	for _, t := range expectedServerTriggers(server) {
+		if !existingTriggers[t.table+"."+t.name] {
+			report.add(Drift{Kind: DriftMissingTrigger, Object: t.name, Expected: "ON " + t.table, Fixable: true})
+		}
+	}
+
+	return report, nil
+}
+
+func hasPrimaryKey(indexes []actualIndex, table string, columns []string) bool {
+	for _, idx := range indexes {
+		if idx.TableName == table && idx.IsPrimary && sameColumns(idx.Columns, columns) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueConstraintDrift checks whether the table has a unique constraint on the columns.
+// A unique index that isn't a constraint is a drift as well, the upserts refer to the constraints by their names.
+func uniqueConstraintDrift(indexes []actualIndex, table string, columns []string) (Drift, bool) {
+	expected := "UNIQUE (" + strings.Join(columns, ", ") + ")"
+	var index *actualIndex
+	for i, idx := range indexes {
+		if idx.TableName != table || !sameColumns(idx.Columns, columns) {
+			continue
+		}
+		if idx.IsConstraint {
+			return Drift{}, false
+		}
+		index = &indexes[i]
+	}
+	if index == nil {
+		return Drift{Kind: DriftMissingIndex, Object: table, Expected: expected, Fixable: true}, true
+	}
+	return Drift{Kind: DriftIndexNotConstraint, Object: table, Expected: expected, Actual: index.IndexName, Fixable: true}, true
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string(nil), a...)
+	sortedB := append([]string(nil), b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FixServerDrift fixes the fixable drifts from the report in one transaction and returns the report of the schema after the fix.
+// The missing schema is created with MigrateServer. The column types are never changed, they have to be fixed manually.
+func FixServerDrift(ctx context.Context, db *pg.DB, server *twmodel.Server, report *DriftReport) (*DriftReport, error) {
+	fixable := 0
+	missingSchema := false
+	for _, d := range report.Drifts {
+		if d.Fixable {
+			fixable++
+		}
+		if d.Kind == DriftMissingSchema {
+			missingSchema = true
+		}
+	}
+	if fixable == 0 {
+		return report, nil
+	}
+
+	if missingSchema {
+		if _, err := MigrateServer(db, server, LatestMigration); err != nil {
+			return nil, err
+		}
+	} else {
+		err := db.WithParam("SERVER", pg.Safe(server.Key)).RunInTransaction(ctx, func(tx *pg.Tx) error {
+			if err := lockSchema(tx, server.Key); err != nil {
+				return err
+			}
+			return fixDrifts(tx, server, report.Drifts)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: couldn't fix the drift", server.Key)
+		}
+	}
+
+	after, err := DetectServerDrift(ctx, db, server)
+	if err != nil {
+		return nil, err
+	}
+	after.Fixed = len(report.Drifts) - len(after.Drifts)
+	if after.Fixed < 0 {
+		after.Fixed = 0
+	}
+	return after, nil
+}
+
+func fixDrifts(tx *pg.Tx, server *twmodel.Server, drifts []Drift) error {
+	tables := make(map[string]expectedTable)
+	for _, t := range expectedServerTables(server) {
+		tables[t.name] = t
+	}
+	kinds := make(map[DriftKind]bool)
+	for _, d := range drifts {
+		kinds[d.Kind] = true
+	}
+	s := Schema{Name: server.Key, VersionCode: server.VersionCode}
+
+	if kinds[DriftMissingTable] {
+		if err := createTables(tx, serverModels()); err != nil {
+			return err
+		}
+	}
+	for _, d := range drifts {
+		var err error
+		switch d.Kind {
+		case DriftMissingColumn:
+			err = addColumn(tx, s, tables, d.Object)
+		case DriftColumnDefault:
+			err = setColumnDefault(tx, s, d.Object, d.Expected)
+		case DriftMissingIndex:
+			err = addIndex(tx, s, tables[d.Object], d.Expected)
+		case DriftIndexNotConstraint:
+			err = addUniqueConstraintUsingIndex(tx, s, tables[d.Object], d.Expected, d.Actual)
+		}
+		if err != nil {
+			return errors.Wrap(err, d.String())
+		}
+	}
+	// the functions have to be created before the triggers executing them
+	if kinds[DriftMissingFunction] || kinds[DriftOutdatedFunction] || kinds[DriftMissingTrigger] {
+		if err := execStatements([]string{initServerFunctions, rowHashFunctions})(tx, s); err != nil {
+			return errors.Wrap(err, "couldn't create the functions")
+		}
+	}
+	if kinds[DriftMissingTrigger] {
+		if err := execStatements([]string{initServerTriggers, rowHashTriggers})(tx, s); err != nil {
+			return errors.Wrap(err, "couldn't create the triggers")
+		}
+	}
+	// the recreated tables and the added columns don't fire the triggers deleting the row hashes
+	if entities := rowHashEntities(drifts); len(entities) > 0 {
+		if _, err := tx.Exec("DELETE FROM ?.row_hashes WHERE entity = ANY (?)", pg.Ident(s.Name), pg.Array(entities)); err != nil {
+			return errors.Wrap(err, "couldn't delete the row hashes")
+		}
+	}
+	return nil
+}
+
+// rowHashEntities returns the tables whose rows have to be saved again by the next data update after fixing the drifts.
+func rowHashEntities(drifts []Drift) []string {
+	var entities []string
+	seen := make(map[string]bool)
+	for _, d := range drifts {
+		table := d.Object
+		switch d.Kind {
+		case DriftMissingTable:
+		case DriftMissingColumn:
+			table, _ = splitColumnObject(d.Object)
+		default:
+			continue
+		}
+		switch table {
+		case "tribes", "players", "villages":
+			if !seen[table] {
+				seen[table] = true
+				entities = append(entities, table)
+			}
+		}
+	}
+	return entities
+}
+
+func createTables(tx *pg.Tx, models []interface{}) error {
+	for _, model := range models {
+		err := tx.Model(model).CreateTable(&orm.CreateTableOptions{
+			IfNotExists: true,
+		})
+		if err != nil {
+			return errors.Wrap(err, "couldn't create the table")
+		}
+	}
+	return nil
+}
+
+func splitColumnObject(object string) (string, string) {
+	parts := strings.SplitN(object, ".", 2)
+	if len(parts) != 2 {
+		return object, ""
+	}
+	return parts[0], parts[1]
+}
+
+func addColumn(tx *pg.Tx, s Schema, tables map[string]expectedTable, object string) error {
+	tableName, columnName := splitColumnObject(object)
+	for _, c := range tables[tableName].columns {
+		if c.name != columnName {
+			continue
+		}
+		q := "ALTER TABLE ?0.?1 ADD COLUMN IF NOT EXISTS ?2 " + c.sqlType
+		if c.dflt != "" {
+			q += " DEFAULT " + c.dflt
+		}
+		_, err := tx.Exec(q, pg.Ident(s.Name), pg.Ident(tableName), pg.Ident(columnName))
+		return err
+	}
+	return errors.Errorf("unknown column %s", object)
+}
+
+func setColumnDefault(tx *pg.Tx, s Schema, object, dflt string) error {
+	tableName, columnName := splitColumnObject(object)
+	_, err := tx.Exec(
+		"ALTER TABLE ?0.?1 ALTER COLUMN ?2 SET DEFAULT "+dflt,
+		pg.Ident(s.Name),
+		pg.Ident(tableName),
+		pg.Ident(columnName),
+	)
+	return err
+}
+
+func addIndex(tx *pg.Tx, s Schema, table expectedTable, constraint string) error {
+	if table.name == "" {
+		return errors.New("unknown table")
+	}
+	if table.pk != nil && constraint == "PRIMARY KEY ("+strings.Join(table.pk, ", ")+")" {
+		_, err := tx.Exec("ALTER TABLE ?0.?1 ADD "+constraint, pg.Ident(s.Name), pg.Ident(table.name))
+		return err
+	}
+	for _, u := range table.uniques {
+		if constraint != "UNIQUE ("+strings.Join(u, ", ")+")" {
+			continue
+		}
+		_, err := tx.Exec(
+			"ALTER TABLE ?0.?1 ADD CONSTRAINT ?2 "+constraint,
+			pg.Ident(s.Name),
+			pg.Ident(table.name),
+			pg.Ident(uniqueConstraintName(table.name, u)),
+		)
+		return err
+	}
+	return errors.Errorf("unknown constraint %s", constraint)
+}
+
+// addUniqueConstraintUsingIndex turns the existing unique index into the constraint (the index is renamed to the constraint name).
+func addUniqueConstraintUsingIndex(tx *pg.Tx, s Schema, table expectedTable, constraint, index string) error {
+	for _, u := range table.uniques {
+		if constraint != "UNIQUE ("+strings.Join(u, ", ")+")" {
+			continue
+		}
+		_, err := tx.Exec(
+			"ALTER TABLE ?0.?1 ADD CONSTRAINT ?2 UNIQUE USING INDEX ?3",
+			pg.Ident(s.Name),
+			pg.Ident(table.name),
+			pg.Ident(uniqueConstraintName(table.name, u)),
+			pg.Ident(index),
+		)
+		return err
+	}
+	return errors.Errorf("unknown constraint %s", constraint)
+}
+
+// uniqueConstraintName returns the name that PostgreSQL gives the unique constraint created with the table
+// (e.g. daily_tribe_stats_tribe_id_create_date_key used by the ON CONFLICT ON CONSTRAINT clauses).
+func uniqueConstraintName(table string, columns []string) string {
+	return truncateIdentifier(fmt.Sprintf("%s_%s_key", table, strings.Join(columns, "_")))
+}
@@ -0,0 +1,84 @@
+// The test is in the external package, because postgrestest imports postgres.
+package postgres_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-pg/pg/v10"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+)
+
+func TestDetectAndFixServerDrift(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+	ctx := context.Background()
+	detect := func() *postgres.DriftReport {
+		t.Helper()
+		report, err := postgres.DetectServerDrift(ctx, db, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	kinds := func(report *postgres.DriftReport) map[string]postgres.DriftKind {
+		byObject := make(map[string]postgres.DriftKind, len(report.Drifts))
+		for _, d := range report.Drifts {
+			byObject[d.Object] = d.Kind
+		}
+		return byObject
+	}
+
+	if report := detect(); report.HasDrift() {
+		t.Fatalf("the new schema has drifted: %v", report.Drifts)
+	}
+
+	for _, stmt := range []string{
+		"ALTER TABLE ?0.players DROP COLUMN daily_growth",
+		"DROP TRIGGER ?1 ON ?0.villages",
+		"ALTER TABLE ?0.players ALTER COLUMN name TYPE varchar(50)",
+	} {
+		if _, err := db.Exec(stmt, pg.Ident(server.Key), pg.Ident(server.Key+"_delete_row_hash")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := detect()
+	want := map[string]postgres.DriftKind{
+		"players.daily_growth":          postgres.DriftMissingColumn,
+		server.Key + "_delete_row_hash": postgres.DriftMissingTrigger,
+		"players.name":                  postgres.DriftColumnType,
+	}
+	if got := kinds(report); !reflect.DeepEqual(got, want) {
+		t.Fatalf("DetectServerDrift() = %v, want %v", got, want)
+	}
+
+	after, err := postgres.FixServerDrift(ctx, db, server, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the column types have to be fixed manually
+	want = map[string]postgres.DriftKind{
+		"players.name": postgres.DriftColumnType,
+	}
+	if got := kinds(after); !reflect.DeepEqual(got, want) || after.Fixed != 2 {
+		t.Errorf("FixServerDrift() = %v (fixed: %d), want %v (fixed: 2)", got, after.Fixed, want)
+	}
+
+	if _, err := db.Exec("DROP SCHEMA ? CASCADE", pg.Ident(server.Key)); err != nil {
+		t.Fatal(err)
+	}
+	report = detect()
+	if got := kinds(report); !reflect.DeepEqual(got, map[string]postgres.DriftKind{server.Key: postgres.DriftMissingSchema}) {
+		t.Fatalf("DetectServerDrift() = %v, want the missing schema", got)
+	}
+	after, err = postgres.FixServerDrift(ctx, db, server, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.HasDrift() {
+		t.Errorf("the recreated schema has drifted: %v", after.Drifts)
+	}
+}
@@ -0,0 +1,158 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+func TestNormalizeSQLType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"timestamptz", "timestamp with time zone"},
+		{"timestamp", "timestamp without time zone"},
+		{"timestamp with time zone", "timestamp with time zone"},
+		{"INT", "integer"},
+		{"bigserial", "bigint"},
+		{"float8", "double precision"},
+		{" bool ", "boolean"},
+		{"varchar", "character varying"},
+		{"text", "text"},
+		{"int[]", "integer[]"},
+		{"varchar[]", "character varying[]"},
+		{"jsonb", "jsonb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := normalizeSQLType(tt.in); got != tt.want {
+				t.Errorf("normalizeSQLType(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueConstraintDrift(t *testing.T) {
+	columns := []string{"tribe_id", "create_date"}
+	tests := []struct {
+		name       string
+		indexes    []actualIndex
+		wantDrift  bool
+		wantKind   DriftKind
+		wantActual string
+	}{
+		{
+			name: "constraint",
+			indexes: []actualIndex{
+				{IndexName: "daily_tribe_stats_pkey", TableName: "daily_tribe_stats", IsPrimary: true, IsConstraint: true, Columns: []string{"id"}},
+				{IndexName: "daily_tribe_stats_tribe_id_create_date_key", TableName: "daily_tribe_stats", IsConstraint: true, Columns: []string{"create_date", "tribe_id"}},
+			},
+		},
+		{
+			name: "constraint and a redundant index",
+			indexes: []actualIndex{
+				{IndexName: "daily_tribe_stats_tribe_id_create_date_idx", TableName: "daily_tribe_stats", Columns: columns},
+				{IndexName: "daily_tribe_stats_tribe_id_create_date_key", TableName: "daily_tribe_stats", IsConstraint: true, Columns: columns},
+			},
+		},
+		{
+			name: "index only",
+			indexes: []actualIndex{
+				{IndexName: "daily_tribe_stats_tribe_id_create_date_idx", TableName: "daily_tribe_stats", Columns: columns},
+			},
+			wantDrift:  true,
+			wantKind:   DriftIndexNotConstraint,
+			wantActual: "daily_tribe_stats_tribe_id_create_date_idx",
+		},
+		{
+			name: "missing",
+			indexes: []actualIndex{
+				{IndexName: "daily_tribe_stats_pkey", TableName: "daily_tribe_stats", IsPrimary: true, IsConstraint: true, Columns: []string{"id"}},
+				{IndexName: "daily_player_stats_tribe_id_create_date_key", TableName: "daily_player_stats", IsConstraint: true, Columns: columns},
+			},
+			wantDrift: true,
+			wantKind:  DriftMissingIndex,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := uniqueConstraintDrift(tt.indexes, "daily_tribe_stats", columns)
+			if ok != tt.wantDrift {
+				t.Fatalf("uniqueConstraintDrift() reported drift = %v, want %v", ok, tt.wantDrift)
+			}
+			if !ok {
+				return
+			}
+			if d.Kind != tt.wantKind || d.Actual != tt.wantActual || d.Expected != "UNIQUE (tribe_id, create_date)" || !d.Fixable {
+				t.Errorf("uniqueConstraintDrift() = %+v", d)
+			}
+		})
+	}
+}
+
+func TestUniqueConstraintName(t *testing.T) {
+	tests := []struct {
+		table   string
+		columns []string
+		want    string
+	}{
+		{"daily_tribe_stats", []string{"tribe_id", "create_date"}, "daily_tribe_stats_tribe_id_create_date_key"},
+		{"daily_player_stats", []string{"player_id", "create_date"}, "daily_player_stats_player_id_create_date_key"},
+		{"stats", []string{"create_date"}, "stats_create_date_key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := uniqueConstraintName(tt.table, tt.columns); got != tt.want {
+				t.Errorf("uniqueConstraintName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectedServerRowHashTriggers(t *testing.T) {
+	server := &twmodel.Server{Key: "pl1", VersionCode: "pl"}
+
+	tables := make(map[string]bool)
+	for _, trigger := range expectedServerTriggers(server) {
+		if trigger.name == "pl1_delete_row_hash" {
+			tables[trigger.table] = true
+		}
+	}
+	for _, table := range []string{"tribes", "players", "villages"} {
+		if !tables[table] {
+			t.Errorf("the trigger deleting the row hashes isn't expected on %s", table)
+		}
+	}
+
+	found := false
+	for _, f := range expectedServerFunctions(server) {
+		if f.name == "delete_row_hash" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the function delete_row_hash isn't expected")
+	}
+}
+
+func TestRowHashEntities(t *testing.T) {
+	drifts := []Drift{
+		{Kind: DriftMissingTable, Object: "villages"},
+		{Kind: DriftMissingColumn, Object: "players.daily_growth"},
+		{Kind: DriftMissingColumn, Object: "players.most_points"},
+		{Kind: DriftMissingColumn, Object: "ennoblements.points"},
+		{Kind: DriftMissingTable, Object: "stats"},
+		{Kind: DriftColumnDefault, Object: "tribes.exists"},
+		{Kind: DriftMissingTrigger, Object: "pl1_delete_row_hash"},
+	}
+	got := rowHashEntities(drifts)
+	want := []string{"villages", "players"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rowHashEntities() = %v, want %v", got, want)
+	}
+}
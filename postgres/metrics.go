@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rowsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dataupdater_db_rows_written_total",
+	Help: "Number of rows inserted, updated or deleted, by table and operation.",
+}, []string{"table", "operation"})
+
+// CountRowsWritten counts the rows written by a query the hook doesn't see as a write,
+// e.g. a raw INSERT ... SELECT run with Exec.
+func CountRowsWritten(table, operation string, rows int) {
+	rowsWritten.WithLabelValues(table, operation).Add(float64(rows))
+}
+
+// metricsQueryHook counts the rows written by the queries built with the ORM.
+type metricsQueryHook struct{}
+
+var _ pg.QueryHook = metricsQueryHook{}
+
+func (metricsQueryHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (metricsQueryHook) AfterQuery(_ context.Context, event *pg.QueryEvent) error {
+	if event.Err != nil || event.Result == nil {
+		return nil
+	}
+	cmd, ok := event.Query.(orm.QueryCommand)
+	if !ok {
+		return nil
+	}
+	op := cmd.Operation()
+	if op != orm.InsertOp && op != orm.UpdateOp && op != orm.DeleteOp {
+		return nil
+	}
+	rowsWritten.
+		WithLabelValues(tableName(cmd.Query()), strings.ToLower(string(op))).
+		Add(float64(event.Result.RowsAffected()))
+	return nil
+}
+
+// tableName returns the name of the table without the schema (e.g. players instead of ?SERVER.players).
+func tableName(q *orm.Query) string {
+	if q == nil || q.TableModel() == nil {
+		return "unknown"
+	}
+	name := string(q.TableModel().Table().SQLName)
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.Trim(name, `"`)
+}
@@ -0,0 +1,357 @@
+package postgres
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+)
+
+const (
+	PublicSchema = "public"
+	// LatestMigration migrates the schema to the newest version.
+	LatestMigration = -1
+)
+
+var ErrIrreversibleMigration = errors.New("the migration can't be reverted")
+
+// Schema is the schema a migration is applied to.
+type Schema struct {
+	Name string
+	// VersionCode is the version of the server, empty for the public schema.
+	VersionCode twmodel.VersionCode
+}
+
+// Migration changes a schema. The migrations are applied in the ascending order of their versions
+// and every migration is run in its own transaction, together with the update of the schema_migrations table.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *pg.Tx, s Schema) error
+	// Down is optional, the migration can't be reverted if it's nil.
+	Down func(tx *pg.Tx, s Schema) error
+}
+
+// sqlMigration returns a migration that executes the given statements.
+// ?0 in the statements is replaced with the schema name and ?1 with the version code.
+func sqlMigration(version int, name string, up []string, down []string) Migration {
+	m := Migration{
+		Version: version,
+		Name:    name,
+		Up:      execStatements(up),
+	}
+	if down != nil {
+		m.Down = execStatements(down)
+	}
+	return m
+}
+
+func execStatements(statements []string) func(tx *pg.Tx, s Schema) error {
+	return func(tx *pg.Tx, s Schema) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement, pg.Safe(s.Name), s.VersionCode); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// MigrationResult describes what has been done to the schema.
+type MigrationResult struct {
+	Schema      string        `json:"schema"`
+	FromVersion int           `json:"fromVersion"`
+	ToVersion   int           `json:"toVersion"`
+	Applied     []int         `json:"applied"`
+	Reverted    []int         `json:"reverted"`
+	Duration    time.Duration `json:"duration"`
+}
+
+func (r *MigrationResult) Changed() bool {
+	return len(r.Applied) > 0 || len(r.Reverted) > 0
+}
+
+// MigrationStatus is the version of the schema and the migrations that haven't been applied yet.
+type MigrationStatus struct {
+	Schema  string `json:"schema"`
+	Version int    `json:"version"`
+	Latest  int    `json:"latest"`
+	Pending []int  `json:"pending"`
+}
+
+// MigratePublic migrates the public schema to the target version (LatestMigration for the newest one).
+func MigratePublic(db *pg.DB, target int) (*MigrationResult, error) {
+	return migrate(db, Schema{Name: PublicSchema}, publicMigrations, target)
+}
+
+// MigrateServer migrates the schema of the server (it's created if it doesn't exist) to the target version.
+func MigrateServer(db *pg.DB, server *twmodel.Server, target int) (*MigrationResult, error) {
+	// the schema may be reverted, so PrepareServerSchema checks it again
+	preparedSchemas.Delete(server.Key)
+	return migrate(db, Schema{Name: server.Key, VersionCode: server.VersionCode}, serverMigrations, target)
+}
+
+// PublicMigrationStatus returns the migration status of the public schema.
+func PublicMigrationStatus(db *pg.DB) (*MigrationStatus, error) {
+	return migrationStatus(db, PublicSchema, publicMigrations)
+}
+
+// ServerMigrationStatus returns the migration status of the server schema.
+func ServerMigrationStatus(db *pg.DB, server *twmodel.Server) (*MigrationStatus, error) {
+	return migrationStatus(db, server.Key, serverMigrations)
+}
+
+// ServerMigrationProgress is reported after every server schema has been migrated.
+type ServerMigrationProgress struct {
+	Server string           `json:"server"`
+	Done   int              `json:"done"`
+	Total  int              `json:"total"`
+	Result *MigrationResult `json:"result,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// MigrateServers migrates the schemas of the given servers one by one and reports the progress after each of them.
+// It doesn't stop on the first error, the returned error says how many schemas couldn't be migrated.
+func MigrateServers(
+	ctx context.Context,
+	db *pg.DB,
+	servers []*twmodel.Server,
+	target int,
+	progress func(p ServerMigrationProgress),
+) error {
+	failed := 0
+	for i, server := range servers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := ServerMigrationProgress{
+			Server: server.Key,
+			Done:   i + 1,
+			Total:  len(servers),
+		}
+		result, err := MigrateServer(db, server, target)
+		if err != nil {
+			failed++
+			p.Error = err.Error()
+		}
+		p.Result = result
+		if progress != nil {
+			progress(p)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("couldn't migrate %d of %d server schemas", failed, len(servers))
+	}
+	return nil
+}
+
+func latestVersion(migrations []Migration) int {
+	latest := 0
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+func sortedMigrations(migrations []Migration) []Migration {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted
+}
+
+func migrationStatus(db *pg.DB, schema string, migrations []Migration) (*MigrationStatus, error) {
+	status := &MigrationStatus{
+		Schema:  schema,
+		Latest:  latestVersion(migrations),
+		Pending: []int{},
+	}
+	applied, err := appliedMigrations(db, schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range sortedMigrations(migrations) {
+		if applied[m.Version] {
+			status.Version = m.Version
+			continue
+		}
+		status.Pending = append(status.Pending, m.Version)
+	}
+	return status, nil
+}
+
+// appliedMigrations returns the versions of the migrations applied to the schema
+// (none if the schema or the schema_migrations table doesn't exist).
+func appliedMigrations(db pg.DBI, schema string) (map[int]bool, error) {
+	var exists bool
+	_, err := db.QueryOne(
+		pg.Scan(&exists),
+		"SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = ? AND table_name = 'schema_migrations')",
+		schema,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't check whether the schema_migrations table exists", schema)
+	}
+	applied := make(map[int]bool)
+	if !exists {
+		return applied, nil
+	}
+	var versions []int
+	if _, err := db.Query(pg.Scan(&versions), "SELECT version FROM ?.schema_migrations", pg.Ident(schema)); err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the applied migrations", schema)
+	}
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+func migrate(db *pg.DB, s Schema, migrations []Migration, target int) (*MigrationResult, error) {
+	start := time.Now()
+	latest := latestVersion(migrations)
+	if target == LatestMigration {
+		target = latest
+	}
+	if target < 0 || target > latest {
+		return nil, errors.Errorf("%s: invalid target version %d (the latest one is %d)", s.Name, target, latest)
+	}
+
+	if err := prepareMigrationsTable(db, s.Name); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	result := &MigrationResult{
+		Schema:   s.Name,
+		Applied:  []int{},
+		Reverted: []int{},
+	}
+	sorted := sortedMigrations(migrations)
+	for _, m := range sorted {
+		if applied[m.Version] {
+			result.FromVersion = m.Version
+		}
+	}
+
+	// up
+	for _, m := range sorted {
+		if m.Version > target || applied[m.Version] {
+			continue
+		}
+		ok, err := runMigration(db, s, m, true)
+		if err != nil {
+			return result, err
+		}
+		if ok {
+			result.Applied = append(result.Applied, m.Version)
+			log.WithField("schema", s.Name).Infof("%s: The migration %d (%s) has been applied", s.Name, m.Version, m.Name)
+		}
+	}
+	// down
+	for i := len(sorted) - 1; i >= 0; i-- {
+		m := sorted[i]
+		if m.Version <= target || !applied[m.Version] {
+			continue
+		}
+		if m.Down == nil {
+			return result, errors.Wrapf(ErrIrreversibleMigration, "%s: %d (%s)", s.Name, m.Version, m.Name)
+		}
+		ok, err := runMigration(db, s, m, false)
+		if err != nil {
+			return result, err
+		}
+		if ok {
+			result.Reverted = append(result.Reverted, m.Version)
+			log.WithField("schema", s.Name).Infof("%s: The migration %d (%s) has been reverted", s.Name, m.Version, m.Name)
+		}
+	}
+
+	result.ToVersion = target
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// lockSchema serializes the migrations of the schema run by many processes (e.g. several instances starting at once).
+func lockSchema(tx *pg.Tx, schema string) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "schema_migrations:"+schema); err != nil {
+		return errors.Wrapf(err, "%s: couldn't lock the schema", schema)
+	}
+	return nil
+}
+
+func prepareMigrationsTable(db *pg.DB, schema string) error {
+	return db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		if err := lockSchema(tx, schema); err != nil {
+			return err
+		}
+		statements := []string{
+			"CREATE SCHEMA IF NOT EXISTS ?0",
+			`CREATE TABLE IF NOT EXISTS ?0.schema_migrations (
+				version integer PRIMARY KEY,
+				name text NOT NULL,
+				applied_at timestamp with time zone NOT NULL DEFAULT now()
+			)`,
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement, pg.Ident(schema)); err != nil {
+				return errors.Wrapf(err, "%s: couldn't create the schema_migrations table", schema)
+			}
+		}
+		return nil
+	})
+}
+
+// runMigration applies (or reverts) the migration unless another process has done it in the meantime.
+func runMigration(db *pg.DB, s Schema, m Migration, up bool) (bool, error) {
+	ran := false
+	err := db.WithParam("SERVER", pg.Safe(s.Name)).RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		if err := lockSchema(tx, s.Name); err != nil {
+			return err
+		}
+		var applied bool
+		_, err := tx.QueryOne(
+			pg.Scan(&applied),
+			"SELECT EXISTS (SELECT 1 FROM ?.schema_migrations WHERE version = ?)",
+			pg.Ident(s.Name),
+			m.Version,
+		)
+		if err != nil {
+			return errors.Wrapf(err, "%s: couldn't check the migration %d", s.Name, m.Version)
+		}
+		if applied == up {
+			return nil
+		}
+
+		if up {
+			if err := m.Up(tx, s); err != nil {
+				return errors.Wrapf(err, "%s: couldn't apply the migration %d (%s)", s.Name, m.Version, m.Name)
+			}
+			_, err = tx.Exec(
+				"INSERT INTO ?.schema_migrations (version, name) VALUES (?, ?)",
+				pg.Ident(s.Name),
+				m.Version,
+				m.Name,
+			)
+		} else {
+			if err := m.Down(tx, s); err != nil {
+				return errors.Wrapf(err, "%s: couldn't revert the migration %d (%s)", s.Name, m.Version, m.Name)
+			}
+			_, err = tx.Exec("DELETE FROM ?.schema_migrations WHERE version = ?", pg.Ident(s.Name), m.Version)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s: couldn't update the schema_migrations table", s.Name)
+		}
+		ran = true
+		return nil
+	})
+	return ran, err
+}
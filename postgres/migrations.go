@@ -0,0 +1,171 @@
+package postgres
+
+// publicMigrations change the public schema. Never modify the applied migrations, add a new one instead.
+var publicMigrations = []Migration{
+	{
+		// the baseline is idempotent, so the dbs created before the migrations were introduced are migrated as well
+		Version: 1,
+		Name:    "init",
+		Up: execStatements([]string{
+			initPublicTables,
+			initPublicDefaultValues,
+			initPublicFunctions,
+		}),
+	},
+	sqlMigration(2, "failed_tasks", []string{
+		`CREATE TABLE IF NOT EXISTS failed_tasks (
+			"id" bigserial,
+			"task_name" text NOT NULL,
+			"server_key" text,
+			"version_code" text,
+			"url" text,
+			"timezone" text,
+			"args_bin" bytea,
+			"attempts" jsonb,
+			"created_at" timestamptz DEFAULT now(),
+			PRIMARY KEY ("id")
+		)`,
+	}, []string{
+		"DROP TABLE IF EXISTS failed_tasks",
+	}),
+	sqlMigration(3, "task_runs", []string{
+		`CREATE TABLE IF NOT EXISTS task_runs (
+			"id" bigserial,
+			"task_name" text NOT NULL,
+			"server_key" text,
+			"started_at" timestamptz NOT NULL,
+			"finished_at" timestamptz,
+			"outcome" text NOT NULL,
+			"error" text,
+			"players_upserted" bigint,
+			"tribes_upserted" bigint,
+			"villages_upserted" bigint,
+			"players_marked_deleted" bigint,
+			"tribes_marked_deleted" bigint,
+			"daily_player_stats_upserted" bigint,
+			"daily_tribe_stats_upserted" bigint,
+			"history_records_inserted" bigint,
+			"ennoblements_inserted" bigint,
+			"villages_deleted" bigint,
+			PRIMARY KEY ("id")
+		)`,
+		"CREATE INDEX IF NOT EXISTS task_runs_server_key_started_at_idx ON task_runs (server_key, started_at DESC)",
+		"CREATE INDEX IF NOT EXISTS task_runs_task_name_started_at_idx ON task_runs (task_name, started_at DESC)",
+	}, []string{
+		"DROP TABLE IF EXISTS task_runs",
+	}),
+	sqlMigration(4, "version_schedules", []string{
+		`CREATE TABLE IF NOT EXISTS version_schedules (
+			"version_code" text,
+			"update_server_data" text,
+			"update_history" text,
+			"update_stats" text,
+			"updated_at" timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY ("version_code")
+		)`,
+	}, []string{
+		"DROP TABLE IF EXISTS version_schedules",
+	}),
+	sqlMigration(5, "missed_runs", []string{
+		`CREATE TABLE IF NOT EXISTS missed_runs (
+			"id" bigserial,
+			"server_key" text NOT NULL,
+			"task_name" text NOT NULL,
+			"date" date NOT NULL,
+			"scheduled_at" timestamptz NOT NULL,
+			"caught_up" boolean NOT NULL,
+			"detected_at" timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY ("id"),
+			UNIQUE ("server_key", "task_name", "date")
+		)`,
+	}, []string{
+		"DROP TABLE IF EXISTS missed_runs",
+	}),
+	sqlMigration(6, "server_pauses", []string{
+		`CREATE TABLE IF NOT EXISTS server_pauses (
+			"server_key" text,
+			"reason" text,
+			"paused_at" timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY ("server_key")
+		)`,
+	}, []string{
+		"DROP TABLE IF EXISTS server_pauses",
+	}),
+	sqlMigration(7, "version_pauses", []string{
+		`CREATE TABLE IF NOT EXISTS version_pauses (
+			"version_code" text,
+			"reason" text,
+			"paused_at" timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY ("version_code")
+		)`,
+	}, []string{
+		"DROP TABLE IF EXISTS version_pauses",
+	}),
+	sqlMigration(8, "task_runs_row_changes", []string{
+		`ALTER TABLE task_runs
+			ADD COLUMN IF NOT EXISTS players_inserted bigint,
+			ADD COLUMN IF NOT EXISTS players_changed bigint,
+			ADD COLUMN IF NOT EXISTS players_unchanged bigint,
+			ADD COLUMN IF NOT EXISTS tribes_inserted bigint,
+			ADD COLUMN IF NOT EXISTS tribes_changed bigint,
+			ADD COLUMN IF NOT EXISTS tribes_unchanged bigint,
+			ADD COLUMN IF NOT EXISTS villages_inserted bigint,
+			ADD COLUMN IF NOT EXISTS villages_changed bigint,
+			ADD COLUMN IF NOT EXISTS villages_unchanged bigint`,
+	}, []string{
+		`ALTER TABLE task_runs
+			DROP COLUMN IF EXISTS players_inserted,
+			DROP COLUMN IF EXISTS players_changed,
+			DROP COLUMN IF EXISTS players_unchanged,
+			DROP COLUMN IF EXISTS tribes_inserted,
+			DROP COLUMN IF EXISTS tribes_changed,
+			DROP COLUMN IF EXISTS tribes_unchanged,
+			DROP COLUMN IF EXISTS villages_inserted,
+			DROP COLUMN IF EXISTS villages_changed,
+			DROP COLUMN IF EXISTS villages_unchanged`,
+	}),
+	sqlMigration(9, "task_runs_deleted_rows", []string{
+		`ALTER TABLE task_runs
+			ADD COLUMN IF NOT EXISTS history_records_deleted bigint,
+			ADD COLUMN IF NOT EXISTS daily_stats_deleted bigint,
+			ADD COLUMN IF NOT EXISTS server_stats_inserted bigint`,
+	}, []string{
+		`ALTER TABLE task_runs
+			DROP COLUMN IF EXISTS history_records_deleted,
+			DROP COLUMN IF EXISTS daily_stats_deleted,
+			DROP COLUMN IF EXISTS server_stats_inserted`,
+	}),
+}
+
+// serverMigrations change the server schemas. Never modify the applied migrations, add a new one instead.
+var serverMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "init",
+		Up: execStatements([]string{
+			initServerTables,
+			initServerFunctions,
+			initServerTriggers,
+			initServerDefaultValues,
+		}),
+	},
+	sqlMigration(2, "row_hashes", []string{
+		`CREATE TABLE IF NOT EXISTS ?0.row_hashes (
+			"entity" text,
+			"id" bigint,
+			"hash" bigint NOT NULL,
+			PRIMARY KEY ("entity", "id")
+		)`,
+	}, []string{
+		"DROP TABLE IF EXISTS ?0.row_hashes",
+	}),
+	sqlMigration(3, "row_hashes_invalidation", []string{
+		rowHashFunctions,
+		rowHashTriggers,
+	}, []string{
+		"DROP TRIGGER IF EXISTS ?0_delete_row_hash ON ?0.tribes",
+		"DROP TRIGGER IF EXISTS ?0_delete_row_hash ON ?0.players",
+		"DROP TRIGGER IF EXISTS ?0_delete_row_hash ON ?0.villages",
+		"DROP FUNCTION IF EXISTS ?0.delete_row_hash()",
+	}),
+}
@@ -1,34 +1,67 @@
 package postgres
 
 import (
-	"fmt"
+	"context"
 	"github.com/Kichiyaki/go-pg-logrus-query-logger/v10"
-	"github.com/Kichiyaki/goutil/envutil"
 	"github.com/go-pg/pg/v10"
-	"github.com/go-pg/pg/v10/orm"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"sync"
+
+	"github.com/tribalwarshelp/dataupdater/catalog"
 )
 
 var log = logrus.WithField("package", "pkg/postgres")
 
 type Config struct {
+	User     string
+	Password string
+	Database string
+	// Addr is the address of the db in the form host:port.
+	Addr     string
+	PoolSize int
+	// LogQueries enables logging of all executed queries.
+	LogQueries           bool
 	SkipDBInitialization bool
+	// SeedFile is the JSON/YAML file with the versions imported on the db initialization if the versions table is empty (see catalog.Seed).
+	// The built-in versions are imported if it's empty.
+	SeedFile string
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg.Addr == "" {
+		return errors.New("cfg.Addr is required")
+	}
+	if cfg.Database == "" {
+		return errors.New("cfg.Database is required")
+	}
+	if cfg.PoolSize < 0 {
+		return errors.New("cfg.PoolSize must be greater than or equal to 0")
+	}
+	return nil
 }
 
+// Connect connects to the db and prepares it. A nil cfg means the defaults of pg.Options (localhost:5432, user postgres).
 func Connect(cfg *Config) (*pg.DB, error) {
-	db := pg.Connect(prepareOptions())
+	if cfg == nil {
+		cfg = &Config{}
+	} else if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	db := pg.Connect(prepareOptions(cfg))
+	db.AddQueryHook(metricsQueryHook{})
+	db.AddQueryHook(tracingQueryHook{})
 
-	if envutil.GetenvBool("LOG_DB_QUERIES") {
+	if cfg.LogQueries {
 		db.AddQueryHook(querylogger.Logger{
 			Log:            log,
 			MaxQueryLength: 2000,
 		})
 	}
 
-	if cfg == nil || !cfg.SkipDBInitialization {
-		if err := prepareDB(db); err != nil {
+	if !cfg.SkipDBInitialization {
+		if err := prepareDB(db, cfg.SeedFile); err != nil {
 			return nil, err
 		}
 	}
@@ -36,94 +69,91 @@ func Connect(cfg *Config) (*pg.DB, error) {
 	return db, nil
 }
 
-func prepareOptions() *pg.Options {
+func prepareOptions(cfg *Config) *pg.Options {
 	return &pg.Options{
-		User:     envutil.GetenvString("DB_USER"),
-		Password: envutil.GetenvString("DB_PASSWORD"),
-		Database: envutil.GetenvString("DB_NAME"),
-		Addr:     envutil.GetenvString("DB_HOST") + ":" + envutil.GetenvString("DB_PORT"),
-		PoolSize: envutil.GetenvInt("DB_POOL_SIZE"),
+		User:     cfg.User,
+		Password: cfg.Password,
+		Database: cfg.Database,
+		Addr:     cfg.Addr,
+		PoolSize: cfg.PoolSize,
 	}
 }
 
-func prepareDB(db *pg.DB) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "couldn't start a transaction")
+func prepareDB(db *pg.DB, seedFile string) error {
+	if _, err := MigratePublic(db, LatestMigration); err != nil {
+		return errors.Wrap(err, "couldn't migrate the public schema")
 	}
-	defer func() {
-		if err := tx.Close(); err != nil {
-			log.Warn(errors.Wrap(err, "prepareDB: couldn't rollback the transaction"))
-		}
-	}()
 
-	dbModels := []interface{}{
-		(*twmodel.SpecialServer)(nil),
-		(*twmodel.Server)(nil),
-		(*twmodel.Version)(nil),
-		(*twmodel.PlayerToServer)(nil),
-		(*twmodel.PlayerNameChange)(nil),
+	return importSeed(db, seedFile)
+}
+
+// importSeed imports the versions from the seed only into an empty versions table,
+// so the versions added, modified or removed later (twctl, the admin API) aren't overwritten on every startup.
+// Use twctl import-seed to import the seed into a non-empty table.
+func importSeed(db *pg.DB, seedFile string) error {
+	count, err := db.Model(&twmodel.Version{}).Count()
+	if err != nil {
+		return errors.Wrap(err, "couldn't count the versions")
+	}
+	if count > 0 {
+		log.WithField("numberOfVersions", count).Debug("prepareDB: The versions table isn't empty, the seed won't be imported")
+		return nil
 	}
 
-	for _, model := range dbModels {
-		err := tx.Model(model).CreateTable(&orm.CreateTableOptions{
-			IfNotExists: true,
-		})
+	seed, err := loadSeed(seedFile)
+	if err != nil {
+		return err
+	}
+	err = db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		result, err := catalog.Import(context.Background(), tx, seed, catalog.ImportOptions{})
 		if err != nil {
-			return errors.Wrap(err, "couldn't create the table")
+			return err
 		}
+		log.
+			WithField("versionsInserted", result.VersionsInserted).
+			WithField("specialServersInserted", result.SpecialServersInserted).
+			Info("prepareDB: The versions have been imported")
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "couldn't import the versions")
 	}
+	return nil
+}
 
-	type statementWithParams struct {
-		statement string
-		params    []interface{}
-	}
-
-	for _, s := range []statementWithParams{
-		{
-			statement: pgDefaultValues,
-		},
-		{
-			statement: allVersionsPGInsertStatements,
-		},
-		{
-			statement: allSpecialServersPGInsertStatements,
-		},
-		{
-			statement: pgDropSchemaFunctions,
-			params:    []interface{}{pg.Safe("public")},
-		},
-		{
-			statement: pgFunctions,
-		},
-	} {
-		if _, err := tx.Exec(s.statement, s.params...); err != nil {
-			return errors.Wrap(err, "couldn't prepare the db")
-		}
+func loadSeed(seedFile string) (*catalog.Seed, error) {
+	if seedFile == "" {
+		return catalog.DefaultSeed()
 	}
-
-	if err := tx.Commit(); err != nil {
-		return errors.Wrap(err, "couldn't commit changes")
+	seed, err := catalog.LoadSeedFile(seedFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't load the seed")
 	}
+	return seed, nil
+}
 
-	var servers []*twmodel.Server
-	if err := db.Model(&servers).Select(); err != nil {
-		return errors.Wrap(err, "couldn't load servers")
-	}
+// preparedSchemas contains the keys of the servers whose schema this process has found at the latest version.
+var preparedSchemas sync.Map
 
-	for _, server := range servers {
-		if err := createServerSchema(db, server, true); err != nil {
-			return err
+// PrepareServerSchema creates the schema of the server if it doesn't exist and applies its pending migrations.
+// The schema is checked once per process, so it can be called before every task that touches the schema.
+func PrepareServerSchema(db *pg.DB, server *twmodel.Server) error {
+	if _, ok := preparedSchemas.Load(server.Key); ok {
+		return nil
+	}
+	status, err := ServerMigrationStatus(db, server)
+	if err != nil {
+		return err
+	}
+	if len(status.Pending) > 0 {
+		if _, err := MigrateServer(db, server, LatestMigration); err != nil {
+			return errors.Wrapf(err, "couldn't prepare the schema for the server '%s'", server.Key)
 		}
 	}
-
+	preparedSchemas.Store(server.Key, true)
 	return nil
 }
 
-func CreateServerSchema(db *pg.DB, server *twmodel.Server) error {
-	return createServerSchema(db, server, false)
-}
-
 func SchemaExists(db pg.DBI, schemaName string) bool {
 	exists, err := db.
 		Model().
@@ -135,64 +165,3 @@ func SchemaExists(db pg.DBI, schemaName string) bool {
 	}
 	return exists
 }
-
-func createServerSchema(db *pg.DB, server *twmodel.Server, init bool) error {
-	if !init && SchemaExists(db, server.Key) {
-		return nil
-	}
-
-	tx, err := db.WithParam("SERVER", pg.Safe(server.Key)).Begin()
-	if err != nil {
-		return errors.Wrap(err, "couldn't start a transaction")
-	}
-	defer func() {
-		if err := tx.Close(); err != nil {
-			log.Warn(errors.Wrap(err, "createServerSchema: Couldn't rollback the transaction"))
-		}
-	}()
-
-	if _, err := tx.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", server.Key)); err != nil {
-		return errors.Wrap(err, "couldn't create for the server '"+server.Key+"'")
-	}
-
-	dbModels := []interface{}{
-		(*twmodel.Tribe)(nil),
-		(*twmodel.Player)(nil),
-		(*twmodel.Village)(nil),
-		(*twmodel.Ennoblement)(nil),
-		(*twmodel.ServerStats)(nil),
-		(*twmodel.TribeHistory)(nil),
-		(*twmodel.PlayerHistory)(nil),
-		(*twmodel.TribeChange)(nil),
-		(*twmodel.DailyPlayerStats)(nil),
-		(*twmodel.DailyTribeStats)(nil),
-	}
-
-	for _, model := range dbModels {
-		err := tx.Model(model).CreateTable(&orm.CreateTableOptions{
-			IfNotExists: true,
-		})
-		if err != nil {
-			return err
-		}
-	}
-
-	statements := []string{
-		serverPGFunctions,
-		serverPGTriggers,
-		serverPGDefaultValues,
-	}
-	if init {
-		statements = append([]string{pgDropSchemaFunctions}, statements...)
-	}
-	for _, statement := range statements {
-		if _, err := tx.Exec(statement, pg.Safe(server.Key), server.VersionCode); err != nil {
-			return errors.Wrap(err, "couldn't initialize the schema")
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return errors.Wrap(err, "couldn't commit changes")
-	}
-	return nil
-}
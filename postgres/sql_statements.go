@@ -1,64 +1,254 @@
 package postgres
 
+// The statements of the first public and server migrations (see publicMigrations and serverMigrations).
+// They're frozen - never modify them, change the schemas with a new migration instead.
 const (
-	allSpecialServersPGInsertStatements = `
-		INSERT INTO public.special_servers (version_code, key) VALUES ('pl', 'pls1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('en', 'ens1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('uk', 'uks1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('uk', 'master') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('it', 'its1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('hu', 'hus1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('fr', 'frs1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('us', 'uss1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('nl', 'nls1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('es', 'ess1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('ro', 'ros1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('gr', 'grs1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('br', 'brs1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('tr', 'trs1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('cs', 'css1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('de', 'des1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('ru', 'rus1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('ch', 'chs1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('pt', 'pts1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-		INSERT INTO public.special_servers (version_code, key) VALUES ('sk', 'sks1') ON CONFLICT ON CONSTRAINT special_servers_version_code_key_key DO NOTHING;
-	`
-	allVersionsPGInsertStatements = `
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('pl', 'Polska', 'plemiona.pl', 'Europe/Warsaw') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('uk', 'United Kingdom', 'tribalwars.co.uk', 'Europe/London') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('hu', 'Hungary', 'klanhaboru.hu', 'Europe/Budapest') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('it', 'Italy', 'tribals.it', 'Europe/Rome') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('fr', 'France', 'guerretribale.fr', 'Europe/Paris') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('us', 'United States', 'tribalwars.us', 'America/New_York') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('nl', 'The Netherlands', 'tribalwars.nl', 'Europe/Amsterdam') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('es', 'Spain', 'guerrastribales.es', 'Europe/Madrid') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('ro', 'Romania', 'triburile.ro', 'Europe/Bucharest') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('gr', 'Greece', 'fyletikesmaxes.gr', 'Europe/Athens') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('br', 'Brazil', 'tribalwars.com.br', 'America/Sao_Paulo') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('tr', 'Turkey', 'klanlar.org', 'Europe/Istanbul') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('cs', 'Czech Republic', 'divokekmeny.cz', 'Europe/Prague') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('ru', 'Russia', 'voyna-plemyon.ru', 'Europe/Moscow') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('ch', 'Switerzland', 'staemme.ch', 'Europe/Zurich') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('pt', 'Portugal', 'tribalwars.com.pt', 'Europe/Lisbon') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('en', 'International', 'tribalwars.net', 'Europe/London') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('de', 'Germany', 'die-staemme.de', 'Europe/Berlin') ON CONFLICT (code) DO NOTHING;
-		INSERT INTO public.versions (code, name, host, timezone) VALUES ('sk', 'Slovakia', 'divoke-kmene.sk', 'Europe/Bratislava') ON CONFLICT (code) DO NOTHING;
-	`
+	initPublicTables = `
+		CREATE TABLE IF NOT EXISTS special_servers (
+			"id" bigserial,
+			"version_code" text,
+			"key" text,
+			PRIMARY KEY ("id"),
+			UNIQUE ("version_code", "key")
+		);
 
-	pgDropSchemaFunctions = `
-		DO
-		$do$
-		DECLARE
-				funcTableRecord RECORD;
-		BEGIN
-			FOR funcTableRecord IN SELECT routine_schema, routine_name from information_schema.routines where routine_type = 'FUNCTION' AND specific_schema = '?0' LOOP
-				EXECUTE 'DROP FUNCTION IF EXISTS ' || funcTableRecord.routine_schema || '.' || funcTableRecord.routine_name || ' CASCADE;';
-			END LOOP;
-		END
-		$do$;
+		CREATE TABLE IF NOT EXISTS servers (
+			"key" text UNIQUE,
+			"status" text,
+			"number_of_players" bigint,
+			"number_of_tribes" bigint,
+			"number_of_villages" bigint,
+			"config" jsonb,
+			"building_config" jsonb,
+			"unit_config" jsonb,
+			"version_code" text,
+			"data_updated_at" timestamptz DEFAULT now(),
+			"history_updated_at" timestamptz DEFAULT now(),
+			"stats_updated_at" timestamptz DEFAULT now(),
+			PRIMARY KEY ("key"),
+			UNIQUE ("key")
+		);
+
+		CREATE TABLE IF NOT EXISTS versions (
+			"code" text,
+			"name" text UNIQUE,
+			"host" text,
+			"timezone" text,
+			PRIMARY KEY ("code"),
+			UNIQUE ("name")
+		);
+
+		CREATE TABLE IF NOT EXISTS player_to_servers (
+			"id" bigserial,
+			"server_key" text,
+			"player_id" bigint,
+			PRIMARY KEY ("id"),
+			UNIQUE ("server_key", "player_id")
+		);
+
+		CREATE TABLE IF NOT EXISTS player_name_changes (
+			"id" bigserial,
+			"version_code" text,
+			"player_id" bigint,
+			"old_name" text,
+			"new_name" text,
+			"change_date" DATE DEFAULT CURRENT_DATE,
+			PRIMARY KEY ("id"),
+			UNIQUE ("version_code", "player_id", "old_name", "new_name", "change_date")
+		);
 	`
+	initServerTables = `
+		CREATE TABLE IF NOT EXISTS ?0.tribes (
+			"id" bigint,
+			"name" text,
+			"tag" text,
+			"exists" boolean,
+			"total_members" bigint,
+			"total_villages" bigint,
+			"points" bigint,
+			"all_points" bigint,
+			"rank" bigint,
+			"dominance" double precision,
+			"best_rank" bigint,
+			"best_rank_at" timestamptz DEFAULT now(),
+			"most_points" bigint,
+			"most_points_at" timestamptz DEFAULT now(),
+			"most_villages" bigint,
+			"most_villages_at" timestamptz DEFAULT now(),
+			"created_at" timestamptz DEFAULT now(),
+			"deleted_at" timestamptz,
+			"rank_att" bigint,
+			"score_att" bigint,
+			"rank_def" bigint,
+			"score_def" bigint,
+			"rank_sup" bigint,
+			"score_sup" bigint,
+			"rank_total" bigint,
+			"score_total" bigint,
+			PRIMARY KEY ("id")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.players (
+			"id" bigint,
+			"name" text,
+			"exists" boolean,
+			"total_villages" bigint,
+			"points" bigint,
+			"rank" bigint,
+			"tribe_id" bigint,
+			"daily_growth" bigint,
+			"best_rank" bigint,
+			"best_rank_at" timestamptz DEFAULT now(),
+			"most_points" bigint,
+			"most_points_at" timestamptz DEFAULT now(),
+			"most_villages" bigint,
+			"most_villages_at" timestamptz DEFAULT now(),
+			"joined_at" timestamptz DEFAULT now(),
+			"last_activity_at" timestamptz DEFAULT now(),
+			"deleted_at" timestamptz,
+			"rank_att" bigint,
+			"score_att" bigint,
+			"rank_def" bigint,
+			"score_def" bigint,
+			"rank_sup" bigint,
+			"score_sup" bigint,
+			"rank_total" bigint,
+			"score_total" bigint,
+			PRIMARY KEY ("id")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.villages (
+			"id" bigint,
+			"name" text,
+			"points" bigint,
+			"x" bigint,
+			"y" bigint,
+			"bonus" bigint,
+			"player_id" bigint,
+			PRIMARY KEY ("id")
+		);
 
-	pgFunctions = `
+		CREATE TABLE IF NOT EXISTS ?0.ennoblements (
+			"id" bigserial,
+			"village_id" bigint,
+			"new_owner_id" bigint,
+			"new_owner_tribe_id" bigint,
+			"old_owner_id" bigint,
+			"old_owner_tribe_id" bigint,
+			"ennobled_at" timestamptz DEFAULT now(),
+			PRIMARY KEY ("id")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.stats (
+			"id" bigserial,
+			"active_players" bigint,
+			"inactive_players" bigint,
+			"players" bigint,
+			"active_tribes" bigint,
+			"inactive_tribes" bigint,
+			"tribes" bigint,
+			"villages" bigint,
+			"bonus_villages" bigint,
+			"barbarian_villages" bigint,
+			"player_villages" bigint,
+			"create_date" DATE DEFAULT now(),
+			PRIMARY KEY ("id"),
+			UNIQUE ("create_date")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.tribe_history (
+			"rank_att" bigint,
+			"score_att" bigint,
+			"rank_def" bigint,
+			"score_def" bigint,
+			"rank_sup" bigint,
+			"score_sup" bigint,
+			"rank_total" bigint,
+			"score_total" bigint,
+			"id" bigserial,
+			"tribe_id" bigint,
+			"total_members" bigint,
+			"total_villages" bigint,
+			"points" bigint,
+			"all_points" bigint,
+			"rank" bigint,
+			"dominance" double precision,
+			"create_date" DATE DEFAULT now(),
+			PRIMARY KEY ("id"),
+			UNIQUE ("tribe_id", "create_date")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.player_history (
+			"rank_att" bigint,
+			"score_att" bigint,
+			"rank_def" bigint,
+			"score_def" bigint,
+			"rank_sup" bigint,
+			"score_sup" bigint,
+			"rank_total" bigint,
+			"score_total" bigint,
+			"id" bigserial,
+			"player_id" bigint,
+			"total_villages" bigint,
+			"points" bigint,
+			"rank" bigint,
+			"tribe_id" bigint,
+			"create_date" DATE DEFAULT CURRENT_DATE,
+			PRIMARY KEY ("id"),
+			UNIQUE ("player_id", "create_date")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.tribe_changes (
+			"id" bigserial,
+			"player_id" bigint,
+			"old_tribe_id" bigint,
+			"new_tribe_id" bigint,
+			"created_at" timestamptz DEFAULT now(),
+			PRIMARY KEY ("id")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.daily_player_stats (
+			"id" bigserial,
+			"player_id" bigint,
+			"villages" bigint,
+			"points" bigint,
+			"rank" bigint,
+			"create_date" DATE DEFAULT CURRENT_DATE,
+			"rank_att" bigint,
+			"score_att" bigint,
+			"rank_def" bigint,
+			"score_def" bigint,
+			"rank_sup" bigint,
+			"score_sup" bigint,
+			"rank_total" bigint,
+			"score_total" bigint,
+			PRIMARY KEY ("id"),
+			UNIQUE ("player_id", "create_date")
+		);
+
+		CREATE TABLE IF NOT EXISTS ?0.daily_tribe_stats (
+			"id" bigserial,
+			"tribe_id" bigint,
+			"members" bigint,
+			"villages" bigint,
+			"points" bigint,
+			"all_points" bigint,
+			"rank" bigint,
+			"dominance" double precision,
+			"create_date" DATE DEFAULT CURRENT_DATE,
+			"rank_att" bigint,
+			"score_att" bigint,
+			"rank_def" bigint,
+			"score_def" bigint,
+			"rank_sup" bigint,
+			"score_sup" bigint,
+			"rank_total" bigint,
+			"score_total" bigint,
+			PRIMARY KEY ("id"),
+			UNIQUE ("tribe_id", "create_date")
+		);
+	`
+	initPublicFunctions = `
 		CREATE OR REPLACE FUNCTION update_most_points_most_villages_best_rank_last_activity()
 			RETURNS trigger AS
 		$BODY$
@@ -104,7 +294,7 @@ const (
 		LANGUAGE plpgsql;
 	`
 
-	serverPGFunctions = `
+	initServerFunctions = `
 		CREATE OR REPLACE FUNCTION ?0.log_tribe_change()
 			RETURNS trigger AS
 		$BODY$
@@ -169,37 +359,44 @@ const (
 		$BODY$
 		LANGUAGE plpgsql VOLATILE;
 	`
-	serverPGTriggers = `
+	// the triggers are dropped first, so the statements can be re-run on the existing schemas
+	initServerTriggers = `
+		DROP TRIGGER IF EXISTS ?0_log_tribe_change_on_insert ON ?0.players;
 		CREATE TRIGGER ?0_log_tribe_change_on_insert
 			AFTER INSERT
 			ON ?0.players
 			FOR EACH ROW
 			EXECUTE PROCEDURE ?0.log_tribe_change();
 	
+		DROP TRIGGER IF EXISTS ?0_log_tribe_change_on_update ON ?0.players;
 		CREATE TRIGGER ?0_log_tribe_change_on_update
 			AFTER UPDATE
 			ON ?0.players
 			FOR EACH ROW
 			EXECUTE PROCEDURE ?0.log_tribe_change();
 
+		DROP TRIGGER IF EXISTS ?0_name_change ON ?0.players;
 		CREATE TRIGGER ?0_name_change
 			AFTER UPDATE
 			ON ?0.players
 			FOR EACH ROW
 			EXECUTE PROCEDURE ?0.log_player_name_change();
 
+		DROP TRIGGER IF EXISTS ?0_update_ennoblement_old_and_new_owner_tribe_id ON ?0.ennoblements;
 		CREATE TRIGGER ?0_update_ennoblement_old_and_new_owner_tribe_id
 			BEFORE INSERT
 			ON ?0.ennoblements
 			FOR EACH ROW
 			EXECUTE PROCEDURE ?0.get_old_and_new_owner_tribe_id();
 
+		DROP TRIGGER IF EXISTS ?0_update_most_points_most_villages_best_rank_last_activity ON ?0.players;
 		CREATE TRIGGER ?0_update_most_points_most_villages_best_rank_last_activity
 			BEFORE INSERT OR UPDATE
 			ON ?0.players
 			FOR EACH ROW
 			EXECUTE PROCEDURE update_most_points_most_villages_best_rank_last_activity();
 
+		DROP TRIGGER IF EXISTS ?0_update_most_points_most_villages_best_rank_last_activity ON ?0.tribes;
 		CREATE TRIGGER ?0_update_most_points_most_villages_best_rank_last_activity
 			BEFORE INSERT OR UPDATE
 			ON ?0.tribes
@@ -207,7 +404,47 @@ const (
 			EXECUTE PROCEDURE update_most_points_most_villages_best_rank_last_activity();
 	`
 
-	serverPGDefaultValues = `
+	// the row hashes cover only the columns saved by the data update, so the hash of a row changed or deleted
+	// by anything else (e.g. marking the players as deleted, a manual query) is deleted
+	// and the next data update saves the row again (see the server migration row_hashes_invalidation)
+	rowHashFunctions = `
+		CREATE OR REPLACE FUNCTION ?0.delete_row_hash()
+			RETURNS trigger AS
+		$BODY$
+		BEGIN
+			IF TG_OP = 'UPDATE' AND OLD IS NOT DISTINCT FROM NEW THEN
+				RETURN NULL;
+			END IF;
+			DELETE FROM ?0.row_hashes WHERE entity = TG_TABLE_NAME AND id = OLD.id;
+			RETURN NULL;
+		END;
+		$BODY$
+		LANGUAGE plpgsql VOLATILE;
+	`
+	rowHashTriggers = `
+		DROP TRIGGER IF EXISTS ?0_delete_row_hash ON ?0.tribes;
+		CREATE TRIGGER ?0_delete_row_hash
+			AFTER UPDATE OR DELETE
+			ON ?0.tribes
+			FOR EACH ROW
+			EXECUTE PROCEDURE ?0.delete_row_hash();
+
+		DROP TRIGGER IF EXISTS ?0_delete_row_hash ON ?0.players;
+		CREATE TRIGGER ?0_delete_row_hash
+			AFTER UPDATE OR DELETE
+			ON ?0.players
+			FOR EACH ROW
+			EXECUTE PROCEDURE ?0.delete_row_hash();
+
+		DROP TRIGGER IF EXISTS ?0_delete_row_hash ON ?0.villages;
+		CREATE TRIGGER ?0_delete_row_hash
+			AFTER UPDATE OR DELETE
+			ON ?0.villages
+			FOR EACH ROW
+			EXECUTE PROCEDURE ?0.delete_row_hash();
+	`
+
+	initServerDefaultValues = `
 		ALTER TABLE ?0.daily_player_stats ALTER COLUMN create_date set default CURRENT_DATE;
 		ALTER TABLE ?0.daily_tribe_stats ALTER COLUMN create_date set default CURRENT_DATE;
 		ALTER TABLE ?0.player_history ALTER COLUMN create_date set default CURRENT_DATE;
@@ -215,7 +452,7 @@ const (
 		ALTER TABLE ?0.stats ALTER COLUMN create_date set default CURRENT_DATE;
 	`
 
-	pgDefaultValues = `
+	initPublicDefaultValues = `
 		ALTER TABLE player_name_changes ALTER COLUMN change_date set default CURRENT_DATE;
 	`
 )
@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxTracedQueryLength = 2000
+
+var tracer = otel.Tracer("github.com/tribalwarshelp/dataupdater/postgres")
+
+// tracingQueryHook creates a span for every query executed within a traced context.
+// The queries executed outside of a trace (e.g. on startup) are skipped.
+type tracingQueryHook struct{}
+
+var _ pg.QueryHook = tracingQueryHook{}
+
+func (tracingQueryHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+
+	name := "postgres"
+	attrs := []attribute.KeyValue{semconv.DBSystemPostgreSQL}
+	if cmd, ok := event.Query.(orm.QueryCommand); ok {
+		op := string(cmd.Operation())
+		table := tableName(cmd.Query())
+		name = "postgres " + op + " " + table
+		attrs = append(attrs, semconv.DBOperationKey.String(op), semconv.DBSQLTableKey.String(table))
+	}
+	if query, err := event.UnformattedQuery(); err == nil {
+		stmt := string(query)
+		if len(stmt) > maxTracedQueryLength {
+			stmt = stmt[:maxTracedQueryLength]
+		}
+		attrs = append(attrs, semconv.DBStatementKey.String(stmt))
+	}
+
+	ctx, _ = tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx, nil
+}
+
+func (tracingQueryHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return nil
+	}
+	if event.Err != nil && event.Err != pg.ErrNoRows {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, event.Err.Error())
+	} else if event.Result != nil {
+		span.SetAttributes(attribute.Int("db.rows_affected", event.Result.RowsAffected()))
+	}
+	span.End()
+	return nil
+}
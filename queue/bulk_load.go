@@ -0,0 +1,324 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/postgres"
+)
+
+var odColumns = []string{
+	"rank_att",
+	"score_att",
+	"rank_def",
+	"score_def",
+	"rank_sup",
+	"score_sup",
+	"rank_total",
+	"score_total",
+}
+
+// copyRow encodes a row in the CSV format of COPY, the unquoted empty fields are NULLs.
+type copyRow struct {
+	b      []byte
+	fields int
+}
+
+func (r *copyRow) reset() {
+	r.b = r.b[:0]
+	r.fields = 0
+}
+
+func (r *copyRow) next() {
+	if r.fields > 0 {
+		r.b = append(r.b, ',')
+	}
+	r.fields++
+}
+
+func (r *copyRow) null() {
+	r.next()
+}
+
+func (r *copyRow) int(v int) {
+	r.next()
+	r.b = strconv.AppendInt(r.b, int64(v), 10)
+}
+
+func (r *copyRow) int64(v int64) {
+	r.next()
+	r.b = strconv.AppendInt(r.b, v, 10)
+}
+
+func (r *copyRow) float(v float64) {
+	r.next()
+	r.b = strconv.AppendFloat(r.b, v, 'f', -1, 64)
+}
+
+// string writes the empty string as NULL, just like go-pg does with the string fields without use_zero.
+func (r *copyRow) string(v string) {
+	if v == "" {
+		r.null()
+		return
+	}
+	r.next()
+	r.b = append(r.b, '"')
+	r.b = append(r.b, strings.ReplaceAll(v, `"`, `""`)...)
+	r.b = append(r.b, '"')
+}
+
+func (r *copyRow) bool(v *bool) {
+	if v == nil {
+		r.null()
+		return
+	}
+	r.next()
+	r.b = strconv.AppendBool(r.b, *v)
+}
+
+func (r *copyRow) od(od twmodel.OpponentsDefeated) {
+	r.int(od.RankAtt)
+	r.int(od.ScoreAtt)
+	r.int(od.RankDef)
+	r.int(od.ScoreDef)
+	r.int(od.RankSup)
+	r.int(od.ScoreSup)
+	r.int(od.RankTotal)
+	r.int(od.ScoreTotal)
+}
+
+// SaveServerData upserts the tribes, players and villages the same way as the server data update
+// (all of them, i.e. without comparing the row hashes, and without the stats, the deleted players/tribes and the server config).
+// The threshold has the same meaning as Config.BulkLoadThreshold.
+// It's meant for benchmarking the upsert methods.
+func SaveServerData(
+	ctx context.Context,
+	db *pg.DB,
+	server *twmodel.Server,
+	tribes []*twmodel.Tribe,
+	players []*twmodel.Player,
+	villages []*twmodel.Village,
+	threshold int,
+) error {
+	w := &workerUpdateServerData{
+		db:                db.WithParam("SERVER", pg.Safe(server.Key)),
+		server:            server,
+		bulkLoadThreshold: threshold,
+	}
+	return w.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if len(tribes) > 0 {
+			if err := w.upsertTribes(tx, tribes); err != nil {
+				return errors.Wrap(err, "couldn't insert tribes")
+			}
+		}
+		if len(players) > 0 {
+			if err := w.upsertPlayers(tx, players); err != nil {
+				return errors.Wrap(err, "couldn't insert players")
+			}
+		}
+		if len(villages) > 0 {
+			if err := w.upsertVillages(tx, villages); err != nil {
+				return errors.Wrap(err, "couldn't insert villages")
+			}
+		}
+		return nil
+	})
+}
+
+// bulkUpsert upserts the rows of the server table by copying them into a temp table
+// and merging it into the server table with one INSERT ... SELECT ... ON CONFLICT.
+// The triggers fire the same way as with the multi-row INSERT.
+type bulkUpsert struct {
+	table   string
+	columns []string
+	// conflict is the conflict target of ON CONFLICT, (id) by default
+	conflict string
+	// set contains the SET clauses of ON CONFLICT DO UPDATE
+	set      []string
+	rows     int
+	writeRow func(r *copyRow, i int)
+	// id returns the ID of the row (see detectChanges)
+	id func(i int) int
+}
+
+func (u bulkUpsert) exec(tx *pg.Tx) error {
+	tmpTable := "bulk_" + u.table
+	columns := quoteColumns(u.columns)
+
+	// the temp table is dropped at the end of the transaction, so it doesn't outlive the pooled connection
+	if _, err := tx.Exec(
+		"CREATE TEMP TABLE ? ON COMMIT DROP AS SELECT "+columns+" FROM ?SERVER.? WITH NO DATA",
+		pg.Ident(tmpTable),
+		pg.Ident(u.table),
+	); err != nil {
+		return errors.Wrapf(err, "couldn't create the temp table %s", tmpTable)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriterSize(pw, 64*1024)
+		r := &copyRow{}
+		for i := 0; i < u.rows; i++ {
+			r.reset()
+			u.writeRow(r, i)
+			r.b = append(r.b, '\n')
+			if _, err := w.Write(r.b); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+	_, err := tx.CopyFrom(pr, "COPY ? ("+columns+") FROM STDIN WITH (FORMAT csv)", pg.Ident(tmpTable))
+	// unblocks the writer if COPY has failed before reading all rows
+	_ = pr.Close()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't copy the rows to %s", tmpTable)
+	}
+
+	conflict := u.conflict
+	if conflict == "" {
+		conflict = "(id)"
+	}
+	res, err := tx.Exec(
+		"INSERT INTO ?SERVER.? ("+columns+") SELECT "+columns+" FROM ? ON CONFLICT "+conflict+" DO UPDATE SET "+strings.Join(u.set, ", "),
+		pg.Ident(u.table),
+		pg.Ident(tmpTable),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't merge %s into %s", tmpTable, u.table)
+	}
+	postgres.CountRowsWritten(u.table, "insert", res.RowsAffected())
+	return nil
+}
+
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdent(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func quoteIdent(name string) string {
+	return `"` + name + `"`
+}
+
+// excludedSet returns the SET clauses updating the given columns with the values proposed for insertion.
+func excludedSet(columns ...string) []string {
+	set := make([]string, len(columns))
+	for i, column := range columns {
+		set[i] = quoteIdent(column) + " = EXCLUDED." + quoteIdent(column)
+	}
+	return set
+}
+
+func bulkUpsertTribes(tribes []*twmodel.Tribe) bulkUpsert {
+	columns := append([]string{
+		"id",
+		"name",
+		"tag",
+		"total_members",
+		"total_villages",
+		"points",
+		"all_points",
+		"rank",
+		"exists",
+		"dominance",
+	}, odColumns...)
+	return bulkUpsert{
+		table:   "tribes",
+		columns: columns,
+		set:     append(excludedSet(columns[1:]...), "deleted_at = null"),
+		rows:    len(tribes),
+		writeRow: func(r *copyRow, i int) {
+			tribe := tribes[i]
+			r.int(tribe.ID)
+			r.string(tribe.Name)
+			r.string(tribe.Tag)
+			r.int(tribe.TotalMembers)
+			r.int(tribe.TotalVillages)
+			r.int(tribe.Points)
+			r.int(tribe.AllPoints)
+			r.int(tribe.Rank)
+			r.bool(tribe.Exists)
+			r.float(tribe.Dominance)
+			r.od(tribe.OpponentsDefeated)
+		},
+		id: func(i int) int {
+			return tribes[i].ID
+		},
+	}
+}
+
+func bulkUpsertPlayers(players []*twmodel.Player) bulkUpsert {
+	columns := append([]string{
+		"id",
+		"name",
+		"total_villages",
+		"points",
+		"rank",
+		"exists",
+		"tribe_id",
+		"daily_growth",
+	}, odColumns...)
+	return bulkUpsert{
+		table:   "players",
+		columns: columns,
+		set:     append(excludedSet(columns[1:]...), "deleted_at = null"),
+		rows:    len(players),
+		writeRow: func(r *copyRow, i int) {
+			player := players[i]
+			r.int(player.ID)
+			r.string(player.Name)
+			r.int(player.TotalVillages)
+			r.int(player.Points)
+			r.int(player.Rank)
+			r.bool(player.Exists)
+			r.int(player.TribeID)
+			r.int(player.DailyGrowth)
+			r.od(player.OpponentsDefeated)
+		},
+		id: func(i int) int {
+			return players[i].ID
+		},
+	}
+}
+
+func bulkUpsertVillages(villages []*twmodel.Village) bulkUpsert {
+	columns := []string{
+		"id",
+		"name",
+		"points",
+		"x",
+		"y",
+		"bonus",
+		"player_id",
+	}
+	return bulkUpsert{
+		table:   "villages",
+		columns: columns,
+		set:     excludedSet(columns[1:]...),
+		rows:    len(villages),
+		writeRow: func(r *copyRow, i int) {
+			village := villages[i]
+			r.int(village.ID)
+			r.string(village.Name)
+			r.int(village.Points)
+			r.int(village.X)
+			r.int(village.Y)
+			r.int(village.Bonus)
+			r.int(village.PlayerID)
+		},
+		id: func(i int) int {
+			return villages[i].ID
+		},
+	}
+}
@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+)
+
+func TestCopyRow(t *testing.T) {
+	yes := true
+
+	tests := []struct {
+		name  string
+		write func(r *copyRow)
+		want  string
+	}{
+		{
+			name: "numbers",
+			write: func(r *copyRow) {
+				r.int(1)
+				r.int64(-2)
+				r.float(0.5)
+			},
+			want: "1,-2,0.5",
+		},
+		{
+			name: "empty string is NULL",
+			write: func(r *copyRow) {
+				r.int(1)
+				r.string("")
+				r.int(2)
+			},
+			want: "1,,2",
+		},
+		{
+			name: "nil bool is NULL",
+			write: func(r *copyRow) {
+				r.bool(nil)
+				r.bool(&yes)
+			},
+			want: ",true",
+		},
+		{
+			name: "quotes",
+			write: func(r *copyRow) {
+				r.string(`"Knights"`)
+			},
+			want: `"""Knights"""`,
+		},
+		{
+			name: "separators and newlines",
+			write: func(r *copyRow) {
+				r.string("a,b")
+				r.string("line 1\nline 2\r\n")
+			},
+			want: "\"a,b\",\"line 1\nline 2\r\n\"",
+		},
+		{
+			name: "backslash",
+			write: func(r *copyRow) {
+				r.string(`\N`)
+			},
+			want: `"\N"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &copyRow{}
+			tt.write(r)
+			if got := string(r.b); got != tt.want {
+				t.Errorf("copyRow = %q, want %q", got, tt.want)
+			}
+
+			r.reset()
+			r.int(7)
+			if got := string(r.b); got != "7" {
+				t.Errorf("after reset copyRow = %q, want %q", got, "7")
+			}
+		})
+	}
+}
+
+func TestUseBulkLoad(t *testing.T) {
+	tests := []struct {
+		threshold int
+		rows      int
+		want      bool
+	}{
+		{threshold: 0, rows: DefaultBulkLoadThreshold - 1, want: false},
+		{threshold: 0, rows: DefaultBulkLoadThreshold, want: true},
+		{threshold: 10, rows: 9, want: false},
+		{threshold: 10, rows: 10, want: true},
+		{threshold: -1, rows: DefaultBulkLoadThreshold, want: false},
+	}
+
+	for _, tt := range tests {
+		w := &workerUpdateServerData{bulkLoadThreshold: tt.threshold}
+		if got := w.useBulkLoad(tt.rows); got != tt.want {
+			t.Errorf("useBulkLoad(%d) with threshold %d = %t, want %t", tt.rows, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestSaveServerDataCopyMatchesInsert(t *testing.T) {
+	db := postgrestest.Connect(t)
+	insertServer := postgrestest.Server(t, db)
+	copyServer := postgrestest.Server(t, db)
+	exists := true
+	gone := false
+	newData := func(points int) ([]*twmodel.Tribe, []*twmodel.Player, []*twmodel.Village) {
+		tribes := []*twmodel.Tribe{
+			{
+				ID:                1,
+				Name:              `"Quoted", tribe ąę`,
+				Tag:               `T,"1"`,
+				Exists:            &exists,
+				TotalMembers:      2,
+				TotalVillages:     2,
+				Points:            points,
+				AllPoints:         points * 2,
+				Rank:              1,
+				Dominance:         12.5,
+				OpponentsDefeated: twmodel.OpponentsDefeated{RankAtt: 1, ScoreAtt: points, RankTotal: 2, ScoreTotal: 7},
+			},
+			{ID: 2, Name: "Gone", Tag: "G", Exists: &gone},
+		}
+		players := []*twmodel.Player{
+			{
+				ID:                1,
+				Name:              `O'Brien, "the" żółw`,
+				Exists:            &exists,
+				TotalVillages:     1,
+				Points:            points,
+				Rank:              1,
+				TribeID:           1,
+				OpponentsDefeated: twmodel.OpponentsDefeated{RankDef: 3, ScoreDef: points},
+			},
+			{ID: 2, Name: `back\slash`, Exists: &gone},
+			{ID: 3, Name: "NoExists", TribeID: 1},
+		}
+		villages := []*twmodel.Village{
+			{ID: 1, Name: "Village, 001", Points: points, X: 500, Y: 500, Bonus: 1, PlayerID: 1},
+			{ID: 2, Name: `Barbarian "village"`, Points: 26, X: 501, Y: 499},
+		}
+		return tribes, players, villages
+	}
+
+	// the second save updates the rows saved by the first one
+	for _, points := range []int{100, 250} {
+		tribes, players, villages := newData(points)
+		if err := SaveServerData(context.Background(), db, insertServer, tribes, players, villages, -1); err != nil {
+			t.Fatalf("SaveServerData (INSERT) returned %v", err)
+		}
+		tribes, players, villages = newData(points)
+		if err := SaveServerData(context.Background(), db, copyServer, tribes, players, villages, 1); err != nil {
+			t.Fatalf("SaveServerData (COPY) returned %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		model func() interface{}
+	}{
+		{"tribes", func() interface{} { return &[]*twmodel.Tribe{} }},
+		{"players", func() interface{} { return &[]*twmodel.Player{} }},
+		{"villages", func() interface{} { return &[]*twmodel.Village{} }},
+	} {
+		inserted := loadSavedRows(t, db, insertServer, tc.model())
+		copied := loadSavedRows(t, db, copyServer, tc.model())
+		if reflect.ValueOf(inserted).Elem().Len() == 0 {
+			t.Errorf("no %s were saved", tc.name)
+		}
+		if !reflect.DeepEqual(inserted, copied) {
+			t.Errorf("%s saved with COPY differ from the ones saved with INSERT", tc.name)
+		}
+	}
+}
+
+// loadSavedRows loads the rows ordered by id, the set timestamps are replaced with a fixed time
+// as they depend on the time of the save.
+func loadSavedRows(t *testing.T, db *pg.DB, server *twmodel.Server, model interface{}) interface{} {
+	t.Helper()
+	if err := db.WithParam("SERVER", pg.Safe(server.Key)).Model(model).Order("id ASC").Select(); err != nil {
+		t.Fatalf("couldn't load the rows: %v", err)
+	}
+	var timestamps []*time.Time
+	switch rows := model.(type) {
+	case *[]*twmodel.Tribe:
+		for _, r := range *rows {
+			timestamps = append(timestamps, &r.BestRankAt, &r.MostPointsAt, &r.MostVillagesAt, &r.CreatedAt, &r.DeletedAt)
+		}
+	case *[]*twmodel.Player:
+		for _, r := range *rows {
+			timestamps = append(
+				timestamps,
+				&r.BestRankAt,
+				&r.MostPointsAt,
+				&r.MostVillagesAt,
+				&r.JoinedAt,
+				&r.LastActivityAt,
+				&r.DeletedAt,
+			)
+		}
+	}
+	for _, ts := range timestamps {
+		if !ts.IsZero() {
+			*ts = time.Unix(0, 0).UTC()
+		}
+	}
+	return model
+}
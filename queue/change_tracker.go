@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+)
+
+const (
+	checksumsKeyPrefix = "dataupdater:checksums:"
+	checksumsTTL       = 7 * 24 * time.Hour
+)
+
+// changeTracker computes checksums of the files fetched from a TW server
+// and compares them with the checksums stored during the previous update.
+type changeTracker struct {
+	redis     redis.UniversalClient
+	serverKey string
+	mu        sync.Mutex
+	checksums map[string]string
+}
+
+func newChangeTracker(client redis.UniversalClient, serverKey string) *changeTracker {
+	return &changeTracker{
+		redis:     client,
+		serverKey: serverKey,
+		checksums: make(map[string]string),
+	}
+}
+
+func (ct *changeTracker) middleware() transportMiddleware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &changeTrackerTransport{
+			rt: rt,
+			ct: ct,
+		}
+	}
+}
+
+func (ct *changeTracker) key() string {
+	return checksumsKeyPrefix + ct.serverKey
+}
+
+func (ct *changeTracker) record(fileName string, payload []byte) {
+	sum := sha256.Sum256(payload)
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.checksums[fileName] = hex.EncodeToString(sum[:])
+}
+
+// changed reports whether any of the fetched files has changed since the last saved update.
+func (ct *changeTracker) changed(ctx context.Context) (bool, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if len(ct.checksums) == 0 {
+		return true, nil
+	}
+
+	prev, err := ct.redis.HGetAll(ctx, ct.key()).Result()
+	if err != nil {
+		return true, errors.Wrap(err, "couldn't load the previous checksums")
+	}
+	for fileName, sum := range ct.checksums {
+		if prev[fileName] != sum {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// save should be called after the fetched data has been successfully saved in the database.
+func (ct *changeTracker) save(ctx context.Context) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if len(ct.checksums) == 0 {
+		return nil
+	}
+
+	values := make(map[string]interface{}, len(ct.checksums))
+	for fileName, sum := range ct.checksums {
+		values[fileName] = sum
+	}
+	_, err := ct.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, ct.key())
+		pipe.HSet(ctx, ct.key(), values)
+		pipe.Expire(ctx, ct.key(), checksumsTTL)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "couldn't save the checksums")
+	}
+	return nil
+}
+
+// reset deletes the saved checksums, so the next update saves the fetched data even if it hasn't changed.
+func (ct *changeTracker) reset(ctx context.Context) error {
+	if err := ct.redis.Del(ctx, ct.key()).Err(); err != nil {
+		return errors.Wrap(err, "couldn't delete the checksums")
+	}
+	return nil
+}
+
+type changeTrackerTransport struct {
+	rt http.RoundTripper
+	ct *changeTracker
+}
+
+func (t *changeTrackerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	fileName, err := dataloader.FileNameFromURL(req.URL)
+	if err != nil {
+		return resp, nil
+	}
+
+	payload, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(payload))
+	t.ct.record(fileName, payload)
+	return resp, nil
+}
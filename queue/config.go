@@ -4,24 +4,190 @@ import (
 	"github.com/go-pg/pg/v10"
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+	"github.com/tribalwarshelp/dataupdater/ratelimit"
+)
+
+const (
+	DataQueue                 = "data"
+	HistoryQueue              = "history"
+	MaintenanceQueue          = "maintenance"
+	EnnoblementsQueue         = "ennoblements"
+	DefaultReservationTimeout = 2 * time.Minute
+	DefaultHTTPTimeout        = 10 * time.Second
+	DefaultTransactionTimeout = 20 * time.Second
+	DefaultBulkLoadThreshold  = 20000
+	// DefaultUpdateHistorySpec and DefaultUpdateStatsSpec are the global schedules of the history and stats updates,
+	// run in the timezone of every version.
+	DefaultUpdateHistorySpec = "30 1 * * *"
+	DefaultUpdateStatsSpec   = "45 1 * * *"
 )
 
+// QueueNames returns the names of all queues.
+func QueueNames() []string {
+	return []string{DataQueue, HistoryQueue, MaintenanceQueue, EnnoblementsQueue}
+}
+
+type QueueConfig struct {
+	// WorkerLimit is the number of workers processing the queue. Default is Config.WorkerLimit.
+	WorkerLimit int
+	// ReservationTimeout is the time after which a message is returned to the queue if it hasn't been processed.
+	// Default is 2 minutes.
+	ReservationTimeout time.Duration
+}
+
+// Retention specifies how long the data is kept before it's deleted by the vacuum tasks.
+type Retention struct {
+	// History is how long the history records and the daily stats are kept. Default is 180 days.
+	History time.Duration
+	// DeletedPlayers is how long the data of the deleted players is kept. Default is 14 days.
+	DeletedPlayers time.Duration
+	// DeletedTribes is how long the data of the deleted tribes is kept. Default is 1 day.
+	DeletedTribes time.Duration
+	// TaskRuns is how long the task runs (see model.TaskRun) are kept. Default is 30 days.
+	TaskRuns time.Duration
+	// Snapshots is how long the snapshots saved by Config.Archiver are kept. Default is 30 days.
+	Snapshots time.Duration
+}
+
+func DefaultRetention() Retention {
+	return Retention{
+		History:        180 * day,
+		DeletedPlayers: 14 * day,
+		DeletedTribes:  day,
+		TaskRuns:       30 * day,
+		Snapshots:      30 * day,
+	}
+}
+
 type Config struct {
-	Redis       redis.UniversalClient
+	Redis redis.UniversalClient
+	// WorkerLimit is the default number of workers per queue.
 	WorkerLimit int
-	DB          *pg.DB
+	// Queues contains the queue-specific settings (queue name => settings).
+	Queues map[string]*QueueConfig
+	// Routes overrides the queue the task is added to (task name => queue name).
+	Routes        map[string]string
+	DB            *pg.DB
+	ServerDataDir string
+	Archiver      *archive.Archiver
+	RateLimiter   *ratelimit.Limiter
+	// HTTPTimeout is the timeout of the requests sent to TW servers. Default is 10 seconds.
+	HTTPTimeout time.Duration
+	// TransactionTimeout is the timeout of the transaction which saves the server data. Default is 20 seconds.
+	TransactionTimeout time.Duration
+	// BulkLoadThreshold is the number of tribes/players/villages from which they're saved with COPY instead of INSERT.
+	// Default (0) is 20000, a negative value disables COPY. Every bulk load threshold in this package has this meaning.
+	BulkLoadThreshold int
+	// Retention - the zero values are replaced with the defaults.
+	Retention Retention
+	// UpdateHistorySpec and UpdateStatsSpec are the global schedules of the history and stats updates (see cron.Schedules).
+	// The servers updated since the last scheduled run are up to date. Default is DefaultUpdateHistorySpec/DefaultUpdateStatsSpec.
+	UpdateHistorySpec string
+	UpdateStatsSpec   string
 }
 
 func validateConfig(cfg *Config) error {
 	if cfg == nil || cfg.Redis == nil {
 		return errors.New("cfg.Redis is required")
 	}
+	for name, queueCfg := range cfg.Queues {
+		if !isValidQueueName(name) {
+			return errors.Errorf("cfg.Queues: unknown queue '%s'", name)
+		}
+		if queueCfg == nil {
+			continue
+		}
+		if queueCfg.WorkerLimit < 0 {
+			return errors.Errorf("cfg.Queues[%s].WorkerLimit must be greater than or equal to 0", name)
+		}
+		if queueCfg.ReservationTimeout < 0 {
+			return errors.Errorf("cfg.Queues[%s].ReservationTimeout must be greater than or equal to 0", name)
+		}
+	}
+	if cfg.HTTPTimeout < 0 {
+		return errors.New("cfg.HTTPTimeout must be greater than or equal to 0")
+	}
+	if cfg.TransactionTimeout < 0 {
+		return errors.New("cfg.TransactionTimeout must be greater than or equal to 0")
+	}
+	if cfg.RateLimiter != nil && cfg.RateLimiter.LeaseTimeout() < httpTimeoutOrDefault(cfg.HTTPTimeout) {
+		return errors.New("the lease timeout of cfg.RateLimiter must be greater than or equal to cfg.HTTPTimeout")
+	}
+	if cfg.Retention.History < 0 ||
+		cfg.Retention.DeletedPlayers < 0 ||
+		cfg.Retention.DeletedTribes < 0 ||
+		cfg.Retention.TaskRuns < 0 ||
+		cfg.Retention.Snapshots < 0 {
+		return errors.New("cfg.Retention must be greater than or equal to 0")
+	}
+	for name, spec := range map[string]string{"UpdateHistorySpec": cfg.UpdateHistorySpec, "UpdateStatsSpec": cfg.UpdateStatsSpec} {
+		if spec == "" {
+			continue
+		}
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return errors.Wrapf(err, "cfg.%s: invalid spec '%s'", name, spec)
+		}
+	}
+	for taskName, queueName := range cfg.Routes {
+		if _, ok := defaultRoutes[taskName]; !ok {
+			return errors.Errorf("cfg.Routes: unknown task '%s'", taskName)
+		}
+		if !isValidQueueName(queueName) {
+			return errors.Errorf("cfg.Routes[%s]: unknown queue '%s'", taskName, queueName)
+		}
+	}
 	return nil
 }
 
+func isValidQueueName(name string) bool {
+	for _, queueName := range QueueNames() {
+		if queueName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// httpTimeoutOrDefault replaces the zero timeout with DefaultHTTPTimeout.
+func httpTimeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return DefaultHTTPTimeout
+	}
+	return timeout
+}
+
+// transactionTimeoutOrDefault replaces the zero timeout with DefaultTransactionTimeout.
+func transactionTimeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return DefaultTransactionTimeout
+	}
+	return timeout
+}
+
+// bulkLoadThresholdOrDefault replaces the zero threshold with DefaultBulkLoadThreshold.
+func bulkLoadThresholdOrDefault(threshold int) int {
+	if threshold == 0 {
+		return DefaultBulkLoadThreshold
+	}
+	return threshold
+}
+
 type registerTasksConfig struct {
-	DB    *pg.DB
-	Queue *Queue
+	DB                 *pg.DB
+	Queue              *Queue
+	ServerDataDir      string
+	Archiver           *archive.Archiver
+	RateLimiter        *ratelimit.Limiter
+	HTTPTimeout        time.Duration
+	TransactionTimeout time.Duration
+	BulkLoadThreshold  int
+	Retention          Retention
+	UpdateHistorySpec  string
+	UpdateStatsSpec    string
 }
 
 func validateRegisterTasksConfig(cfg *registerTasksConfig) error {
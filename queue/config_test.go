@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/tribalwarshelp/dataupdater/ratelimit"
+)
+
+func TestValidateConfigLeaseTimeout(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+
+	tests := []struct {
+		name         string
+		leaseTimeout time.Duration
+		httpTimeout  time.Duration
+		wantErr      bool
+	}{
+		{"default timeouts", 0, 0, false},
+		{"equal timeouts", 10 * time.Second, 10 * time.Second, false},
+		{"lease shorter than the default http timeout", 5 * time.Second, 0, true},
+		{"lease shorter than the http timeout", time.Minute, 2 * time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, err := ratelimit.New(&ratelimit.Config{
+				Redis:                 client,
+				MaxConcurrentRequests: 1,
+				LeaseTimeout:          tt.leaseTimeout,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateConfig(&Config{
+				Redis:       client,
+				RateLimiter: limiter,
+				HTTPTimeout: tt.httpTimeout,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
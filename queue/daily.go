@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"context"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/pause"
+)
+
+// dailyTask describes a task that is run once a day for every open server (e.g. the history update).
+type dailyTask struct {
+	// prefix is used in the log messages (e.g. taskUpdateHistory.execute)
+	prefix string
+	// serverTaskName is the task added to the queue for every server
+	serverTaskName string
+	// updatedAtColumn is the column that stores when the task was last run for the server
+	updatedAtColumn string
+	// overrideColumn is the column of the version_schedules table that overrides the schedule of the task
+	overrideColumn string
+	// globalSpec is the schedule of the task used by the versions which don't override it
+	globalSpec string
+}
+
+// enqueueDailyTasks adds the server task to the queue for every open server in the given location
+// that hasn't been updated since the last scheduled run yet (of the version's schedule or d.globalSpec).
+// If version is nil, the servers whose version has its own schedule are skipped (see model.VersionSchedule),
+// otherwise only the servers of the given version are taken into account.
+func (t *task) enqueueDailyTasks(
+	ctx context.Context,
+	d dailyTask,
+	timezone string,
+	version *twmodel.Version,
+) error {
+	entry := log.WithField("timezone", timezone)
+	location, err := t.loadLocation(timezone)
+	if err != nil {
+		err = errors.Wrap(err, d.prefix)
+		entry.Error(err)
+		return err
+	}
+	versionSpec := ""
+	if version != nil {
+		versionSpec, err = t.loadVersionScheduleSpec(ctx, d, version.Code)
+		if err != nil {
+			err = errors.Wrap(err, d.prefix)
+			entry.Error(err)
+			return err
+		}
+	}
+	spec := d.globalSpec
+	if versionSpec != "" {
+		spec = versionSpec
+	}
+	date, err := dailyCutoff(time.Now(), location, spec)
+	if err != nil {
+		err = errors.Wrap(err, d.prefix)
+		entry.Error(err)
+		return err
+	}
+	var servers []*twmodel.Server
+	q := t.db.WithContext(ctx).
+		Model(&servers).
+		Where("status = ?", twmodel.ServerStatusOpen).
+		Apply(pause.NotPaused).
+		WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			return q.
+				Where("? IS NULL", pg.Ident("server."+d.updatedAtColumn)).
+				WhereOr("? < ?", pg.Ident("server."+d.updatedAtColumn), date), nil
+		}).
+		Relation("Version")
+	if version != nil {
+		entry = entry.WithField("code", version.Code)
+		q = q.Where("server.version_code = ?", version.Code)
+	} else {
+		q = q.
+			Where("version.timezone = ?", timezone).
+			Where(
+				"server.version_code NOT IN (SELECT version_code FROM version_schedules WHERE ? <> '')",
+				pg.Ident(d.overrideColumn),
+			)
+	}
+	if err := q.Select(); err != nil {
+		err = errors.Wrap(err, d.prefix)
+		entry.Errorln(err)
+		return err
+	}
+	entry.
+		WithField("numberOfServers", len(servers)).
+		Infof("%s: Update has started", d.prefix)
+	period := date.Format(dailyPeriodLayout)
+	if versionSpec != "" {
+		// the version's schedule may run the task more than once a day
+		period = date.UTC().Format(time.RFC3339)
+	}
+	for _, server := range servers {
+		err := t.queue.Add(newServerTaskMessage(ctx, d.serverTaskName, server.Key, period, timezone, server))
+		if err != nil {
+			log.
+				WithField("key", server.Key).
+				Warn(
+					errors.Wrapf(
+						err,
+						"%s: %s: Couldn't add the task '%s' for this server",
+						d.prefix,
+						server.Key,
+						d.serverTaskName,
+					),
+				)
+		}
+	}
+	return nil
+}
+
+// loadVersionScheduleSpec returns the spec overriding the schedule of the task for the given version
+// or an empty string if the version uses the global schedule.
+func (t *task) loadVersionScheduleSpec(ctx context.Context, d dailyTask, code twmodel.VersionCode) (string, error) {
+	var spec string
+	err := t.db.WithContext(ctx).
+		Model((*model.VersionSchedule)(nil)).
+		Column(d.overrideColumn).
+		Where("version_code = ?", code).
+		Select(pg.Scan(&spec))
+	if err != nil && !errors.Is(err, pg.ErrNoRows) {
+		return "", errors.Wrapf(err, "couldn't load the schedule of the version '%s'", code)
+	}
+	return spec, nil
+}
+
+// dailyCutoff returns the time since which the servers are considered up to date:
+// the last run of the spec (in the given location) before now or the midnight if the spec hasn't run in the last week.
+func dailyCutoff(now time.Time, location *time.Location, spec string) (time.Time, error) {
+	year, month, day := now.In(location).Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, location)
+	schedule, err := cron.ParseStandard("CRON_TZ=" + location.String() + " " + spec)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid spec '%s'", spec)
+	}
+	for _, lookback := range []time.Duration{24 * time.Hour, 7 * 24 * time.Hour} {
+		var last time.Time
+		for next := schedule.Next(now.Add(-lookback)); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+			last = next
+		}
+		if !last.IsZero() {
+			return last, nil
+		}
+	}
+	return midnight, nil
+}
@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDailyCutoff(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		spec    string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "default schedule",
+			now:  time.Date(2021, 5, 1, 12, 0, 0, 0, warsaw),
+			spec: DefaultUpdateHistorySpec,
+			want: time.Date(2021, 5, 1, 1, 30, 0, 0, warsaw),
+		},
+		{
+			name: "default schedule at the time of the run",
+			now:  time.Date(2021, 5, 1, 1, 30, 0, 0, warsaw),
+			spec: DefaultUpdateHistorySpec,
+			want: time.Date(2021, 5, 1, 1, 30, 0, 0, warsaw),
+		},
+		{
+			// the servers updated at 02:00 haven't been updated since the run at 03:00
+			name: "schedule moved to 03:00",
+			now:  time.Date(2021, 5, 1, 3, 0, 0, 0, warsaw),
+			spec: "0 3 * * *",
+			want: time.Date(2021, 5, 1, 3, 0, 0, 0, warsaw),
+		},
+		{
+			name: "version schedule",
+			now:  time.Date(2021, 5, 1, 12, 0, 0, 0, warsaw),
+			spec: "0 3 * * *",
+			want: time.Date(2021, 5, 1, 3, 0, 0, 0, warsaw),
+		},
+		{
+			name: "version schedule which hasn't run today yet",
+			now:  time.Date(2021, 5, 1, 2, 0, 0, 0, warsaw),
+			spec: "0 3 * * *",
+			want: time.Date(2021, 4, 30, 3, 0, 0, 0, warsaw),
+		},
+		{
+			name: "version schedule running twice a day",
+			now:  time.Date(2021, 5, 1, 18, 0, 0, 0, warsaw),
+			spec: "0 3,15 * * *",
+			want: time.Date(2021, 5, 1, 15, 0, 0, 0, warsaw),
+		},
+		{
+			name: "weekly version schedule",
+			now:  time.Date(2021, 5, 1, 12, 0, 0, 0, warsaw),
+			spec: "0 4 * * 1",
+			want: time.Date(2021, 4, 26, 4, 0, 0, 0, warsaw),
+		},
+		{
+			name: "monthly schedule which hasn't run in the last week",
+			now:  time.Date(2021, 5, 20, 12, 0, 0, 0, warsaw),
+			spec: "0 4 1 * *",
+			want: time.Date(2021, 5, 20, 0, 0, 0, 0, warsaw),
+		},
+		{
+			name:    "invalid spec",
+			now:     time.Date(2021, 5, 1, 12, 0, 0, 0, warsaw),
+			spec:    "0 3 * *",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dailyCutoff(tt.now, warsaw, tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dailyCutoff() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("dailyCutoff() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/taskq/v3"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+const (
+	attemptsKeyPrefix = "dataupdater:attempts:"
+	attemptsTTL       = 48 * time.Hour
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// deadLetterStore saves the tasks that have exhausted their retries in the failed_tasks table.
+// The errors of the previous attempts are kept in Redis until the task succeeds or fails permanently.
+type deadLetterStore struct {
+	db    *pg.DB
+	redis redis.UniversalClient
+}
+
+// withAttemptTracking records the errors of the failed attempts under the attempt ID kept in the message metadata.
+func (s *deadLetterStore) withAttemptTracking(h taskq.Handler) taskq.Handler {
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		meta := metaFromContext(msg.Ctx)
+		err := h.HandleMessage(msg)
+		if err != nil {
+			if meta.AttemptID == "" {
+				// the metadata is carried to the next attempts (see withMessageMeta)
+				meta.AttemptID = uuid.NewString()
+			}
+			s.recordAttempt(msg, meta.AttemptID, err)
+		} else if meta.AttemptID != "" {
+			s.clearAttempts(msg, meta.AttemptID)
+		}
+		return err
+	})
+}
+
+// fallbackHandler returns a taskq fallback handler for the task with the given handler.
+// The handler is used to decode the message args. It expects the metadata in msg.Ctx (see withMessageMeta).
+func (s *deadLetterStore) fallbackHandler(handler interface{}) func(msg *taskq.Message) error {
+	return func(msg *taskq.Message) error {
+		ft := &model.FailedTask{
+			TaskName: msg.TaskName,
+		}
+		// the metadata isn't saved, the task is added to the queue again without it (see Queue.Requeue)
+		if attemptID := metaFromContext(msg.Ctx).AttemptID; attemptID != "" {
+			ft.Attempts = s.popAttempts(msg, attemptID)
+		}
+		if len(ft.Attempts) == 0 && msg.Err != nil {
+			ft.Attempts = append(ft.Attempts, &model.FailedTaskAttempt{
+				Number:   msg.ReservedCount + 1,
+				Error:    msg.Err.Error(),
+				FailedAt: time.Now(),
+			})
+		}
+
+		entry := log.WithField("task", msg.TaskName)
+		argsBin, err := msg.MarshalArgs()
+		if err != nil {
+			entry.Warn(errors.Wrap(err, "deadLetterStore: couldn't marshal the args"))
+		} else {
+			ft.ArgsBin = argsBin
+			args, err := decodeArgs(handler, argsBin)
+			if err != nil {
+				entry.Warn(errors.Wrap(err, "deadLetterStore: couldn't decode the args"))
+			}
+			info := newMessageArgsInfo(args)
+			ft.ServerKey = info.serverKey
+			ft.VersionCode = info.versionCode
+			ft.URL = info.url
+			ft.Timezone = info.timezone
+		}
+
+		if _, err := s.db.Model(ft).Returning("id").Insert(); err != nil {
+			err = errors.Wrapf(err, "deadLetterStore: %s: couldn't save the failed task", msg.TaskName)
+			entry.Error(err)
+			return err
+		}
+		entry.
+			WithFields(map[string]interface{}{
+				"failedTaskID": ft.ID,
+				"key":          ft.ServerKey,
+			}).
+			Warnf("%s: the task has been moved to the failed tasks", msg.TaskName)
+		return nil
+	}
+}
+
+func (s *deadLetterStore) recordAttempt(msg *taskq.Message, attemptID string, taskErr error) {
+	key := attemptsKey(msg, attemptID)
+	b, err := json.Marshal(&model.FailedTaskAttempt{
+		Number:   msg.ReservedCount + 1,
+		Error:    taskErr.Error(),
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, b)
+		pipe.Expire(ctx, key, attemptsTTL)
+		return nil
+	})
+	if err != nil {
+		log.WithField("task", msg.TaskName).Warn(errors.Wrap(err, "deadLetterStore: couldn't record the attempt"))
+	}
+}
+
+func (s *deadLetterStore) clearAttempts(msg *taskq.Message, attemptID string) {
+	key := attemptsKey(msg, attemptID)
+	if err := s.redis.Del(context.Background(), key).Err(); err != nil {
+		log.WithField("task", msg.TaskName).Warn(errors.Wrap(err, "deadLetterStore: couldn't clear the attempts"))
+	}
+}
+
+func (s *deadLetterStore) popAttempts(msg *taskq.Message, attemptID string) []*model.FailedTaskAttempt {
+	key := attemptsKey(msg, attemptID)
+	ctx := context.Background()
+	var values *redis.StringSliceCmd
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		values = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		log.WithField("task", msg.TaskName).Warn(errors.Wrap(err, "deadLetterStore: couldn't load the attempts"))
+		return nil
+	}
+
+	var attempts []*model.FailedTaskAttempt
+	for _, value := range values.Val() {
+		attempt := &model.FailedTaskAttempt{}
+		if err := json.Unmarshal([]byte(value), attempt); err == nil {
+			attempts = append(attempts, attempt)
+		}
+	}
+	return attempts
+}
+
+// attemptsKey identifies the message by the attempt ID carried in its metadata,
+// because taskq changes the message ID on every retry and doesn't keep the message name.
+func attemptsKey(msg *taskq.Message, attemptID string) string {
+	return attemptsKeyPrefix + msg.TaskName + ":" + attemptID
+}
+
+// decodeArgs decodes the msgpack-encoded args into the types expected by the given handler.
+func decodeArgs(handler interface{}, b []byte) ([]interface{}, error) {
+	ft := reflect.TypeOf(handler)
+	if ft == nil || ft.Kind() != reflect.Func {
+		return nil, errors.New("the handler isn't a function")
+	}
+	start := 0
+	if ft.NumIn() > 0 && ft.In(0).Implements(contextType) {
+		start = 1
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n == -1 {
+		n = 0
+	}
+	if n != ft.NumIn()-start {
+		return nil, errors.Errorf("got %d args, wanted %d", n, ft.NumIn()-start)
+	}
+
+	args := make([]interface{}, 0, n)
+	for i := start; i < ft.NumIn(); i++ {
+		arg := reflect.New(ft.In(i)).Elem()
+		if err := dec.DecodeValue(arg); err != nil {
+			return nil, errors.Wrapf(err, "couldn't decode the arg %d", i-start)
+		}
+		args = append(args, arg.Interface())
+	}
+	return args, nil
+}
+
+// messageArgsInfo contains the information extracted from the decoded message args.
+type messageArgsInfo struct {
+	serverKey   string
+	versionCode twmodel.VersionCode
+	url         string
+	timezone    string
+}
+
+func newMessageArgsInfo(args []interface{}) messageArgsInfo {
+	info := messageArgsInfo{}
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case *twmodel.Server:
+			if v != nil {
+				info.serverKey = v.Key
+				info.versionCode = v.VersionCode
+			}
+		case *twmodel.Version:
+			if v != nil {
+				info.versionCode = v.Code
+			}
+		case string:
+			if strings.HasPrefix(v, "http") {
+				info.url = v
+			} else {
+				info.timezone = v
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/tribalwarshelp/shared/tw/twurlbuilder"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+var (
+	ErrUnknownTask     = errors.New("unknown task")
+	ErrInvalidArg      = errors.New("invalid arg")
+	ErrServerNotFound  = errors.New("server not found")
+	ErrVersionNotFound = errors.New("version not found")
+)
+
+type taskArgKind string
+
+const (
+	taskArgNone     taskArgKind = ""
+	taskArgServer   taskArgKind = "server"
+	taskArgVersion  taskArgKind = "version"
+	taskArgTimezone taskArgKind = "timezone"
+)
+
+var taskArgKinds = map[string]taskArgKind{
+	LoadVersionsAndUpdateServerData: taskArgNone,
+	LoadServersAndUpdateData:        taskArgVersion,
+	UpdateServerData:                taskArgServer,
+	Vacuum:                          taskArgNone,
+	VacuumServerData:                taskArgServer,
+	UpdateEnnoblements:              taskArgNone,
+	UpdateServerEnnoblements:        taskArgServer,
+	UpdateHistory:                   taskArgTimezone,
+	UpdateVersionHistory:            taskArgVersion,
+	UpdateServerHistory:             taskArgServer,
+	UpdateStats:                     taskArgTimezone,
+	UpdateVersionStats:              taskArgVersion,
+	UpdateServerStats:               taskArgServer,
+	DeleteNonExistentVillages:       taskArgNone,
+	ServerDeleteNonExistentVillages: taskArgServer,
+}
+
+// TaskNames returns the sorted names of all tasks.
+func TaskNames() []string {
+	names := make([]string, 0, len(taskArgKinds))
+	for name := range taskArgKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TaskArgKind returns what the arg of the given task is ("server", "version", "timezone" or "" if the task has no arg).
+func TaskArgKind(taskName string) (string, error) {
+	kind, ok := taskArgKinds[taskName]
+	if !ok {
+		return "", errors.Wrapf(ErrUnknownTask, "'%s'", taskName)
+	}
+	return string(kind), nil
+}
+
+// Enqueue adds the given task to the queue.
+// arg is a server key, a version code or a timezone, depending on the task (see TaskArgKind).
+func (q *Queue) Enqueue(ctx context.Context, taskName, arg string) (*taskq.Message, error) {
+	kind, ok := taskArgKinds[taskName]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownTask, "'%s'", taskName)
+	}
+	if kind == taskArgNone && arg != "" {
+		return nil, errors.Wrapf(ErrInvalidArg, "the task '%s' doesn't accept any args", taskName)
+	}
+	if kind != taskArgNone && arg == "" {
+		return nil, errors.Wrapf(ErrInvalidArg, "the task '%s' requires a %s", taskName, kind)
+	}
+
+	args, err := q.buildTaskArgs(ctx, taskName, kind, arg)
+	if err != nil {
+		return nil, err
+	}
+	msg := GetTask(taskName).WithArgs(ctx, args...)
+	if err := q.Add(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (q *Queue) buildTaskArgs(ctx context.Context, taskName string, kind taskArgKind, arg string) ([]interface{}, error) {
+	switch kind {
+	case taskArgServer:
+		server := &twmodel.Server{}
+		if err := q.db.ModelContext(ctx, server).Relation("Version").Where("key = ?", arg).Select(); err != nil {
+			if err == pg.ErrNoRows {
+				return nil, errors.Wrapf(ErrServerNotFound, "'%s'", arg)
+			}
+			return nil, errors.Wrapf(err, "couldn't load the server '%s'", arg)
+		}
+		switch taskName {
+		case UpdateServerHistory, UpdateServerStats:
+			return []interface{}{server.Version.Timezone, server}, nil
+		case VacuumServerData:
+			return []interface{}{server}, nil
+		}
+		return []interface{}{twurlbuilder.BuildServerURL(server.Key, server.Version.Host), server}, nil
+	case taskArgVersion:
+		version := &twmodel.Version{}
+		if err := q.db.ModelContext(ctx, version).Relation("SpecialServers").Where("code = ?", arg).Select(); err != nil {
+			if err == pg.ErrNoRows {
+				return nil, errors.Wrapf(ErrVersionNotFound, "'%s'", arg)
+			}
+			return nil, errors.Wrapf(err, "couldn't load the version '%s'", arg)
+		}
+		return []interface{}{version}, nil
+	case taskArgTimezone:
+		if _, err := time.LoadLocation(arg); err != nil {
+			return nil, errors.Wrapf(ErrInvalidArg, "invalid timezone '%s'", arg)
+		}
+		return []interface{}{arg}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,212 @@
+package queue
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/taskq/v3"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+)
+
+type ErrorKind string
+
+const (
+	// ErrorKindNetwork - timeouts, connection resets, 5xx responses etc.
+	ErrorKindNetwork ErrorKind = "network"
+	// ErrorKindRemote - the TW server has rejected the request (e.g. 404 for a closed world).
+	ErrorKindRemote ErrorKind = "remote"
+	// ErrorKindValidation - the data is malformed.
+	ErrorKindValidation ErrorKind = "validation"
+	// ErrorKindDatabase - the error has been returned by PostgreSQL.
+	ErrorKindDatabase ErrorKind = "database"
+	// ErrorKindConflict - another task has been holding the server lock for too long.
+	ErrorKindConflict ErrorKind = "conflict"
+	// ErrorKindUnknown - the error couldn't be classified.
+	ErrorKindUnknown ErrorKind = "unknown"
+)
+
+func (k ErrorKind) String() string {
+	return string(k)
+}
+
+// Error is an error returned by a task handler.
+// Permanent errors fail the task immediately, the other ones are retried with an exponential backoff.
+type Error struct {
+	Kind      ErrorKind
+	Permanent bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+func ClassifyError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return &Error{
+			Kind:      classified.Kind,
+			Permanent: classified.Permanent,
+			Err:       err,
+		}
+	}
+
+	var statusErr *dataloader.StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Temporary() {
+			return &Error{Kind: ErrorKindNetwork, Err: err}
+		}
+		return &Error{Kind: ErrorKindRemote, Permanent: true, Err: err}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Error{Kind: ErrorKindRemote, Permanent: true, Err: err}
+	}
+
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) {
+		return &Error{Kind: ErrorKindDatabase, Permanent: isPermanentPGError(pgErr), Err: err}
+	}
+
+	if isValidationError(err) {
+		return &Error{Kind: ErrorKindValidation, Permanent: true, Err: err}
+	}
+
+	if isNetworkError(err) {
+		return &Error{Kind: ErrorKindNetwork, Err: err}
+	}
+
+	return &Error{Kind: ErrorKindUnknown, Err: err}
+}
+
+func isPermanentPGError(err pg.Error) bool {
+	code := err.Field('C')
+	if len(code) < 2 {
+		return false
+	}
+	switch code[:2] {
+	case "22", // data exception
+		"23", // integrity constraint violation
+		"42": // syntax error or access rule violation
+		return true
+	}
+	return false
+}
+
+func isValidationError(err error) bool {
+	var numErr *strconv.NumError
+	var csvErr *csv.ParseError
+	var xmlErr *xml.SyntaxError
+	return errors.As(err, &numErr) ||
+		errors.As(err, &csvErr) ||
+		errors.As(err, &xmlErr) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, dataloader.ErrInvalidData)
+}
+
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// taskError implements taskq.Delayer, so taskq uses the returned delay instead of its own backoff.
+// A zero delay means that the task won't be retried.
+type taskError struct {
+	err   *Error
+	delay time.Duration
+}
+
+var _ taskq.Delayer = (*taskError)(nil)
+
+func (e *taskError) Error() string {
+	return e.err.Error()
+}
+
+func (e *taskError) Unwrap() error {
+	return e.err
+}
+
+func (e *taskError) Delay() time.Duration {
+	return e.delay
+}
+
+func newTaskError(err error, opts *taskq.TaskOptions, retry int) *taskError {
+	classified := ClassifyError(err)
+	if classified.Permanent {
+		return &taskError{
+			err: classified,
+		}
+	}
+	return &taskError{
+		err:   classified,
+		delay: backoff(opts.MinBackoff, opts.MaxBackoff, retry),
+	}
+}
+
+// backoff returns an exponential backoff with a jitter (from 50% to 100% of the computed delay).
+func backoff(min, max time.Duration, retry int) time.Duration {
+	d := min
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func withErrorClassification(opts *taskq.TaskOptions, h taskq.Handler) taskq.Handler {
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		err := h.HandleMessage(msg)
+		if err == nil {
+			return nil
+		}
+		taskErr := newTaskError(err, opts, msg.ReservedCount)
+		entry := log.WithFields(map[string]interface{}{
+			"task":          msg.TaskName,
+			"errorKind":     taskErr.err.Kind,
+			"permanent":     taskErr.err.Permanent,
+			"reservedCount": msg.ReservedCount,
+		})
+		if taskErr.err.Permanent {
+			entry.Warnf("%s: the task has failed permanently and won't be retried", msg.TaskName)
+		} else if msg.ReservedCount < opts.RetryLimit {
+			entry.
+				WithField("delay", taskErr.delay.String()).
+				Infof("%s: the task has failed and will be retried", msg.TaskName)
+		}
+		return taskErr
+	})
+}
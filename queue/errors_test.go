@@ -0,0 +1,245 @@
+package queue
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+)
+
+type testPGError struct {
+	code string
+}
+
+func (e testPGError) Error() string {
+	return "pg error " + e.code
+}
+
+func (e testPGError) Field(field byte) string {
+	if field == 'C' {
+		return e.code
+	}
+	return ""
+}
+
+func (e testPGError) IntegrityViolation() bool {
+	return e.code[:2] == "23"
+}
+
+func TestClassifyError(t *testing.T) {
+	_, numErr := strconv.Atoi("abc")
+
+	tests := []struct {
+		name      string
+		err       error
+		kind      ErrorKind
+		permanent bool
+	}{
+		{
+			name:      "already classified",
+			err:       errors.Wrap(&Error{Kind: ErrorKindValidation, Permanent: true, Err: errors.New("invalid")}, "wrapped"),
+			kind:      ErrorKindValidation,
+			permanent: true,
+		},
+		{
+			name: "5xx",
+			err:  errors.Wrap(&dataloader.StatusError{StatusCode: http.StatusBadGateway}, "couldn't load"),
+			kind: ErrorKindNetwork,
+		},
+		{
+			name: "429",
+			err:  &dataloader.StatusError{StatusCode: http.StatusTooManyRequests},
+			kind: ErrorKindNetwork,
+		},
+		{
+			name:      "404",
+			err:       &dataloader.StatusError{StatusCode: http.StatusNotFound},
+			kind:      ErrorKindRemote,
+			permanent: true,
+		},
+		{
+			name:      "missing file",
+			err:       errors.Wrap(fs.ErrNotExist, "couldn't open the file"),
+			kind:      ErrorKindRemote,
+			permanent: true,
+		},
+		{
+			name:      "integrity constraint violation",
+			err:       errors.Wrap(testPGError{code: "23505"}, "couldn't insert"),
+			kind:      ErrorKindDatabase,
+			permanent: true,
+		},
+		{
+			name: "serialization failure",
+			err:  testPGError{code: "40001"},
+			kind: ErrorKindDatabase,
+		},
+		{
+			name:      "invalid number",
+			err:       errors.Wrap(numErr, "couldn't parse"),
+			kind:      ErrorKindValidation,
+			permanent: true,
+		},
+		{
+			name:      "invalid csv",
+			err:       &csv.ParseError{Line: 1, Err: csv.ErrFieldCount},
+			kind:      ErrorKindValidation,
+			permanent: true,
+		},
+		{
+			name:      "invalid data",
+			err:       errors.Wrap(dataloader.ErrInvalidData, "couldn't load villages"),
+			kind:      ErrorKindValidation,
+			permanent: true,
+		},
+		{
+			name: "unexpected EOF",
+			err:  errors.Wrap(io.ErrUnexpectedEOF, "couldn't read"),
+			kind: ErrorKindNetwork,
+		},
+		{
+			name: "deadline exceeded",
+			err:  context.DeadlineExceeded,
+			kind: ErrorKindNetwork,
+		},
+		{
+			name: "connection reset",
+			err:  errors.Wrap(syscall.ECONNRESET, "read"),
+			kind: ErrorKindNetwork,
+		},
+		{
+			name: "unknown",
+			err:  errors.New("something went wrong"),
+			kind: ErrorKindUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyError(tt.err)
+			if got.Kind != tt.kind || got.Permanent != tt.permanent {
+				t.Errorf("ClassifyError() = %s (permanent: %t), want %s (permanent: %t)", got.Kind, got.Permanent, tt.kind, tt.permanent)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Error("the classified error doesn't wrap the original one")
+			}
+		})
+	}
+
+	if ClassifyError(nil) != nil {
+		t.Error("ClassifyError(nil) != nil")
+	}
+}
+
+func TestClassifyErrorInvalidData(t *testing.T) {
+	dl := dataloader.NewFSServerDataLoader(fstest.MapFS{
+		"village.txt": &fstest.MapFile{Data: []byte("1,Village,500,500\n")},
+	})
+	_, err := dl.LoadVillages()
+	if err == nil {
+		t.Fatal("LoadVillages() didn't return an error for the malformed data")
+	}
+	got := ClassifyError(errors.Wrap(err, "couldn't load villages"))
+	if got.Kind != ErrorKindValidation || !got.Permanent {
+		t.Errorf("ClassifyError() = %s (permanent: %t), want %s (permanent: true)", got.Kind, got.Permanent, ErrorKindValidation)
+	}
+}
+
+func TestClassifyErrorUpdateServerData(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+	q, _ := newTestQueue(t, db)
+	q.task.serverDataDir = t.TempDir()
+	testServerData{
+		villages: "1,Village,500,500,1,100,0\n",
+		players:  "1,Alice,0,1\n",
+	}.writeDir(t, filepath.Join(q.task.serverDataDir, server.Key))
+
+	err := (&taskUpdateServerData{q.task}).execute(context.Background(), "", server)
+	if err == nil {
+		t.Fatal("execute() didn't return an error for the malformed data")
+	}
+	got := ClassifyError(err)
+	if got.Kind != ErrorKindValidation || !got.Permanent {
+		t.Errorf("ClassifyError() = %s (permanent: %t), want %s (permanent: true)", got.Kind, got.Permanent, ErrorKindValidation)
+	}
+	if villages := countTestRows(t, db, server, (*twmodel.Village)(nil)); villages != 0 {
+		t.Errorf("villages = %d, want 0", villages)
+	}
+	run := &model.TaskRun{}
+	if err := db.Model(run).Where("server_key = ?", server.Key).Select(); err != nil {
+		t.Fatal(err)
+	}
+	if run.Outcome != model.TaskRunOutcomeFailed {
+		t.Errorf("outcome = %s, want %s", run.Outcome, model.TaskRunOutcomeFailed)
+	}
+}
+
+func TestClassifyErrorPostgres(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+
+	_, err := db.Exec("INSERT INTO ?.villages (id) VALUES (1), (1)", pg.Ident(server.Key))
+	if err == nil {
+		t.Fatal("the duplicated village has been inserted")
+	}
+	if got := ClassifyError(err); got.Kind != ErrorKindDatabase || !got.Permanent {
+		t.Errorf("unique violation: ClassifyError() = %s (permanent: %t), want %s (permanent: true)", got.Kind, got.Permanent, ErrorKindDatabase)
+	}
+
+	err = db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SET LOCAL statement_timeout = '10ms'"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("SELECT pg_sleep(1)")
+		return err
+	})
+	if err == nil {
+		t.Fatal("the statement timeout hasn't canceled the query")
+	}
+	if got := ClassifyError(err); got.Kind != ErrorKindDatabase || got.Permanent {
+		t.Errorf("statement timeout: ClassifyError() = %s (permanent: %t), want %s (permanent: false)", got.Kind, got.Permanent, ErrorKindDatabase)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		retry    int
+		want     time.Duration
+	}{
+		{"first retry", time.Second, time.Minute, 1, time.Second},
+		{"second retry", time.Second, time.Minute, 2, 2 * time.Second},
+		{"fourth retry", time.Second, time.Minute, 4, 8 * time.Second},
+		{"capped", time.Second, time.Minute, 20, time.Minute},
+		{"min greater than max", time.Minute, time.Second, 1, time.Second},
+		{"zero", 0, 0, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := backoff(tt.min, tt.max, tt.retry)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("backoff() = %s, want between %s and %s", got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
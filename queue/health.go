@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// fetchStaleAfter is how long the consumer may not fetch messages before it's considered stalled.
+// The idle fetchers block for up to 10 seconds (taskq's WaitTimeout) per fetch.
+const fetchStaleAfter = time.Minute
+
+// fetchMonitor is a Redis hook which records the time of the last successful fetch (XREADGROUP) from every queue stream.
+type fetchMonitor struct {
+	mu        sync.Mutex
+	queues    map[string]string
+	lastFetch map[string]time.Time
+}
+
+var _ redis.Hook = (*fetchMonitor)(nil)
+
+func newFetchMonitor(queueNames []string) *fetchMonitor {
+	m := &fetchMonitor{
+		queues:    make(map[string]string, len(queueNames)),
+		lastFetch: make(map[string]time.Time, len(queueNames)),
+	}
+	for _, name := range queueNames {
+		m.queues[fmt.Sprintf(taskqStreamKeyFormat, name)] = name
+	}
+	return m
+}
+
+func (m *fetchMonitor) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (m *fetchMonitor) AfterProcess(_ context.Context, cmd redis.Cmder) error {
+	if cmd.Name() != "xreadgroup" {
+		return nil
+	}
+	// a nil reply means that the fetch has timed out without any messages
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		return nil
+	}
+	args := cmd.Args()
+	for i, arg := range args {
+		if s, ok := arg.(string); ok && strings.EqualFold(s, "streams") && i+1 < len(args) {
+			stream, _ := args[i+1].(string)
+			m.recordFetch(stream)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *fetchMonitor) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (m *fetchMonitor) AfterProcessPipeline(_ context.Context, _ []redis.Cmder) error {
+	return nil
+}
+
+func (m *fetchMonitor) recordFetch(stream string) {
+	name, ok := m.queues[stream]
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastFetch[name] = time.Now()
+}
+
+func (m *fetchMonitor) lastFetchOf(name string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastFetch[name]
+}
+
+// CheckConsumers returns an error if the consumers of any queue have stopped fetching messages.
+// The consumer that doesn't fetch, because all its workers are busy, is considered healthy.
+func (q *Queue) CheckConsumers(_ context.Context) error {
+	q.mu.Lock()
+	startedAt := q.startedAt
+	q.mu.Unlock()
+	if startedAt.IsZero() {
+		return errors.New("the consumers haven't been started")
+	}
+
+	names := make([]string, 0, len(q.queues))
+	for name := range q.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	var stalled []string
+	for _, name := range names {
+		stats := q.queues[name].Consumer().Stats()
+		if stats.NumWorker == 0 {
+			stalled = append(stalled, fmt.Sprintf("%s: no workers are running", name))
+			continue
+		}
+		last := q.fetches.lastFetchOf(name)
+		if last.IsZero() {
+			last = startedAt
+		}
+		if now.Sub(last) <= fetchStaleAfter {
+			continue
+		}
+		if stats.Buffered > 0 || stats.InFlight >= stats.NumWorker {
+			continue
+		}
+		stalled = append(stalled, fmt.Sprintf("%s: the last fetch at %s", name, last.Format(time.RFC3339)))
+	}
+	if len(stalled) > 0 {
+		return errors.Errorf("the consumers have stopped fetching messages (%s)", strings.Join(stalled, ", "))
+	}
+	return nil
+}
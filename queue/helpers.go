@@ -1,10 +1,13 @@
 package queue
 
 import (
-	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"context"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"io"
 	"net/http"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
 )
 
 func countPlayerVillages(villages []*twmodel.Village) int {
@@ -32,17 +35,55 @@ func calcPlayerDailyGrowth(diffInDays, points int) int {
 	return 0
 }
 
-func newHTTPClient() *http.Client {
+type transportMiddleware func(rt http.RoundTripper) http.RoundTripper
+
+// newHTTPClient returns a client whose timeout starts when the request is actually sent,
+// so the time spent waiting for the rate limiter (see task.rateLimitMiddleware) doesn't count toward it.
+func newHTTPClient(timeout time.Duration, middlewares ...transportMiddleware) *http.Client {
+	transport := dataloader.NewStatusCheckingTransport(http.DefaultTransport)
+	if timeout > 0 {
+		transport = &timeoutTransport{
+			rt:      transport,
+			timeout: timeout,
+		}
+	}
+	for _, middleware := range middlewares {
+		transport = middleware(transport)
+	}
 	return &http.Client{
-		Timeout: 10 * time.Second,
+		Transport: transport,
 	}
 }
 
-func newServerDataLoader(url string) *twdataloader.ServerDataLoader {
-	return twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
-		BaseURL: url,
-		Client:  newHTTPClient(),
-	})
+// timeoutTransport limits the time of the request including reading the response body, just like http.Client.Timeout.
+type timeoutTransport struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelingBody{
+		ReadCloser: resp.Body,
+		cancel:     cancel,
+	}
+	return resp, nil
+}
+
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 type playersSearchableByID struct {
@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+const (
+	serverLockKeyPrefix       = "dataupdater:lock:server:"
+	serverLockObtainTimeout   = 5 * time.Second
+	serverLockRescheduleDelay = time.Minute
+	serverLockMaxReschedules  = 30
+	dailyPeriodLayout         = "2006-01-02"
+)
+
+// serverLockTTL is a variable, so the tests don't have to wait for the refreshes.
+var serverLockTTL = 30 * time.Second
+
+// serverLockScope groups the server-scoped tasks which can't run at the same time.
+type serverLockScope string
+
+const (
+	// serverLockScopeData - the tasks reading and modifying the tribes, players, villages and their history/stats.
+	serverLockScopeData serverLockScope = "data"
+	// serverLockScopeEnnoblements - the ennoblement updates only conflict with each other.
+	serverLockScopeEnnoblements serverLockScope = "ennoblements"
+)
+
+// skipError means that the server-scoped task hasn't been run.
+// It isn't a failure, so the task is neither retried nor moved to the failed tasks (see task.withSkipHandling).
+type skipError struct {
+	reason string
+	// rescheduleAfter > 0 means that the task is added to the queue again with this delay.
+	rescheduleAfter time.Duration
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+func isSkipError(err error) bool {
+	var skipErr *skipError
+	return errors.As(err, &skipErr)
+}
+
+// withServerLock runs fn while holding a Redis lock for the given server and scope,
+// so only one task of the scope at a time modifies the server data, even if they are processed by different workers.
+// The task doesn't wait for the lock held by another task, it's rescheduled instead
+// (or skipped if it's an ennoblement update - the next one loads the skipped ennoblements anyway).
+// The lock is refreshed until fn returns. The context passed to fn is canceled once the lock is lost
+// (another task has obtained it or it couldn't be refreshed for serverLockTTL*2/3), so fn doesn't modify
+// the server data without holding the lock.
+func (t *task) withServerLock(ctx context.Context, serverKey string, scope serverLockScope, fn func(ctx context.Context) error) error {
+	key := serverLockKeyPrefix + serverKey
+	if scope != serverLockScopeData {
+		key += ":" + string(scope)
+	}
+	obtainCtx, cancel := context.WithTimeout(ctx, serverLockObtainTimeout)
+	lock, err := t.locker.Obtain(obtainCtx, key, serverLockTTL, nil)
+	cancel()
+	if err != nil {
+		if errors.Is(err, redislock.ErrNotObtained) {
+			skipErr := &skipError{
+				reason: serverKey + ": another task is being processed for this server",
+			}
+			if scope == serverLockScopeData {
+				skipErr.rescheduleAfter = serverLockRescheduleDelay
+			}
+			return skipErr
+		}
+		return errors.Wrapf(err, "%s: couldn't obtain the server lock", serverKey)
+	}
+
+	lockCtx, cancelLockCtx := context.WithCancel(ctx)
+	defer cancelLockCtx()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	lost := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(serverLockTTL / 3)
+		defer ticker.Stop()
+		lastRefresh := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), serverLockTTL/3)
+				err := lock.Refresh(ctx, serverLockTTL, nil)
+				cancel()
+				switch {
+				case err == nil:
+					lastRefresh = time.Now()
+				case errors.Is(err, redislock.ErrNotObtained) || time.Since(lastRefresh) >= serverLockTTL*2/3:
+					log.WithField("key", serverKey).Error(errors.Wrapf(err, "%s: the server lock has been lost", serverKey))
+					close(lost)
+					cancelLockCtx()
+					return
+				default:
+					log.WithField("key", serverKey).Warn(errors.Wrapf(err, "%s: couldn't refresh the server lock, retrying", serverKey))
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		close(stop)
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lock.Release(ctx); err != nil && !errors.Is(err, redislock.ErrLockNotHeld) {
+			log.WithField("key", serverKey).Warn(errors.Wrapf(err, "%s: couldn't release the server lock", serverKey))
+		}
+	}()
+
+	err = fn(lockCtx)
+	select {
+	case <-lost:
+		if err != nil {
+			return errors.Wrapf(err, "%s: the server lock has been lost", serverKey)
+		}
+	default:
+	}
+	return err
+}
+
+// withSkipHandling completes the message if the task has returned a skipError, rescheduling it if requested.
+// The task fails permanently if it has already been rescheduled serverLockMaxReschedules times.
+func (t *task) withSkipHandling(h taskq.Handler) taskq.Handler {
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		count := metaFromContext(msg.Ctx).Reschedules
+		err := h.HandleMessage(msg)
+
+		var skipErr *skipError
+		if !errors.As(err, &skipErr) {
+			return err
+		}
+		entry := log.WithField("task", msg.TaskName)
+		if skipErr.rescheduleAfter <= 0 {
+			markTaskSkipped(msg.Ctx)
+			tasksSkipped.WithLabelValues(msg.TaskName, skipResultSkipped).Inc()
+			entry.Infof("%s: the task has been skipped: %s", msg.TaskName, skipErr.reason)
+			return nil
+		}
+		if count >= serverLockMaxReschedules {
+			return &Error{
+				Kind:      ErrorKindConflict,
+				Permanent: true,
+				Err:       errors.Errorf("%s: the task has been rescheduled %d times: %s", msg.TaskName, count, skipErr.reason),
+			}
+		}
+		if err := t.reschedule(msg, count+1, skipErr.rescheduleAfter); err != nil {
+			return errors.Wrapf(err, "%s: couldn't reschedule the task", msg.TaskName)
+		}
+		markTaskSkipped(msg.Ctx)
+		tasksSkipped.WithLabelValues(msg.TaskName, skipResultRescheduled).Inc()
+		entry.
+			WithFields(map[string]interface{}{
+				"delay": skipErr.rescheduleAfter.String(),
+				"count": count + 1,
+			}).
+			Infof("%s: the task has been rescheduled: %s", msg.TaskName, skipErr.reason)
+		return nil
+	})
+}
+
+// reschedule adds a copy of the message to the queue. The copy has no name, so it isn't dropped as a duplicate of the message.
+// The number of reschedules is carried in the metadata of the copy.
+func (t *task) reschedule(msg *taskq.Message, count int, delay time.Duration) error {
+	rescheduled := GetTask(msg.TaskName).WithArgs(msg.Ctx)
+	rescheduled.ArgsBin = msg.ArgsBin
+	if err := setMessageMeta(rescheduled, func(meta *messageMeta) {
+		// the copy is a new message, its attempts are tracked separately
+		*meta = messageMeta{Reschedules: count}
+	}); err != nil {
+		return errors.Wrap(err, "couldn't add the reschedule count to the args")
+	}
+	rescheduled.Delay = delay
+	return t.queue.Add(rescheduled)
+}
+
+// newServerTaskMessage returns a message whose name is unique per task, server and period.
+// taskq drops the messages with a name that has already been added to the queue,
+// so the task is enqueued at most once per period for the given server.
+func newServerTaskMessage(ctx context.Context, taskName, serverKey, period string, args ...interface{}) *taskq.Message {
+	msg := GetTask(taskName).WithArgs(ctx, args...)
+	msg.Name = taskName + ":" + serverKey + ":" + period
+	return msg
+}
+
+// periodOf returns the identifier of the period of the given length which contains t.
+func periodOf(t time.Time, d time.Duration) string {
+	return t.Truncate(d).UTC().Format(time.RFC3339)
+}
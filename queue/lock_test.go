@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+func newTestLockTask(t *testing.T) (*task, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return &task{locker: redislock.New(client)}, mr
+}
+
+func TestWithServerLock(t *testing.T) {
+	tk, mr := newTestLockTask(t)
+	key := serverLockKeyPrefix + "pl1"
+
+	called := false
+	err := tk.withServerLock(context.Background(), "pl1", serverLockScopeData, func(ctx context.Context) error {
+		called = true
+		if !mr.Exists(key) {
+			t.Errorf("the lock %s isn't held", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withServerLock() error = %v", err)
+	}
+	if !called {
+		t.Error("fn hasn't been called")
+	}
+	if mr.Exists(key) {
+		t.Errorf("the lock %s hasn't been released", key)
+	}
+}
+
+func TestWithServerLockHeldByAnotherTask(t *testing.T) {
+	tk, _ := newTestLockTask(t)
+	lock, err := tk.locker.Obtain(context.Background(), serverLockKeyPrefix+"pl1", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(context.Background())
+
+	tests := []struct {
+		scope           serverLockScope
+		rescheduleAfter time.Duration
+	}{
+		{serverLockScopeData, serverLockRescheduleDelay},
+		{serverLockScopeEnnoblements, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.scope), func(t *testing.T) {
+			if tt.scope != serverLockScopeData {
+				other, err := tk.locker.Obtain(context.Background(), serverLockKeyPrefix+"pl1:"+string(tt.scope), time.Minute, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer other.Release(context.Background())
+			}
+			err := tk.withServerLock(context.Background(), "pl1", tt.scope, func(ctx context.Context) error {
+				t.Error("fn has been called without the lock")
+				return nil
+			})
+			var skipErr *skipError
+			if !errors.As(err, &skipErr) {
+				t.Fatalf("withServerLock() error = %v, want *skipError", err)
+			}
+			if skipErr.rescheduleAfter != tt.rescheduleAfter {
+				t.Errorf("rescheduleAfter = %s, want %s", skipErr.rescheduleAfter, tt.rescheduleAfter)
+			}
+		})
+	}
+}
+
+func TestWithServerLockLost(t *testing.T) {
+	defer func(ttl time.Duration) {
+		serverLockTTL = ttl
+	}(serverLockTTL)
+	serverLockTTL = 300 * time.Millisecond
+
+	tk, mr := newTestLockTask(t)
+	err := tk.withServerLock(context.Background(), "pl1", serverLockScopeData, func(ctx context.Context) error {
+		// e.g. the lock has expired while the worker was stalled
+		mr.Del(serverLockKeyPrefix + "pl1")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			t.Error("the context hasn't been canceled after losing the lock")
+			return nil
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("withServerLock() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestPeriodOf(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		d    time.Duration
+		want string
+	}{
+		{"start of the period", time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC), time.Hour, "2021-05-01T12:00:00Z"},
+		{"middle of the period", time.Date(2021, 5, 1, 12, 59, 59, 0, time.UTC), time.Hour, "2021-05-01T12:00:00Z"},
+		{"next period", time.Date(2021, 5, 1, 13, 0, 0, 0, time.UTC), time.Hour, "2021-05-01T13:00:00Z"},
+		{"minutes", time.Date(2021, 5, 1, 12, 7, 30, 0, time.UTC), 5 * time.Minute, "2021-05-01T12:05:00Z"},
+		{"another location", time.Date(2021, 5, 1, 14, 30, 0, 0, warsaw), time.Hour, "2021-05-01T12:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := periodOf(tt.t, tt.d); got != tt.want {
+				t.Errorf("periodOf() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
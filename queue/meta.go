@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/taskq/v3"
+
+	"github.com/tribalwarshelp/dataupdater/tracing"
+)
+
+// messageMeta is the metadata of a message. taskq messages don't have headers,
+// so it's prepended to the message args as a single envelope. The envelope is added by Queue.Add (the trace context)
+// and withMessageMeta (the attempt ID, the reschedule count), and removed only by withMessageMeta.
+// The handlers never see it, they access the metadata via metaFromContext.
+type messageMeta struct {
+	// Trace is the trace context of the span which has added the message (see withTracing).
+	Trace tracing.Carrier `msgpack:"trace,omitempty"`
+	// AttemptID identifies the message across its retries (see deadLetterStore.withAttemptTracking).
+	AttemptID string `msgpack:"attempt,omitempty"`
+	// Reschedules is the number of times the task has been rescheduled (see task.withSkipHandling).
+	Reschedules int `msgpack:"rescheduled,omitempty"`
+}
+
+func (m *messageMeta) empty() bool {
+	return m.Trace == nil && m.AttemptID == "" && m.Reschedules == 0
+}
+
+type metaEnvelope struct {
+	Meta *messageMeta `msgpack:"__meta"`
+}
+
+type messageMetaKey struct{}
+
+// metaFromContext returns the metadata of the message being processed, the changes are saved in the message args.
+func metaFromContext(ctx context.Context) *messageMeta {
+	if ctx != nil {
+		if meta, ok := ctx.Value(messageMetaKey{}).(*messageMeta); ok {
+			return meta
+		}
+	}
+	return &messageMeta{}
+}
+
+// withMessageMeta removes the metadata envelope from the args and passes the metadata to the handler via msg.Ctx.
+// The envelope is added back after the handler has returned, so the changed metadata is carried to the next attempt.
+// It must be the outermost handler.
+func withMessageMeta(h taskq.Handler) taskq.Handler {
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		argsBin, err := msg.MarshalArgs()
+		if err != nil {
+			return errors.Wrapf(err, "%s: couldn't marshal the args", msg.TaskName)
+		}
+		meta, unwrapped, ok := unwrapMeta(argsBin)
+		if !ok {
+			meta = &messageMeta{}
+			unwrapped = argsBin
+		}
+		origCtx := msg.Ctx
+		parent := origCtx
+		if parent == nil {
+			parent = context.Background()
+		}
+		msg.ArgsBin = unwrapped
+		msg.Ctx = context.WithValue(parent, messageMetaKey{}, meta)
+
+		err = h.HandleMessage(msg)
+
+		msg.Ctx = origCtx
+		msg.ArgsBin = argsBin
+		if !meta.empty() {
+			wrapped, wrapErr := wrapMeta(unwrapped, meta)
+			if wrapErr != nil {
+				log.WithField("task", msg.TaskName).Warn(errors.Wrapf(wrapErr, "%s: couldn't add the metadata to the args", msg.TaskName))
+			} else {
+				msg.ArgsBin = wrapped
+			}
+		}
+		return err
+	})
+}
+
+// setMessageMeta changes the metadata in the args of a message which is going to be added to the queue.
+func setMessageMeta(msg *taskq.Message, fn func(meta *messageMeta)) error {
+	argsBin, err := msg.MarshalArgs()
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal the args")
+	}
+	meta, unwrapped, ok := unwrapMeta(argsBin)
+	if !ok {
+		meta = &messageMeta{}
+		unwrapped = argsBin
+	}
+	fn(meta)
+	if meta.empty() {
+		msg.ArgsBin = unwrapped
+		return nil
+	}
+	wrapped, err := wrapMeta(unwrapped, meta)
+	if err != nil {
+		return errors.Wrap(err, "couldn't add the metadata to the args")
+	}
+	msg.ArgsBin = wrapped
+	return nil
+}
+
+// wrapMeta prepends the metadata envelope to the msgpack-encoded args.
+func wrapMeta(argsBin []byte, meta *messageMeta) ([]byte, error) {
+	return prependArg(argsBin, &metaEnvelope{Meta: meta})
+}
+
+// unwrapMeta removes the metadata envelope from the msgpack-encoded args.
+// It reports false if the args don't start with the envelope.
+func unwrapMeta(argsBin []byte) (*messageMeta, []byte, bool) {
+	raw, rest, ok := shiftArg(argsBin)
+	if !ok {
+		return nil, nil, false
+	}
+	envelope := &metaEnvelope{}
+	if err := msgpack.Unmarshal(raw, envelope); err != nil || envelope.Meta == nil {
+		return nil, nil, false
+	}
+	return envelope.Meta, rest, true
+}
+
+// prependArg prepends the given value to the msgpack-encoded args.
+func prependArg(argsBin []byte, v interface{}) ([]byte, error) {
+	r := bytes.NewReader(argsBin)
+	n, err := msgpack.NewDecoder(r).DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n == -1 {
+		n = 0
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	if err := enc.EncodeArrayLen(n + 1); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	buf.Write(argsBin[len(argsBin)-r.Len():])
+	return buf.Bytes(), nil
+}
+
+// shiftArg splits the msgpack-encoded args into the first arg and the remaining args.
+func shiftArg(argsBin []byte) (msgpack.RawMessage, []byte, bool) {
+	r := bytes.NewReader(argsBin)
+	dec := msgpack.NewDecoder(r)
+	n, err := dec.DecodeArrayLen()
+	if err != nil || n < 1 {
+		return nil, nil, false
+	}
+	var raw msgpack.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, nil, false
+	}
+
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).EncodeArrayLen(n - 1); err != nil {
+		return nil, nil, false
+	}
+	buf.Write(argsBin[len(argsBin)-r.Len():])
+	return raw, buf.Bytes(), true
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/taskq/v3"
+
+	"github.com/tribalwarshelp/dataupdater/tracing"
+)
+
+func TestWrapMeta(t *testing.T) {
+	meta := &messageMeta{
+		Trace:       tracing.Carrier{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		AttemptID:   "attempt-id",
+		Reschedules: 3,
+	}
+
+	tests := []struct {
+		name string
+		args []interface{}
+	}{
+		{"no args", []interface{}{}},
+		{"one arg", []interface{}{"pl"}},
+		{"many args", []interface{}{"https://pl170.plemiona.pl", map[string]interface{}{"key": "pl170"}, int8(3)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsBin, err := msgpack.Marshal(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wrapped, err := wrapMeta(argsBin, meta)
+			if err != nil {
+				t.Fatalf("wrapMeta() error = %v", err)
+			}
+
+			got, unwrapped, ok := unwrapMeta(wrapped)
+			if !ok {
+				t.Fatal("unwrapMeta() didn't find the envelope")
+			}
+			if !reflect.DeepEqual(got, meta) {
+				t.Errorf("meta = %+v, want %+v", got, meta)
+			}
+			if string(unwrapped) != string(argsBin) {
+				t.Errorf("args = %x, want %x", unwrapped, argsBin)
+			}
+		})
+	}
+}
+
+func TestUnwrapMetaWithoutEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		args interface{}
+	}{
+		{"no args", []interface{}{}},
+		{"string arg", []interface{}{"pl"}},
+		{"map arg without the metadata", []interface{}{map[string]interface{}{"key": "pl170"}}},
+		{"not an array", "pl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsBin, err := msgpack.Marshal(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, ok := unwrapMeta(argsBin); ok {
+				t.Error("unwrapMeta() reported the envelope in the args without it")
+			}
+		})
+	}
+}
+
+func TestWithMessageMeta(t *testing.T) {
+	argsBin, err := msgpack.Marshal([]interface{}{"en115", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wrapMeta(argsBin, &messageMeta{Reschedules: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &taskq.Message{
+		TaskName: "test",
+		ArgsBin:  wrapped,
+	}
+
+	handlerErr := errors.New("failed")
+	err = withMessageMeta(taskq.HandlerFunc(func(msg *taskq.Message) error {
+		if string(msg.ArgsBin) != string(argsBin) {
+			t.Errorf("the handler got the args %x, want %x", msg.ArgsBin, argsBin)
+		}
+		meta := metaFromContext(msg.Ctx)
+		if meta.Reschedules != 2 {
+			t.Errorf("Reschedules = %d, want 2", meta.Reschedules)
+		}
+		meta.AttemptID = "attempt-id"
+		return handlerErr
+	})).HandleMessage(msg)
+	if err != handlerErr {
+		t.Errorf("HandleMessage() error = %v, want %v", err, handlerErr)
+	}
+
+	// the changed metadata is carried to the next attempt
+	meta, unwrapped, ok := unwrapMeta(msg.ArgsBin)
+	if !ok {
+		t.Fatal("the metadata envelope hasn't been added back to the args")
+	}
+	if want := (&messageMeta{AttemptID: "attempt-id", Reschedules: 2}); !reflect.DeepEqual(meta, want) {
+		t.Errorf("meta = %+v, want %+v", meta, want)
+	}
+	if string(unwrapped) != string(argsBin) {
+		t.Errorf("args = %x, want %x", unwrapped, argsBin)
+	}
+	if msg.Ctx != nil {
+		t.Error("msg.Ctx hasn't been restored")
+	}
+}
@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"github.com/vmihailenco/taskq/v3"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+)
+
+const (
+	taskOutcomeSucceeded      = "succeeded"
+	taskOutcomeFailed         = "failed"
+	taskOutcomeSkipped        = "skipped"
+	addResultAdded            = "added"
+	addResultDuplicate        = "duplicate"
+	addResultFailed           = "failed"
+	skipResultSkipped         = "skipped"
+	skipResultRescheduled     = "rescheduled"
+	queueStatsCollectTimeout  = 5 * time.Second
+	dataloaderCallUnknownFile = "unknown"
+)
+
+var (
+	taskDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dataupdater_task_duration_seconds",
+		Help:    "Duration of the task executions, by task name and version code.",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"task", "version"})
+	tasksProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dataupdater_tasks_processed_total",
+		Help: "Number of task executions, by task name, version code and outcome (succeeded, failed, skipped).",
+	}, []string{"task", "version", "outcome"})
+	tasksSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dataupdater_tasks_skipped_total",
+		Help: "Number of task executions which haven't run the task (e.g. the server lock is held by another task), by task name and result (skipped, rescheduled).",
+	}, []string{"task", "result"})
+	messagesAdded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dataupdater_queue_messages_added_total",
+		Help: "Number of messages added to the queues, by task name, queue and result (added, duplicate, failed).",
+	}, []string{"task", "queue", "result"})
+	dataloaderCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dataupdater_dataloader_call_duration_seconds",
+		Help:    "Duration of the requests sent to TW servers (until the body is read, without waiting for the rate limiter), by version code and file.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"version", "file"})
+	dataloaderBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dataupdater_dataloader_bytes_total",
+		Help: "Number of bytes downloaded from TW servers, by version code and file.",
+	}, []string{"version", "file"})
+	queueMessagesDesc = prometheus.NewDesc(
+		"dataupdater_queue_messages",
+		"Number of messages in the queue, by queue and state (pending, in_flight, delayed).",
+		[]string{"queue", "state"},
+		nil,
+	)
+)
+
+type taskLabelsKey struct{}
+
+// taskLabels contains the labels of the task metrics which depend on the task args, they're set by the handler.
+type taskLabels struct {
+	version twmodel.VersionCode
+	// skipped means that the task hasn't been run (see task.withSkipHandling)
+	skipped bool
+}
+
+// setTaskVersion sets the version label of the metrics of the task being processed.
+func setTaskVersion(ctx context.Context, code twmodel.VersionCode) {
+	if labels, ok := ctx.Value(taskLabelsKey{}).(*taskLabels); ok {
+		labels.version = code
+	}
+}
+
+// markTaskSkipped sets the skipped outcome of the task being processed.
+func markTaskSkipped(ctx context.Context) {
+	if labels, ok := ctx.Value(taskLabelsKey{}).(*taskLabels); ok {
+		labels.skipped = true
+	}
+}
+
+func withMetrics(h taskq.Handler) taskq.Handler {
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		start := time.Now()
+		labels := &taskLabels{}
+		origCtx := msg.Ctx
+		parent := origCtx
+		if parent == nil {
+			parent = context.Background()
+		}
+		msg.Ctx = context.WithValue(parent, taskLabelsKey{}, labels)
+		err := h.HandleMessage(msg)
+		msg.Ctx = origCtx
+		outcome := taskOutcomeSucceeded
+		if err != nil {
+			outcome = taskOutcomeFailed
+		} else if labels.skipped {
+			outcome = taskOutcomeSkipped
+		}
+		version := string(labels.version)
+		taskDuration.WithLabelValues(msg.TaskName, version).Observe(time.Since(start).Seconds())
+		tasksProcessed.WithLabelValues(msg.TaskName, version, outcome).Inc()
+		return err
+	})
+}
+
+func metricsMiddleware(versionCode string) transportMiddleware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &metricsTransport{
+			rt:          rt,
+			versionCode: versionCode,
+		}
+	}
+}
+
+type metricsTransport struct {
+	rt          http.RoundTripper
+	versionCode string
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file, err := dataloader.FileNameFromURL(req.URL)
+	if err != nil {
+		file = dataloaderCallUnknownFile
+	}
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		dataloaderCallDuration.WithLabelValues(t.versionCode, file).Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+	resp.Body = &countingBody{
+		ReadCloser: resp.Body,
+		done: func(n int64) {
+			dataloaderCallDuration.WithLabelValues(t.versionCode, file).Observe(time.Since(start).Seconds())
+			dataloaderBytes.WithLabelValues(t.versionCode, file).Add(float64(n))
+		},
+	}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n      int64
+	done   func(n int64)
+	closed bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.done(b.n)
+	}
+	return err
+}
+
+// queueCollector exports the number of messages in the queues, it loads the stats from Redis on every scrape.
+type queueCollector struct {
+	queue *Queue
+}
+
+var _ prometheus.Collector = (*queueCollector)(nil)
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueMessagesDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), queueStatsCollectTimeout)
+	defer cancel()
+	stats, err := c.queue.Stats(ctx)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	for _, s := range stats {
+		ch <- prometheus.MustNewConstMetric(queueMessagesDesc, prometheus.GaugeValue, float64(s.Pending), s.Name, "pending")
+		ch <- prometheus.MustNewConstMetric(queueMessagesDesc, prometheus.GaugeValue, float64(s.InFlight), s.Name, "in_flight")
+		ch <- prometheus.MustNewConstMetric(queueMessagesDesc, prometheus.GaugeValue, float64(s.Delayed), s.Name, "delayed")
+	}
+}
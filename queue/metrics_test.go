@@ -0,0 +1,42 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+func TestWithMetricsOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		outcome string
+	}{
+		{"succeeded", nil, taskOutcomeSucceeded},
+		{"failed", errors.New("failed"), taskOutcomeFailed},
+		{"skipped", &skipError{reason: "the server has been paused"}, taskOutcomeSkipped},
+	}
+
+	tk := &task{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskName := "testWithMetricsOutcome_" + tt.name
+			h := withMetrics(tk.withSkipHandling(taskq.HandlerFunc(func(msg *taskq.Message) error {
+				return tt.err
+			})))
+			_ = h.HandleMessage(&taskq.Message{TaskName: taskName})
+
+			for _, outcome := range []string{taskOutcomeSucceeded, taskOutcomeFailed, taskOutcomeSkipped} {
+				want := 0.0
+				if outcome == tt.outcome {
+					want = 1
+				}
+				if got := testutil.ToFloat64(tasksProcessed.WithLabelValues(taskName, "", outcome)); got != want {
+					t.Errorf("tasksProcessed{outcome=%q} = %v, want %v", outcome, got, want)
+				}
+			}
+		})
+	}
+}
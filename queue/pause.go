@@ -0,0 +1,27 @@
+package queue
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+// loadPausedServerKeys returns the keys of the paused servers of the version.
+func (t *task) loadPausedServerKeys(ctx context.Context, code twmodel.VersionCode) (map[string]bool, error) {
+	var keys []string
+	err := t.db.WithContext(ctx).
+		Model(&model.ServerPause{}).
+		Column("server_key").
+		Where("server_key IN (SELECT key FROM servers WHERE version_code = ?)", code).
+		Select(&keys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: couldn't load the paused servers", code)
+	}
+	paused := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		paused[key] = true
+	}
+	return paused, nil
+}
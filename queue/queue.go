@@ -2,22 +2,63 @@ package queue
 
 import (
 	"context"
+	"fmt"
+	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/vmihailenco/taskq/v3"
 	"github.com/vmihailenco/taskq/v3/redisq"
+
+	"github.com/tribalwarshelp/dataupdater/model"
 )
 
 var log = logrus.WithField("package", "pkg/queue")
 
+const (
+	// legacyMainQueue is the queue all tasks except the ennoblement updates were added to
+	// before they were split into the data, history and maintenance queues.
+	legacyMainQueue         = "main"
+	legacyQueueCheckTimeout = 5 * time.Second
+)
+
+// defaultRoutes maps the task names to the queues they are added to.
+var defaultRoutes = map[string]string{
+	LoadVersionsAndUpdateServerData: DataQueue,
+	LoadServersAndUpdateData:        DataQueue,
+	UpdateServerData:                DataQueue,
+	UpdateHistory:                   HistoryQueue,
+	UpdateVersionHistory:            HistoryQueue,
+	UpdateServerHistory:             HistoryQueue,
+	UpdateStats:                     HistoryQueue,
+	UpdateVersionStats:              HistoryQueue,
+	UpdateServerStats:               HistoryQueue,
+	Vacuum:                          MaintenanceQueue,
+	VacuumServerData:                MaintenanceQueue,
+	DeleteNonExistentVillages:       MaintenanceQueue,
+	ServerDeleteNonExistentVillages: MaintenanceQueue,
+	UpdateEnnoblements:              EnnoblementsQueue,
+	UpdateServerEnnoblements:        EnnoblementsQueue,
+}
+
 type Queue struct {
-	redis        redis.UniversalClient
-	main         taskq.Queue
-	ennoblements taskq.Queue
-	factory      taskq.Factory
+	redis  redis.UniversalClient
+	db     *pg.DB
+	queues map[string]taskq.Queue
+	// legacy is the legacy main queue, it's registered only if it still had messages on startup
+	legacy  taskq.Queue
+	routes  map[string]string
+	factory taskq.Factory
+	fetches *fetchMonitor
+	// task is used by the methods running the tasks outside the queue workers (e.g. ReplayServerData)
+	task *task
+
+	mu        sync.Mutex
+	startedAt time.Time
 }
 
 func New(cfg *Config) (*Queue, error) {
@@ -27,23 +68,88 @@ func New(cfg *Config) (*Queue, error) {
 
 	q := &Queue{
 		redis: cfg.Redis,
+		db:    cfg.DB,
 	}
 
 	if err := q.init(cfg); err != nil {
 		return nil, err
 	}
 
+	if err := prometheus.Register(&queueCollector{q}); err != nil {
+		log.Warn(errors.Wrap(err, "couldn't register the queue metrics"))
+	}
+
 	return q, nil
 }
 
 func (q *Queue) init(cfg *Config) error {
 	q.factory = redisq.NewFactory()
-	q.main = q.registerQueue("main", cfg.WorkerLimit)
-	q.ennoblements = q.registerQueue("ennoblements", cfg.WorkerLimit)
+	q.fetches = newFetchMonitor(QueueNames())
+	q.redis.AddHook(q.fetches)
+	q.queues = make(map[string]taskq.Queue)
+	for _, name := range QueueNames() {
+		queueCfg := &QueueConfig{}
+		if c, ok := cfg.Queues[name]; ok && c != nil {
+			*queueCfg = *c
+		}
+		if queueCfg.WorkerLimit == 0 {
+			queueCfg.WorkerLimit = cfg.WorkerLimit
+		}
+		if queueCfg.ReservationTimeout == 0 {
+			queueCfg.ReservationTimeout = DefaultReservationTimeout
+		}
+		q.queues[name] = q.registerQueue(name, queueCfg)
+	}
+
+	if err := q.registerLegacyQueue(); err != nil {
+		log.Warn(errors.Wrap(err, "the messages left in the legacy queue won't be processed"))
+	}
+
+	q.routes = make(map[string]string, len(defaultRoutes))
+	for taskName, queueName := range defaultRoutes {
+		q.routes[taskName] = queueName
+	}
+	for taskName, queueName := range cfg.Routes {
+		q.routes[taskName] = queueName
+	}
+
+	retention := DefaultRetention()
+	if cfg.Retention.History > 0 {
+		retention.History = cfg.Retention.History
+	}
+	if cfg.Retention.DeletedPlayers > 0 {
+		retention.DeletedPlayers = cfg.Retention.DeletedPlayers
+	}
+	if cfg.Retention.DeletedTribes > 0 {
+		retention.DeletedTribes = cfg.Retention.DeletedTribes
+	}
+	if cfg.Retention.TaskRuns > 0 {
+		retention.TaskRuns = cfg.Retention.TaskRuns
+	}
+	if cfg.Retention.Snapshots > 0 {
+		retention.Snapshots = cfg.Retention.Snapshots
+	}
+	updateHistorySpec := cfg.UpdateHistorySpec
+	if updateHistorySpec == "" {
+		updateHistorySpec = DefaultUpdateHistorySpec
+	}
+	updateStatsSpec := cfg.UpdateStatsSpec
+	if updateStatsSpec == "" {
+		updateStatsSpec = DefaultUpdateStatsSpec
+	}
 
 	if err := registerTasks(&registerTasksConfig{
-		DB:    cfg.DB,
-		Queue: q,
+		DB:                 cfg.DB,
+		Queue:              q,
+		ServerDataDir:      cfg.ServerDataDir,
+		Archiver:           cfg.Archiver,
+		RateLimiter:        cfg.RateLimiter,
+		HTTPTimeout:        httpTimeoutOrDefault(cfg.HTTPTimeout),
+		TransactionTimeout: transactionTimeoutOrDefault(cfg.TransactionTimeout),
+		BulkLoadThreshold:  cfg.BulkLoadThreshold,
+		Retention:          retention,
+		UpdateHistorySpec:  updateHistorySpec,
+		UpdateStatsSpec:    updateStatsSpec,
 	}); err != nil {
 		return errors.Wrapf(err, "couldn't register tasks")
 	}
@@ -51,41 +157,68 @@ func (q *Queue) init(cfg *Config) error {
 	return nil
 }
 
-func (q *Queue) registerQueue(name string, limit int) taskq.Queue {
+func (q *Queue) registerQueue(name string, cfg *QueueConfig) taskq.Queue {
+	log.
+		WithFields(map[string]interface{}{
+			"queue":              name,
+			"workerLimit":        cfg.WorkerLimit,
+			"reservationTimeout": cfg.ReservationTimeout.String(),
+		}).
+		Debugf("registering the queue '%s'", name)
 	return q.factory.RegisterQueue(&taskq.QueueOptions{
 		Name:               name,
-		ReservationTimeout: time.Minute * 2,
+		ReservationTimeout: cfg.ReservationTimeout,
 		Redis:              q.redis,
-		MinNumWorker:       int32(limit),
-		MaxNumWorker:       int32(limit),
+		MinNumWorker:       int32(cfg.WorkerLimit),
+		MaxNumWorker:       int32(cfg.WorkerLimit),
 	})
 }
 
-func (q *Queue) getQueueByTaskName(name string) taskq.Queue {
-	switch name {
-	case LoadVersionsAndUpdateServerData,
-		LoadServersAndUpdateData,
-		UpdateServerData,
-		Vacuum,
-		VacuumServerData,
-		UpdateHistory,
-		UpdateServerHistory,
-		UpdateStats,
-		UpdateServerStats,
-		DeleteNonExistentVillages,
-		ServerDeleteNonExistentVillages:
-		return q.main
-	case UpdateEnnoblements,
-		UpdateServerEnnoblements:
-		return q.ennoblements
+// registerLegacyQueue registers the legacy main queue with one worker if it still has messages,
+// so the tasks pending at the time of the upgrade aren't lost. Nothing is added to it anymore.
+func (q *Queue) registerLegacyQueue() error {
+	ctx, cancel := context.WithTimeout(context.Background(), legacyQueueCheckTimeout)
+	defer cancel()
+	pending, err := q.redis.XLen(ctx, fmt.Sprintf(taskqStreamKeyFormat, legacyMainQueue)).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "couldn't check the length of the legacy queue")
 	}
+	delayed, err := q.redis.ZCard(ctx, fmt.Sprintf(taskqZSetKeyFormat, legacyMainQueue)).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "couldn't check the delayed messages of the legacy queue")
+	}
+	if pending+delayed == 0 {
+		return nil
+	}
+	log.
+		WithFields(map[string]interface{}{
+			"queue":   legacyMainQueue,
+			"pending": pending,
+			"delayed": delayed,
+		}).
+		Infof("the legacy queue '%s' still has messages, it's going to be drained", legacyMainQueue)
+	q.legacy = q.registerQueue(legacyMainQueue, &QueueConfig{
+		WorkerLimit:        1,
+		ReservationTimeout: DefaultReservationTimeout,
+	})
 	return nil
 }
 
+func (q *Queue) getQueueByTaskName(name string) taskq.Queue {
+	queueName, ok := q.routes[name]
+	if !ok {
+		return nil
+	}
+	return q.queues[queueName]
+}
+
 func (q *Queue) Start(ctx context.Context) error {
 	if err := q.factory.StartConsumers(ctx); err != nil {
 		return errors.Wrap(err, "couldn't start the queue")
 	}
+	q.mu.Lock()
+	q.startedAt = time.Now()
+	q.mu.Unlock()
 	return nil
 }
 
@@ -99,10 +232,37 @@ func (q *Queue) Close() error {
 func (q *Queue) Add(msg *taskq.Message) error {
 	queue := q.getQueueByTaskName(msg.TaskName)
 	if queue == nil {
+		messagesAdded.WithLabelValues(msg.TaskName, "", addResultFailed).Inc()
 		return errors.Errorf("couldn't add the message to the queue: unknown task name '%s'", msg.TaskName)
 	}
+	if err := injectTraceContext(msg); err != nil {
+		log.WithField("task", msg.TaskName).Warn(errors.Wrapf(err, "%s: the message is added without the trace context", msg.TaskName))
+	}
 	if err := queue.Add(msg); err != nil {
+		messagesAdded.WithLabelValues(msg.TaskName, queue.Name(), addResultFailed).Inc()
 		return errors.Wrap(err, "couldn't add the message to the queue")
 	}
+	if msg.Err == taskq.ErrDuplicate {
+		messagesAdded.WithLabelValues(msg.TaskName, queue.Name(), addResultDuplicate).Inc()
+		log.
+			WithField("task", msg.TaskName).
+			Debugf("%s: the message '%s' has already been added to the queue", msg.TaskName, msg.Name)
+		return nil
+	}
+	messagesAdded.WithLabelValues(msg.TaskName, queue.Name(), addResultAdded).Inc()
 	return nil
 }
+
+// Requeue adds the failed task back to the queue with its original args.
+func (q *Queue) Requeue(ft *model.FailedTask) error {
+	if ft == nil {
+		return errors.New("expected *model.FailedTask, got nil")
+	}
+	task := GetTask(ft.TaskName)
+	if task == nil || task.Name() != ft.TaskName {
+		return errors.Errorf("couldn't requeue the failed task: unknown task name '%s'", ft.TaskName)
+	}
+	msg := task.WithArgs(context.Background())
+	msg.ArgsBin = ft.ArgsBin
+	return q.Add(msg)
+}
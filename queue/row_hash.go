@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"hash/fnv"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+// rowChanges is the result of comparing the rows fetched from the TW server
+// with the hashes saved during the previous update.
+type rowChanges struct {
+	table string
+	// rows are the indexes of the new and changed rows
+	rows      []int
+	inserted  int
+	changed   int
+	unchanged int
+	// hashes are the hashes of the new and changed rows
+	hashes []*model.RowHash
+	// stale are the IDs of the saved hashes missing in the fetched data (e.g. deleted players),
+	// they're deleted, so the rows are updated once they're back
+	stale []int
+	// rewrite means all saved hashes are replaced with the hashes of the fetched rows (see allRowsChanged)
+	rewrite bool
+}
+
+type savedRowHash struct {
+	ID   int
+	Hash int64
+}
+
+// savedRowHashesQuery reads only the row_hashes table, not the table of the entity.
+const savedRowHashesQuery = `SELECT id, hash FROM ?SERVER.row_hashes WHERE entity = ?`
+
+func hashRow(b []byte) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return int64(h.Sum64())
+}
+
+// detectChanges hashes the columns saved by the upsert and compares the hashes with the saved ones.
+func detectChanges(tx *pg.Tx, u bulkUpsert) (*rowChanges, error) {
+	var saved []savedRowHash
+	if _, err := tx.Query(&saved, savedRowHashesQuery, u.table); err != nil {
+		return nil, errors.Wrapf(err, "couldn't load the hashes of %s", u.table)
+	}
+	return compareRowHashes(u, saved), nil
+}
+
+// compareRowHashes compares the hashes of the upserted rows with the saved ones.
+// A row without a saved hash is inserted, e.g. a new row or a row that is back after being marked deleted
+// (the hashes of the rows deleted from the table are deleted along with them, see workerDeleteNonExistentVillages).
+// The hashes of the rows missing in the fetched data are stale.
+func compareRowHashes(u bulkUpsert, saved []savedRowHash) *rowChanges {
+	previous := make(map[int]int64, len(saved))
+	for _, s := range saved {
+		previous[s.ID] = s.Hash
+	}
+
+	changes := &rowChanges{table: u.table}
+	current := make(map[int]bool, u.rows)
+	r := &copyRow{}
+	for i := 0; i < u.rows; i++ {
+		r.reset()
+		u.writeRow(r, i)
+		id := u.id(i)
+		hash := hashRow(r.b)
+		current[id] = true
+
+		prev, exists := previous[id]
+		switch {
+		case !exists:
+			changes.inserted++
+		case prev != hash:
+			changes.changed++
+		default:
+			changes.unchanged++
+			continue
+		}
+		changes.rows = append(changes.rows, i)
+		changes.hashes = append(changes.hashes, &model.RowHash{
+			Entity: u.table,
+			ID:     id,
+			Hash:   hash,
+		})
+	}
+	for _, s := range saved {
+		if !current[s.ID] {
+			changes.stale = append(changes.stale, s.ID)
+		}
+	}
+	return changes
+}
+
+// allRowsChanged hashes the columns saved by the upsert without comparing them with the saved hashes.
+// All rows are changed, so they're all saved and their hashes replace the saved ones.
+func allRowsChanged(u bulkUpsert) *rowChanges {
+	changes := &rowChanges{
+		table:   u.table,
+		rows:    make([]int, u.rows),
+		changed: u.rows,
+		hashes:  make([]*model.RowHash, u.rows),
+		rewrite: true,
+	}
+	r := &copyRow{}
+	for i := 0; i < u.rows; i++ {
+		r.reset()
+		u.writeRow(r, i)
+		changes.rows[i] = i
+		changes.hashes[i] = &model.RowHash{
+			Entity: u.table,
+			ID:     u.id(i),
+			Hash:   hashRow(r.b),
+		}
+	}
+	return changes
+}
+
+// saveRowHashes saves the hashes of the new and changed rows and deletes the stale ones (or all saved ones if they're rewritten).
+func (w *workerUpdateServerData) saveRowHashes(tx *pg.Tx, changes ...*rowChanges) error {
+	var hashes []*model.RowHash
+	for _, c := range changes {
+		if c == nil {
+			continue
+		}
+		hashes = append(hashes, c.hashes...)
+		if c.rewrite {
+			if _, err := tx.Model((*model.RowHash)(nil)).
+				Where("entity = ?", c.table).
+				Delete(); err != nil {
+				return errors.Wrapf(err, "couldn't delete the hashes of %s", c.table)
+			}
+			continue
+		}
+		if len(c.stale) == 0 {
+			continue
+		}
+		if _, err := tx.Model((*model.RowHash)(nil)).
+			Where("entity = ?", c.table).
+			Where("id = ANY (?)", pg.Array(c.stale)).
+			Delete(); err != nil {
+			return errors.Wrapf(err, "couldn't delete the stale hashes of %s", c.table)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	if w.useBulkLoad(len(hashes)) {
+		return bulkUpsert{
+			table:    "row_hashes",
+			columns:  []string{"entity", "id", "hash"},
+			conflict: "(entity, id)",
+			set:      excludedSet("hash"),
+			rows:     len(hashes),
+			writeRow: func(r *copyRow, i int) {
+				r.string(hashes[i].Entity)
+				r.int(hashes[i].ID)
+				r.int64(hashes[i].Hash)
+			},
+		}.exec(tx)
+	}
+	if _, err := tx.Model(&hashes).
+		OnConflict("(entity, id) DO UPDATE").
+		Set("hash = EXCLUDED.hash").
+		Returning("NULL").
+		Insert(); err != nil {
+		return errors.Wrap(err, "couldn't save the row hashes")
+	}
+	return nil
+}
+
+func filterTribes(tribes []*twmodel.Tribe, c *rowChanges) []*twmodel.Tribe {
+	filtered := make([]*twmodel.Tribe, len(c.rows))
+	for i, index := range c.rows {
+		filtered[i] = tribes[index]
+	}
+	return filtered
+}
+
+func filterPlayers(players []*twmodel.Player, c *rowChanges) []*twmodel.Player {
+	filtered := make([]*twmodel.Player, len(c.rows))
+	for i, index := range c.rows {
+		filtered[i] = players[index]
+	}
+	return filtered
+}
+
+func filterVillages(villages []*twmodel.Village, c *rowChanges) []*twmodel.Village {
+	filtered := make([]*twmodel.Village, len(c.rows))
+	for i, index := range c.rows {
+		filtered[i] = villages[index]
+	}
+	return filtered
+}
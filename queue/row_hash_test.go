@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+type testRow struct {
+	id   int
+	name string
+}
+
+func newTestUpsert(rows ...testRow) bulkUpsert {
+	return bulkUpsert{
+		table: "player",
+		rows:  len(rows),
+		writeRow: func(r *copyRow, i int) {
+			r.int(rows[i].id)
+			r.string(rows[i].name)
+		},
+		id: func(i int) int {
+			return rows[i].id
+		},
+	}
+}
+
+func testRowHash(row testRow) int64 {
+	r := &copyRow{}
+	r.int(row.id)
+	r.string(row.name)
+	return hashRow(r.b)
+}
+
+func TestHashRow(t *testing.T) {
+	// the FNV-1a offset basis
+	if got, want := hashRow(nil), int64(-3750763034362895579); got != want {
+		t.Errorf("hashRow(nil) = %d, want %d", got, want)
+	}
+	if hashRow([]byte("1,abc")) != hashRow([]byte("1,abc")) {
+		t.Error("hashRow returned different hashes for the same row")
+	}
+	if hashRow([]byte("1,abc")) == hashRow([]byte("1,abd")) {
+		t.Error("hashRow returned the same hash for different rows")
+	}
+}
+
+func TestSavedRowHashesQuery(t *testing.T) {
+	// the query mustn't read the table of the entity (the whole villages table used to be joined on every update)
+	query := string(orm.NewFormatter().WithParam("SERVER", pg.Safe("pl1")).FormatQuery(nil, savedRowHashesQuery, "villages"))
+	want := `SELECT id, hash FROM pl1.row_hashes WHERE entity = 'villages'`
+	if query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+}
+
+func TestCompareRowHashes(t *testing.T) {
+	alice := testRow{1, "alice"}
+	bob := testRow{2, "bob"}
+	renamedBob := testRow{2, "bobby"}
+
+	tests := []struct {
+		name      string
+		rows      []testRow
+		saved     []savedRowHash
+		wantRows  []int
+		inserted  int
+		changed   int
+		unchanged int
+		stale     []int
+	}{
+		{
+			name:     "inserted",
+			rows:     []testRow{alice, bob},
+			wantRows: []int{0, 1},
+			inserted: 2,
+		},
+		{
+			name:      "changed",
+			rows:      []testRow{alice, renamedBob},
+			saved:     []savedRowHash{{alice.id, testRowHash(alice)}, {bob.id, testRowHash(bob)}},
+			wantRows:  []int{1},
+			changed:   1,
+			unchanged: 1,
+		},
+		{
+			name:      "unchanged",
+			rows:      []testRow{alice, bob},
+			saved:     []savedRowHash{{alice.id, testRowHash(alice)}, {bob.id, testRowHash(bob)}},
+			unchanged: 2,
+		},
+		{
+			name:      "stale",
+			rows:      []testRow{alice},
+			saved:     []savedRowHash{{alice.id, testRowHash(alice)}, {bob.id, testRowHash(bob)}},
+			unchanged: 1,
+			stale:     []int{bob.id},
+		},
+		{
+			// the hash has been deleted as stale when the row was marked deleted
+			name:      "the row is back after being marked deleted",
+			rows:      []testRow{alice, bob},
+			saved:     []savedRowHash{{alice.id, testRowHash(alice)}},
+			wantRows:  []int{1},
+			inserted:  1,
+			unchanged: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := compareRowHashes(newTestUpsert(tt.rows...), tt.saved)
+			if changes.inserted != tt.inserted || changes.changed != tt.changed || changes.unchanged != tt.unchanged {
+				t.Errorf(
+					"inserted/changed/unchanged = %d/%d/%d, want %d/%d/%d",
+					changes.inserted,
+					changes.changed,
+					changes.unchanged,
+					tt.inserted,
+					tt.changed,
+					tt.unchanged,
+				)
+			}
+			if len(changes.rows) != len(tt.wantRows) || (len(tt.wantRows) > 0 && !reflect.DeepEqual(changes.rows, tt.wantRows)) {
+				t.Errorf("rows = %v, want %v", changes.rows, tt.wantRows)
+			}
+			if len(changes.hashes) != len(changes.rows) {
+				t.Fatalf("got %d hashes for %d rows", len(changes.hashes), len(changes.rows))
+			}
+			for i, index := range changes.rows {
+				row := tt.rows[index]
+				if h := changes.hashes[i]; h.Entity != "player" || h.ID != row.id || h.Hash != testRowHash(row) {
+					t.Errorf("hashes[%d] = %+v, want the hash of %+v", i, h, row)
+				}
+			}
+			sort.Ints(changes.stale)
+			if len(changes.stale) != len(tt.stale) || (len(tt.stale) > 0 && !reflect.DeepEqual(changes.stale, tt.stale)) {
+				t.Errorf("stale = %v, want %v", changes.stale, tt.stale)
+			}
+		})
+	}
+}
+
+func TestAllRowsChanged(t *testing.T) {
+	alice := testRow{1, "alice"}
+	bob := testRow{2, "bob"}
+
+	changes := allRowsChanged(newTestUpsert(alice, bob))
+	if !changes.rewrite {
+		t.Error("rewrite = false, want true")
+	}
+	if changes.inserted != 0 || changes.changed != 2 || changes.unchanged != 0 {
+		t.Errorf("inserted/changed/unchanged = %d/%d/%d, want 0/2/0", changes.inserted, changes.changed, changes.unchanged)
+	}
+	if !reflect.DeepEqual(changes.rows, []int{0, 1}) {
+		t.Errorf("rows = %v, want [0 1]", changes.rows)
+	}
+	for i, row := range []testRow{alice, bob} {
+		if h := changes.hashes[i]; h.Entity != "player" || h.ID != row.id || h.Hash != testRowHash(row) {
+			t.Errorf("hashes[%d] = %+v, want the hash of %+v", i, h, row)
+		}
+	}
+}
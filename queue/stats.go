@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// the keys used by redisq
+const (
+	taskqStreamKeyFormat = "taskq:{%s}:stream"
+	taskqZSetKeyFormat   = "taskq:{%s}:zset"
+	taskqStreamGroup     = "taskq"
+)
+
+type QueueStats struct {
+	Name string `json:"name"`
+	// Pending is the number of messages waiting to be processed.
+	Pending int64 `json:"pending"`
+	// InFlight is the number of messages reserved by the consumers (of all processes).
+	InFlight int64 `json:"inFlight"`
+	// Delayed is the number of messages scheduled to be added to the queue later (e.g. retries).
+	Delayed int64 `json:"delayed"`
+	// WorkerLimit is the number of workers processing the queue in this process.
+	WorkerLimit int `json:"workerLimit"`
+}
+
+// Stats returns the stats of all queues (and of the legacy main queue while it's being drained).
+func (q *Queue) Stats(ctx context.Context) ([]*QueueStats, error) {
+	names := QueueNames()
+	if q.legacy != nil {
+		names = append(names, legacyMainQueue)
+	}
+	stats := make([]*QueueStats, 0, len(names))
+	for _, name := range names {
+		s, err := q.queueStats(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load the stats of the queue '%s'", name)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+func (q *Queue) queueStats(ctx context.Context, name string) (*QueueStats, error) {
+	stream := fmt.Sprintf(taskqStreamKeyFormat, name)
+	var length *redis.IntCmd
+	var pending *redis.XPendingCmd
+	var delayed *redis.IntCmd
+	_, err := q.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		length = pipe.XLen(ctx, stream)
+		pending = pipe.XPending(ctx, stream, taskqStreamGroup)
+		delayed = pipe.ZCard(ctx, fmt.Sprintf(taskqZSetKeyFormat, name))
+		return nil
+	})
+	if err != nil && err != redis.Nil && !isNoGroupError(err) {
+		return nil, err
+	}
+
+	stats := &QueueStats{
+		Name:     name,
+		Delayed:  delayed.Val(),
+		InFlight: 0,
+	}
+	if p, err := pending.Result(); err == nil {
+		stats.InFlight = p.Count
+	}
+	stats.Pending = length.Val() - stats.InFlight
+	if stats.Pending < 0 {
+		stats.Pending = 0
+	}
+	if queue, ok := q.queues[name]; ok {
+		stats.WorkerLimit = int(queue.Options().MaxNumWorker)
+	} else if name == legacyMainQueue && q.legacy != nil {
+		stats.WorkerLimit = int(q.legacy.Options().MaxNumWorker)
+	}
+	return stats, nil
+}
+
+// isNoGroupError reports whether the consumer group hasn't been created yet (no consumer has been started).
+func isNoGroupError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOGROUP")
+}
@@ -1,11 +1,23 @@
 package queue
 
 import (
+	"context"
+	"github.com/bsm/redislock"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
+	"github.com/tribalwarshelp/shared/tw/twdataloader"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"github.com/vmihailenco/taskq/v3"
+	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/archive"
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/pause"
+	"github.com/tribalwarshelp/dataupdater/postgres"
+	"github.com/tribalwarshelp/dataupdater/ratelimit"
 )
 
 const (
@@ -17,18 +29,35 @@ const (
 	UpdateEnnoblements              = "updateEnnoblements"
 	UpdateServerEnnoblements        = "updateServerEnnoblements"
 	UpdateHistory                   = "updateHistory"
+	UpdateVersionHistory            = "updateVersionHistory"
 	UpdateServerHistory             = "updateServerHistory"
 	UpdateStats                     = "updateStats"
+	UpdateVersionStats              = "updateVersionStats"
 	UpdateServerStats               = "updateServerStats"
 	DeleteNonExistentVillages       = "deleteNonExistentVillages"
 	ServerDeleteNonExistentVillages = "serverDeleteNonExistentVillages"
 	defaultRetryLimit               = 3
+	defaultMinBackoff               = 15 * time.Second
+	defaultMaxBackoff               = 10 * time.Minute
 )
 
 type task struct {
-	db              *pg.DB
-	queue           *Queue
-	cachedLocations sync.Map
+	db            *pg.DB
+	queue         *Queue
+	serverDataDir string
+	archiver      *archive.Archiver
+	rateLimiter   *ratelimit.Limiter
+	deadLetters   *deadLetterStore
+	locker        *redislock.Client
+	httpTimeout   time.Duration
+	txTimeout     time.Duration
+	// bulkLoadThreshold - see Config.BulkLoadThreshold
+	bulkLoadThreshold int
+	retention         Retention
+	// updateHistorySpec and updateStatsSpec are the global schedules of the history and stats updates
+	updateHistorySpec string
+	updateStatsSpec   string
+	cachedLocations   sync.Map
 }
 
 func (t *task) loadLocation(timezone string) (*time.Location, error) {
@@ -44,15 +73,100 @@ func (t *task) loadLocation(timezone string) (*time.Location, error) {
 	return location, nil
 }
 
+// runServerTask runs fn for the server-scoped task holding the server lock (see withServerLock).
+// The task is skipped if the server or its version has been paused after it was enqueued.
+// The pending migrations of the server schema are applied before fn is run.
+func (t *task) runServerTask(ctx context.Context, server *twmodel.Server, scope serverLockScope, fn func(ctx context.Context) error) error {
+	paused, err := pause.IsServerPaused(ctx, t.db, server)
+	if err != nil {
+		return err
+	}
+	if paused {
+		return &skipError{
+			reason: server.Key + ": the server has been paused",
+		}
+	}
+	return t.withServerLock(ctx, server.Key, scope, func(ctx context.Context) error {
+		if err := postgres.PrepareServerSchema(t.db.WithContext(ctx), server); err != nil {
+			return err
+		}
+		return fn(ctx)
+	})
+}
+
+func (t *task) newServerDataLoader(
+	ctx context.Context,
+	url string,
+	server *twmodel.Server,
+	middlewares ...transportMiddleware,
+) dataloader.ServerDataLoader {
+	if t.serverDataDir != "" {
+		return dataloader.NewDirServerDataLoader(filepath.Join(t.serverDataDir, server.Key))
+	}
+	host := ""
+	if server.Version != nil {
+		host = server.Version.Host
+	}
+	return dataloader.NewValidatingServerDataLoader(twdataloader.NewServerDataLoader(&twdataloader.ServerDataLoaderConfig{
+		BaseURL: url,
+		Client: newHTTPClient(
+			t.httpTimeout,
+			append(
+				// the first middleware is the closest to the network,
+				// so the time spent waiting for the rate limiter isn't included in the call duration metric
+				[]transportMiddleware{
+					metricsMiddleware(string(server.VersionCode)),
+					t.rateLimitMiddleware(host),
+					tracingMiddleware(ctx),
+				},
+				middlewares...,
+			)...,
+		),
+	}))
+}
+
+func (t *task) rateLimitMiddleware(host string) transportMiddleware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if t.rateLimiter == nil || host == "" {
+			return rt
+		}
+		return t.rateLimiter.Transport(rt, host)
+	}
+}
+
+func (t *task) archiveMiddleware(server *twmodel.Server, fetchedAt time.Time) transportMiddleware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if t.archiver == nil {
+			return rt
+		}
+		return t.archiver.Transport(rt, server.Key, archive.NewSnapshotID(fetchedAt))
+	}
+}
+
 func registerTasks(cfg *registerTasksConfig) error {
 	if err := validateRegisterTasksConfig(cfg); err != nil {
 		return errors.Wrap(err, "config is invalid")
 	}
 
 	t := &task{
-		db:    cfg.DB,
-		queue: cfg.Queue,
+		db:            cfg.DB,
+		queue:         cfg.Queue,
+		serverDataDir: cfg.ServerDataDir,
+		archiver:      cfg.Archiver,
+		rateLimiter:   cfg.RateLimiter,
+		deadLetters: &deadLetterStore{
+			db:    cfg.DB,
+			redis: cfg.Queue.redis,
+		},
+		locker:            redislock.New(cfg.Queue.redis),
+		httpTimeout:       cfg.HTTPTimeout,
+		txTimeout:         cfg.TransactionTimeout,
+		bulkLoadThreshold: cfg.BulkLoadThreshold,
+		retention:         cfg.Retention,
+		updateHistorySpec: cfg.UpdateHistorySpec,
+		updateStatsSpec:   cfg.UpdateStatsSpec,
 	}
+	cfg.Queue.task = t
 	options := []*taskq.TaskOptions{
 		{
 			Name:    LoadVersionsAndUpdateServerData,
@@ -86,6 +200,10 @@ func registerTasks(cfg *registerTasksConfig) error {
 			Name:    UpdateHistory,
 			Handler: (&taskUpdateHistory{t}).execute,
 		},
+		{
+			Name:    UpdateVersionHistory,
+			Handler: (&taskUpdateVersionHistory{t}).execute,
+		},
 		{
 			Name:       UpdateServerHistory,
 			RetryLimit: defaultRetryLimit,
@@ -95,6 +213,10 @@ func registerTasks(cfg *registerTasksConfig) error {
 			Name:    UpdateStats,
 			Handler: (&taskUpdateStats{t}).execute,
 		},
+		{
+			Name:    UpdateVersionStats,
+			Handler: (&taskUpdateVersionStats{t}).execute,
+		},
 		{
 			Name:    UpdateServerStats,
 			Handler: (&taskUpdateServerStats{t}).execute,
@@ -113,6 +235,21 @@ func registerTasks(cfg *registerTasksConfig) error {
 		if opts.RetryLimit == 0 {
 			opts.RetryLimit = defaultRetryLimit
 		}
+		if opts.MinBackoff == 0 {
+			opts.MinBackoff = defaultMinBackoff
+		}
+		if opts.MaxBackoff == 0 {
+			opts.MaxBackoff = defaultMaxBackoff
+		}
+		handler := opts.Handler
+		opts.Handler = withMessageMeta(
+			withTracing(
+				t.deadLetters.withAttemptTracking(
+					withMetrics(withErrorClassification(opts, t.withSkipHandling(taskq.NewHandler(handler)))),
+				),
+			),
+		)
+		opts.FallbackHandler = withMessageMeta(taskq.HandlerFunc(t.deadLetters.fallbackHandler(handler))).HandleMessage
 		taskq.RegisterTask(opts)
 	}
 
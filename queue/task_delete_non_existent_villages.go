@@ -5,19 +5,22 @@ import (
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"github.com/tribalwarshelp/shared/tw/twurlbuilder"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/pause"
 )
 
 type taskDeleteNonExistentVillages struct {
 	*task
 }
 
-func (t *taskDeleteNonExistentVillages) execute() error {
+func (t *taskDeleteNonExistentVillages) execute(ctx context.Context) error {
 	var servers []*twmodel.Server
-	err := t.db.
+	err := t.db.WithContext(ctx).
 		Model(&servers).
 		Relation("Version").
 		Where("status = ?", twmodel.ServerStatusOpen).
-		Relation("Version").
+		Apply(pause.NotPaused).
 		Select()
 	if err != nil {
 		err = errors.Wrap(err, "taskDeleteNonExistentVillages.execute")
@@ -27,14 +30,17 @@ func (t *taskDeleteNonExistentVillages) execute() error {
 	log.
 		WithField("numberOfServers", len(servers)).
 		Info("taskDeleteNonExistentVillages.execute: Servers have been loaded and added to the queue")
+	period := periodOf(time.Now(), day)
 	for _, server := range servers {
 		err := t.queue.Add(
-			GetTask(ServerDeleteNonExistentVillages).
-				WithArgs(
-					context.Background(),
-					twurlbuilder.BuildServerURL(server.Key, server.Version.Host),
-					server,
-				),
+			newServerTaskMessage(
+				ctx,
+				ServerDeleteNonExistentVillages,
+				server.Key,
+				period,
+				twurlbuilder.BuildServerURL(server.Key, server.Version.Host),
+				server,
+			),
 		)
 		if err != nil {
 			log.
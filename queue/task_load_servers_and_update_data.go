@@ -4,10 +4,14 @@ import (
 	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/tribalwarshelp/shared/tw/twdataloader"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"time"
 
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/pause"
 	"github.com/tribalwarshelp/dataupdater/postgres"
 )
 
@@ -20,17 +24,34 @@ type serverWithURL struct {
 	url             string
 }
 
-func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
+func (t *taskLoadServersAndUpdateData) execute(ctx context.Context, version *twmodel.Version) error {
 	if err := t.validatePayload(version); err != nil {
 		log.Debug(errors.Wrap(err, "taskLoadServersAndUpdateData.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, version.Code)
 	entry := log.WithField("host", version.Host)
+	versionPaused, err := pause.IsVersionPaused(ctx, t.db, version.Code)
+	if err != nil {
+		err = errors.Wrap(err, "taskLoadServersAndUpdateData.execute")
+		entry.Error(err)
+		return err
+	}
+	if versionPaused {
+		entry.Infof("taskLoadServersAndUpdateData.execute: %s: The version has been paused, skipping", version.Code)
+		return nil
+	}
+	pausedServers, err := t.loadPausedServerKeys(ctx, version.Code)
+	if err != nil {
+		err = errors.Wrap(err, "taskLoadServersAndUpdateData.execute")
+		entry.Error(err)
+		return err
+	}
 	entry.Infof("taskLoadServersAndUpdateData.execute: %s: Loading servers", version.Host)
 	loadedServers, err := twdataloader.
 		NewVersionDataLoader(&twdataloader.VersionDataLoaderConfig{
 			Host:   version.Host,
-			Client: newHTTPClient(),
+			Client: newHTTPClient(t.httpTimeout, t.rateLimitMiddleware(version.Host), tracingMiddleware(ctx)),
 		}).
 		LoadServers()
 	if err != nil {
@@ -44,13 +65,19 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 		if version.SpecialServers.Contains(loadedServer.Key) {
 			continue
 		}
+		// the paused servers are left untouched, but they mustn't be marked as closed
+		if pausedServers[loadedServer.Key] {
+			entry.WithField("key", loadedServer.Key).Debugf("taskLoadServersAndUpdateData.execute: %s: The server has been paused, skipping", loadedServer.Key)
+			serverKeys = append(serverKeys, loadedServer.Key)
+			continue
+		}
 		server := &twmodel.Server{
 			Key:         loadedServer.Key,
 			Status:      twmodel.ServerStatusOpen,
 			VersionCode: version.Code,
 			Version:     version,
 		}
-		if err := postgres.CreateServerSchema(t.db, server); err != nil {
+		if err := postgres.PrepareServerSchema(t.db.WithContext(ctx), server); err != nil {
 			logrus.Warn(errors.Wrapf(err, "taskLoadServersAndUpdateData.execute: %s: Couldn't create the schema", server.Key))
 			continue
 		}
@@ -62,7 +89,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 	}
 
 	if len(servers) > 0 {
-		if _, err := t.db.Model(&servers).
+		if _, err := t.db.WithContext(ctx).Model(&servers).
 			OnConflict("(key) DO UPDATE").
 			Set("status = ?", twmodel.ServerStatusOpen).
 			Set("version_code = EXCLUDED.version_code").
@@ -74,7 +101,7 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 		}
 	}
 
-	if _, err := t.db.Model(&twmodel.Server{}).
+	if _, err := t.db.WithContext(ctx).Model(&twmodel.Server{}).
 		Set("status = ?", twmodel.ServerStatusClosed).
 		Where("key NOT IN (?) AND version_code = ?", pg.In(serverKeys), version.Code).
 		Update(); err != nil {
@@ -84,8 +111,9 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 	}
 
 	entry.Infof("%s: Servers have been loaded", version.Host)
+	period := periodOf(time.Now(), t.dataUpdatePeriod(ctx, version))
 	for _, server := range servers {
-		err := t.queue.Add(GetTask(UpdateServerData).WithArgs(context.Background(), server.url, server.Server))
+		err := t.queue.Add(newServerTaskMessage(ctx, UpdateServerData, server.Key, period, server.url, server.Server))
 		if err != nil {
 			log.
 				WithField("key", server.Key).
@@ -103,6 +131,36 @@ func (t *taskLoadServersAndUpdateData) execute(version *twmodel.Version) error {
 	return nil
 }
 
+// dataUpdatePeriod returns the period within which the server data is updated at most once.
+// It's an hour unless the version has its own schedule (then it's the interval between the runs, at least a minute).
+func (t *taskLoadServersAndUpdateData) dataUpdatePeriod(ctx context.Context, version *twmodel.Version) time.Duration {
+	schedule := &model.VersionSchedule{}
+	err := t.db.WithContext(ctx).Model(schedule).Where("version_code = ?", version.Code).Select()
+	if err != nil {
+		if err != pg.ErrNoRows {
+			log.Warn(errors.Wrapf(err, "%s: couldn't load the schedule", version.Code))
+		}
+		return time.Hour
+	}
+	if schedule.UpdateServerData == "" {
+		return time.Hour
+	}
+	sched, err := cron.ParseStandard(schedule.UpdateServerData)
+	if err != nil {
+		log.Warn(errors.Wrapf(err, "%s: invalid schedule '%s'", version.Code, schedule.UpdateServerData))
+		return time.Hour
+	}
+	next := sched.Next(time.Now())
+	period := sched.Next(next).Sub(next)
+	if period < time.Minute {
+		return time.Minute
+	}
+	if period > time.Hour {
+		return time.Hour
+	}
+	return period
+}
+
 func (t *taskLoadServersAndUpdateData) validatePayload(version *twmodel.Version) error {
 	if version == nil {
 		return errors.New("expected *twmodel.Version, got nil")
@@ -10,17 +10,24 @@ type taskLoadVersionsAndUpdateServerData struct {
 	*task
 }
 
-func (t *taskLoadVersionsAndUpdateServerData) execute() error {
+func (t *taskLoadVersionsAndUpdateServerData) execute(ctx context.Context) error {
 	var versions []*twmodel.Version
 	log.Debug("taskLoadVersionsAndUpdateServerData.execute: Loading versions...")
-	if err := t.db.Model(&versions).Relation("SpecialServers").Select(); err != nil {
+	// the versions with their own schedule are updated separately (see model.VersionSchedule)
+	err := t.db.WithContext(ctx).
+		Model(&versions).
+		Relation("SpecialServers").
+		Where("code NOT IN (SELECT version_code FROM version_schedules WHERE update_server_data <> '')").
+		Where("code NOT IN (SELECT version_code FROM version_pauses)").
+		Select()
+	if err != nil {
 		err = errors.Wrap(err, "taskLoadVersionsAndUpdateServerData.execute: Couldn't load versions")
 		log.Fatal(err)
 		return err
 	}
 	log.Debug("taskLoadVersionsAndUpdateServerData.execute: Versions have been loaded")
 	for _, version := range versions {
-		err := t.queue.Add(GetTask(LoadServersAndUpdateData).WithArgs(context.Background(), version))
+		err := t.queue.Add(GetTask(LoadServersAndUpdateData).WithArgs(ctx, version))
 		if err != nil {
 			log.
 				WithField("code", version.Code).
@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+)
+
+const taskRunSaveTimeout = 5 * time.Second
+
+func newTaskRun(taskName, serverKey string) *model.TaskRun {
+	return &model.TaskRun{
+		TaskName:  taskName,
+		ServerKey: serverKey,
+		StartedAt: time.Now(),
+	}
+}
+
+// finishTaskRun saves the run in the task_runs table.
+// The task doesn't fail if the run couldn't be saved.
+func (t *task) finishTaskRun(run *model.TaskRun, err error) {
+	run.FinishedAt = time.Now()
+	if isSkipError(err) {
+		run.Outcome = model.TaskRunOutcomeSkipped
+		run.Error = err.Error()
+	} else if err != nil {
+		run.Outcome = model.TaskRunOutcomeFailed
+		run.Error = err.Error()
+	} else if run.Outcome == "" {
+		run.Outcome = model.TaskRunOutcomeSucceeded
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), taskRunSaveTimeout)
+	defer cancel()
+	if _, err := t.db.ModelContext(ctx, run).Returning("id").Insert(); err != nil {
+		log.
+			WithFields(map[string]interface{}{
+				"task": run.TaskName,
+				"key":  run.ServerKey,
+			}).
+			Warn(errors.Wrapf(err, "%s: %s: couldn't save the task run", run.TaskName, run.ServerKey))
+	}
+}
@@ -1,28 +1,40 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
-	"github.com/tribalwarshelp/shared/tw/twdataloader"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/model"
 )
 
 type taskServerDeleteNonExistentVillages struct {
 	*task
 }
 
-func (t *taskServerDeleteNonExistentVillages) execute(url string, server *twmodel.Server) error {
+func (t *taskServerDeleteNonExistentVillages) execute(ctx context.Context, url string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskServerDeleteNonExistentVillages.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, server.VersionCode)
 	entry := log.WithField("key", server.Key)
 	entry.Infof("taskServerDeleteNonExistentVillages.execute: %s: Deleting non-existent villages...", server.Key)
-	err := (&workerDeleteNonExistentVillages{
-		db:         t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		dataloader: newServerDataLoader(url),
-		server:     server,
-	}).delete()
+	run := newTaskRun(ServerDeleteNonExistentVillages, server.Key)
+	err := t.runServerTask(ctx, server, serverLockScopeData, func(ctx context.Context) error {
+		return (&workerDeleteNonExistentVillages{
+			db:         t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+			dataloader: t.newServerDataLoader(ctx, url, server),
+			server:     server,
+			run:        run,
+		}).delete()
+	})
+	t.finishTaskRun(run, err)
+	if isSkipError(err) {
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskServerDeleteNonExistentVillages.execute")
 		entry.Error(err)
@@ -42,8 +54,9 @@ func (t *taskServerDeleteNonExistentVillages) validatePayload(server *twmodel.Se
 
 type workerDeleteNonExistentVillages struct {
 	db         *pg.DB
-	dataloader *twdataloader.ServerDataLoader
+	dataloader dataloader.ServerDataLoader
 	server     *twmodel.Server
+	run        *model.TaskRun
 }
 
 func (w *workerDeleteNonExistentVillages) delete() error {
@@ -68,12 +81,14 @@ func (w *workerDeleteNonExistentVillages) delete() error {
 
 	totalDeleted := 0
 	if len(idsToDelete) > 0 {
+		// the hashes of the deleted villages are deleted by a trigger, so the villages are inserted again if they're back
 		result, err := w.db.Model(&twmodel.Village{}).Where("id = ANY(?)", pg.Array(idsToDelete)).Delete()
 		if err != nil {
 			return errors.Wrap(err, "couldn't delete villages that don't exist")
 		}
 		totalDeleted = result.RowsAffected()
 	}
+	w.run.VillagesDeleted = totalDeleted
 	log.WithField("key", w.server.Key).Debugf("%s: deleted %d villages", w.server.Key, totalDeleted)
 	return nil
 }
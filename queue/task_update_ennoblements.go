@@ -5,18 +5,22 @@ import (
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"github.com/tribalwarshelp/shared/tw/twurlbuilder"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/pause"
 )
 
 type taskUpdateEnnoblements struct {
 	*task
 }
 
-func (t *taskUpdateEnnoblements) execute() error {
+func (t *taskUpdateEnnoblements) execute(ctx context.Context) error {
 	var servers []*twmodel.Server
-	err := t.db.
+	err := t.db.WithContext(ctx).
 		Model(&servers).
 		Relation("Version").
 		Where("status = ?", twmodel.ServerStatusOpen).
+		Apply(pause.NotPaused).
 		Select()
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateEnnoblements.execute")
@@ -24,10 +28,17 @@ func (t *taskUpdateEnnoblements) execute() error {
 		return err
 	}
 	log.WithField("numberOfServers", len(servers)).Info("taskUpdateEnnoblements.execute: Update of the ennoblements has started...")
+	period := periodOf(time.Now(), time.Minute)
 	for _, server := range servers {
 		err := t.queue.Add(
-			GetTask(UpdateServerEnnoblements).
-				WithArgs(context.Background(), twurlbuilder.BuildServerURL(server.Key, server.Version.Host), server),
+			newServerTaskMessage(
+				ctx,
+				UpdateServerEnnoblements,
+				server.Key,
+				period,
+				twurlbuilder.BuildServerURL(server.Key, server.Version.Host),
+				server,
+			),
 		)
 		if err != nil {
 			log.
@@ -5,40 +5,64 @@ import (
 	"github.com/go-pg/pg/v10"
 	"github.com/go-pg/pg/v10/orm"
 	"github.com/pkg/errors"
-	"github.com/tribalwarshelp/shared/tw/twdataloader"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/postgres"
 )
 
 type taskUpdateServerData struct {
 	*task
 }
 
-func (t *taskUpdateServerData) execute(url string, server *twmodel.Server) error {
+func (t *taskUpdateServerData) execute(ctx context.Context, url string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerData.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, server.VersionCode)
 	now := time.Now()
 	entry := log.WithField("key", server.Key)
 	entry.Infof("taskUpdateServerData.execute: %s: Update of the server data has started...", server.Key)
-	err := (&workerUpdateServerData{
-		db:         t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		dataloader: newServerDataLoader(url),
-		server:     server,
-	}).update()
+	ct := newChangeTracker(t.queue.redis, server.Key)
+	run := newTaskRun(UpdateServerData, server.Key)
+	var result updateServerDataResult
+	err := t.runServerTask(ctx, server, serverLockScopeData, func(ctx context.Context) error {
+		var err error
+		result, err = (&workerUpdateServerData{
+			db:                t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+			dataloader:        t.newServerDataLoader(ctx, url, server, t.archiveMiddleware(server, now), ct.middleware()),
+			server:            server,
+			txTimeout:         t.txTimeout,
+			changeTracker:     ct,
+			run:               run,
+			bulkLoadThreshold: t.bulkLoadThreshold,
+		}).update()
+		return err
+	})
+	t.finishTaskRun(run, err)
+	if isSkipError(err) {
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerData.execute")
 		entry.Error(err)
 		return err
 	}
 	duration := time.Since(now)
-	entry.
+	entry = entry.
 		WithFields(map[string]interface{}{
 			"duration":       duration.Nanoseconds(),
 			"durationPretty": duration.String(),
-		}).
-		Infof("taskUpdateServerData.execute: %s: the server data has been updated", server.Key)
+			"outcome":        result.outcome(),
+		})
+	if result.unchanged {
+		entry.Infof("taskUpdateServerData.execute: %s: the server data hasn't changed since the last update", server.Key)
+		return nil
+	}
+	entry.Infof("taskUpdateServerData.execute: %s: the server data has been updated", server.Key)
 	return nil
 }
 
@@ -51,9 +75,33 @@ func (t *taskUpdateServerData) validatePayload(server *twmodel.Server) error {
 }
 
 type workerUpdateServerData struct {
-	db         *pg.DB
-	dataloader *twdataloader.ServerDataLoader
-	server     *twmodel.Server
+	db            *pg.DB
+	dataloader    dataloader.ServerDataLoader
+	server        *twmodel.Server
+	changeTracker *changeTracker
+	run           *model.TaskRun
+	txTimeout     time.Duration
+	// bulkLoadThreshold - see Config.BulkLoadThreshold
+	bulkLoadThreshold int
+	// ignoreHashes makes the update save all tribes/players/villages and rewrite their hashes
+	// instead of saving only the rows that differ from the saved hashes (e.g. the rows have been changed by hand)
+	ignoreHashes bool
+}
+
+const (
+	updateServerDataOutcomeUpdated   = "updated"
+	updateServerDataOutcomeUnchanged = "unchanged"
+)
+
+type updateServerDataResult struct {
+	unchanged bool
+}
+
+func (r updateServerDataResult) outcome() string {
+	if r.unchanged {
+		return updateServerDataOutcomeUnchanged
+	}
+	return updateServerDataOutcomeUpdated
 }
 
 type loadPlayersResult struct {
@@ -64,9 +112,14 @@ type loadPlayersResult struct {
 	numberOfPlayers int
 }
 
-func (w *workerUpdateServerData) loadPlayers(od map[int]*twmodel.OpponentsDefeated) (loadPlayersResult, error) {
+func (w *workerUpdateServerData) loadPlayers(
+	players []*twmodel.Player,
+	od map[int]*twmodel.OpponentsDefeated,
+) (loadPlayersResult, error) {
 	var ennoblements []*twmodel.Ennoblement
-	result := loadPlayersResult{}
+	result := loadPlayersResult{
+		players: players,
+	}
 	if err := w.db.
 		Model(&ennoblements).
 		DistinctOn("new_owner_id").
@@ -76,11 +129,6 @@ func (w *workerUpdateServerData) loadPlayers(od map[int]*twmodel.OpponentsDefeat
 		return result, errors.Wrap(err, "couldn't load ennoblements")
 	}
 
-	var err error
-	result.players, err = w.dataloader.LoadPlayers()
-	if err != nil {
-		return result, err
-	}
 	result.numberOfPlayers = len(result.players)
 
 	now := time.Now()
@@ -132,14 +180,14 @@ type loadTribesResult struct {
 	numberOfTribes int
 }
 
-func (w *workerUpdateServerData) loadTribes(od map[int]*twmodel.OpponentsDefeated, numberOfVillages int) (loadTribesResult, error) {
-	var err error
-	result := loadTribesResult{}
-	result.tribes, err = w.dataloader.LoadTribes()
-	if err != nil {
-		return result, err
+func (w *workerUpdateServerData) loadTribes(
+	tribes []*twmodel.Tribe,
+	od map[int]*twmodel.OpponentsDefeated,
+	numberOfVillages int,
+) (loadTribesResult, error) {
+	result := loadTribesResult{
+		tribes: tribes,
 	}
-
 	result.numberOfTribes = len(result.tribes)
 	result.ids = make([]int, result.numberOfTribes)
 	for index, tribe := range result.tribes {
@@ -236,51 +284,105 @@ func (w *workerUpdateServerData) calculateDailyPlayerStats(
 	return todaysStats
 }
 
-func (w *workerUpdateServerData) update() error {
+// updateDailyGrowthQuery recalculates players.daily_growth the same way as loadPlayers
+// (getDateDifferenceInDays and calcPlayerDailyGrowth), only the changed rows are updated.
+const updateDailyGrowthQuery = `UPDATE ?SERVER.players AS player
+	SET daily_growth = CASE WHEN first_ennoblement.days > 0 THEN player.points / first_ennoblement.days ELSE 0 END
+	FROM (
+		SELECT DISTINCT ON (new_owner_id) new_owner_id, trunc(extract(epoch FROM now() - ennobled_at) / 86400)::int AS days
+		FROM ?SERVER.ennoblements
+		ORDER BY new_owner_id ASC, ennobled_at ASC
+	) AS first_ennoblement
+	WHERE player.id = first_ennoblement.new_owner_id
+		AND player.exists = true
+		AND player.daily_growth <> CASE WHEN first_ennoblement.days > 0 THEN player.points / first_ennoblement.days ELSE 0 END`
+
+// hasChanged reports whether the data fetched from the TW server differs from the data saved during the last update.
+// Skipping the update of the unchanged data is safe, because:
+//   - the tribes/players missing in the fetched data have been marked as deleted by the update which saved the checksums,
+//   - the daily stats are recalculated after every history update (see below),
+//   - the only column depending on the current time, players.daily_growth, is recalculated by updateUnchanged.
+func (w *workerUpdateServerData) hasChanged() (bool, error) {
+	if w.changeTracker == nil || w.ignoreHashes {
+		return true, nil
+	}
+	// the daily stats must be recalculated after every history update
+	if w.server.HistoryUpdatedAt.After(w.server.DataUpdatedAt) {
+		return true, nil
+	}
+	return w.changeTracker.changed(context.Background())
+}
+
+func (w *workerUpdateServerData) update() (updateServerDataResult, error) {
+	result := updateServerDataResult{}
+
 	pod, err := w.dataloader.LoadOD(false)
 	if err != nil {
-		return errors.Wrap(err, "couldn't load players OD")
+		return result, errors.Wrap(err, "couldn't load players OD")
 	}
 
 	tod, err := w.dataloader.LoadOD(true)
 	if err != nil {
-		return errors.Wrap(err, "couldn't load tribes OD")
+		return result, errors.Wrap(err, "couldn't load tribes OD")
 	}
 
 	villages, err := w.dataloader.LoadVillages()
 	if err != nil {
-		return errors.Wrap(err, "couldn't load villages")
+		return result, errors.Wrap(err, "couldn't load villages")
 	}
 	numberOfVillages := len(villages)
 
-	tribesResult, err := w.loadTribes(tod, countPlayerVillages(villages))
+	tribes, err := w.dataloader.LoadTribes()
 	if err != nil {
-		return errors.Wrap(err, "couldn't load tribes")
+		return result, errors.Wrap(err, "couldn't load tribes")
 	}
 
-	playersResult, err := w.loadPlayers(pod)
+	players, err := w.dataloader.LoadPlayers()
 	if err != nil {
-		return errors.Wrap(err, "couldn't load players")
+		return result, errors.Wrap(err, "couldn't load players")
 	}
 
 	cfg, err := w.dataloader.GetConfig()
 	if err != nil {
-		return errors.Wrap(err, "couldn't load server config")
+		return result, errors.Wrap(err, "couldn't load server config")
 	}
 
 	buildingCfg, err := w.dataloader.GetBuildingConfig()
 	if err != nil {
-		return errors.Wrap(err, "couldn't load building config")
+		return result, errors.Wrap(err, "couldn't load building config")
 	}
 
 	unitCfg, err := w.dataloader.GetUnitConfig()
 	if err != nil {
-		return errors.Wrap(err, "couldn't load unit config")
+		return result, errors.Wrap(err, "couldn't load unit config")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	changed, err := w.hasChanged()
+	if err != nil {
+		log.WithField("key", w.server.Key).Warn(errors.Wrapf(err, "%s: couldn't determine whether the data has changed", w.server.Key))
+	} else if !changed {
+		result.unchanged = true
+		w.run.Outcome = model.TaskRunOutcomeUnchanged
+		return result, w.updateUnchanged()
+	}
+
+	tribesResult, err := w.loadTribes(tribes, tod, countPlayerVillages(villages))
+	if err != nil {
+		return result, errors.Wrap(err, "couldn't load tribes")
+	}
+
+	playersResult, err := w.loadPlayers(players, pod)
+	if err != nil {
+		return result, errors.Wrap(err, "couldn't load players")
+	}
+
+	dailyTribeStatsUpserted := 0
+	dailyPlayerStatsUpserted := 0
+	var tribesChanges, playersChanges, villagesChanges *rowChanges
+	ctx, cancel := context.WithTimeout(w.db.Context(), w.txTimeout)
 	defer cancel()
-	return w.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+	err = w.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
 		if len(tribesResult.deletedTribes) > 0 {
 			if _, err := tx.Model(&twmodel.Tribe{}).
 				Where("tribe.id  = ANY (?)", pg.Array(tribesResult.deletedTribes)).
@@ -292,22 +394,13 @@ func (w *workerUpdateServerData) update() error {
 			}
 		}
 
+		// the rows are compared with the hashes even if there are none of them, so the stale hashes are deleted
+		tribesChanges, err = w.detectChanges(tx, bulkUpsertTribes(tribesResult.tribes))
+		if err != nil {
+			return err
+		}
 		if tribesResult.numberOfTribes > 0 {
-			if _, err := tx.Model(&tribesResult.tribes).
-				OnConflict("(id) DO UPDATE").
-				Set("name = EXCLUDED.name").
-				Set("tag = EXCLUDED.tag").
-				Set("total_members = EXCLUDED.total_members").
-				Set("total_villages = EXCLUDED.total_villages").
-				Set("points = EXCLUDED.points").
-				Set("all_points = EXCLUDED.all_points").
-				Set("rank = EXCLUDED.rank").
-				Set("exists = EXCLUDED.exists").
-				Set("dominance = EXCLUDED.dominance").
-				Set("deleted_at = null").
-				Apply(appendODSetClauses).
-				Returning("NULL").
-				Insert(); err != nil {
+			if err := w.upsertTribes(tx, filterTribes(tribesResult.tribes, tribesChanges)); err != nil {
 				return errors.Wrap(err, "couldn't insert tribes")
 			}
 
@@ -339,6 +432,7 @@ func (w *workerUpdateServerData) update() error {
 					return errors.Wrap(err, "couldn't insert today's tribe stats")
 				}
 			}
+			dailyTribeStatsUpserted = len(todaysTribeStats)
 		}
 
 		if len(playersResult.deletedPlayers) > 0 {
@@ -352,20 +446,12 @@ func (w *workerUpdateServerData) update() error {
 			}
 		}
 
+		playersChanges, err = w.detectChanges(tx, bulkUpsertPlayers(playersResult.players))
+		if err != nil {
+			return err
+		}
 		if playersResult.numberOfPlayers > 0 {
-			if _, err := tx.Model(&playersResult.players).
-				OnConflict("(id) DO UPDATE").
-				Set("name = EXCLUDED.name").
-				Set("total_villages = EXCLUDED.total_villages").
-				Set("points = EXCLUDED.points").
-				Set("rank = EXCLUDED.rank").
-				Set("exists = EXCLUDED.exists").
-				Set("tribe_id = EXCLUDED.tribe_id").
-				Set("daily_growth = EXCLUDED.daily_growth").
-				Set("deleted_at = null").
-				Returning("NULL").
-				Apply(appendODSetClauses).
-				Insert(); err != nil {
+			if err := w.upsertPlayers(tx, filterPlayers(playersResult.players, playersChanges)); err != nil {
 				return errors.Wrap(err, "couldn't insert players")
 			}
 
@@ -393,6 +479,7 @@ func (w *workerUpdateServerData) update() error {
 					return errors.Wrap(err, "couldn't insert today's player stats")
 				}
 			}
+			dailyPlayerStatsUpserted = len(todaysPlayerStats)
 		}
 
 		if len(playersResult.playersToServer) > 0 {
@@ -405,21 +492,20 @@ func (w *workerUpdateServerData) update() error {
 			}
 		}
 
+		villagesChanges, err = w.detectChanges(tx, bulkUpsertVillages(villages))
+		if err != nil {
+			return err
+		}
 		if len(villages) > 0 {
-			if _, err := tx.Model(&villages).
-				OnConflict("(id) DO UPDATE").
-				Set("name = EXCLUDED.name").
-				Set("points = EXCLUDED.points").
-				Set("x = EXCLUDED.x").
-				Set("y = EXCLUDED.y").
-				Set("bonus = EXCLUDED.bonus").
-				Set("player_id = EXCLUDED.player_id").
-				Returning("NULL").
-				Insert(); err != nil {
+			if err := w.upsertVillages(tx, filterVillages(villages, villagesChanges)); err != nil {
 				return errors.Wrap(err, "couldn't insert villages")
 			}
 		}
 
+		if err := w.saveRowHashes(tx, tribesChanges, playersChanges, villagesChanges); err != nil {
+			return err
+		}
+
 		if _, err := tx.Model(w.server).
 			Set("data_updated_at = ?", time.Now()).
 			Set("unit_config = ?", unitCfg).
@@ -435,6 +521,146 @@ func (w *workerUpdateServerData) update() error {
 		}
 		return nil
 	})
+	if err != nil {
+		return result, err
+	}
+
+	w.run.TribesUpserted = tribesChanges.inserted + tribesChanges.changed
+	w.run.TribesInserted = tribesChanges.inserted
+	w.run.TribesChanged = tribesChanges.changed
+	w.run.TribesUnchanged = tribesChanges.unchanged
+	w.run.TribesMarkedDeleted = len(tribesResult.deletedTribes)
+	w.run.PlayersUpserted = playersChanges.inserted + playersChanges.changed
+	w.run.PlayersInserted = playersChanges.inserted
+	w.run.PlayersChanged = playersChanges.changed
+	w.run.PlayersUnchanged = playersChanges.unchanged
+	w.run.PlayersMarkedDeleted = len(playersResult.deletedPlayers)
+	w.run.VillagesUpserted = villagesChanges.inserted + villagesChanges.changed
+	w.run.VillagesInserted = villagesChanges.inserted
+	w.run.VillagesChanged = villagesChanges.changed
+	w.run.VillagesUnchanged = villagesChanges.unchanged
+	w.run.DailyTribeStatsUpserted = dailyTribeStatsUpserted
+	w.run.DailyPlayerStatsUpserted = dailyPlayerStatsUpserted
+
+	if w.changeTracker != nil {
+		if err := w.changeTracker.save(context.Background()); err != nil {
+			log.WithField("key", w.server.Key).Warn(errors.Wrapf(err, "%s: couldn't save the checksums", w.server.Key))
+		}
+	}
+	return result, nil
+}
+
+// updateUnchanged updates the columns which change even if the fetched data hasn't (see hasChanged).
+func (w *workerUpdateServerData) updateUnchanged() error {
+	ctx, cancel := context.WithTimeout(w.db.Context(), w.txTimeout)
+	defer cancel()
+	return w.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if _, err := tx.Exec(updateDailyGrowthQuery); err != nil {
+			return errors.Wrap(err, "couldn't update the daily growth of players")
+		}
+		if _, err := tx.Model(w.server).
+			Set("data_updated_at = ?", time.Now()).
+			WherePK().
+			Returning("*").
+			Update(); err != nil {
+			return errors.Wrap(err, "couldn't update server")
+		}
+		return nil
+	})
+}
+
+// detectChanges compares the rows with the saved hashes, unless the hashes are ignored.
+func (w *workerUpdateServerData) detectChanges(tx *pg.Tx, u bulkUpsert) (*rowChanges, error) {
+	if w.ignoreHashes {
+		return allRowsChanged(u), nil
+	}
+	return detectChanges(tx, u)
+}
+
+func (w *workerUpdateServerData) useBulkLoad(rows int) bool {
+	threshold := bulkLoadThresholdOrDefault(w.bulkLoadThreshold)
+	return threshold > 0 && rows >= threshold
+}
+
+func (w *workerUpdateServerData) upsertTribes(tx *pg.Tx, tribes []*twmodel.Tribe) error {
+	if len(tribes) == 0 {
+		return nil
+	}
+	if w.useBulkLoad(len(tribes)) {
+		return w.bulkUpsert(tx, bulkUpsertTribes(tribes))
+	}
+	_, err := tx.Model(&tribes).
+		OnConflict("(id) DO UPDATE").
+		Set("name = EXCLUDED.name").
+		Set("tag = EXCLUDED.tag").
+		Set("total_members = EXCLUDED.total_members").
+		Set("total_villages = EXCLUDED.total_villages").
+		Set("points = EXCLUDED.points").
+		Set("all_points = EXCLUDED.all_points").
+		Set("rank = EXCLUDED.rank").
+		Set("exists = EXCLUDED.exists").
+		Set("dominance = EXCLUDED.dominance").
+		Set("deleted_at = null").
+		Apply(appendODSetClauses).
+		Returning("NULL").
+		Insert()
+	return err
+}
+
+func (w *workerUpdateServerData) upsertPlayers(tx *pg.Tx, players []*twmodel.Player) error {
+	if len(players) == 0 {
+		return nil
+	}
+	if w.useBulkLoad(len(players)) {
+		return w.bulkUpsert(tx, bulkUpsertPlayers(players))
+	}
+	_, err := tx.Model(&players).
+		OnConflict("(id) DO UPDATE").
+		Set("name = EXCLUDED.name").
+		Set("total_villages = EXCLUDED.total_villages").
+		Set("points = EXCLUDED.points").
+		Set("rank = EXCLUDED.rank").
+		Set("exists = EXCLUDED.exists").
+		Set("tribe_id = EXCLUDED.tribe_id").
+		Set("daily_growth = EXCLUDED.daily_growth").
+		Set("deleted_at = null").
+		Returning("NULL").
+		Apply(appendODSetClauses).
+		Insert()
+	return err
+}
+
+func (w *workerUpdateServerData) upsertVillages(tx *pg.Tx, villages []*twmodel.Village) error {
+	if len(villages) == 0 {
+		return nil
+	}
+	if w.useBulkLoad(len(villages)) {
+		return w.bulkUpsert(tx, bulkUpsertVillages(villages))
+	}
+	_, err := tx.Model(&villages).
+		OnConflict("(id) DO UPDATE").
+		Set("name = EXCLUDED.name").
+		Set("points = EXCLUDED.points").
+		Set("x = EXCLUDED.x").
+		Set("y = EXCLUDED.y").
+		Set("bonus = EXCLUDED.bonus").
+		Set("player_id = EXCLUDED.player_id").
+		Returning("NULL").
+		Insert()
+	return err
+}
+
+func (w *workerUpdateServerData) bulkUpsert(tx *pg.Tx, u bulkUpsert) error {
+	start := time.Now()
+	if err := u.exec(tx); err != nil {
+		return err
+	}
+	log.
+		WithField("key", w.server.Key).
+		WithField("rows", u.rows).
+		WithField("duration", time.Since(start).String()).
+		Debugf("%s: %s have been saved with COPY", w.server.Key, u.table)
+	return nil
 }
 
 func appendODSetClauses(q *orm.Query) (*orm.Query, error) {
@@ -448,3 +674,36 @@ func appendODSetClauses(q *orm.Query) (*orm.Query, error) {
 			Set("score_total = EXCLUDED.score_total"),
 		nil
 }
+
+// ReplayServerData updates the server data using the given data loader (e.g. a snapshot created by the archiver)
+// instead of the TW server, with the transaction timeout and the bulk load threshold of the queue.
+// It holds the server lock like the data update, so it fails if another task is modifying the server data.
+// If ignoreHashes is true, all rows from the snapshot are saved and their hashes are rewritten,
+// otherwise only the rows that differ from the saved hashes are saved.
+// The checksums saved by the last data update are deleted afterwards,
+// so the next data update saves the fetched data even if it hasn't changed since then.
+func (q *Queue) ReplayServerData(ctx context.Context, dl dataloader.ServerDataLoader, server *twmodel.Server, ignoreHashes bool) error {
+	if server == nil {
+		return errors.New("expected *twmodel.Server, got nil")
+	}
+	t := q.task
+	return t.withServerLock(ctx, server.Key, serverLockScopeData, func(ctx context.Context) error {
+		db := t.db.WithContext(ctx)
+		if err := postgres.PrepareServerSchema(db, server); err != nil {
+			return err
+		}
+		_, err := (&workerUpdateServerData{
+			db:                db.WithParam("SERVER", pg.Safe(server.Key)),
+			dataloader:        dl,
+			server:            server,
+			run:               newTaskRun(UpdateServerData, server.Key),
+			txTimeout:         t.txTimeout,
+			bulkLoadThreshold: t.bulkLoadThreshold,
+			ignoreHashes:      ignoreHashes,
+		}).update()
+		if resetErr := newChangeTracker(q.redis, server.Key).reset(ctx); resetErr != nil && err == nil {
+			err = resetErr
+		}
+		return err
+	})
+}
@@ -0,0 +1,366 @@
+package queue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bsm/redislock"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/postgres/postgrestest"
+)
+
+// testServerData contains the map files (village.txt, player.txt, ally.txt, conquer.txt), the other files are empty.
+type testServerData struct {
+	villages     string
+	players      string
+	tribes       string
+	ennoblements string
+}
+
+func (d testServerData) fs() fstest.MapFS {
+	fsys := fstest.MapFS{
+		"village.txt":           {Data: []byte(d.villages)},
+		"player.txt":            {Data: []byte(d.players)},
+		"ally.txt":              {Data: []byte(d.tribes)},
+		"conquer.txt":           {Data: []byte(d.ennoblements)},
+		"get_config.xml":        {Data: []byte("<config></config>")},
+		"get_building_info.xml": {Data: []byte("<config></config>")},
+		"get_unit_info.xml":     {Data: []byte("<config></config>")},
+	}
+	for _, name := range []string{"kill_all", "kill_att", "kill_def", "kill_sup", "kill_all_tribe", "kill_att_tribe", "kill_def_tribe"} {
+		fsys[name+".txt"] = &fstest.MapFile{}
+	}
+	return fsys
+}
+
+// writeDir saves the files to the given directory, like the files read with Config.ServerDataDir.
+func (d testServerData) writeDir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range d.fs() {
+		if err := os.WriteFile(filepath.Join(dir, name), f.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// updateTestServerData runs the data update without the change tracker, like a replay with the hashes.
+func updateTestServerData(t *testing.T, db *pg.DB, server *twmodel.Server, data testServerData) *model.TaskRun {
+	t.Helper()
+	run := newTaskRun(UpdateServerData, server.Key)
+	_, err := (&workerUpdateServerData{
+		db:         db.WithParam("SERVER", pg.Safe(server.Key)),
+		dataloader: dataloader.NewFSServerDataLoader(data.fs()),
+		server:     server,
+		run:        run,
+		txTimeout:  DefaultTransactionTimeout,
+	}).update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+func countTestRows(t *testing.T, db *pg.DB, server *twmodel.Server, model interface{}) int {
+	t.Helper()
+	count, err := db.WithParam("SERVER", pg.Safe(server.Key)).Model(model).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func loadTestPlayer(t *testing.T, db *pg.DB, server *twmodel.Server, id int) *twmodel.Player {
+	t.Helper()
+	player := &twmodel.Player{}
+	if err := db.WithParam("SERVER", pg.Safe(server.Key)).Model(player).Where("id = ?", id).Select(); err != nil {
+		t.Fatal(err)
+	}
+	return player
+}
+
+func TestWorkerUpdateServerDataHasChanged(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	saved := newChangeTracker(client, "pl1")
+	saved.record("village.txt", []byte("1,Village,500,500,0,26,0\n"))
+	if err := saved.save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tracker := func(village string) *changeTracker {
+		ct := newChangeTracker(client, "pl1")
+		if village != "" {
+			ct.record("village.txt", []byte(village))
+		}
+		return ct
+	}
+	dataUpdatedAt := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		changeTracker    *changeTracker
+		ignoreHashes     bool
+		historyUpdatedAt time.Time
+		want             bool
+	}{
+		{
+			name:          "same files",
+			changeTracker: tracker("1,Village,500,500,0,26,0\n"),
+			want:          false,
+		},
+		{
+			name:          "changed file",
+			changeTracker: tracker("1,Village,500,500,0,27,0\n"),
+			want:          true,
+		},
+		{
+			name:          "no recorded files",
+			changeTracker: tracker(""),
+			want:          true,
+		},
+		{
+			name: "no change tracker",
+			want: true,
+		},
+		{
+			name:          "ignored hashes",
+			changeTracker: tracker("1,Village,500,500,0,26,0\n"),
+			ignoreHashes:  true,
+			want:          true,
+		},
+		{
+			name:             "history updated before the last data update",
+			changeTracker:    tracker("1,Village,500,500,0,26,0\n"),
+			historyUpdatedAt: dataUpdatedAt.Add(-time.Hour),
+			want:             false,
+		},
+		{
+			name:             "history updated after the last data update",
+			changeTracker:    tracker("1,Village,500,500,0,26,0\n"),
+			historyUpdatedAt: dataUpdatedAt.Add(time.Hour),
+			want:             true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &workerUpdateServerData{
+				server: &twmodel.Server{
+					Key:              "pl1",
+					DataUpdatedAt:    dataUpdatedAt,
+					HistoryUpdatedAt: tt.historyUpdatedAt,
+				},
+				changeTracker: tt.changeTracker,
+				ignoreHashes:  tt.ignoreHashes,
+			}
+			got, err := w.hasChanged()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("hasChanged() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerUpdateServerDataDeletedPlayerIsBack(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+	data := testServerData{
+		villages: "1,Village,500,500,1,100,0\n2,Village,501,501,2,50,0\n",
+		players:  "1,Alice,0,1,100,1\n2,Bob,0,1,50,2\n",
+	}
+
+	if run := updateTestServerData(t, db, server, data); run.PlayersInserted != 2 {
+		t.Fatalf("PlayersInserted = %d, want 2", run.PlayersInserted)
+	}
+
+	// Bob has deleted his account
+	run := updateTestServerData(t, db, server, testServerData{
+		villages: "1,Village,500,500,1,100,0\n2,Village,501,501,0,50,0\n",
+		players:  "1,Alice,0,1,100,1\n",
+	})
+	if run.PlayersMarkedDeleted != 1 {
+		t.Fatalf("PlayersMarkedDeleted = %d, want 1", run.PlayersMarkedDeleted)
+	}
+	if bob := loadTestPlayer(t, db, server, 2); bob.Exists == nil || *bob.Exists {
+		t.Fatal("Bob hasn't been marked as deleted")
+	}
+
+	// Bob is back with the same data as before the deletion
+	run = updateTestServerData(t, db, server, data)
+	if run.PlayersInserted != 1 || run.PlayersUnchanged != 1 {
+		t.Errorf("PlayersInserted = %d, PlayersUnchanged = %d, want 1 and 1", run.PlayersInserted, run.PlayersUnchanged)
+	}
+	bob := loadTestPlayer(t, db, server, 2)
+	if bob.Exists == nil || !*bob.Exists || !bob.DeletedAt.IsZero() {
+		t.Errorf("Bob: exists = %v, deleted_at = %s, want true and null", bob.Exists, bob.DeletedAt)
+	}
+}
+
+func TestWorkerUpdateServerDataRowChangedByQuery(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+	data := testServerData{
+		villages: "1,Village,500,500,1,100,0\n",
+		players:  "1,Alice,0,1,100,1\n2,Bob,0,0,0,2\n",
+	}
+	updateTestServerData(t, db, server, data)
+
+	if _, err := db.Exec("UPDATE ?.players SET name = 'Mallory' WHERE id = 1", pg.Ident(server.Key)); err != nil {
+		t.Fatal(err)
+	}
+
+	run := updateTestServerData(t, db, server, data)
+	if run.PlayersInserted != 1 || run.PlayersUnchanged != 1 {
+		t.Errorf("PlayersInserted = %d, PlayersUnchanged = %d, want 1 and 1", run.PlayersInserted, run.PlayersUnchanged)
+	}
+	if alice := loadTestPlayer(t, db, server, 1); alice.Name != "Alice" {
+		t.Errorf("name = %s, want Alice", alice.Name)
+	}
+}
+
+func newTestQueue(t *testing.T, db *pg.DB) (*Queue, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	q := &Queue{
+		redis: client,
+		db:    db,
+	}
+	q.task = &task{
+		db:        db,
+		queue:     q,
+		locker:    redislock.New(client),
+		txTimeout: DefaultTransactionTimeout,
+	}
+	return q, mr
+}
+
+func TestQueueReplayServerDataServerLocked(t *testing.T) {
+	q, mr := newTestQueue(t, nil)
+	saved := newChangeTracker(q.redis, "pl1")
+	saved.record("village.txt", []byte("1,Village,500,500,0,26,0\n"))
+	if err := saved.save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := q.task.locker.Obtain(context.Background(), serverLockKeyPrefix+"pl1", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(context.Background())
+
+	err = q.ReplayServerData(context.Background(), nil, &twmodel.Server{Key: "pl1"}, true)
+	if !isSkipError(err) {
+		t.Errorf("ReplayServerData() error = %v, want *skipError", err)
+	}
+	if !mr.Exists(saved.key()) {
+		t.Error("the checksums have been deleted by the replay which hasn't been run")
+	}
+}
+
+func TestQueueReplayServerData(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+	q, mr := newTestQueue(t, db)
+	data := testServerData{
+		villages: "1,Village,500,500,1,100,0\n",
+		players:  "1,Alice,0,1,100,1\n",
+	}
+	liveUpdate := func() updateServerDataResult {
+		t.Helper()
+		ct := newChangeTracker(q.redis, server.Key)
+		ct.record("village.txt", []byte(data.villages))
+		result, err := (&workerUpdateServerData{
+			db:            db.WithParam("SERVER", pg.Safe(server.Key)),
+			dataloader:    dataloader.NewFSServerDataLoader(data.fs()),
+			server:        server,
+			run:           newTaskRun(UpdateServerData, server.Key),
+			txTimeout:     DefaultTransactionTimeout,
+			changeTracker: ct,
+		}).update()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	liveUpdate()
+	if result := liveUpdate(); !result.unchanged {
+		t.Fatal("the update of the unchanged data hasn't been skipped")
+	}
+
+	if err := q.ReplayServerData(context.Background(), dataloader.NewFSServerDataLoader(data.fs()), server, true); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(checksumsKeyPrefix + server.Key) {
+		t.Error("the checksums haven't been deleted after the replay")
+	}
+	if mr.Exists(serverLockKeyPrefix + server.Key) {
+		t.Error("the server lock hasn't been released after the replay")
+	}
+
+	if result := liveUpdate(); result.unchanged {
+		t.Error("the first update after the replay has been skipped")
+	}
+}
+
+func TestTasksWithServerDataDir(t *testing.T) {
+	db := postgrestest.Connect(t)
+	server := postgrestest.Server(t, db)
+	q, _ := newTestQueue(t, db)
+	q.task.serverDataDir = t.TempDir()
+	dir := filepath.Join(q.task.serverDataDir, server.Key)
+	ctx := context.Background()
+
+	data := testServerData{
+		villages:     "1,Village,500,500,1,100,0\n2,Barbarian+village,501,501,0,50,0\n",
+		players:      "1,Alice,1,1,100,1\n",
+		tribes:       "1,Tribe,TAG,1,1,100,100,1\n",
+		ennoblements: "1,1620000000,1,0\n",
+	}
+	data.writeDir(t, dir)
+
+	if err := (&taskUpdateServerData{q.task}).execute(ctx, "", server); err != nil {
+		t.Fatal(err)
+	}
+	if villages, players, tribes := countTestRows(t, db, server, (*twmodel.Village)(nil)),
+		countTestRows(t, db, server, (*twmodel.Player)(nil)),
+		countTestRows(t, db, server, (*twmodel.Tribe)(nil)); villages != 2 || players != 1 || tribes != 1 {
+		t.Errorf("villages = %d, players = %d, tribes = %d, want 2, 1 and 1", villages, players, tribes)
+	}
+
+	if err := (&taskUpdateServerEnnoblements{q.task}).execute(ctx, "", server); err != nil {
+		t.Fatal(err)
+	}
+	if ennoblements := countTestRows(t, db, server, (*twmodel.Ennoblement)(nil)); ennoblements != 1 {
+		t.Errorf("ennoblements = %d, want 1", ennoblements)
+	}
+
+	data.villages = "1,Village,500,500,1,100,0\n"
+	data.writeDir(t, dir)
+	if err := (&taskServerDeleteNonExistentVillages{q.task}).execute(ctx, "", server); err != nil {
+		t.Fatal(err)
+	}
+	if villages := countTestRows(t, db, server, (*twmodel.Village)(nil)); villages != 1 {
+		t.Errorf("villages = %d, want 1", villages)
+	}
+}
@@ -1,27 +1,40 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twdataloader"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/model"
 )
 
 type taskUpdateServerEnnoblements struct {
 	*task
 }
 
-func (t *taskUpdateServerEnnoblements) execute(url string, server *twmodel.Server) error {
+func (t *taskUpdateServerEnnoblements) execute(ctx context.Context, url string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerEnnoblements.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, server.VersionCode)
 	entry := log.WithField("key", server.Key)
 	entry.Debugf("%s: update of the ennoblements has started...", server.Key)
-	err := (&workerUpdateServerEnnoblements{
-		db:         t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		dataloader: newServerDataLoader(url),
-	}).update()
+	run := newTaskRun(UpdateServerEnnoblements, server.Key)
+	err := t.runServerTask(ctx, server, serverLockScopeEnnoblements, func(ctx context.Context) error {
+		return (&workerUpdateServerEnnoblements{
+			db:         t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+			dataloader: t.newServerDataLoader(ctx, url, server),
+			run:        run,
+		}).update()
+	})
+	t.finishTaskRun(run, err)
+	if isSkipError(err) {
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerEnnoblements.execute")
 		entry.Error(err)
@@ -42,7 +55,8 @@ func (t *taskUpdateServerEnnoblements) validatePayload(server *twmodel.Server) e
 
 type workerUpdateServerEnnoblements struct {
 	db         *pg.DB
-	dataloader *twdataloader.ServerDataLoader
+	dataloader dataloader.ServerDataLoader
+	run        *model.TaskRun
 }
 
 func (w *workerUpdateServerEnnoblements) loadEnnoblements() ([]*twmodel.Ennoblement, error) {
@@ -71,6 +85,7 @@ func (w *workerUpdateServerEnnoblements) update() error {
 			return errors.Wrap(err, "couldn't insert ennoblements")
 		}
 	}
+	w.run.EnnoblementsInserted = len(ennoblements)
 
 	return nil
 }
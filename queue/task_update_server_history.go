@@ -1,21 +1,25 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
 )
 
 type taskUpdateServerHistory struct {
 	*task
 }
 
-func (t *taskUpdateServerHistory) execute(timezone string, server *twmodel.Server) error {
+func (t *taskUpdateServerHistory) execute(ctx context.Context, timezone string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerHistory.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, server.VersionCode)
 	location, err := t.loadLocation(timezone)
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerHistory.execute")
@@ -24,11 +28,19 @@ func (t *taskUpdateServerHistory) execute(timezone string, server *twmodel.Serve
 	}
 	entry := log.WithField("key", server.Key)
 	entry.Infof("taskUpdateServerHistory.execute: %s: Update of the server history has started...", server.Key)
-	err = (&workerUpdateServerHistory{
-		db:       t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		server:   server,
-		location: location,
-	}).update()
+	run := newTaskRun(UpdateServerHistory, server.Key)
+	err = t.runServerTask(ctx, server, serverLockScopeData, func(ctx context.Context) error {
+		return (&workerUpdateServerHistory{
+			db:       t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+			server:   server,
+			location: location,
+			run:      run,
+		}).update()
+	})
+	t.finishTaskRun(run, err)
+	if isSkipError(err) {
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerHistory.execute")
 		entry.Error(err)
@@ -51,6 +63,7 @@ type workerUpdateServerHistory struct {
 	db       *pg.DB
 	server   *twmodel.Server
 	location *time.Location
+	run      *model.TaskRun
 }
 
 func (w *workerUpdateServerHistory) update() error {
@@ -124,5 +137,9 @@ func (w *workerUpdateServerHistory) update() error {
 
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.run.HistoryRecordsInserted = len(ph) + len(th)
+	return nil
 }
@@ -1,21 +1,25 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
 )
 
 type taskUpdateServerStats struct {
 	*task
 }
 
-func (t *taskUpdateServerStats) execute(timezone string, server *twmodel.Server) error {
+func (t *taskUpdateServerStats) execute(ctx context.Context, timezone string, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskUpdateServerStats.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, server.VersionCode)
 	location, err := t.loadLocation(timezone)
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerStats.execute")
@@ -24,11 +28,19 @@ func (t *taskUpdateServerStats) execute(timezone string, server *twmodel.Server)
 	}
 	entry := log.WithField("key", server.Key)
 	entry.Infof("taskUpdateServerStats.execute: %s: Update of the server stats has started...", server.Key)
-	err = (&workerUpdateServerStats{
-		db:       t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		server:   server,
-		location: location,
-	}).update()
+	run := newTaskRun(UpdateServerStats, server.Key)
+	err = t.runServerTask(ctx, server, serverLockScopeData, func(ctx context.Context) error {
+		return (&workerUpdateServerStats{
+			db:       t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+			server:   server,
+			location: location,
+			run:      run,
+		}).update()
+	})
+	t.finishTaskRun(run, err)
+	if isSkipError(err) {
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskUpdateServerStats.execute")
 		entry.Error(err)
@@ -51,6 +63,7 @@ type workerUpdateServerStats struct {
 	db       *pg.DB
 	server   *twmodel.Server
 	location *time.Location
+	run      *model.TaskRun
 }
 
 func (w *workerUpdateServerStats) prepare() (*twmodel.ServerStats, error) {
@@ -126,7 +139,8 @@ func (w *workerUpdateServerStats) update() error {
 		}
 	}(w.server)
 
-	if _, err := tx.Model(stats).Returning("NULL").Insert(); err != nil {
+	result, err := tx.Model(stats).Returning("NULL").Insert()
+	if err != nil {
 		return errors.Wrap(err, "couldn't insert server stats")
 	}
 
@@ -139,5 +153,9 @@ func (w *workerUpdateServerStats) update() error {
 		return errors.Wrap(err, "couldn't update the server")
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.run.ServerStatsInserted = result.RowsAffected()
+	return nil
 }
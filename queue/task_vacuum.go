@@ -4,16 +4,21 @@ import (
 	"context"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
+	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
+	"github.com/tribalwarshelp/dataupdater/pause"
 )
 
 type taskVacuum struct {
 	*task
 }
 
-func (t *taskVacuum) execute() error {
+func (t *taskVacuum) execute(ctx context.Context) error {
 	var servers []*twmodel.Server
-	err := t.db.
+	err := t.db.WithContext(ctx).
 		Model(&servers).
+		Apply(pause.NotPaused).
 		Select()
 	if err != nil {
 		err = errors.Wrap(err, "taskVacuum.execute")
@@ -21,8 +26,18 @@ func (t *taskVacuum) execute() error {
 		return err
 	}
 	log.Infof("taskVacuum.execute: The database vacumming process has started...")
+	res, err := t.db.
+		Model(&model.TaskRun{}).
+		Where("started_at < ?", time.Now().Add(-t.retention.TaskRuns)).
+		Delete()
+	if err != nil {
+		log.Warn(errors.Wrap(err, "taskVacuum.execute: Couldn't delete the old task runs"))
+	} else {
+		log.Debugf("taskVacuum.execute: %d old task runs have been deleted", res.RowsAffected())
+	}
+	period := periodOf(time.Now(), day)
 	for _, server := range servers {
-		err := t.queue.Add(GetTask(VacuumServerData).WithArgs(context.Background(), server))
+		err := t.queue.Add(newServerTaskMessage(ctx, VacuumServerData, server.Key, period, server))
 		if err != nil {
 			log.
 				WithField("key", server.Key).
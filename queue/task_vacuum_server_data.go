@@ -1,10 +1,13 @@
 package queue
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/pkg/errors"
 	"github.com/tribalwarshelp/shared/tw/twmodel"
 	"time"
+
+	"github.com/tribalwarshelp/dataupdater/model"
 )
 
 const (
@@ -15,27 +18,54 @@ type taskVacuumServerData struct {
 	*task
 }
 
-func (t *taskVacuumServerData) execute(server *twmodel.Server) error {
+func (t *taskVacuumServerData) execute(ctx context.Context, server *twmodel.Server) error {
 	if err := t.validatePayload(server); err != nil {
 		log.Debug(errors.Wrap(err, "taskVacuumServerData.execute"))
 		return nil
 	}
+	setTaskVersion(ctx, server.VersionCode)
 	entry := log.WithField("key", server.Key)
 	entry.Infof("taskVacuumServerData.execute: %s: Vacumming the database...", server.Key)
-	err := (&workerVacuumServerDB{
-		db:     t.db.WithParam("SERVER", pg.Safe(server.Key)),
-		server: server,
-	}).vacuum()
+	run := newTaskRun(VacuumServerData, server.Key)
+	err := t.runServerTask(ctx, server, serverLockScopeData, func(ctx context.Context) error {
+		return (&workerVacuumServerDB{
+			db:        t.db.WithContext(ctx).WithParam("SERVER", pg.Safe(server.Key)),
+			server:    server,
+			run:       run,
+			retention: t.retention,
+		}).vacuum()
+	})
+	t.finishTaskRun(run, err)
+	if isSkipError(err) {
+		return err
+	}
 	if err != nil {
 		err = errors.Wrap(err, "taskVacuumServerData.execute")
 		entry.Error(err)
 		return err
 	}
 	entry.Infof("taskVacuumServerData.execute: %s: The database has been vacummed", server.Key)
+	t.pruneSnapshots(server)
 
 	return nil
 }
 
+// pruneSnapshots deletes the archived snapshots older than the retention period.
+// A failure is only logged, the snapshots are going to be deleted by the next vacuum.
+func (t *taskVacuumServerData) pruneSnapshots(server *twmodel.Server) {
+	if t.archiver == nil {
+		return
+	}
+	entry := log.WithField("key", server.Key)
+	deleted, err := t.archiver.Prune(server.Key, time.Now().Add(-t.retention.Snapshots))
+	if err != nil {
+		entry.Warn(errors.Wrapf(err, "taskVacuumServerData.pruneSnapshots: %s: Couldn't delete the old snapshots", server.Key))
+	}
+	if deleted > 0 {
+		entry.Debugf("taskVacuumServerData.pruneSnapshots: %s: %d old snapshots have been deleted", server.Key, deleted)
+	}
+}
+
 func (t *taskVacuumServerData) validatePayload(server *twmodel.Server) error {
 	if server == nil {
 		return errors.New("expected *twmodel.Server, got nil")
@@ -45,8 +75,10 @@ func (t *taskVacuumServerData) validatePayload(server *twmodel.Server) error {
 }
 
 type workerVacuumServerDB struct {
-	db     *pg.DB
-	server *twmodel.Server
+	db        *pg.DB
+	server    *twmodel.Server
+	run       *model.TaskRun
+	retention Retention
 }
 
 func (w *workerVacuumServerDB) vacuum() error {
@@ -60,40 +92,57 @@ func (w *workerVacuumServerDB) vacuum() error {
 		}
 	}(w.server)
 
-	withNonExistentPlayers := w.db.Model(&twmodel.Player{}).Column("id").Where("exists = false and NOW() - deleted_at > '14 days'")
-	withNonExistentTribes := w.db.Model(&twmodel.Tribe{}).Column("id").Where("exists = false and NOW() - deleted_at > '1 days'")
+	now := time.Now()
+	historyCreatedBefore := now.Add(-w.retention.History)
+	withNonExistentPlayers := w.db.Model(&twmodel.Player{}).
+		Column("id").
+		Where("exists = false and deleted_at < ?", now.Add(-w.retention.DeletedPlayers))
+	withNonExistentTribes := w.db.Model(&twmodel.Tribe{}).
+		Column("id").
+		Where("exists = false and deleted_at < ?", now.Add(-w.retention.DeletedTribes))
+	historyRecordsDeleted := 0
+	dailyStatsDeleted := 0
 
-	_, err = tx.Model(&twmodel.PlayerHistory{}).
+	result, err := tx.Model(&twmodel.PlayerHistory{}).
 		With("players", withNonExistentPlayers).
-		Where("player_id IN (Select id FROM players) OR player_history.create_date < ?", time.Now().Add(-1*day*180)).
+		Where("player_id IN (Select id FROM players) OR player_history.create_date < ?", historyCreatedBefore).
 		Delete()
 	if err != nil {
 		return errors.Wrap(err, "couldn't delete the old player history records")
 	}
+	historyRecordsDeleted += result.RowsAffected()
 
-	_, err = tx.Model(&twmodel.TribeHistory{}).
+	result, err = tx.Model(&twmodel.TribeHistory{}).
 		With("tribes", withNonExistentTribes).
-		Where("tribe_id IN (Select id FROM tribes) OR tribe_history.create_date < ?", time.Now().Add(-1*day*180)).
+		Where("tribe_id IN (Select id FROM tribes) OR tribe_history.create_date < ?", historyCreatedBefore).
 		Delete()
 	if err != nil {
 		return errors.Wrap(err, "couldn't delete the old tribe history records")
 	}
+	historyRecordsDeleted += result.RowsAffected()
 
-	_, err = tx.Model(&twmodel.DailyPlayerStats{}).
+	result, err = tx.Model(&twmodel.DailyPlayerStats{}).
 		With("players", withNonExistentPlayers).
-		Where("player_id IN (Select id FROM players) OR daily_player_stats.create_date < ?", time.Now().Add(-1*day*180)).
+		Where("player_id IN (Select id FROM players) OR daily_player_stats.create_date < ?", historyCreatedBefore).
 		Delete()
 	if err != nil {
 		return errors.Wrap(err, "couldn't delete the old player stats records")
 	}
+	dailyStatsDeleted += result.RowsAffected()
 
-	_, err = tx.Model(&twmodel.DailyTribeStats{}).
+	result, err = tx.Model(&twmodel.DailyTribeStats{}).
 		With("tribes", withNonExistentTribes).
-		Where("tribe_id IN (Select id FROM tribes) OR daily_tribe_stats.create_date < ?", time.Now().Add(-1*day*180)).
+		Where("tribe_id IN (Select id FROM tribes) OR daily_tribe_stats.create_date < ?", historyCreatedBefore).
 		Delete()
 	if err != nil {
 		return errors.Wrap(err, "couldn't delete the old tribe stats records")
 	}
+	dailyStatsDeleted += result.RowsAffected()
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.run.HistoryRecordsDeleted = historyRecordsDeleted
+	w.run.DailyStatsDeleted = dailyStatsDeleted
+	return nil
 }
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/vmihailenco/taskq/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tribalwarshelp/dataupdater/dataloader"
+	"github.com/tribalwarshelp/dataupdater/tracing"
+)
+
+var tracer = otel.Tracer("github.com/tribalwarshelp/dataupdater/queue")
+
+// injectTraceContext adds the trace context from msg.Ctx to the message metadata,
+// unless the metadata already contains one.
+func injectTraceContext(msg *taskq.Message) error {
+	carrier := tracing.Inject(msg.Ctx)
+	if carrier == nil {
+		return nil
+	}
+	return setMessageMeta(msg, func(meta *messageMeta) {
+		if meta.Trace == nil {
+			meta.Trace = carrier
+		}
+	})
+}
+
+// withTracing starts a span continuing the trace from the message metadata and passes it to the handler via msg.Ctx.
+func withTracing(h taskq.Handler) taskq.Handler {
+	return taskq.HandlerFunc(func(msg *taskq.Message) error {
+		origCtx := msg.Ctx
+		defer func() {
+			msg.Ctx = origCtx
+		}()
+
+		parent := origCtx
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, span := tracer.Start(
+			tracing.Extract(parent, metaFromContext(parent).Trace),
+			msg.TaskName,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("taskq.task_name", msg.TaskName),
+				attribute.Int("taskq.reserved_count", msg.ReservedCount),
+			),
+		)
+		defer span.End()
+		msg.Ctx = ctx
+
+		err := h.HandleMessage(msg)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	})
+}
+
+// tracingMiddleware creates a span for every request sent to a TW server.
+// twdataloader doesn't pass a context to the requests, so the parent span is taken from ctx.
+func tracingMiddleware(ctx context.Context) transportMiddleware {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return rt
+		}
+		return &tracingTransport{
+			rt:  rt,
+			ctx: ctx,
+		}
+	}
+}
+
+type tracingTransport struct {
+	rt  http.RoundTripper
+	ctx context.Context
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file, err := dataloader.FileNameFromURL(req.URL)
+	if err != nil {
+		file = dataloaderCallUnknownFile
+	}
+	ctx, span := tracer.Start(
+		t.ctx,
+		"HTTP "+req.Method+" "+file,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+		),
+	)
+	resp, err := t.rt.RoundTrip(req.WithContext(trace.ContextWithSpan(req.Context(), trace.SpanFromContext(ctx))))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	resp.Body = &countingBody{
+		ReadCloser: resp.Body,
+		done: func(n int64) {
+			span.SetAttributes(semconv.HTTPResponseContentLengthKey.Int64(n))
+			span.End()
+		},
+	}
+	return resp, nil
+}
@@ -0,0 +1,254 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redis_rate/v9"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLeaseTimeout is used if Config.LeaseTimeout isn't set.
+const DefaultLeaseTimeout = time.Minute
+
+const (
+	keyPrefix                = "dataupdater:ratelimit:"
+	minAcquireRetryInterval  = 50 * time.Millisecond
+	maxAcquireRetryInterval  = 250 * time.Millisecond
+	waitTimeLogInfoThreshold = time.Second
+	// the lease expiry is scored with the Redis clock, so the clock skew between the processes doesn't matter,
+	// replicate_commands allows writing after TIME on the Redis versions older than 5
+	acquireSemaphoreScriptSrc = `
+		redis.replicate_commands()
+		local time = redis.call('TIME')
+		local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+		redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+		if redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[2]) then
+			redis.call('ZADD', KEYS[1], now + tonumber(ARGV[1]), ARGV[3])
+			redis.call('PEXPIRE', KEYS[1], ARGV[1])
+			return 1
+		end
+		return 0
+	`
+)
+
+var (
+	log                    = logrus.WithField("package", "pkg/ratelimit")
+	acquireSemaphoreScript = redis.NewScript(acquireSemaphoreScriptSrc)
+)
+
+type Config struct {
+	Redis redis.UniversalClient
+	// RequestsPerSecond is the maximum number of requests per second to a single host (0 = unlimited).
+	RequestsPerSecond int
+	// MaxConcurrentRequests is the maximum number of concurrent downloads from a single host (0 = unlimited).
+	MaxConcurrentRequests int
+	// LeaseTimeout is the time after which a download slot is released even if its holder didn't release it
+	// (e.g. because the process has crashed). Default is 1 minute.
+	// It mustn't be shorter than the timeout of the requests, the slot would be released while it's still in use.
+	LeaseTimeout time.Duration
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg == nil || cfg.Redis == nil {
+		return errors.New("cfg.Redis is required")
+	}
+	if cfg.RequestsPerSecond < 0 {
+		return errors.New("cfg.RequestsPerSecond must be greater than or equal to 0")
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		return errors.New("cfg.MaxConcurrentRequests must be greater than or equal to 0")
+	}
+	if cfg.LeaseTimeout < 0 {
+		return errors.New("cfg.LeaseTimeout must be greater than or equal to 0")
+	}
+	return nil
+}
+
+// Limiter limits the requests sent to TW servers. The limits are shared by all processes using the same Redis instance
+// and are applied per host (twmodel.Version.Host).
+type Limiter struct {
+	redis                 redis.UniversalClient
+	rate                  *redis_rate.Limiter
+	requestsPerSecond     int
+	maxConcurrentRequests int
+	leaseTimeout          time.Duration
+}
+
+func New(cfg *Config) (*Limiter, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	l := &Limiter{
+		redis:                 cfg.Redis,
+		rate:                  redis_rate.NewLimiter(cfg.Redis),
+		requestsPerSecond:     cfg.RequestsPerSecond,
+		maxConcurrentRequests: cfg.MaxConcurrentRequests,
+		leaseTimeout:          cfg.LeaseTimeout,
+	}
+	if l.leaseTimeout <= 0 {
+		l.leaseTimeout = DefaultLeaseTimeout
+	}
+	return l, nil
+}
+
+// LeaseTimeout returns the time after which a download slot is released even if its holder didn't release it.
+func (l *Limiter) LeaseTimeout() time.Duration {
+	return l.leaseTimeout
+}
+
+// Transport returns a http.RoundTripper that waits for the permission of the limiter before every request.
+// The download slot is held until the response body is closed.
+func (l *Limiter) Transport(rt http.RoundTripper, host string) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{
+		rt:      rt,
+		limiter: l,
+		host:    host,
+	}
+}
+
+// waitForRate reports whether the request had to wait.
+func (l *Limiter) waitForRate(ctx context.Context, host string) (bool, error) {
+	if l.requestsPerSecond <= 0 {
+		return false, nil
+	}
+	delayed := false
+	for {
+		res, err := l.rate.Allow(ctx, keyPrefix+"rate:"+host, redis_rate.PerSecond(l.requestsPerSecond))
+		if err != nil {
+			return delayed, errors.Wrap(err, "couldn't check the rate limit")
+		}
+		if res.Allowed > 0 {
+			return delayed, nil
+		}
+		delayed = true
+		if err := sleep(ctx, res.RetryAfter); err != nil {
+			return delayed, err
+		}
+	}
+}
+
+// acquire returns a function that releases the acquired download slot and reports whether the request had to wait.
+func (l *Limiter) acquire(ctx context.Context, host string) (func(), bool, error) {
+	if l.maxConcurrentRequests <= 0 {
+		return func() {}, false, nil
+	}
+	delayed := false
+	key := keyPrefix + "concurrency:" + host
+	token := uuid.NewString()
+	for {
+		acquired, err := acquireSemaphoreScript.Run(
+			ctx,
+			l.redis,
+			[]string{key},
+			strconv.FormatInt(l.leaseTimeout.Milliseconds(), 10),
+			l.maxConcurrentRequests,
+			token,
+		).Int()
+		if err != nil {
+			return nil, delayed, errors.Wrap(err, "couldn't acquire a download slot")
+		}
+		if acquired == 1 {
+			return func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := l.redis.ZRem(ctx, key, token).Err(); err != nil {
+					log.WithField("host", host).Warn(errors.Wrap(err, "couldn't release the download slot"))
+				}
+			}, delayed, nil
+		}
+		delayed = true
+		interval := minAcquireRetryInterval + time.Duration(rand.Int63n(int64(maxAcquireRetryInterval-minAcquireRetryInterval)))
+		if err := sleep(ctx, interval); err != nil {
+			return nil, delayed, err
+		}
+	}
+}
+
+type transport struct {
+	rt      http.RoundTripper
+	limiter *Limiter
+	host    string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	start := time.Now()
+	entry := log.WithField("host", t.host)
+
+	rateDelayed, err := t.limiter.waitForRate(ctx, t.host)
+	if err != nil {
+		entry.Warn(errors.Wrap(err, "the request is sent without waiting for the rate limiter"))
+	}
+	release, concurrencyDelayed, err := t.limiter.acquire(ctx, t.host)
+	if err != nil {
+		entry.Warn(errors.Wrap(err, "the request is sent without acquiring a download slot"))
+		release = func() {}
+	}
+
+	if rateDelayed || concurrencyDelayed {
+		wait := time.Since(start)
+		entry := entry.WithFields(map[string]interface{}{
+			"url":                req.URL.String(),
+			"wait":               wait.Nanoseconds(),
+			"waitPretty":         wait.String(),
+			"rateDelayed":        rateDelayed,
+			"concurrencyDelayed": concurrencyDelayed,
+		})
+		if wait >= waitTimeLogInfoThreshold {
+			entry.Infof("%s: the request has been delayed by the rate limiter", t.host)
+		} else {
+			entry.Debugf("%s: the request has been delayed by the rate limiter", t.host)
+		}
+	}
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{
+		ReadCloser: resp.Body,
+		release:    release,
+	}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release  func()
+	released bool
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.released {
+		b.released = true
+		b.release()
+	}
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
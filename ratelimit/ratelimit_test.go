@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+const testHost = "en.tribalwars.net"
+
+func newTestLimiter(t *testing.T, cfg *Config) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	cfg.Redis = client
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, mr
+}
+
+func heldSlots(t *testing.T, mr *miniredis.Miniredis) int {
+	t.Helper()
+	key := keyPrefix + "concurrency:" + testHost
+	if !mr.Exists(key) {
+		return 0
+	}
+	members, err := mr.ZMembers(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(members)
+}
+
+// tryAcquire returns nil if all the slots are held.
+func tryAcquire(t *testing.T, l *Limiter) func() {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*maxAcquireRetryInterval)
+	defer cancel()
+	release, _, err := l.acquire(ctx, testHost)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+func TestLimiterAcquireRelease(t *testing.T) {
+	l, mr := newTestLimiter(t, &Config{MaxConcurrentRequests: 2})
+
+	first := tryAcquire(t, l)
+	second := tryAcquire(t, l)
+	if first == nil || second == nil {
+		t.Fatal("couldn't acquire a free slot")
+	}
+	if got := heldSlots(t, mr); got != 2 {
+		t.Errorf("held slots = %d, want 2", got)
+	}
+	if tryAcquire(t, l) != nil {
+		t.Fatal("acquired more slots than MaxConcurrentRequests")
+	}
+
+	first()
+	if got := heldSlots(t, mr); got != 1 {
+		t.Errorf("held slots = %d, want 1", got)
+	}
+	if tryAcquire(t, l) == nil {
+		t.Error("couldn't acquire the released slot")
+	}
+}
+
+func TestLimiterLeaseExpiry(t *testing.T) {
+	l, mr := newTestLimiter(t, &Config{MaxConcurrentRequests: 1, LeaseTimeout: 10 * time.Second})
+
+	if tryAcquire(t, l) == nil {
+		t.Fatal("couldn't acquire a free slot")
+	}
+	// the holder has crashed without releasing the slot
+	mr.SetTime(time.Date(2021, 5, 1, 12, 0, 9, 0, time.UTC))
+	if tryAcquire(t, l) != nil {
+		t.Fatal("acquired the slot before its lease expired")
+	}
+	mr.SetTime(time.Date(2021, 5, 1, 12, 0, 11, 0, time.UTC))
+	if tryAcquire(t, l) == nil {
+		t.Error("couldn't acquire the slot after its lease expired")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l, mr := newTestLimiter(t, &Config{})
+
+	for i := 0; i < 3; i++ {
+		if tryAcquire(t, l) == nil {
+			t.Fatal("couldn't acquire a slot without the limit")
+		}
+	}
+	if got := heldSlots(t, mr); got != 0 {
+		t.Errorf("held slots = %d, want 0", got)
+	}
+}
+
+func TestTransportReleasesSlotOnBodyClose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "1,Village,500,500,0,26,0\n")
+	}))
+	defer srv.Close()
+	l, mr := newTestLimiter(t, &Config{MaxConcurrentRequests: 1})
+	client := &http.Client{Transport: l.Transport(nil, testHost)}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := heldSlots(t, mr); got != 1 {
+		t.Errorf("held slots while reading the body = %d, want 1", got)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if got := heldSlots(t, mr); got != 1 {
+		t.Errorf("held slots before closing the body = %d, want 1", got)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := heldSlots(t, mr); got != 0 {
+		t.Errorf("held slots after closing the body = %d, want 0", got)
+	}
+}
+
+func TestTransportReleasesSlotOnError(t *testing.T) {
+	l, mr := newTestLimiter(t, &Config{MaxConcurrentRequests: 1})
+	client := &http.Client{Transport: l.Transport(failingTransport{}, testHost)}
+
+	if _, err := client.Get("http://" + testHost); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := heldSlots(t, mr); got != 0 {
+		t.Errorf("held slots = %d, want 0", got)
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
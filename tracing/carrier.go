@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Carrier holds the propagated trace context (e.g. traceparent).
+type Carrier map[string]string
+
+// Inject returns the carrier with the trace context of the span from ctx
+// or nil if ctx doesn't contain a valid span.
+func Inject(ctx context.Context) Carrier {
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := Carrier{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(carrier))
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns a copy of ctx with the trace context from the carrier.
+func Extract(ctx context.Context, carrier Carrier) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+var log = logrus.WithField("package", "pkg/tracing")
+
+type Config struct {
+	// Exporter is the name of the exporter (otlp or stdout).
+	Exporter string
+	// ServiceName is the name of the service reported with the spans (e.g. dataupdater, cron).
+	ServiceName string
+	// SampleRatio is the ratio of the traces that are sampled (from 0 to 1). Default is 1.
+	SampleRatio float64
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg == nil {
+		return errors.New("cfg is required")
+	}
+	if cfg.Exporter != ExporterOTLP && cfg.Exporter != ExporterStdout {
+		return errors.Errorf("unsupported exporter '%s'", cfg.Exporter)
+	}
+	if cfg.ServiceName == "" {
+		return errors.New("cfg.ServiceName is required")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return errors.New("cfg.SampleRatio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Init sets up the global tracer provider and propagator.
+// The OTLP exporter is configured with the standard ENV variables (e.g. OTEL_EXPORTER_OTLP_ENDPOINT).
+// The returned function flushes the remaining spans and shuts the provider down.
+func Init(cfg *Config) (func(ctx context.Context) error, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, errors.Wrap(err, "tracing.Init")
+	}
+
+	exporter, err := newExporter(cfg.Exporter)
+	if err != nil {
+		return nil, errors.Wrap(err, "tracing.Init: couldn't create the exporter")
+	}
+
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.ServiceName)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "tracing.Init: couldn't create the resource")
+	}
+
+	sampleRatio := cfg.SampleRatio
+	if sampleRatio == 0 {
+		sampleRatio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn(errors.Wrap(err, "tracing"))
+	}))
+
+	return provider.Shutdown, nil
+}
+
+func newExporter(name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case ExporterOTLP:
+		return otlptracehttp.New(context.Background())
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	return nil, errors.Errorf("unsupported exporter '%s'", name)
+}